@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/solar3s/goregen/web"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// passwdCommand runs "goregen passwd", adding or replacing a user of a password file.
+func passwdCommand(args []string) int {
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	file := fs.String("file", "passwd", "path to password file, set it as Web.Auth.PasswordFile in config")
+	role := fs.String("role", string(web.RoleOperator), "role of user: viewer or operator")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s passwd [options] <name>\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	password, err := readPassword("Password: ")
+	if err == nil && terminal.IsTerminal(int(os.Stdin.Fd())) {
+		var confirm string
+		confirm, err = readPassword("Confirm password: ")
+		if err == nil && confirm != password {
+			err = fmt.Errorf("passwords don't match")
+		}
+	}
+	if err == nil && password == "" {
+		err = fmt.Errorf("password is empty")
+	}
+	if err == nil {
+		err = web.SetPassword(*file, fs.Arg(0), password, web.Role(*role))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "saved %s user \"%s\" to %s\n", *role, fs.Arg(0), *file)
+	return 0
+}
+
+// tokenCommand runs "goregen token", generating an API token & its config section.
+func tokenCommand(args []string) int {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	role := fs.String("role", string(web.RoleViewer), "role of token: viewer or operator")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s token [options] <name>\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if err := web.Role(*role).Valid(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	token, hash, err := web.NewToken()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("token: %s\n\n", token)
+	fmt.Println("add to config.toml (token itself isn't saved, keep it safe):")
+	fmt.Printf("\n[[Web.Auth.Tokens]]\n  Name = %q\n  Role = %q\n  Hash = %q\n", fs.Arg(0), *role, hash)
+	return 0
+}
+
+// readPassword reads a password from terminal without echo, or a line from stdin.
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
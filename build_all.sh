@@ -5,6 +5,15 @@ if ! test -d ".git"; then
   exit 1
 fi
 
+# firmware images for "goregen firmware flash" are embedded from committed
+# firmware/images_gen.go, set REBUILD_FIRMWARE=1 to compile them first (needs arduino-cli)
+if [ -n "$REBUILD_FIRMWARE" ]; then
+  ./firmware/build.sh || exit 1
+elif ! test -f firmware/images_gen.go; then
+  echo "firmware/images_gen.go is missing, run ./firmware/build.sh or set REBUILD_FIRMWARE=1" >&2
+  exit 1
+fi
+
 tmp=$(mktemp -d)
 version=$(cat version.go |grep Version |sed 's,.\+ "\([[:alnum:].]\+\)",\1,')
 mkdir -p builds/
@@ -34,6 +43,7 @@ for os in "linux" "darwin" "windows"; do
     cp firmware/firmware.ino $target/
     cp default.toml $target/config.toml
     cp README.md $target/
+    cp -r profiles $target/
     cd $tmp
 
     zipname="goregen_${version}_$os$post.zip"
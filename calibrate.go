@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/client"
+	"github.com/solar3s/goregen/regenbox"
+	"github.com/solar3s/goregen/web"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// calibrateCommand runs "goregen calibrate", fitting voltage calibration of a box
+// to reference voltages read on a multimeter, entered by user.
+func calibrateCommand(args []string) int {
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	r := remoteFlags(fs)
+	degree := fs.Int("degree", 1, fmt.Sprintf("degree of correction polynomial, 1 (linear) to %d", regenbox.MaxCalibrationDegree))
+	samples := fs.Int("samples", 5, "number of voltage reads averaged per point")
+	show := fs.Bool("show", false, "print current calibration & exit")
+	reset := fs.Bool("reset", false, "remove calibration & exit")
+	commandUsage(fs, "calibrate [options]")
+	_ = fs.Parse(args)
+
+	if *degree < 1 || *degree > regenbox.MaxCalibrationDegree {
+		return fail(fmt.Errorf("-degree must be within 1 and %d", regenbox.MaxCalibrationDegree))
+	}
+	if *samples < 1 {
+		*samples = 1
+	}
+
+	c, err := r.connect()
+	if err != nil {
+		return fail(err)
+	}
+
+	// current calibration, raw voltage reads & save, through server or directly
+	var (
+		current *regenbox.Calibration
+		readRaw func() (int, error)
+		save    func(cal *regenbox.Calibration, points []regenbox.CalibrationPoint) error // removes calibration if cal is nil
+		id      string
+	)
+	if c != nil {
+		cal, err := c.Calibration()
+		if err != nil && !client.IsNotFound(err) {
+			return fail(err)
+		}
+		current = cal.Calibration
+		sn, err := c.Snapshot()
+		if err != nil {
+			return fail(err)
+		}
+		if sn.Running && !*show {
+			return fail(regenbox.ErrBoxRunning)
+		}
+		id = r.box
+		if info, err := c.Info(); id == "" && err == nil && len(info.Boxes) > 0 {
+			id = info.Boxes[0] // default box
+		}
+		readRaw = func() (int, error) {
+			sn, err := c.Snapshot()
+			return sn.RawVoltage, err
+		}
+		save = func(cal *regenbox.Calibration, points []regenbox.CalibrationPoint) error {
+			if cal == nil {
+				return c.RemoveCalibration()
+			}
+			_, err := c.Calibrate(points, *degree)
+			return err
+		}
+	} else {
+		b, err := r.openDirect()
+		if err != nil {
+			return fail(err)
+		}
+		defer b.Regenbox.Conn.Close()
+		current, id = b.Config().Calibration, b.Id
+		readRaw = b.Regenbox.ReadRawVoltage
+		save = func(cal *regenbox.Calibration, _ []regenbox.CalibrationPoint) error {
+			if cal != nil {
+				if err := cal.Validate(); err != nil {
+					return err
+				}
+				cal.Identity = b.Identity()
+			}
+			// read config file again, loaded config holds -dev override
+			var cfg *web.Config
+			err := util.ReadTomlFile(&cfg, r.cfgPath)
+			if os.IsNotExist(err) {
+				def := web.DefaultConfig
+				cfg, err = &def, nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = cfg.SetCalibration(b.Id, cal); err != nil {
+				return err
+			}
+			return util.WriteTomlFile(cfg, r.cfgPath)
+		}
+	}
+
+	if *show || current != nil {
+		printCalibration(id, current)
+	}
+	if *show {
+		return 0
+	}
+	if *reset {
+		if err = save(nil, nil); err != nil {
+			return fail(err)
+		}
+		fmt.Fprintf(os.Stderr, "%s: calibration removed\n", id)
+		return 0
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	fmt.Printf("Measure batteries of %d different voltages at least (e.g. charged & discharged), the more the better.\n", *degree+1)
+	fmt.Println("For each one, put it in the box & read its voltage on a multimeter.")
+	var points []regenbox.CalibrationPoint
+	for {
+		fmt.Printf("\npoint %d: press Enter to read voltage, or q when done: ", len(points)+1)
+		answer, err := stdin.ReadString('\n')
+		if err != nil || strings.TrimSpace(answer) == "q" {
+			break
+		}
+		raw, err := averageRaw(readRaw, *samples)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("box reads %dmV, multimeter reads (mV): ", raw)
+		answer, err = stdin.ReadString('\n')
+		if err != nil {
+			break
+		}
+		ref, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(answer), "mV"))
+		if err != nil || ref <= 0 {
+			fmt.Println("expected a voltage in mV, e.g. 1312, point skipped")
+			continue
+		}
+		points = append(points, regenbox.CalibrationPoint{Raw: raw, Reference: ref})
+	}
+	fmt.Println()
+
+	cal, err := regenbox.FitCalibration(points, *degree)
+	if err != nil {
+		return fail(err)
+	}
+	printCalibration(id+" (new)", cal)
+	if err = cal.Validate(); err != nil {
+		return fail(err)
+	}
+	fmt.Printf("save calibration of %s? [y/N] ", id)
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		return 1
+	}
+	if err = save(cal, points); err != nil {
+		return fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "%s: calibration saved\n", id)
+	return 0
+}
+
+// averageRaw averages n raw voltage reads.
+func averageRaw(readRaw func() (int, error), n int) (int, error) {
+	var sum int
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			time.Sleep(time.Millisecond * 200)
+		}
+		v, err := readRaw()
+		if err != nil {
+			return 0, err
+		}
+		sum += v
+	}
+	return (sum + n/2) / n, nil
+}
+
+// printCalibration prints cal of box id, with its points.
+func printCalibration(id string, cal *regenbox.Calibration) {
+	fmt.Printf("%s: calibration %s\n", id, cal)
+	if cal == nil || len(cal.Points) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  RAW\tMULTIMETER\tCORRECTED")
+	for _, p := range cal.Points {
+		fmt.Fprintf(tw, "  %dmV\t%dmV\t%dmV\n", p.Raw, p.Reference, cal.Apply(p.Raw))
+	}
+	_ = tw.Flush()
+	fmt.Printf("  max error %dmV, measured %s", cal.MaxError(), cal.Time.Local().Format("2006-01-02 15:04"))
+	if cal.Identity != "" {
+		fmt.Printf(" on %s", cal.Identity)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,657 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/client"
+	"github.com/solar3s/goregen/regenbox"
+	"github.com/solar3s/goregen/web"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// remote holds options of commands controlling a box, either through
+// a running goregen server, or directly on its serial port if there's none.
+type remote struct {
+	server   string
+	token    string
+	box      string
+	insecure bool
+	direct   bool
+	dev      string
+	root     string
+	config   string
+
+	cfg     *web.Config
+	cfgPath string
+}
+
+// remoteFlags registers remote options on fs.
+func remoteFlags(fs *flag.FlagSet) *remote {
+	r := &remote{}
+	fs.StringVar(&r.server, "server", "", "url of goregen server (defaults to Web.ListenAddr of config)")
+	fs.StringVar(&r.token, "token", os.Getenv("GOREGEN_TOKEN"), "API token if authentication is enabled (defaults to $GOREGEN_TOKEN)")
+	fs.StringVar(&r.box, "box", "", "Id of box (defaults to first box)")
+	fs.BoolVar(&r.insecure, "insecure", false, "don't verify certificate of https server")
+	fs.BoolVar(&r.direct, "direct", false, "talk to serial device directly, even if a server is running")
+	fs.StringVar(&r.dev, "dev", "", "direct mode: path to serial port (defaults to Device of config)")
+	fs.StringVar(&r.root, "root", "", "path to goregen's main directory (defaults to executable path)")
+	fs.StringVar(&r.config, "config", "", "path to config (defaults to <root>/config.toml)")
+	return r
+}
+
+// loadConfig reads config file, or returns default config if there is none.
+func (r *remote) loadConfig() (*web.Config, error) {
+	if r.cfg != nil {
+		return r.cfg, nil
+	}
+	r.cfgPath = r.config
+	if r.cfgPath == "" {
+		root := r.root
+		if root == "" {
+			exe, err := os.Executable()
+			if err != nil {
+				return nil, err
+			}
+			root = filepath.Dir(exe)
+		}
+		r.cfgPath = filepath.Join(root, "config.toml")
+	}
+	var cfg *web.Config
+	err := util.ReadTomlFile(&cfg, r.cfgPath)
+	if os.IsNotExist(err) {
+		cfg, err = &web.DefaultConfig, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading config \"%s\": %s", r.cfgPath, err)
+	}
+	r.cfg = cfg
+	return cfg, nil
+}
+
+// connect returns a client of running goregen server. It returns nil, nil when
+// commands should talk to the box directly: with -direct, or if no server
+// answers on its default address.
+func (r *remote) connect() (*client.Client, error) {
+	cfg, err := r.loadConfig()
+	if err != nil || r.direct {
+		return nil, err
+	}
+
+	addr := r.server
+	if addr == "" {
+		scheme := "http"
+		if cfg.Web.TLS.Enabled {
+			scheme = "https"
+		}
+		host, port, err := net.SplitHostPort(cfg.Web.ListenAddr)
+		if err == nil && (host == "" || host == "0.0.0.0" || host == "::") {
+			host = "localhost"
+		}
+		addr = scheme + "://" + net.JoinHostPort(host, port)
+	}
+	c, err := client.New(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.Token = r.token
+	c.Box = r.box
+	if r.insecure {
+		c.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	} else if cfg.Web.TLS.Enabled && cfg.Web.TLS.CertFile == "" && r.server == "" {
+		// trust self-signed certificate of local server
+		pem, err := ioutil.ReadFile(filepath.Join(filepath.Dir(r.cfgPath), web.SelfSignedCert))
+		if err == nil {
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(pem)
+			c.SetTLSConfig(&tls.Config{RootCAs: pool})
+		}
+	}
+
+	_, err = c.Info()
+	if _, ok := err.(*client.Error); ok || err == nil || r.server != "" {
+		return c, err
+	}
+	fmt.Fprintf(os.Stderr, "no goregen server at %s, talking to box directly\n", addr)
+	return nil, nil
+}
+
+// boxConfig returns config of targeted box, with -dev override.
+func (r *remote) boxConfig() (web.BoxConfig, error) {
+	cfg, err := r.loadConfig()
+	if err != nil {
+		return web.BoxConfig{}, err
+	}
+	if r.dev != "" {
+		cfg.Device = r.dev
+		cfg.Boxes = nil
+	}
+	configs := cfg.BoxConfigs()
+	if r.box == "" {
+		return configs[0], nil
+	}
+	for _, bc := range configs {
+		if bc.Id == r.box {
+			return bc, nil
+		}
+	}
+	return web.BoxConfig{}, fmt.Errorf("%s \"%s\"", web.ErrUnknownBox, r.box)
+}
+
+// openDirect connects to targeted box on its serial port.
+func (r *remote) openDirect() (*web.Box, error) {
+	bc, err := r.boxConfig()
+	if err != nil {
+		return nil, err
+	}
+	rbox, err := openRegenbox(bc)
+	if err != nil {
+		return nil, err
+	}
+	if rbox.Conn == nil {
+		return nil, fmt.Errorf("%s: no RegenBox found on serial ports, see -dev", bc.Id)
+	}
+	return web.NewBox(bc, rbox, nil), nil
+}
+
+// dataDir returns directory of chart logs of targeted box.
+func (r *remote) dataDir() (string, error) {
+	bc, err := r.boxConfig()
+	if err != nil {
+		return "", err
+	}
+	return r.cfg.BoxDataDir(bc.Id), nil
+}
+
+// commandUsage sets usage of fs, for command "goregen <usage>".
+func commandUsage(fs *flag.FlagSet, usage string) {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n", filepath.Base(os.Args[0]), usage)
+		fs.PrintDefaults()
+	}
+}
+
+// fail prints err and returns exit code 1.
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// statusCommand runs "goregen status", printing state of boxes.
+func statusCommand(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	r := remoteFlags(fs)
+	asJSON := fs.Bool("json", false, "print status as json")
+	commandUsage(fs, "status [options]")
+	_ = fs.Parse(args)
+
+	c, err := r.connect()
+	if err != nil {
+		return fail(err)
+	}
+	var boxes []web.APIBox
+	if c != nil {
+		boxes, err = c.Boxes()
+		if err != nil {
+			return fail(err)
+		}
+		if r.box != "" {
+			var filtered []web.APIBox
+			for _, b := range boxes {
+				if b.Id == r.box {
+					filtered = append(filtered, b)
+				}
+			}
+			if filtered == nil {
+				return fail(fmt.Errorf("%s \"%s\"", web.ErrUnknownBox, r.box))
+			}
+			boxes = filtered
+		}
+	} else {
+		b, err := r.openDirect()
+		if err != nil {
+			return fail(err)
+		}
+		defer b.Regenbox.Conn.Close()
+		boxes = []web.APIBox{{Id: b.Id, Device: b.Config().Device, Snapshot: b.Regenbox.Snapshot()}}
+	}
+
+	if *asJSON {
+		printJSON(boxes)
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BOX\tSTATE\tCHARGE\tVOLTAGE\tFIRMWARE\tSESSION")
+	for _, b := range boxes {
+		sn := b.Snapshot
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%dmV\t%s\t%s\n", b.Id, sn.State, sn.ChargeState, sn.Voltage, sn.Firmware, sessionStatus(b.Session))
+	}
+	_ = tw.Flush()
+	return 0
+}
+
+// sessionStatus summarizes sess in a line.
+func sessionStatus(sess *web.APISession) string {
+	if sess == nil {
+		return "-"
+	}
+	status := "running"
+	if sess.Paused {
+		status = "paused"
+	}
+	line := fmt.Sprintf("%s %s, step %d (%s), %.1fmAh", status, sess.CycleType, sess.Progress.Step+1,
+		time.Duration(sess.Progress.Elapsed).Truncate(time.Second), sess.Progress.Capacity.MilliAmpHours)
+	if sess.LastMessage != nil {
+		line += ": " + sess.LastMessage.Status
+	}
+	return line
+}
+
+// startCommand runs "goregen start", starting a session on a box. Without a
+// running server, session runs in foreground until it's over or interrupted.
+func startCommand(args []string) int {
+	fs := flag.NewFlagSet("start", flag.ExitOnError)
+	r := remoteFlags(fs)
+	mode := fs.String("mode", "", "charger, discharger, cycler or profiler (defaults to Regenbox.Mode of box)")
+	top := fs.Int("top", 0, "target voltage of charges (mV)")
+	bottom := fs.Int("bottom", 0, "target voltage of discharges (mV)")
+	cycles := fs.Int("cycles", 0, "cycler mode: number of half-cycles")
+	up := fs.Duration("up", 0, "maximum duration of charges")
+	down := fs.Duration("down", 0, "maximum duration of discharges")
+	ticker := fs.Duration("ticker", 0, "interval between measures")
+	chargeFirst := fs.Bool("charge-first", false, "cycler mode: start with a charge")
+	profile := fs.String("profile", "", "profiler mode: name of profile")
+	save := fs.Bool("save", false, "save config changes to server config file")
+	commandUsage(fs, "start [options]")
+	_ = fs.Parse(args)
+
+	// applies options explicitly set to cfg
+	var setErr error
+	apply := func(cfg *regenbox.Config) {
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "mode":
+				m := strings.Title(strings.ToLower(*mode))
+				if err := cfg.Mode.UnmarshalText([]byte(m)); m == "" || err != nil {
+					setErr = fmt.Errorf("unknown mode \"%s\", expected charger, discharger, cycler or profiler", *mode)
+				}
+			case "top":
+				cfg.TopVoltage = *top
+			case "bottom":
+				cfg.BottomVoltage = *bottom
+			case "cycles":
+				cfg.NbHalfCycles = *cycles
+			case "up":
+				cfg.UpDuration = util.Duration(*up)
+			case "down":
+				cfg.DownDuration = util.Duration(*down)
+			case "ticker":
+				cfg.Ticker = util.Duration(*ticker)
+			case "charge-first":
+				cfg.ChargeFirst = *chargeFirst
+			case "profile":
+				cfg.Profile = *profile
+			}
+		})
+	}
+
+	c, err := r.connect()
+	if err != nil {
+		return fail(err)
+	}
+	if c == nil {
+		return startDirect(r, apply, &setErr)
+	}
+
+	cfg, err := c.Config()
+	if err != nil {
+		return fail(err)
+	}
+	apply(&cfg.Regenbox)
+	if setErr != nil {
+		return fail(setErr)
+	}
+	if fs.NFlag() > 0 {
+		_, err = c.SetConfig(cfg, *save)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	sess, err := c.Start()
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Println(sessionStatus(&sess))
+	return 0
+}
+
+// startDirect runs a session on box opened directly, until it's over or
+// interrupted, and saves its chart log to data directory of box.
+func startDirect(r *remote, apply func(cfg *regenbox.Config), setErr *error) int {
+	b, err := r.openDirect()
+	if err != nil {
+		return fail(err)
+	}
+	defer b.Regenbox.Conn.Close()
+
+	bc := b.Config()
+	apply(&bc.Regenbox)
+	if *setErr != nil {
+		return fail(*setErr)
+	}
+	err = bc.Validate()
+	if err == nil {
+		err = b.SetConfig(bc)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if bc.Regenbox.Mode == regenbox.Profiler {
+		p, err := regenbox.FindProfile(r.cfg.Web.ProfilesDir, bc.Regenbox.Profile)
+		if err != nil {
+			return fail(err)
+		}
+		b.Regenbox.SetProfile(p)
+	}
+	dir, err := r.dataDir()
+	if err != nil {
+		return fail(err)
+	}
+
+	sess := web.NewSession(b, r.cfg.User)
+	err, snaps, messages := b.Regenbox.Start()
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "%s: started %s, press <Ctrl-C> to stop\n", b.Id, sess.CycleType)
+	trap := make(chan os.Signal, 1)
+	signal.Notify(trap, os.Interrupt)
+	for {
+		select {
+		case <-trap:
+			b.Regenbox.Stop()
+		case sn := <-snaps:
+			sess.Add(sn)
+			sess.Progress = b.Regenbox.Progress()
+			printSnapshot(sn)
+		case msg := <-messages:
+			fmt.Printf("%s  %s: %s\n", time.Now().Format("15:04:05"), msg.Type, msg.Status)
+			if !msg.Final {
+				continue
+			}
+			if len(sess.Measures.Data) == 0 {
+				return 0
+			}
+			sess.CycleType = msg.Type
+			sess.Progress = b.Regenbox.Progress()
+			chart := sess.ChartLog(!msg.Erronous, msg.Status)
+			err = os.MkdirAll(dir, 0755)
+			if err == nil {
+				err = util.WriteTomlFile(chart, filepath.Join(dir, chart.FileName()))
+			}
+			if err != nil {
+				return fail(fmt.Errorf("couldn't save chart log: %s", err))
+			}
+			fmt.Fprintf(os.Stderr, "saved chart log %s\n", filepath.Join(dir, chart.FileName()))
+			if msg.Erronous {
+				return 1
+			}
+			return 0
+		}
+	}
+}
+
+// stopCommand runs "goregen stop", stopping session of a box.
+func stopCommand(args []string) int {
+	fs := flag.NewFlagSet("stop", flag.ExitOnError)
+	r := remoteFlags(fs)
+	commandUsage(fs, "stop [options]")
+	_ = fs.Parse(args)
+
+	c, err := r.connect()
+	if err != nil {
+		return fail(err)
+	}
+	if c == nil {
+		return fail(fmt.Errorf("no goregen server running, sessions started by \"goregen start\" stop with <Ctrl-C>"))
+	}
+	err = c.Stop()
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Fprintln(os.Stderr, "stopped")
+	return 0
+}
+
+// logsCommand runs "goregen logs list|show", listing or showing chart logs of a box.
+func logsCommand(args []string) int {
+	usage := func() int {
+		fmt.Fprintf(os.Stderr, "Usage: %s logs list [options]\n       %s logs show [options] <name>\n",
+			filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	switch args[0] {
+	case "list":
+		return logsListCommand(args[1:])
+	case "show":
+		return logsShowCommand(args[1:])
+	}
+	return usage()
+}
+
+func logsListCommand(args []string) int {
+	fs := flag.NewFlagSet("logs list", flag.ExitOnError)
+	r := remoteFlags(fs)
+	offset := fs.Int("offset", 0, "number of chart logs to skip")
+	limit := fs.Int("limit", 20, "maximum number of chart logs, most recent first")
+	asJSON := fs.Bool("json", false, "print chart logs as json")
+	commandUsage(fs, "logs list [options]")
+	_ = fs.Parse(args)
+
+	c, err := r.connect()
+	if err != nil {
+		return fail(err)
+	}
+	var page web.APIChartLogPage
+	if c != nil {
+		page, err = c.ListChartLogs(*offset, *limit)
+	} else {
+		page, err = listLocalChartLogs(r, *offset, *limit)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if *asJSON {
+		printJSON(page)
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tSTART\tDURATION\tCAPACITY\tRESULT")
+	for _, cl := range page.Items {
+		h := cl.Header
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.1fmAh\t%s\n", cl.Name, h.CycleType, cl.StartTime.Local().Format("2006-01-02 15:04"),
+			time.Duration(h.TotalDuration).Truncate(time.Second), h.MilliAmpHours, h.Reason)
+	}
+	_ = tw.Flush()
+	if page.Offset+len(page.Items) < page.Total {
+		fmt.Fprintf(os.Stderr, "%d more, see -offset\n", page.Total-page.Offset-len(page.Items))
+	}
+	return 0
+}
+
+// listLocalChartLogs lists chart logs in data directory of box, without server.
+func listLocalChartLogs(r *remote, offset int, limit int) (page web.APIChartLogPage, err error) {
+	dir, err := r.dataDir()
+	if err != nil {
+		return page, err
+	}
+	logs, err := web.ChartLogSummaries(dir)
+	if err != nil {
+		return page, err
+	}
+	page = web.APIChartLogPage{Total: len(logs), Offset: offset, Limit: limit}
+	if offset < len(logs) {
+		end := len(logs)
+		if limit > 0 && offset+limit < end {
+			end = offset + limit
+		}
+		page.Items = logs[offset:end]
+	}
+	return page, nil
+}
+
+func logsShowCommand(args []string) int {
+	fs := flag.NewFlagSet("logs show", flag.ExitOnError)
+	r := remoteFlags(fs)
+	format := fs.String("format", "", "print measures too, in format: "+strings.Join(web.ExportFormats, ", "))
+	commandUsage(fs, "logs show [options] <name>")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if *format != "" && !web.IsExportFormat(*format) {
+		return fail(fmt.Errorf("unknown export format \"%s\", expected one of %s", *format, strings.Join(web.ExportFormats, ", ")))
+	}
+
+	c, err := r.connect()
+	if err != nil {
+		return fail(err)
+	}
+	name := fs.Arg(0)
+	var cl *web.ChartLog
+	if c != nil {
+		cl, err = c.Chart(name)
+	} else {
+		var dir string
+		dir, err = r.dataDir()
+		if err == nil {
+			cl = &web.ChartLog{}
+			err = util.ReadTomlFile(cl, filepath.Join(dir, filepath.Base(name)))
+		}
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if *format != "" {
+		err = cl.Export(os.Stdout, *format)
+		if err != nil {
+			return fail(err)
+		}
+		return 0
+	}
+	h := cl.Header()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Box\t%s\n", h.Box)
+	fmt.Fprintf(tw, "Type\t%s\n", h.CycleType)
+	if battery := strings.TrimSpace(fmt.Sprintf("%s %s %s", h.Battery.Brand, h.Battery.Model, h.Battery.Type)); battery != "" {
+		fmt.Fprintf(tw, "Battery\t%s\n", battery)
+	}
+	fmt.Fprintf(tw, "Start\t%s\n", cl.Measures.Start.Local().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(tw, "Duration\t%s\n", time.Duration(h.TotalDuration).Truncate(time.Second))
+	fmt.Fprintf(tw, "Result\t%s (target reached: %t)\n", h.Reason, h.TargetReached)
+	fmt.Fprintf(tw, "Capacity\t%.1fmAh / %.1fmWh\n", h.MilliAmpHours, h.MilliWattHours)
+	fmt.Fprintf(tw, "Measures\t%d, every %s\n", len(cl.Measures.Data), cl.Measures.Interval)
+	if n := len(cl.Measures.Data); n > 0 {
+		fmt.Fprintf(tw, "Voltage\t%dmV -> %dmV\n", cl.Measures.Data[0], cl.Measures.Data[n-1])
+	}
+	_ = tw.Flush()
+	return 0
+}
+
+// watchCommand runs "goregen watch", printing snapshots of a box until interrupted.
+func watchCommand(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	r := remoteFlags(fs)
+	interval := fs.Duration("interval", time.Second, "interval between snapshots")
+	asJSON := fs.Bool("json", false, "print snapshots & cycle messages as json lines")
+	commandUsage(fs, "watch [options]")
+	_ = fs.Parse(args)
+
+	c, err := r.connect()
+	if err != nil {
+		return fail(err)
+	}
+	trap := make(chan os.Signal, 1)
+	signal.Notify(trap, os.Interrupt)
+	enc := json.NewEncoder(os.Stdout)
+
+	if c == nil {
+		b, err := r.openDirect()
+		if err != nil {
+			return fail(err)
+		}
+		defer b.Regenbox.Conn.Close()
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		for {
+			sn := b.Regenbox.Snapshot()
+			if *asJSON {
+				_ = enc.Encode(client.Event{Type: client.EventState, Snapshot: sn})
+			} else {
+				printSnapshot(sn)
+			}
+			select {
+			case <-trap:
+				return 0
+			case <-ticker.C:
+			}
+		}
+	}
+
+	sub, err := c.Subscribe(*interval)
+	if err != nil {
+		return fail(err)
+	}
+	defer sub.Close()
+	for {
+		select {
+		case <-trap:
+			return 0
+		case ev, ok := <-sub.C:
+			if !ok {
+				return fail(fmt.Errorf("lost connection to server: %s", sub.Err()))
+			}
+			switch {
+			case ev.Type == client.EventTicker:
+			case *asJSON:
+				_ = enc.Encode(ev)
+			case ev.Type == client.EventState:
+				printSnapshot(ev.Snapshot)
+			case ev.Type == client.EventCycle:
+				fmt.Printf("%s  %s: %s\n", time.Now().Format("15:04:05"), ev.Cycle.Type, ev.Cycle.Status)
+			}
+		}
+	}
+}
+
+// printSnapshot prints sn in a line.
+func printSnapshot(sn regenbox.Snapshot) {
+	status := ""
+	if sn.Paused {
+		status = "  paused"
+	}
+	fmt.Printf("%s  %s  %-11s  %4dmV  %.1fmAh%s\n", sn.Time.Format("15:04:05"), sn.State, sn.ChargeState,
+		sn.Voltage, sn.Capacity.MilliAmpHours, status)
+}
@@ -0,0 +1,376 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/client"
+	"github.com/solar3s/goregen/regenbox"
+	"github.com/solar3s/goregen/regenbox/sim"
+	"github.com/solar3s/goregen/web"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// goregen is the path to goregen binary built by TestMain: commands are run
+// as a user would, and exit with their own codes.
+var goregen string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "goregen-bin")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	goregen = filepath.Join(dir, "goregen")
+	out, err := exec.Command("go", "build", "-o", goregen, ".").CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't build goregen: %s\n%s", err, out)
+		os.Exit(1)
+	}
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// cliBox is the Id of the simulated box configured by newCLIRoot.
+const cliBox = "sim"
+
+// newCLIRoot returns a goregen root directory, with a config of a simulated
+// box served on listenAddr. Its data directory is in root too.
+func newCLIRoot(t *testing.T, listenAddr string) string {
+	root, err := ioutil.TempDir("", "goregen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := web.DefaultConfig
+	cfg.Web.ListenAddr = listenAddr
+	cfg.Web.DataDir = filepath.Join(root, "data")
+	cfg.Web.ProfilesDir = filepath.Join(root, "profiles")
+	cfg.Regenbox.Ticker = util.Duration(100 * time.Millisecond)
+	cfg.Boxes = []web.BoxConfig{{
+		Id:       cliBox,
+		Device:   sim.Scheme + "://nimh-aa?speed=6000&soc=0.1&test=" + t.Name(),
+		Battery:  cfg.Battery,
+		Resistor: 4,
+		Regenbox: cfg.Regenbox,
+	}}
+	err = util.WriteTomlFile(cfg, filepath.Join(root, "config.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// syncBuffer is a bytes.Buffer written by a command while it's read by a test.
+type syncBuffer struct {
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+// command returns "goregen args...", without GOREGEN_TOKEN from test environment.
+func command(args ...string) *exec.Cmd {
+	cmd := exec.Command(goregen, args...)
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "GOREGEN_TOKEN=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	return cmd
+}
+
+// run runs "goregen args..." until it exits, and returns its outputs & exit code.
+func run(t *testing.T, args ...string) (stdout string, stderr string, code int) {
+	var out, errOut bytes.Buffer
+	cmd := command(args...)
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	done := make(chan error, 1)
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(time.Second * 30):
+		_ = cmd.Process.Kill()
+		t.Fatalf("goregen %s: timeout", strings.Join(args, " "))
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		code = ee.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), code
+}
+
+// expect runs "goregen args...", and checks its exit code & that its stdout contains want.
+func expect(t *testing.T, code int, want string, args ...string) (stdout string, stderr string) {
+	stdout, stderr, c := run(t, args...)
+	if c != code || !strings.Contains(stdout, want) {
+		t.Errorf("goregen %s: expected code %d & output containing \"%s\", got %d:\n%s%s",
+			strings.Join(args, " "), code, want, c, stdout, stderr)
+	}
+	return stdout, stderr
+}
+
+// watch runs "goregen watch args...", and interrupts it after it printed n lines.
+func watch(t *testing.T, n int, args ...string) []string {
+	cmd := command(append([]string{"watch", "-interval", "100ms"}, args...)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr syncBuffer
+	cmd.Stderr = &stderr
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	var got []string
+	timeout := time.After(time.Second * 10)
+	for len(got) < n {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				_ = cmd.Wait()
+				t.Fatalf("watch exited after %d lines: %s", len(got), stderr.String())
+			}
+			got = append(got, line)
+		case <-timeout:
+			_ = cmd.Process.Kill()
+			t.Fatalf("watch: timeout after %d lines: %s", len(got), stderr.String())
+		}
+	}
+	_ = cmd.Process.Signal(os.Interrupt)
+	go func() {
+		for range lines {
+		}
+	}()
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("watch: expected clean exit on interrupt, got %s: %s", err, stderr.String())
+	}
+	return got
+}
+
+func TestCLI_Direct(t *testing.T) {
+	root := newCLIRoot(t, freeAddr(t)) // no server running
+	defer os.RemoveAll(root)
+
+	stdout, stderr := expect(t, 0, "Connected", "status", "-root", root)
+	if !strings.Contains(stderr, "talking to box directly") {
+		t.Errorf("expected fallback to serial device, got:\n%s", stderr)
+	}
+	if lines := strings.Split(strings.TrimSpace(stdout), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], cliBox+" ") {
+		t.Errorf("expected header & line of box %s, got:\n%s", cliBox, stdout)
+	}
+	stdout, _ = expect(t, 0, "", "status", "-root", root, "-json")
+	var boxes []web.APIBox
+	if err := json.Unmarshal([]byte(stdout), &boxes); err != nil || len(boxes) != 1 || boxes[0].Snapshot.State != regenbox.Connected {
+		t.Errorf("unexpected json status %v: %s", err, stdout)
+	}
+	_, stderr = expect(t, 1, "", "status", "-root", root, "-box", "nope")
+	if !strings.Contains(stderr, web.ErrUnknownBox.Error()) {
+		t.Errorf("expected unknown box error, got:\n%s", stderr)
+	}
+
+	// direct session runs in foreground until it's over
+	stdout, stderr = expect(t, 0, "Target voltage reached", "start", "-root", root, "-mode", "discharger", "-bottom", "1000")
+	if !strings.Contains(stdout, "Discharging") || !strings.Contains(stderr, "saved chart log") {
+		t.Errorf("expected measures & saved chart log, got:\n%s%s", stdout, stderr)
+	}
+	expect(t, 1, "", "start", "-root", root, "-mode", "recharger")
+
+	stdout, _ = expect(t, 0, "Discharge", "logs", "list", "-root", root)
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 1 chart log, got:\n%s", stdout)
+	}
+	name := strings.Fields(lines[1])[0]
+	expect(t, 0, "Target voltage reached", "logs", "show", "-root", root, name)
+	expect(t, 0, "voltage_mV", "logs", "show", "-root", root, "-format", "csv", name)
+	expect(t, 1, "", "logs", "show", "-root", root, "missing.log")
+	expect(t, 2, "", "logs", "-root", root)
+
+	// nothing to stop without a server
+	_, stderr = expect(t, 1, "", "stop", "-root", root)
+	if !strings.Contains(stderr, "no goregen server running") {
+		t.Errorf("expected no server error, got:\n%s", stderr)
+	}
+
+	for _, line := range watch(t, 2, "-root", root) {
+		if !strings.Contains(line, "Connected") {
+			t.Errorf("unexpected watch line \"%s\"", line)
+		}
+	}
+}
+
+func TestCLI_Server(t *testing.T) {
+	root := newCLIRoot(t, freeAddr(t))
+	defer os.RemoveAll(root)
+	token, hash, err := web.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// serve box of root through a test server, requiring an operator token
+	var cfg *web.Config
+	if err = util.ReadTomlFile(&cfg, filepath.Join(root, "config.toml")); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Web.Auth.Tokens = []web.TokenConfig{{Name: "test", Role: web.RoleOperator, Hash: hash}}
+	bc := cfg.Boxes[0]
+	port, mode, err := regenbox.OpenPortName(bc.Device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := regenbox.NewSerial(port, mode, bc.Device, false)
+	conn.Start()
+	rbox, err := regenbox.NewRegenBox(conn, &bc.Regenbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boxes := web.NewRegistry()
+	_ = boxes.Add(web.NewBox(bc, rbox, nil))
+	srv := web.NewServer("test", boxes, cfg, filepath.Join(root, "config.toml"), false)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	defer rbox.Stop()
+
+	remote := []string{"-root", root, "-server", ts.URL, "-token", token}
+	_, stderr := expect(t, 1, "", "status", "-root", root, "-server", ts.URL)
+	if !strings.Contains(stderr, "401") || strings.Contains(stderr, "talking to box directly") {
+		t.Errorf("expected unauthorized error, without fallback to serial device, got:\n%s", stderr)
+	}
+	expect(t, 0, cliBox, append([]string{"status"}, remote...)...)
+
+	expect(t, 0, "running Discharge", append([]string{"start", "-mode", "discharger", "-bottom", "900", "-down", "1h"}, remote...)...)
+	if c := rbox.Config(); c.Mode != regenbox.Discharger || c.BottomVoltage != 900 {
+		t.Errorf("expected start options to be applied, got %+v", c)
+	}
+	expect(t, 0, "running Discharge", append([]string{"status"}, remote...)...)
+	lines := watch(t, 2, append([]string{"-json"}, remote...)...)
+	for _, line := range lines {
+		var ev client.Event
+		if err := json.Unmarshal([]byte(line), &ev); err != nil || ev.Type == "" {
+			t.Errorf("unexpected watch event %v: %s", err, line)
+		}
+	}
+	_, stderr = expect(t, 0, "", append([]string{"stop"}, remote...)...)
+	if !strings.Contains(stderr, "stopped") {
+		t.Errorf("expected stopped, got:\n%s", stderr)
+	}
+
+	// chart log is saved once session is over
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		stdout, _, code := run(t, append([]string{"logs", "list"}, remote...)...)
+		if code == 0 && strings.Contains(stdout, "Discharge") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("chart log not listed after stop, got %d:\n%s", code, stdout)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func TestCLI_Serve(t *testing.T) {
+	addr := freeAddr(t)
+	root := newCLIRoot(t, addr)
+	defer os.RemoveAll(root)
+
+	cmd := command("serve", "-root", root, "-session", "finalize")
+	var stderr syncBuffer
+	cmd.Stdout, cmd.Stderr = ioutil.Discard, &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		select {
+		case <-exited:
+		default:
+			_ = cmd.Process.Kill()
+		}
+	}()
+
+	// interrupt is trapped once server is up
+	deadline := time.Now().Add(time.Second * 10)
+	for !strings.Contains(stderr.String(), "Press <Ctrl-C> to quit") {
+		select {
+		case err := <-exited:
+			t.Fatalf("serve exited: %v\n%s", err, stderr.String())
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("serve: timeout\n%s", stderr.String())
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	// commands find server from config of root
+	stdout, errOut := expect(t, 0, "Connected", "status", "-root", root)
+	if strings.Contains(errOut, "talking to box directly") {
+		t.Errorf("expected status from server, got:\n%s%s", stdout, errOut)
+	}
+	expect(t, 0, "running Charge", "start", "-root", root, "-mode", "charger")
+	expect(t, 0, "", "stop", "-root", root)
+
+	_ = cmd.Process.Signal(os.Interrupt)
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("serve: expected clean exit on interrupt, got %s\n%s", err, stderr.String())
+		}
+	case <-time.After(time.Second * 15):
+		t.Fatalf("serve: no exit on interrupt\n%s", stderr.String())
+	}
+	if _, err := os.Stat(filepath.Join(root, "goregen.log")); err != nil {
+		t.Errorf("expected log file in root: %s", err)
+	}
+}
@@ -0,0 +1,391 @@
+// Package client is a Go client of goregen's REST API (see web.APIPrefix) & websocket.
+//
+//	c, err := client.New("http://localhost:3636")
+//	sn, err := c.Snapshot()
+//
+// Resources are decoded in their web & regenbox types, so that enums such
+// as State, ChargeState or BotMode are decoded with their own marshallers.
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/solar3s/goregen/regenbox"
+	"github.com/solar3s/goregen/web"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout of http requests.
+const DefaultTimeout = time.Second * 30
+
+// FlashTimeout of firmware uploads, which outlast DefaultTimeout.
+const FlashTimeout = time.Minute * 3
+
+// Error is returned when server answers a request with an error status.
+type Error struct {
+	Status  int    // http status code
+	Message string // error message of server
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("goregen: %d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// IsNotFound is true if err is a 404 error: unknown box or chart log, no running session...
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Status == http.StatusNotFound
+}
+
+// Client targets a single box of a goregen server, all of its methods are safe for concurrent use.
+type Client struct {
+	URL        *url.URL     // base url of goregen server, e.g. http://localhost:3636
+	Box        string       // Id of targeted box, first box of server if empty
+	Token      string       // API token, sent as bearer token when authentication is enabled
+	HTTPClient *http.Client // used for http requests
+	Dialer     *websocket.Dialer
+
+	defaultBox string
+	mu         sync.Mutex
+}
+
+// New creates a client of goregen server at addr, e.g. "http://localhost:3636"
+// (scheme defaults to http), targeting its first box.
+func New(addr string) (*Client, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unexpected scheme \"%s\", expected http or https", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return &Client{
+		URL:        u,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		Dialer:     &websocket.Dialer{HandshakeTimeout: DefaultTimeout},
+	}, nil
+}
+
+// SetTLSConfig sets cfg for https requests & websocket connections, e.g. to
+// trust the self-signed certificate of server.
+func (c *Client) SetTLSConfig(cfg *tls.Config) {
+	c.HTTPClient.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: cfg,
+	}
+	c.Dialer.TLSClientConfig = cfg
+}
+
+// box returns Id of targeted box, asking server for its first box if unset.
+func (c *Client) box() (string, error) {
+	if c.Box != "" {
+		return c.Box, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.defaultBox != "" {
+		return c.defaultBox, nil
+	}
+	info, err := c.Info()
+	if err != nil {
+		return "", err
+	}
+	if len(info.Boxes) == 0 {
+		return "", fmt.Errorf("goregen: server has no box")
+	}
+	c.defaultBox = info.Boxes[0]
+	return c.defaultBox, nil
+}
+
+// boxPath returns API path of box resource elems.
+func (c *Client) boxPath(elems ...string) (string, error) {
+	id, err := c.box()
+	if err != nil {
+		return "", err
+	}
+	p := "/boxes/" + url.PathEscape(id)
+	for _, e := range elems {
+		p += "/" + e
+	}
+	return p, nil
+}
+
+// request sends an API request, with in json encoded as body if not nil. A successful
+// response is decoded to out if not nil, otherwise its body is returned unread.
+func (c *Client) request(method string, path string, query url.Values, in interface{}, out interface{}) (io.ReadCloser, error) {
+	return c.requestWith(c.HTTPClient, method, path, query, in, out)
+}
+
+// requestWith sends an API request with hc, see request.
+func (c *Client) requestWith(hc *http.Client, method string, path string, query url.Values, in interface{}, out interface{}) (io.ReadCloser, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	u := *c.URL
+	u.Path += web.APIPrefix + path
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	c.authorize(req.Header)
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr web.APIError
+		if json.NewDecoder(resp.Body).Decode(&apiErr) != nil || apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return nil, &Error{Status: resp.StatusCode, Message: apiErr.Error}
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		resp.Body.Close()
+		return nil, nil
+	}
+	if out == nil {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return nil, fmt.Errorf("goregen: couldn't decode response of %s %s: %s", method, path, err)
+	}
+	return nil, nil
+}
+
+func (c *Client) authorize(h http.Header) {
+	if c.Token != "" {
+		h.Set("Authorization", "Bearer "+c.Token)
+	}
+}
+
+// get decodes API resource at path to out.
+func (c *Client) get(path string, query url.Values, out interface{}) error {
+	_, err := c.request(http.MethodGet, path, query, nil, out)
+	return err
+}
+
+// Info returns version of server & Id of its boxes.
+func (c *Client) Info() (info web.APIInfo, err error) {
+	err = c.get("", nil, &info)
+	return info, err
+}
+
+// Boxes returns every box of server.
+func (c *Client) Boxes() (boxes []web.APIBox, err error) {
+	err = c.get("/boxes", nil, &boxes)
+	return boxes, err
+}
+
+// Snapshot returns current state & measures of box.
+func (c *Client) Snapshot() (sn regenbox.Snapshot, err error) {
+	p, err := c.boxPath("snapshot")
+	if err != nil {
+		return sn, err
+	}
+	err = c.get(p, nil, &sn)
+	return sn, err
+}
+
+// Firmware returns firmware info of box.
+func (c *Client) Firmware() (fw web.APIFirmware, err error) {
+	p, err := c.boxPath("firmware")
+	if err != nil {
+		return fw, err
+	}
+	err = c.get(p, nil, &fw)
+	return fw, err
+}
+
+// FlashFirmware uploads prebuilt firmware variant to stopped box, and returns firmware it
+// reports once reconnected. If variant is empty, server flashes the current firmware again.
+func (c *Client) FlashFirmware(variant string) (fw web.APIFirmware, err error) {
+	p, err := c.boxPath("firmware", "flash")
+	if err != nil {
+		return fw, err
+	}
+	var query url.Values
+	if variant != "" {
+		query = url.Values{"variant": {variant}}
+	}
+	hc := *c.HTTPClient
+	if hc.Timeout != 0 && hc.Timeout < FlashTimeout {
+		hc.Timeout = FlashTimeout
+	}
+	_, err = c.requestWith(&hc, http.MethodPost, p, query, nil, &fw)
+	return fw, err
+}
+
+// Config returns config of box.
+func (c *Client) Config() (cfg web.APIBoxConfig, err error) {
+	p, err := c.boxPath("config")
+	if err != nil {
+		return cfg, err
+	}
+	err = c.get(p, nil, &cfg)
+	return cfg, err
+}
+
+// SetConfig sets config of stopped box, and saves server config file if save is true.
+// It returns config of box, as set.
+func (c *Client) SetConfig(cfg web.APIBoxConfig, save bool) (web.APIBoxConfig, error) {
+	p, err := c.boxPath("config")
+	if err != nil {
+		return cfg, err
+	}
+	var out web.APIBoxConfig
+	_, err = c.request(http.MethodPatch, p, url.Values{"save": {strconv.FormatBool(save)}}, cfg, &out)
+	return out, err
+}
+
+// Calibration returns voltage calibration of box, or an error satisfying IsNotFound if none.
+func (c *Client) Calibration() (cal web.APICalibration, err error) {
+	p, err := c.boxPath("calibration")
+	if err != nil {
+		return cal, err
+	}
+	err = c.get(p, nil, &cal)
+	return cal, err
+}
+
+// Calibrate fits voltage calibration of stopped box to points, with a polynomial of
+// degree (1 for a linear correction), and saves it to server config.
+func (c *Client) Calibrate(points []regenbox.CalibrationPoint, degree int) (cal web.APICalibration, err error) {
+	p, err := c.boxPath("calibration")
+	if err != nil {
+		return cal, err
+	}
+	_, err = c.request(http.MethodPut, p, nil, web.APICalibrate{Points: points, Degree: degree}, &cal)
+	return cal, err
+}
+
+// RemoveCalibration removes voltage calibration of stopped box, from server config too.
+func (c *Client) RemoveCalibration() error {
+	p, err := c.boxPath("calibration")
+	if err != nil {
+		return err
+	}
+	_, err = c.request(http.MethodDelete, p, nil, nil, nil)
+	return err
+}
+
+// Session returns session running on box, or an error satisfying IsNotFound if none.
+func (c *Client) Session() (sess web.APISession, err error) {
+	p, err := c.boxPath("session")
+	if err != nil {
+		return sess, err
+	}
+	err = c.get(p, nil, &sess)
+	return sess, err
+}
+
+// Start starts a session with current config of box.
+func (c *Client) Start() (sess web.APISession, err error) {
+	return c.sessionAction(http.MethodPost, "")
+}
+
+// Stop stops session running on box.
+func (c *Client) Stop() error {
+	p, err := c.boxPath("session")
+	if err != nil {
+		return err
+	}
+	_, err = c.request(http.MethodDelete, p, nil, nil, nil)
+	return err
+}
+
+// Pause pauses session running on box.
+func (c *Client) Pause() (web.APISession, error) {
+	return c.sessionAction(http.MethodPost, "pause")
+}
+
+// Resume resumes paused session of box.
+func (c *Client) Resume() (web.APISession, error) {
+	return c.sessionAction(http.MethodPost, "resume")
+}
+
+func (c *Client) sessionAction(method string, action string) (sess web.APISession, err error) {
+	elems := []string{"session"}
+	if action != "" {
+		elems = append(elems, action)
+	}
+	p, err := c.boxPath(elems...)
+	if err != nil {
+		return sess, err
+	}
+	_, err = c.request(method, p, nil, nil, &sess)
+	return sess, err
+}
+
+// ListChartLogs returns a page of at most limit chart logs of box, most recent
+// first, skipping offset ones. A limit of 0 lists as many as server allows.
+func (c *Client) ListChartLogs(offset int, limit int) (page web.APIChartLogPage, err error) {
+	p, err := c.boxPath("chartlogs")
+	if err != nil {
+		return page, err
+	}
+	q := url.Values{"offset": {strconv.Itoa(offset)}, "limit": {strconv.Itoa(limit)}}
+	err = c.get(p, q, &page)
+	return page, err
+}
+
+// Chart returns chart log name of box, with its measures.
+func (c *Client) Chart(name string) (*web.ChartLog, error) {
+	p, err := c.boxPath("chartlogs", url.PathEscape(name))
+	if err != nil {
+		return nil, err
+	}
+	var cl web.ChartLog
+	err = c.get(p, nil, &cl)
+	if err != nil {
+		return nil, err
+	}
+	return &cl, nil
+}
+
+// Export writes chart log name of box to w, in format (see web.ExportFormats).
+func (c *Client) Export(w io.Writer, name string, format string) error {
+	p, err := c.boxPath("chartlogs", url.PathEscape(name), "export")
+	if err != nil {
+		return err
+	}
+	body, err := c.request(http.MethodGet, p, url.Values{"format": {format}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// Profiles returns profiles available on server in Profiler mode.
+func (c *Client) Profiles() (profiles []*regenbox.Profile, err error) {
+	err = c.get("/profiles", nil, &profiles)
+	return profiles, err
+}
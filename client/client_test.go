@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bytes"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/regenbox"
+	"github.com/solar3s/goregen/regenbox/sim"
+	"github.com/solar3s/goregen/web"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer is a goregen server of a simulated box "b1", requiring an operator token.
+type testServer struct {
+	*httptest.Server
+	srv   *web.Server
+	dir   string
+	token string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	dir, err := ioutil.TempDir("", "goregen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, hash, err := web.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := web.DefaultConfig
+	cfg.Web.DataDir = filepath.Join(dir, "data")
+	cfg.Web.StaticDir = filepath.Join(dir, "static")
+	cfg.Web.ProfilesDir = filepath.Join(dir, "profiles")
+	cfg.Web.Auth.Tokens = []web.TokenConfig{{Name: "test", Role: web.RoleOperator, Hash: hash}}
+	cfg.Regenbox.Ticker = util.Duration(time.Millisecond * 100)
+	cfg.Regenbox.Mode = regenbox.Discharger
+	bc := web.BoxConfig{
+		Id:       "b1",
+		Device:   sim.Scheme + "://nimh-aa?speed=600&resistor=4&test=" + t.Name(), // new battery for each test
+		Battery:  cfg.Battery,
+		Resistor: 4,
+		Regenbox: cfg.Regenbox,
+	}
+	cfg.Boxes = []web.BoxConfig{bc}
+
+	port, mode, err := regenbox.OpenPortName(bc.Device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := regenbox.NewSerial(port, mode, bc.Device, false)
+	conn.Start()
+	rbox, err := regenbox.NewRegenBox(conn, &bc.Regenbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boxes := web.NewRegistry()
+	_ = boxes.Add(web.NewBox(bc, rbox, nil))
+	srv := web.NewServer("test", boxes, &cfg, filepath.Join(dir, "config.toml"), false)
+	return &testServer{Server: httptest.NewServer(srv), srv: srv, dir: dir, token: token}
+}
+
+// Close stops server & running sessions, and removes its directory.
+func (ts *testServer) Close() {
+	ts.Server.Close()
+	for _, b := range ts.srv.Boxes.List() {
+		b.Regenbox.Stop()
+	}
+	_ = os.RemoveAll(ts.dir)
+}
+
+// client returns a client of ts, authenticated unless anonymous.
+func (ts *testServer) client(t *testing.T, anonymous bool) *Client {
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !anonymous {
+		c.Token = ts.token
+	}
+	return c
+}
+
+func TestClient_Snapshot(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	c := ts.client(t, true)
+
+	_, err := c.Snapshot()
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusUnauthorized || e.Message != "authentication required" {
+		t.Errorf("expected 401 error, got %v", err)
+	}
+
+	c.Token = ts.token
+	sn, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sn.Voltage == 0 || sn.State != regenbox.Connected || sn.Running {
+		t.Errorf("unexpected snapshot: %+v", sn)
+	}
+	if c.defaultBox != "b1" {
+		t.Errorf("expected default box b1, got \"%s\"", c.defaultBox)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	c := ts.client(t, false)
+	c.Box = "b1"
+
+	_, err := c.Session()
+	if !IsNotFound(err) {
+		t.Errorf("expected 404 error, got %v", err)
+	}
+	if err = c.Stop(); !IsNotFound(err) {
+		t.Errorf("expected 404 error, got %v", err)
+	}
+	if _, err = c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Start()
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusConflict {
+		t.Errorf("expected 409 error, got %v", err)
+	}
+	cfg, err := c.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.SetConfig(cfg, false)
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusConflict {
+		t.Errorf("expected 409 error, got %v", err)
+	}
+	if err = c.Stop(); err != nil {
+		t.Errorf("expected no error on 204, got %s", err)
+	}
+
+	c.Box = "unknown"
+	_, err = c.Snapshot()
+	if !IsNotFound(err) {
+		t.Errorf("expected 404 error, got %v", err)
+	}
+}
+
+func TestClient_Session(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	c := ts.client(t, false)
+
+	sess, err := c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.CycleType != regenbox.CycleDischarge || sess.Started.IsZero() {
+		t.Errorf("unexpected session %+v", sess)
+	}
+	if sess, err = c.Pause(); err != nil || !sess.Paused {
+		t.Errorf("expected paused session, got %+v (%v)", sess, err)
+	}
+	if sess, err = c.Resume(); err != nil || sess.Paused {
+		t.Errorf("expected resumed session, got %+v (%v)", sess, err)
+	}
+	time.Sleep(time.Millisecond * 350)
+	if err = c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// chart log is saved once session is over
+	var page web.APIChartLogPage
+	for i := 0; i < 20 && page.Total == 0; i++ {
+		time.Sleep(time.Millisecond * 50)
+		if page, err = c.ListChartLogs(0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if page.Total != 1 || len(page.Items) != 1 {
+		t.Fatalf("expected a chart log, got %+v", page)
+	}
+	name := page.Items[0].Name
+	cl, err := c.Chart(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cl.Measures.Data) == 0 || cl.CycleType != regenbox.CycleDischarge {
+		t.Errorf("unexpected %s chart log of %d measures", cl.CycleType, len(cl.Measures.Data))
+	}
+	var buf bytes.Buffer
+	if err = c.Export(&buf, name, web.ExportCSV); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "time,elapsed_s,voltage_mV") {
+		t.Errorf("unexpected export:\n%s", buf.String())
+	}
+	if _, err = c.Chart("nope.log"); !IsNotFound(err) {
+		t.Errorf("expected 404 error, got %v", err)
+	}
+}
+
+func TestClient_FlashFirmware(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	c := ts.client(t, false)
+
+	_, err := c.FlashFirmware("nope")
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusBadRequest || !strings.Contains(e.Message, "nope") {
+		t.Errorf("expected 400 error, got %v", err)
+	}
+	if c.HTTPClient.Timeout != DefaultTimeout {
+		t.Errorf("expected timeout of client to be left untouched, got %s", c.HTTPClient.Timeout)
+	}
+}
+
+func TestClient_Subscribe(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	c := ts.client(t, true)
+	if _, err := c.Subscribe(0); err == nil || err.(*Error).Status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 error, got %v", err)
+	}
+
+	c.Token = ts.token
+	sub, err := c.Subscribe(time.Millisecond * 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for every type of event, then for end of session
+	got := make(map[string]Event)
+	timeout := time.After(time.Second * 5)
+	for stopped := false; ; {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				t.Fatalf("subscription ended: %v", sub.Err())
+			}
+			got[ev.Type] = ev
+		case <-timeout:
+			t.Fatalf("timeout waiting for events, got %+v", got)
+		}
+		if !stopped && len(got) == 3 {
+			if err = c.Stop(); err != nil {
+				t.Fatal(err)
+			}
+			stopped = true
+		}
+		if stopped && got[EventCycle].Cycle.Final {
+			break
+		}
+	}
+	if sn := got[EventState].Snapshot; sn.State != regenbox.Connected || sn.Voltage == 0 {
+		t.Errorf("unexpected state event: %+v", got[EventState])
+	}
+	if got[EventTicker].Voltage == 0 {
+		t.Errorf("unexpected ticker event: %+v", got[EventTicker])
+	}
+	if cycle := got[EventCycle].Cycle; cycle.Type != regenbox.CycleDischarge || cycle.Status == "" {
+		t.Errorf("unexpected cycle event: %+v", got[EventCycle])
+	}
+
+	sub.Close()
+	for range sub.C {
+	}
+	if sub.Err() != nil {
+		t.Errorf("expected no error once closed, got %s", sub.Err())
+	}
+}
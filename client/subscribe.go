@@ -0,0 +1,141 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/solar3s/goregen/regenbox"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Types of websocket events.
+const (
+	EventState  = "state"  // Snapshot is set
+	EventTicker = "ticker" // Voltage is set
+	EventCycle  = "cycle"  // Cycle is set
+)
+
+// Event is a frame sent by server on the websocket of a box, only the field matching Type is set.
+type Event struct {
+	Type     string
+	Snapshot regenbox.Snapshot     // state: current state of box, sent every poll interval
+	Voltage  int                   // ticker: live voltage measure (mV), sent every Regenbox.Ticker
+	Cycle    regenbox.CycleMessage // cycle: message of running session
+}
+
+// frame is an encoded Event, as sent by web.Server.Websocket.
+type frame struct {
+	Type string
+	Data json.RawMessage
+}
+
+// Subscription receives events of a box until it's closed or its connection is lost.
+type Subscription struct {
+	C <-chan Event // closed once subscription is over, see Err
+
+	conn *websocket.Conn
+	done chan struct{}
+	err  error
+	once sync.Once
+	sync.Mutex
+}
+
+// Subscribe connects to websocket of box, snapshots are sent every poll
+// interval (server's Web.WebsocketInterval if 0).
+func (c *Client) Subscribe(poll time.Duration) (*Subscription, error) {
+	id, err := c.box()
+	if err != nil {
+		return nil, err
+	}
+	u := *c.URL
+	u.Scheme = "ws"
+	if c.URL.Scheme == "https" {
+		u.Scheme = "wss"
+	}
+	u.Path += "/box/" + url.PathEscape(id) + "/websocket"
+	if poll > 0 {
+		u.RawQuery = url.Values{"poll": {poll.String()}}.Encode()
+	}
+	h := make(http.Header)
+	c.authorize(h)
+	conn, resp, err := c.Dialer.Dial(u.String(), h)
+	if err != nil {
+		if resp != nil {
+			return nil, &Error{Status: resp.StatusCode, Message: err.Error()}
+		}
+		return nil, err
+	}
+
+	ch := make(chan Event, 16)
+	sub := &Subscription{C: ch, conn: conn, done: make(chan struct{})}
+	go sub.read(ch)
+	return sub, nil
+}
+
+func (sub *Subscription) read(ch chan<- Event) {
+	defer close(ch)
+	for {
+		var f frame
+		err := sub.conn.ReadJSON(&f)
+		if err != nil {
+			sub.close(err)
+			return
+		}
+		ev, err := decodeEvent(f)
+		if err != nil {
+			sub.close(err)
+			return
+		}
+		select {
+		case ch <- ev:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// decodeEvent decodes Data of f according to its Type.
+func decodeEvent(f frame) (ev Event, err error) {
+	ev.Type = f.Type
+	switch f.Type {
+	case EventState:
+		err = json.Unmarshal(f.Data, &ev.Snapshot)
+	case EventTicker:
+		err = json.Unmarshal(f.Data, &ev.Voltage)
+	case EventCycle:
+		err = json.Unmarshal(f.Data, &ev.Cycle)
+	default:
+		return ev, fmt.Errorf("goregen: unknown websocket event type \"%s\"", f.Type)
+	}
+	if err != nil {
+		err = fmt.Errorf("goregen: couldn't decode %s event: %s", f.Type, err)
+	}
+	return ev, err
+}
+
+// close closes connection, err is the reason unless subscription was closed by Close.
+func (sub *Subscription) close(err error) {
+	sub.once.Do(func() {
+		sub.Lock()
+		sub.err = err
+		sub.Unlock()
+		close(sub.done)
+		sub.conn.Close()
+	})
+}
+
+// Close ends subscription, C is closed after events it already buffered.
+func (sub *Subscription) Close() error {
+	sub.close(nil)
+	return nil
+}
+
+// Err returns why subscription ended, nil if it was closed by Close.
+func (sub *Subscription) Err() error {
+	sub.Lock()
+	defer sub.Unlock()
+	return sub.err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/web"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// exportCommand runs "goregen export", converting chart logs to csv, tsv
+// or json. It returns process exit code.
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", web.ExportCSV, "export format: "+strings.Join(web.ExportFormats, ", "))
+	outDir := fs.String("o", ".", "output directory, - for stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export [options] <chart log>...\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if !web.IsExportFormat(*format) {
+		fmt.Fprintf(os.Stderr, "unknown export format \"%s\", expected one of %s\n",
+			*format, strings.Join(web.ExportFormats, ", "))
+		return 2
+	}
+
+	code := 0
+	for _, fname := range fs.Args() {
+		out, err := exportChartLog(fname, *format, *outDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", fname, err)
+			code = 1
+		} else if out != "" {
+			fmt.Fprintf(os.Stderr, "%s -> %s\n", fname, out)
+		}
+	}
+	return code
+}
+
+// exportChartLog exports chart log fname to dir in format, and returns
+// the path of written file (empty when written to stdout).
+func exportChartLog(fname string, format string, dir string) (string, error) {
+	var cl web.ChartLog
+	err := util.ReadTomlFile(&cl, fname)
+	if err != nil {
+		return "", err
+	}
+	if dir == "-" {
+		return "", cl.Export(os.Stdout, format)
+	}
+
+	out := filepath.Join(dir, web.ExportFileName(fname, format))
+	f, err := os.Create(out)
+	if err != nil {
+		return "", err
+	}
+	err = cl.Export(f, format)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return out, err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/solar3s/goregen/firmware"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// firmwareCommand runs "goregen firmware flash", uploading a new firmware to a box.
+func firmwareCommand(args []string) int {
+	if len(args) == 0 || args[0] != "flash" {
+		fmt.Fprintf(os.Stderr, "Usage: %s firmware flash [options]\n", filepath.Base(os.Args[0]))
+		return 2
+	}
+	return firmwareFlashCommand(args[1:])
+}
+
+func firmwareFlashCommand(args []string) int {
+	fs := flag.NewFlagSet("firmware flash", flag.ExitOnError)
+	r := remoteFlags(fs)
+	variant := fs.String("variant", "", "firmware to upload: "+strings.Join(firmware.VariantNames(), ", ")+
+		" (defaults to current one if known, else "+firmware.DefaultVariant+")")
+	hexPath := fs.String("hex", "", "direct mode: upload custom Intel HEX image instead of a prebuilt variant")
+	board := fs.String("board", "", "direct mode: "+strings.Join(firmware.BoardNames(), ", ")+" (defaults to Firmware.Board of config)")
+	avrdude := fs.String("avrdude", "", "direct mode: path to avrdude (defaults to Firmware.Avrdude of config, or PATH)")
+	commandUsage(fs, "firmware flash [options]")
+	_ = fs.Parse(args)
+
+	if *variant != "" {
+		if _, err := firmware.LookupVariant(*variant); err != nil {
+			return fail(err)
+		}
+		if *hexPath != "" {
+			return fail(fmt.Errorf("-variant and -hex are exclusive"))
+		}
+	}
+
+	c, err := r.connect()
+	if err != nil {
+		return fail(err)
+	}
+	if c != nil {
+		if *hexPath != "" || *board != "" || *avrdude != "" {
+			return fail(fmt.Errorf("-hex, -board & -avrdude need direct mode, stop goregen server or use -direct"))
+		}
+		fmt.Fprintln(os.Stderr, "flashing firmware, this may take a minute...")
+		fw, err := c.FlashFirmware(*variant)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("box runs firmware %s\n", fw.Version)
+		return 0
+	}
+
+	cfg := r.cfg.Firmware
+	if *board != "" {
+		cfg.Board = *board
+	}
+	if *avrdude != "" {
+		cfg.Avrdude = *avrdude
+	}
+	brd, err := firmware.LookupBoard(cfg.Board)
+	if err != nil {
+		return fail(err)
+	}
+	b, err := r.openDirect()
+	if err != nil {
+		return fail(err)
+	}
+	defer b.Regenbox.Conn.Close()
+
+	var img []byte
+	target := ""
+	if *hexPath != "" {
+		img, err = ioutil.ReadFile(*hexPath)
+	} else {
+		target = firmware.TargetVariant(*variant, b.Regenbox.FirmwareVersion())
+		img, err = firmware.Image(target)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: flashing %s on %s...\n", b.Id, flashedName(target, *hexPath), b.Regenbox.Conn.Path())
+	a := firmware.Avrdude{Path: cfg.Avrdude, Board: brd, Output: os.Stderr}
+	fw, err := firmware.Flash(b.Regenbox, a, target, img)
+	if err != nil {
+		return fail(err)
+	}
+	if !fw.Known {
+		fmt.Fprintf(os.Stderr, "warning: firmware \"%s\" isn't known by this version of goregen\n", fw.Version)
+	}
+	fmt.Printf("box runs firmware %s\n", fw.Version)
+	return 0
+}
+
+// flashedName names what is flashed, for logs.
+func flashedName(variant string, hexPath string) string {
+	if hexPath != "" {
+		return filepath.Base(hexPath)
+	}
+	return "firmware " + variant
+}
@@ -0,0 +1,52 @@
+#!/bin/bash
+# Compiles every firmware variant with arduino-cli, and embeds
+# their Intel HEX images in goregen (firmware/images_gen.go).
+# images_gen.go is committed: run again whenever a .ino file changes.
+#
+#   arduino-cli core install arduino:avr
+#   ./firmware/build.sh
+
+set -e
+
+if ! test -d ".git"; then
+  echo "needs to be in root directory" >&2
+  exit 1
+fi
+
+if ! command -v arduino-cli >/dev/null; then
+  echo "arduino-cli is needed to build firmware images, see https://arduino.github.io/arduino-cli/" >&2
+  exit 1
+fi
+
+fqbn=${FQBN:-arduino:avr:nano:cpu=atmega328old}
+tmp=$(mktemp -d)
+out=firmware/images_gen.go
+
+# variant:source, see Variants in firmware.go
+variants="v0:firmware.ino anode:anode.ino cathode:cathode.ino v2:framed.ino"
+
+{
+  echo "// Code generated by build.sh. DO NOT EDIT."
+  echo
+  echo "package firmware"
+  echo
+  echo "func init() {"
+} > $tmp/images_gen.go
+
+for v in $variants; do
+  name=${v%%:*}
+  src=${v#*:}
+  echo "building $name from $src" >&2
+  mkdir -p "$tmp/$name"
+  cp "firmware/$src" "$tmp/$name/$name.ino"
+  arduino-cli compile --fqbn "$fqbn" --output-dir "$tmp/$name/build" "$tmp/$name" >&2
+  {
+    echo "	images[\"$name\"] = \`$(tr -d '\r' < "$tmp/$name/build/$name.ino.hex")"
+    echo "\`"
+  } >> $tmp/images_gen.go
+done
+
+echo "}" >> $tmp/images_gen.go
+mv $tmp/images_gen.go $out
+rm -rf $tmp
+echo "wrote $out" >&2
@@ -0,0 +1,255 @@
+// Package firmware uploads prebuilt regenbox firmwares to a box, using avrdude.
+//
+// Images of every Variant are compiled from the .ino files of this folder by
+// build.sh, and embedded in goregen. Nothing is compiled when flashing a box.
+package firmware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/solar3s/goregen/regenbox"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrNoImage = errors.New("no prebuilt image embedded in this build of goregen, see firmware/build.sh")
+
+// Variant is a firmware flavour, built from one of the .ino files of this folder.
+type Variant struct {
+	Name        string // version reported by ReadFirmware
+	Source      string
+	Description string
+}
+
+// Variants lists firmwares available for flashing.
+var Variants = []Variant{
+	{"v0", "firmware.ino", "original firmware"},
+	{"anode", "anode.ino", "rolling voltage average, AREF auto-calibration"},
+	{"cathode", "cathode.ino", "v0 with AREF auto-calibration"},
+	{"v2", "framed.ino", "framed protocol with checksums"},
+}
+
+// DefaultVariant is flashed when no variant is given, and box firmware isn't a known variant.
+const DefaultVariant = "v0"
+
+// LookupVariant returns variant name.
+func LookupVariant(name string) (Variant, error) {
+	for _, v := range Variants {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	return Variant{}, fmt.Errorf("unknown firmware variant \"%s\", expected one of %s",
+		name, strings.Join(VariantNames(), ", "))
+}
+
+// VariantNames returns names of Variants.
+func VariantNames() []string {
+	names := make([]string, len(Variants))
+	for i, v := range Variants {
+		names[i] = v.Name
+	}
+	return names
+}
+
+// images holds Intel HEX images of variants, see build.sh.
+var images = map[string]string{}
+
+// Image returns Intel HEX image of variant.
+func Image(variant string) ([]byte, error) {
+	if _, err := LookupVariant(variant); err != nil {
+		return nil, err
+	}
+	img, ok := images[variant]
+	if !ok {
+		return nil, ErrNoImage
+	}
+	return []byte(img), nil
+}
+
+// Board holds avrdude settings of an Arduino board.
+type Board struct {
+	Part       string // avrdude -p
+	Programmer string // avrdude -c
+	BaudRate   int    // avrdude -b, upload speed of bootloader
+}
+
+// Boards are the Arduino boards regenboxes are made of, by name.
+var Boards = map[string]Board{
+	"nano":     {Part: "atmega328p", Programmer: "arduino", BaudRate: 57600}, // old bootloader
+	"nano-new": {Part: "atmega328p", Programmer: "arduino", BaudRate: 115200},
+	"uno":      {Part: "atmega328p", Programmer: "arduino", BaudRate: 115200},
+}
+
+// DefaultBoard is the board of regenboxes, unless configured otherwise.
+const DefaultBoard = "nano"
+
+// LookupBoard returns board name, or DefaultBoard if name is empty.
+func LookupBoard(name string) (Board, error) {
+	if name == "" {
+		name = DefaultBoard
+	}
+	b, ok := Boards[name]
+	if !ok {
+		return Board{}, fmt.Errorf("unknown board \"%s\", expected one of %s", name, strings.Join(BoardNames(), ", "))
+	}
+	return b, nil
+}
+
+// BoardNames returns names of Boards, sorted.
+func BoardNames() []string {
+	var names []string
+	for name := range Boards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckHex checks that img is a well-formed Intel HEX image.
+func CheckHex(img []byte) error {
+	sc := bufio.NewScanner(bytes.NewReader(img))
+	n := 0
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		n++
+		if line[0] != ':' {
+			return fmt.Errorf("line %d: missing record mark", n)
+		}
+		rec, err := hex.DecodeString(line[1:])
+		if err != nil || len(rec) < 5 || len(rec) != int(rec[0])+5 {
+			return fmt.Errorf("line %d: malformed record", n)
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			return fmt.Errorf("line %d: checksum mismatch", n)
+		}
+		if rec[3] == 0x01 {
+			// end of file record
+			return nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return errors.New("missing end of file record")
+}
+
+// flashTimeout is how long avrdude gets to upload an image.
+var flashTimeout = time.Minute * 2
+
+// Avrdude uploads images to a board with avrdude.
+type Avrdude struct {
+	Path   string // avrdude executable, searched in PATH if empty
+	Board  Board
+	Output io.Writer // receives avrdude output, if not nil
+}
+
+// Args returns avrdude arguments to upload file to board on port.
+func (a Avrdude) Args(port string, file string) []string {
+	return []string{
+		"-p", a.Board.Part,
+		"-c", a.Board.Programmer,
+		"-P", port,
+		"-b", strconv.Itoa(a.Board.BaudRate),
+		"-D",
+		"-U", "flash:w:" + file + ":i",
+	}
+}
+
+// Flash uploads Intel HEX image img to board on port.
+func (a Avrdude) Flash(port string, img []byte) error {
+	if err := CheckHex(img); err != nil {
+		return fmt.Errorf("invalid image: %s", err)
+	}
+	path := a.Path
+	if path == "" {
+		path = "avrdude"
+	}
+	f, err := ioutil.TempFile("", "goregen-*.hex")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(img)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flashTimeout)
+	defer cancel()
+	var out bytes.Buffer
+	var w io.Writer = &out
+	if a.Output != nil {
+		w = io.MultiWriter(&out, a.Output)
+	}
+	cmd := exec.CommandContext(ctx, path, a.Args(port, f.Name())...)
+	cmd.Stdout, cmd.Stderr = w, w
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("avrdude: %s%s", err, lastLines(out.String(), 3))
+	}
+	return nil
+}
+
+// lastLines returns the last n lines of s, indented on new lines.
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		return ""
+	}
+	return "\n  " + strings.Join(lines, "\n  ")
+}
+
+// Flash uploads img to rb with a, and checks that rb reports variant as firmware
+// once reconnected. variant may be empty for custom images, which aren't checked.
+func Flash(rb *regenbox.RegenBox, a Avrdude, variant string, img []byte) (regenbox.Firmware, error) {
+	// check image before releasing port
+	if err := CheckHex(img); err != nil {
+		return regenbox.Firmware{}, fmt.Errorf("invalid image: %s", err)
+	}
+	fw, err := rb.Flash(func(port string) error {
+		return a.Flash(port, img)
+	})
+	if err != nil {
+		return fw, err
+	}
+	if variant != "" && fw.Version != variant {
+		return fw, fmt.Errorf("flashed %s, but box reports firmware \"%s\"", variant, fw.Version)
+	}
+	return fw, nil
+}
+
+// TargetVariant returns variant if it's not empty, else variant of firmware
+// currently running on box, if it's known, or DefaultVariant.
+func TargetVariant(variant string, current string) string {
+	if variant != "" {
+		return variant
+	}
+	if _, err := LookupVariant(current); err == nil {
+		return current
+	}
+	return DefaultVariant
+}
@@ -0,0 +1,166 @@
+package firmware
+
+import (
+	"fmt"
+	"github.com/solar3s/goregen/regenbox"
+	"github.com/solar3s/goregen/regenbox/sim"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testHex is a valid Intel HEX image: 4 data bytes & end of file record.
+const testHex = ":04000000DEADBEEFC4\n:00000001FF\n"
+
+func TestCheckHex(t *testing.T) {
+	for img, ok := range map[string]bool{
+		testHex:                                    true,
+		":04000000DEADBEEFC5\n:00000001FF\n":       false, // checksum
+		":04000000DEADBEEFC4\n":                    false, // no end of file
+		"04000000DEADBEEFC4\n:00000001FF\n":        false, // record mark
+		":0400000ZDEADBEEFC4\n:00000001FF\n":       false, // not hex
+		":04000000DEADBEEFC4\r\n:00000001FF\r\n\n": true,
+	} {
+		err := CheckHex([]byte(img))
+		if (err == nil) != ok {
+			t.Errorf("%q: expected ok=%v, got %v", img, ok, err)
+		}
+	}
+}
+
+func TestImage(t *testing.T) {
+	if _, err := Image("v9"); err == nil || !strings.Contains(err.Error(), "unknown firmware variant") {
+		t.Errorf("expected unknown variant error, got %v", err)
+	}
+	// every variant is flashable, see build.sh
+	for _, v := range Variants {
+		img, err := Image(v.Name)
+		if err != nil {
+			t.Errorf("%s: %s", v.Name, err)
+			continue
+		}
+		if err = CheckHex(img); err != nil {
+			t.Errorf("%s: %s", v.Name, err)
+		}
+	}
+}
+
+func TestTargetVariant(t *testing.T) {
+	for _, test := range [][3]string{
+		{"v2", "anode", "v2"},
+		{"", "anode", "anode"},
+		{"", regenbox.OutdatedFirmware, DefaultVariant},
+		{"", "", DefaultVariant},
+	} {
+		if v := TargetVariant(test[0], test[1]); v != test[2] {
+			t.Errorf("TargetVariant(%q, %q): expected %s, got %s", test[0], test[1], test[2], v)
+		}
+	}
+}
+
+// fakeAvrdude writes a script standing for avrdude, which saves its
+// arguments & uploaded image in dir, then exits with status.
+func fakeAvrdude(t *testing.T, dir string, status int) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake avrdude needs a unix shell")
+	}
+	path := filepath.Join(dir, "avrdude")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" > "%[1]s/args"
+for arg; do
+	case "$arg" in
+	flash:w:*) file=${arg#flash:w:}; cp "${file%%:i}" "%[1]s/image.hex";;
+	esac
+done
+echo "avrdude: fake upload done"
+exit %[2]d
+`, dir, status)
+	err := ioutil.WriteFile(path, []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAvrdude_Flash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goregen-avrdude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	board, _ := LookupBoard("")
+	a := Avrdude{Path: fakeAvrdude(t, dir, 0), Board: board}
+	err = a.Flash("/dev/ttyUSB0", []byte(testHex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if !strings.HasPrefix(string(args), "-p atmega328p -c arduino -P /dev/ttyUSB0 -b 57600 -D -U flash:w:") {
+		t.Errorf("unexpected avrdude arguments: %s", args)
+	}
+	img, _ := ioutil.ReadFile(filepath.Join(dir, "image.hex"))
+	if string(img) != testHex {
+		t.Errorf("unexpected uploaded image: %q", img)
+	}
+
+	if err = a.Flash("/dev/ttyUSB0", []byte("garbage")); err == nil {
+		t.Error("expected invalid image error")
+	}
+
+	a.Path = fakeAvrdude(t, dir, 1)
+	err = a.Flash("/dev/ttyUSB0", []byte(testHex))
+	if err == nil || !strings.Contains(err.Error(), "fake upload done") {
+		t.Errorf("expected avrdude error with its output, got %v", err)
+	}
+}
+
+func TestFlash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goregen-avrdude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := "sim://nimh-aa?id=flash"
+	port, cfg, err := regenbox.OpenPortName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := regenbox.NewSerial(port, cfg, name, true)
+	conn.Start()
+	rb, err := regenbox.NewRegenBox(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rb.Conn.Close() }()
+
+	a := Avrdude{Path: fakeAvrdude(t, dir, 0), Board: Boards["uno"]}
+	// simulated box keeps its firmware
+	_, err = Flash(rb, a, "v0", []byte(testHex))
+	if err == nil || !strings.Contains(err.Error(), "box reports firmware \"sim\"") {
+		t.Errorf("expected firmware check error, got %v", err)
+	}
+	fw, err := Flash(rb, a, "", []byte(testHex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fw.Version != sim.DefaultFirmware {
+		t.Errorf("expected firmware %s, got %s", sim.DefaultFirmware, fw.Version)
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if !strings.Contains(string(args), "-P "+name) {
+		t.Errorf("expected box device as port, got %s", args)
+	}
+
+	a.Path = fakeAvrdude(t, dir, 1)
+	if _, err = Flash(rb, a, "", []byte(testHex)); err == nil {
+		t.Error("expected avrdude error")
+	}
+	if st := rb.State(); st != regenbox.Connected {
+		t.Errorf("expected box to reconnect after failure, got %s", st)
+	}
+}
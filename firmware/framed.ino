@@ -0,0 +1,331 @@
+/*---------------------------------------------------------------------*
+  This file is the reference firmware for goregen's framed protocol (v2),
+  it is responsible for communicating with the main executable "goregen"
+
+  In case of a major upgrade, or if you need to install it on a new
+  Arduino board, please refer to the wiki section of the project :
+
+      https://github.com/solar3s/goregen/wiki/Upgrading-firmware
+-----------------------------------------------------------------------*/
+
+#define VERSION "v2"
+
+/*---------------------------------------------------------------------*
+  Provides direct pin access via a framed serial protocol
+
+  Every instruction & answer is a frame:
+
+    FRAME_START | seq | cmd | len | payload (len bytes) | crc8
+
+  crc8 covers seq, cmd, len & payload (CRC-8/SMBUS: poly 0x07, init 0).
+  Answers repeat seq & cmd of their instruction, their payload is the
+  same as in v0 protocol (see firmware.ino):
+    - On toggle instructions: 1 single boolean byte for new state
+        (LED_TOGGLE)
+    - On other pin instructions: empty payload
+        (LED_0/1, PIN_DISCHARGE_0/1, PIN_CHARGE_0/1, MODE_*, PING)
+    - On uint readings: ascii repr of value
+        (READ_A0, READ_V, READ_VERSION)
+
+  Instructions that can't be processed are answered with a NAK frame,
+  holding rejected cmd and reason (NAK_CHECKSUM, NAK_UNKNOWN, NAK_LENGTH).
+
+  Single byte instructions of v0 protocol are still answered the v0 way,
+  goregen reads VERSION this way before switching to frames.
+
+-----------------------------------------------------------------------*/
+
+
+// -------------------------------------------
+// Input instructions (waiting on serial read)
+//
+// READ_* writes string response
+#define READ_A0         0x00 // read A0 pin
+#define READ_V          0x01 // fancy A0 reads and compute voltage
+#define READ_VERSION    0x02 // returns current firmware version
+
+// LED_TOGGLE writes boolean response (led state)
+#define LED_TOGGLE      0x12 // led toggle
+
+// all other commands return an empty response
+#define LED_0           0x10 // led off
+#define LED_1           0x11 // led on
+#define PIN_DISCHARGE_0 0x30 // pin discharge off
+#define PIN_DISCHARGE_1 0x31 // pin discharge on
+#define PIN_CHARGE_0    0x40 // pin charge off
+#define PIN_CHARGE_1    0x41 // pin charge on
+
+#define MODE_IDLE       0x50 // enable idle mode
+#define MODE_CHARGE     0x51 // enable charge mode
+#define MODE_DISCHARGE  0x52 // enable discharge mode
+
+#define PING            0xA0 // just a ping
+
+#define STOP_BYTE       0xff // sent after all v0 communication
+
+// ---------------------------
+// Framing
+#define FRAME_START     0xfe // first byte of every frame
+#define NAK             0xe0 // answer cmd of rejected instructions
+#define NAK_CHECKSUM    0x01 // crc8 mismatch
+#define NAK_UNKNOWN     0x02 // unknown instruction
+#define NAK_LENGTH      0x03 // unexpected payload
+
+#define FRAME_TIMEOUT   50   // ms to wait for the rest of a frame
+#define MAX_PAYLOAD     16   // longest payload read or written
+
+// ---------------------------
+// Internal address and config
+#define PIN_CHARGE    4        // output pin address (charge)
+#define PIN_DISCHARGE 3        // output pin address (discharge)
+#define PIN_LED       13       // output pin address (arduino led)
+#define PIN_ANALOG    A0       // analog pin on battery-0 voltage
+
+// config parameters for getVoltage()
+#define CAN_REF       2410 // tension de reference du CAN
+#define CAN_BITSIZE   1023 // précision du CAN
+#define NB_ANALOG_RD  204  // how many analog read to measure average
+
+// Averaging parameters
+#define VOLTAGE_HISTORY_NUM  10                  // Number of samples for averaging
+unsigned long gVoltageHist[VOLTAGE_HISTORY_NUM]; // Voltage history
+unsigned long gHistCounter = 0;                  // Voltage measurement counter
+
+// answer being built, see handle()
+byte gOut[MAX_PAYLOAD];
+byte gOutLen = 0;
+
+// computeAvgVoltage retreive the previous last
+// VOLTAGE_HISTORY_NUM measures and averages on that
+unsigned long computeAvgVoltage() {
+  unsigned long avgVoltage = 0;
+  byte sz = gHistCounter < VOLTAGE_HISTORY_NUM?
+    gHistCounter: VOLTAGE_HISTORY_NUM;
+  for (byte i = 0; i < sz; i++) {
+    avgVoltage += gVoltageHist[i];
+  }
+  avgVoltage = floor(avgVoltage / sz);
+  return avgVoltage;
+}
+
+void setCharge(boolean b) {
+  digitalWrite(PIN_CHARGE, !b);
+}
+
+void setDischarge(boolean b) {
+  digitalWrite(PIN_DISCHARGE, b);
+}
+
+void setLed(boolean b) {
+  digitalWrite(PIN_LED, b);
+}
+
+boolean toggleLed() {
+  boolean b = !digitalRead(PIN_LED);
+  setLed(b);
+  return b;
+}
+
+unsigned long getAnalog() {
+  return analogRead(PIN_ANALOG);
+}
+
+unsigned long getVoltage() {
+  unsigned long tmp, sum;
+  sum = 0;
+  for(byte i=0; i < NB_ANALOG_RD; i++){
+    tmp = getAnalog();
+    sum = sum + tmp;
+    delay(1);
+  }
+  sum = sum / NB_ANALOG_RD;
+  // convert using CAN specs and ref value
+  sum = (sum * CAN_REF) / CAN_BITSIZE;
+
+  gVoltageHist[gHistCounter % VOLTAGE_HISTORY_NUM] = sum;
+  gHistCounter++;
+
+  return computeAvgVoltage();
+}
+
+// crc8 updates crc with b (CRC-8/SMBUS)
+byte crc8(byte crc, byte b) {
+  crc ^= b;
+  for (byte i = 0; i < 8; i++) {
+    crc = crc & 0x80? (crc << 1) ^ 0x07: crc << 1;
+  }
+  return crc;
+}
+
+// outPrint sets s as answer, outNumber sets ascii repr of v
+void outPrint(const char *s) {
+  gOutLen = 0;
+  while (*s && gOutLen < MAX_PAYLOAD) {
+    gOut[gOutLen++] = *s++;
+  }
+}
+
+void outNumber(unsigned long v) {
+  char buf[11];
+  ultoa(v, buf, 10);
+  outPrint(buf);
+}
+
+// handle processes instruction in, its answer is left in gOut.
+// It returns false if instruction is unknown.
+boolean handle(byte in) {
+  gOutLen = 0;
+  switch (in) {
+    case READ_VERSION:
+      outPrint(VERSION);
+      break;
+    case READ_A0:
+      outNumber(getAnalog());
+      break;
+    case READ_V:
+      outNumber(getVoltage());
+      break;
+
+    case LED_0:
+      setLed(0);
+      break;
+    case LED_1:
+      setLed(1);
+      break;
+    case LED_TOGGLE:
+      gOut[gOutLen++] = toggleLed();
+      break;
+
+    case PIN_DISCHARGE_0:
+      setDischarge(0);
+      break;
+    case PIN_DISCHARGE_1:
+      setDischarge(1);
+      break;
+
+    case PIN_CHARGE_0:
+      setCharge(0);
+      break;
+    case PIN_CHARGE_1:
+      setCharge(1);
+      break;
+
+    case MODE_IDLE:
+      setDischarge(0);
+      setCharge(0);
+      break;
+    case MODE_CHARGE:
+      setDischarge(0);
+      setCharge(1);
+      break;
+    case MODE_DISCHARGE:
+      setCharge(0);
+      setDischarge(1);
+      break;
+    case PING:
+      break;
+    default:
+      return false;
+  }
+  return true;
+}
+
+// writeFrame sends a frame holding payload
+void writeFrame(byte seq, byte cmd, byte *payload, byte len) {
+  byte crc = 0;
+  crc = crc8(crc, seq);
+  crc = crc8(crc, cmd);
+  crc = crc8(crc, len);
+  for (byte i = 0; i < len; i++) {
+    crc = crc8(crc, payload[i]);
+  }
+  Serial.write(FRAME_START);
+  Serial.write(seq);
+  Serial.write(cmd);
+  Serial.write(len);
+  Serial.write(payload, len);
+  Serial.write(crc);
+}
+
+void writeNak(byte seq, byte cmd, byte reason) {
+  byte payload[2] = {cmd, reason};
+  writeFrame(seq, NAK, payload, 2);
+}
+
+// readFrame reads the rest of a frame, once FRAME_START was received
+void readFrame() {
+  byte header[3]; // seq, cmd, len
+  if (Serial.readBytes(header, 3) != 3) {
+    // incomplete frame, drop it
+    return;
+  }
+  byte seq = header[0], cmd = header[1], len = header[2];
+  byte crc = 0;
+  for (byte i = 0; i < 3; i++) {
+    crc = crc8(crc, header[i]);
+  }
+
+  // no instruction takes a payload yet, still read it to check crc
+  byte payload[MAX_PAYLOAD];
+  for (byte i = 0; i < len; i++) {
+    byte b;
+    if (Serial.readBytes(&b, 1) != 1) {
+      return;
+    }
+    crc = crc8(crc, b);
+    if (i < MAX_PAYLOAD) {
+      payload[i] = b;
+    }
+  }
+  byte sum;
+  if (Serial.readBytes(&sum, 1) != 1) {
+    return;
+  }
+
+  if (sum != crc) {
+    writeNak(seq, cmd, NAK_CHECKSUM);
+  } else if (len > 0) {
+    writeNak(seq, cmd, NAK_LENGTH);
+  } else if (!handle(cmd)) {
+    writeNak(seq, cmd, NAK_UNKNOWN);
+  } else {
+    writeFrame(seq, cmd, gOut, gOutLen);
+  }
+}
+
+void setup() {
+  Serial.begin(57600);
+  Serial.setTimeout(FRAME_TIMEOUT);
+  // reference de tension pour les mesures
+  analogReference(EXTERNAL);
+
+  pinMode(PIN_CHARGE, OUTPUT);
+  pinMode(PIN_DISCHARGE, OUTPUT);
+  pinMode(PIN_LED, OUTPUT);
+
+  setCharge(0);
+  setDischarge(0);
+  setLed(1);
+}
+
+
+// framed talk protocol, with v0 fallback
+void loop() {
+  if (!Serial.available()) {
+    return;
+  }
+
+  byte in = Serial.read();
+  if (in == FRAME_START) {
+    readFrame();
+    return;
+  }
+
+  if (!handle(in)) {
+    // do not talk to strangers
+    return;
+  }
+  // v0 answer, end communication
+  Serial.write(gOut, gOutLen);
+  Serial.write(STOP_BYTE);
+}
@@ -5,11 +5,13 @@ go 1.12
 require (
 	github.com/BurntSushi/toml v0.3.0 // indirect
 	github.com/creack/goselect v0.0.0-20160714172859-1bd5ca702c61 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/gorilla/context v0.0.0-20160226214623-1ea25387ff6f // indirect
 	github.com/gorilla/mux v1.6.0
 	github.com/gorilla/websocket v1.4.1
 	github.com/rkjdid/errors v0.0.0-20170526093139-c9dd0c1e5fc1 // indirect
 	github.com/rkjdid/util v0.0.0-20171112122515-ba6a983d9160
 	go.bug.st/serial.v1 v0.0.0-20170728081230-eae1344f9f90
-	golang.org/x/sys v0.0.0-20171208153348-b8f5ef32195c // indirect
+	golang.org/x/crypto v0.0.0-20190605123033-f99c8df09eb5
+	golang.org/x/net v0.0.0-20190522155817-f3200d17e092 // indirect
 )
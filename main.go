@@ -1,36 +1,94 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"github.com/rkjdid/util"
 	"github.com/solar3s/goregen/regenbox"
+	"github.com/solar3s/goregen/regenbox/sim"
 	"github.com/solar3s/goregen/web"
 	"io"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var (
-	conn       *regenbox.SerialConnection
 	rootConfig *web.Config
+	logFile    *os.File
+	tui        bool // "goregen tui": render a dashboard on terminal instead of logs
 )
 
+// commands are run by "goregen <command>", instead of goregen itself.
+var commands = map[string]func(args []string) int{
+	"export":    exportCommand,
+	"passwd":    passwdCommand,
+	"token":     tokenCommand,
+	"status":    statusCommand,
+	"start":     startCommand,
+	"stop":      stopCommand,
+	"logs":      logsCommand,
+	"watch":     watchCommand,
+	"firmware":  firmwareCommand,
+	"calibrate": calibrateCommand,
+}
+
+// usage prints usage of goregen server & its commands.
+func usage() {
+	name := filepath.Base(os.Args[0])
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [serve|tui] [options]\n", name)
+	fmt.Fprintf(out, "       %s <command> [options], see %s <command> -h\n\n", name, name)
+	fmt.Fprintln(out, "Commands:")
+	fmt.Fprintln(out, "  serve    run goregen server (default)")
+	fmt.Fprintln(out, "  tui      run goregen server, with a live dashboard of boxes on terminal")
+	fmt.Fprintln(out, "  status   print state of boxes")
+	fmt.Fprintln(out, "  start    start a session, with config overrides")
+	fmt.Fprintln(out, "  stop     stop running session")
+	fmt.Fprintln(out, "  watch    print snapshots of a box until interrupted")
+	fmt.Fprintln(out, "  logs     list or show chart logs")
+	fmt.Fprintln(out, "  firmware flash a new firmware to a box, with avrdude")
+	fmt.Fprintln(out, "  calibrate correct voltages of a box against a multimeter")
+	fmt.Fprintln(out, "  export   export chart logs to csv, tsv or json")
+	fmt.Fprintln(out, "  passwd   add or update a user of web authentication")
+	fmt.Fprintln(out, "  token    generate an API token")
+	fmt.Fprintln(out, "\nCommands status, start, stop, watch, logs, firmware & calibrate talk to a running goregen server,")
+	fmt.Fprintln(out, "or directly to the box on its serial port if there's none.")
+	fmt.Fprintln(out, "\nOptions of serve & tui:")
+	flag.PrintDefaults()
+}
+
 var (
-	device     = flag.String("dev", "-", "path to serial port, if empty it will be searched automatically")
+	device     = flag.String("dev", "-", "path to serial port, if empty it will be searched automatically (sim://nimh-aa?speed=600 for a simulated box)")
 	rootPath   = flag.String("root", "", "path to goregen's main directory (defaults to executable path)")
 	cfgPath    = flag.String("config", "", "path to config (defaults to <root>/config.toml)")
 	assetsPath = flag.String("assets", "", "restore static assets to provided directory & exit")
 	logDir     = flag.String("log", "", "path to logs directory (defaults to <root>/log)")
 	dataDir    = flag.String("data", "", "path to data directory (defaults to <root>/data)")
+	session    = flag.String("session", "ask", "what to do with sessions interrupted by a crash: ask, resume or finalize")
 	verbose    = flag.Bool("v", false, "higher verbosity")
 	version    = flag.Bool("version", false, "print version & exit")
 )
 
-func init() {
+// setup runs commands, or parses flags & config of goregen server.
+func setup() {
+	// subcommands
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+		if os.Args[1] == "serve" || os.Args[1] == "tui" {
+			tui = os.Args[1] == "tui"
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
+	flag.Usage = usage
 	flag.Parse()
 
 	// print version & exit
@@ -76,7 +134,7 @@ func init() {
 	}
 
 	logPath := filepath.Join(*logDir, time.Now().Format("2006-01-02_15h04m05.log"))
-	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err = os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Fatalf("couldn't create log file: %s", err)
 	}
@@ -113,25 +171,30 @@ func init() {
 		log.Printf("created new config file \"%s\"", *cfgPath)
 	}
 
+	switch *session {
+	case "ask", "resume", "finalize":
+	default:
+		log.Fatalf("invalid -session value \"%s\", expected ask, resume or finalize", *session)
+	}
+
 	// override device from -dev flag
 	if *device != "-" {
 		rootConfig.Device = *device
 	}
-	// explicit device address
-	if rootConfig.Device != "" {
-		dev := rootConfig.Device
-		port, config, err := regenbox.OpenPortName(dev)
-		if err != nil {
-			log.Fatal("error opening serial port: ", err)
-		}
-		conn = regenbox.NewSerial(port, config, dev, true)
-		conn.Start()
-	}
-
 	// datalogs directory
 	if *dataDir != "" {
 		rootConfig.Web.DataDir = *dataDir
 	}
+	err = rootConfig.Validate()
+	if ve, ok := err.(regenbox.ValidationError); ok {
+		log.Printf("invalid config \"%s\":", *cfgPath)
+		for _, fe := range ve {
+			log.Printf("  %s", fe)
+		}
+		os.Exit(1)
+	} else if err != nil {
+		log.Fatalf("invalid config \"%s\": %s", *cfgPath, err)
+	}
 	err = os.MkdirAll(rootConfig.Web.DataDir, 0755)
 	if err != nil {
 		log.Fatalf("couldn't mkdir Web.DataDir \"%s\": %s", rootConfig.Web.DataDir, err)
@@ -143,44 +206,161 @@ func init() {
 	_ = util.WriteToml(rootConfig, logFile)
 }
 
-func main() {
-	rbox, err := regenbox.NewRegenBox(conn, &rootConfig.Regenbox)
+// openBox connects to box described by cfg, on its explicit device
+// address if any, or on the first serial port answering otherwise.
+// Box is returned along with any connection error, its watcher
+// reconnects it once its device is available.
+func openBox(cfg web.BoxConfig) (*web.Box, error) {
+	rbox, err := openRegenbox(cfg)
+	log.Printf("%s: starting conn watcher (poll rate: %s)", cfg.Id, rootConfig.Watcher.ConnPollRate)
+	watcher := regenbox.NewWatcher(rbox, &rootConfig.Watcher)
+	watcher.WatchConn()
+	return web.NewBox(cfg, rbox, watcher), err
+}
+
+// openRegenbox connects to RegenBox described by cfg, see openBox.
+// A RegenBox is always returned, disconnected if its device couldn't be
+// opened or didn't answer, in which case an error is returned too.
+func openRegenbox(cfg web.BoxConfig) (*regenbox.RegenBox, error) {
+	var (
+		conn    regenbox.Transport
+		openErr error
+	)
+	if cfg.Device != "" {
+		dev := cfg.Device
+		if strings.HasPrefix(dev, sim.Scheme+"://") {
+			dev = sim.WithResistor(dev, float64(cfg.Resistor))
+		}
+		port, config, err := regenbox.OpenPortName(dev)
+		if err != nil {
+			openErr = fmt.Errorf("error opening serial port: %s", err)
+			conn = regenbox.NewClosedSerial(dev, config)
+		} else {
+			sc := regenbox.NewSerial(port, config, dev, true)
+			sc.Start()
+			conn = sc
+		}
+	}
+
+	rbox, err := regenbox.NewRegenBox(conn, &cfg.Regenbox)
 	if err != nil {
-		log.Println("error scanning for RegenBox:", err)
+		log.Printf("%s: error scanning for RegenBox: %s", cfg.Id, err)
+	}
+	if openErr != nil {
+		return rbox, openErr
 	}
 	if conn != nil {
 		_, err := rbox.TestConnection()
 		if err != nil {
-			log.Printf("no response from regenbox on port \"%s\": %s", *device, err)
-			os.Exit(1)
-		} else {
-			log.Printf("connected to \"%s\"", *device)
+			conn.Close()
+			return rbox, fmt.Errorf("no response from regenbox on port \"%s\": %s", cfg.Device, err)
 		}
+		log.Printf("%s: connected to \"%s\"", cfg.Id, cfg.Device)
 	}
+	return rbox, nil
+}
 
-	log.Printf("starting conn watcher (poll rate: %s)", rootConfig.Watcher.ConnPollRate)
-	watcher := regenbox.NewWatcher(rbox, &rootConfig.Watcher)
-	watcher.WatchConn()
+// recoverSession looks for a session of b interrupted by a crash, and
+// either resumes or finalizes it as an interrupted chart log, see -session.
+func recoverSession(b *web.Box, stdin *bufio.Reader) {
+	dir := rootConfig.BoxDataDir(b.Id)
+	sess, err := web.LoadSession(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("%s: couldn't load interrupted session: %s", b.Id, err)
+		}
+		return
+	}
+	log.Printf("%s: found interrupted %s session (step %d, %s elapsed, last saved %s)",
+		b.Id, sess.CycleType, sess.Progress.Step+1, sess.Progress.Elapsed, sess.Saved.Format("2006-01-02 15:04:05"))
 
-	log.Printf("starting webserver on http://%s ...", rootConfig.Web.ListenAddr)
-	go web.StartServer(Version, rbox, rootConfig, *cfgPath, *verbose)
+	resume := *session == "resume"
+	if *session == "ask" {
+		fmt.Printf("%s: resume interrupted session? [y/N] ", b.Id)
+		answer, _ := stdin.ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		resume = answer == "y" || answer == "yes"
+	}
+	if resume {
+		b.ResumeOnStart(sess)
+		return
+	}
 
-	// small delay to allow for panic in StartServer
-	<-time.After(time.Millisecond * 500)
-	log.Println("Press <Ctrl-C> to quit")
+	fname, err := web.FinalizeSession(dir, sess)
+	if err != nil {
+		log.Printf("%s: couldn't finalize interrupted session: %s", b.Id, err)
+	} else if fname != "" {
+		log.Printf("%s: saved interrupted session to chart log: %s", b.Id, fname)
+	}
+}
+
+func main() {
+	setup()
+	boxes := web.NewRegistry()
+	for _, bc := range rootConfig.BoxConfigs() {
+		b, err := openBox(bc)
+		if err != nil {
+			log.Printf("%s: %s, waiting for it to be connected", bc.Id, err)
+		}
+		_ = boxes.Add(b)
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	for _, b := range boxes.List() {
+		recoverSession(b, stdin)
+	}
+
+	scheme := "http"
+	if rootConfig.Web.TLS.Enabled {
+		scheme = "https"
+	}
+	log.Printf("starting webserver on %s://%s ...", scheme, rootConfig.Web.ListenAddr)
+	srv := web.NewServer(Version, boxes, rootConfig, *cfgPath, *verbose)
+	go srv.ListenAndServe()
 
-	trap := make(chan os.Signal)
-	signal.Notify(trap, os.Kill, os.Interrupt)
-	<-trap
-	fmt.Println()
+	// reload config when its file is modified, or on SIGHUP
+	stopWatch := make(chan struct{})
+	go srv.WatchConfig(stopWatch)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("SIGHUP received, reloading config...")
+			err := srv.Reload()
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+
+	// small delay to allow for panic in ListenAndServe
+	<-time.After(time.Millisecond * 500)
+	if tui {
+		// logs would garble the dashboard, log file only
+		log.SetOutput(logFile)
+		err := srv.RunTUI(os.Stdin, os.Stdout)
+		log.SetOutput(io.MultiWriter(logFile, os.Stderr))
+		if err != nil {
+			log.Println(err)
+		}
+	} else {
+		log.Println("Press <Ctrl-C> to quit")
+		trap := make(chan os.Signal)
+		signal.Notify(trap, os.Kill, os.Interrupt)
+		<-trap
+		fmt.Println()
+	}
 	log.Println("quit received...")
 
+	close(stopWatch)
 	cleanExit := make(chan struct{})
 	go func() {
-		watcher.Stop()
-		rbox.Stop()
-		if rbox.Conn != nil {
-			rbox.Conn.Close()
+		for _, b := range boxes.List() {
+			b.Watcher.Stop()
+			b.Regenbox.Stop()
+			if b.Regenbox.Conn != nil {
+				b.Regenbox.Conn.Close()
+			}
 		}
 
 		close(cleanExit)
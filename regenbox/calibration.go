@@ -0,0 +1,212 @@
+package regenbox
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxCalibrationDegree is the highest degree of Calibration polynomials.
+const MaxCalibrationDegree = 3
+
+// MaxCorrection is the largest correction (mV) a Calibration may apply
+// to voltages of single cells, see Calibration.Validate.
+const MaxCorrection = 250
+
+// calibrationRange are the voltages (mV) a Calibration is checked on.
+var calibrationRange = [2]int{800, 1800}
+
+var ErrNotCalibrated = errors.New("box isn't calibrated")
+
+// Calibration corrects voltages read by a box, as measured against a reference multimeter.
+// Corrected voltage is a polynomial of raw voltage: Coeffs[0] + Coeffs[1]*raw + Coeffs[2]*raw²...
+type Calibration struct {
+	Coeffs   []float64
+	Points   []CalibrationPoint `toml:",omitempty"` // reference measures Coeffs were fitted to
+	Time     time.Time          // when Points were measured
+	Identity string             `toml:",omitempty"` // of calibrated box, see DeviceIdentity
+}
+
+// CalibrationPoint is a voltage read by a box, along with the voltage read by a multimeter.
+type CalibrationPoint struct {
+	Raw       int // mV, as read by box
+	Reference int // mV, as read by multimeter
+}
+
+// FitCalibration fits a polynomial of degree (1 for a linear correction) to points,
+// by least squares. It needs at least degree+1 points of distinct raw voltages.
+func FitCalibration(points []CalibrationPoint, degree int) (*Calibration, error) {
+	if degree < 1 || degree > MaxCalibrationDegree {
+		return nil, fmt.Errorf("degree must be within 1 and %d, got %d", MaxCalibrationDegree, degree)
+	}
+	distinct := make(map[int]bool)
+	for _, p := range points {
+		distinct[p.Raw] = true
+	}
+	if len(distinct) <= degree {
+		return nil, fmt.Errorf("a degree %d calibration needs %d points of distinct voltages, got %d",
+			degree, degree+1, len(distinct))
+	}
+
+	// normal equations of least squares, on columns scaled to
+	// unit magnitude to keep powers of mV well conditioned
+	n := degree + 1
+	scale := make([]float64, n)
+	for j := range scale {
+		scale[j] = math.Pow(float64(calibrationRange[1]), float64(j))
+	}
+	a := make([][]float64, n)
+	for i := range a {
+		a[i] = make([]float64, n+1)
+	}
+	for _, p := range points {
+		x := make([]float64, n)
+		for j := range x {
+			x[j] = math.Pow(float64(p.Raw), float64(j)) / scale[j]
+		}
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				a[i][j] += x[i] * x[j]
+			}
+			a[i][n] += x[i] * float64(p.Reference)
+		}
+	}
+	coeffs, err := solve(a)
+	if err != nil {
+		return nil, err
+	}
+	for j := range coeffs {
+		coeffs[j] /= scale[j]
+	}
+	return &Calibration{
+		Coeffs: coeffs,
+		Points: append([]CalibrationPoint(nil), points...),
+		Time:   time.Now(),
+	}, nil
+}
+
+// solve solves linear system of augmented matrix a, by gaussian elimination with partial pivoting.
+func solve(a [][]float64) ([]float64, error) {
+	n := len(a)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, errors.New("calibration points don't determine a polynomial, measure more voltages")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		for row := col + 1; row < n; row++ {
+			f := a[row][col] / a[col][col]
+			for k := col; k <= n; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+		}
+	}
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := a[row][n]
+		for k := row + 1; k < n; k++ {
+			sum -= a[row][k] * x[k]
+		}
+		x[row] = sum / a[row][row]
+	}
+	return x, nil
+}
+
+// Apply returns raw voltage corrected by c, c may be nil.
+func (c *Calibration) Apply(raw int) int {
+	if c == nil || len(c.Coeffs) == 0 {
+		return raw
+	}
+	return int(math.Round(c.eval(float64(raw))))
+}
+
+func (c *Calibration) eval(x float64) float64 {
+	var v float64
+	for i := len(c.Coeffs) - 1; i >= 0; i-- {
+		v = v*x + c.Coeffs[i]
+	}
+	return v
+}
+
+// MaxError returns the largest difference (mV) between Points and their corrected voltage.
+func (c *Calibration) MaxError() int {
+	var max int
+	for _, p := range c.Points {
+		d := c.Apply(p.Raw) - p.Reference
+		if d < 0 {
+			d = -d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// Validate checks that c has at most MaxCalibrationDegree, and doesn't correct
+// voltages of single cells by more than MaxCorrection. It returns a ValidationError.
+func (c *Calibration) Validate() error {
+	var errs ValidationError
+	if len(c.Coeffs) < 2 || len(c.Coeffs) > MaxCalibrationDegree+1 {
+		errs.Add("Coeffs", "expected 2 to %d coefficients, got %d", MaxCalibrationDegree+1, len(c.Coeffs))
+		return errs
+	}
+	for _, v := range c.Coeffs {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			errs.Add("Coeffs", "invalid coefficient %v", v)
+			return errs
+		}
+	}
+	for v := calibrationRange[0]; v <= calibrationRange[1]; v += 50 {
+		if d := c.Apply(v) - v; d > MaxCorrection || d < -MaxCorrection {
+			errs.Add("Coeffs", "corrects %dmV to %dmV, more than %dmV apart", v, c.Apply(v), MaxCorrection)
+			break
+		}
+	}
+	for _, p := range c.Points {
+		if p.Raw <= 0 || p.Reference <= 0 || p.Raw > MaxVoltage {
+			errs.Add("Points", "voltages must be within 1 and %dmV, got %dmV & %dmV", MaxVoltage, p.Raw, p.Reference)
+			break
+		}
+	}
+	return errs.Err()
+}
+
+// String formats c as a polynomial of raw voltage x, e.g. "1.0125x - 12.3".
+func (c *Calibration) String() string {
+	if c == nil || len(c.Coeffs) == 0 {
+		return "none"
+	}
+	var s string
+	for i := len(c.Coeffs) - 1; i >= 0; i-- {
+		v := c.Coeffs[i]
+		var term string
+		switch {
+		case i == 0:
+			term = strconv.FormatFloat(math.Abs(v), 'f', 1, 64)
+		case i == 1:
+			term = strconv.FormatFloat(math.Abs(v), 'f', 4, 64) + "x"
+		default:
+			term = strconv.FormatFloat(math.Abs(v), 'g', 4, 64) + "x^" + strconv.Itoa(i)
+		}
+		switch {
+		case s == "" && v < 0:
+			s = "-" + term
+		case s == "":
+			s = term
+		case v < 0:
+			s += " - " + term
+		default:
+			s += " + " + term
+		}
+	}
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,113 @@
+package regenbox
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFitCalibration(t *testing.T) {
+	// box reads 1.5% low, 12mV off
+	var points []CalibrationPoint
+	for _, raw := range []int{900, 1100, 1250, 1400, 1550} {
+		points = append(points, CalibrationPoint{Raw: raw, Reference: int(math.Round(1.015*float64(raw))) + 12})
+	}
+	c, err := FitCalibration(points, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Coeffs) != 2 || c.Coeffs[1] < 1.014 || c.Coeffs[1] > 1.016 {
+		t.Errorf("unexpected coefficients %v", c.Coeffs)
+	}
+	if e := c.MaxError(); e > 1 {
+		t.Errorf("expected fit within 1mV, got %dmV (%s)", e, c)
+	}
+	if v := c.Apply(1200); v != 1230 {
+		t.Errorf("expected 1200mV corrected to 1230mV, got %d (%s)", v, c)
+	}
+	if err = c.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// quadratic, exact on 3 points
+	c, err = FitCalibration([]CalibrationPoint{{1000, 1000}, {1200, 1210}, {1400, 1440}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := c.MaxError(); e != 0 {
+		t.Errorf("expected exact fit, got %dmV error (%s)", e, c)
+	}
+
+	for _, test := range []struct {
+		points []CalibrationPoint
+		degree int
+	}{
+		{[]CalibrationPoint{{1000, 1010}}, 1},
+		{[]CalibrationPoint{{1000, 1010}, {1000, 1012}}, 1},
+		{[]CalibrationPoint{{1000, 1010}, {1200, 1212}}, 2},
+		{[]CalibrationPoint{{1000, 1010}, {1200, 1212}}, 0},
+		{[]CalibrationPoint{{1000, 1010}, {1200, 1212}}, MaxCalibrationDegree + 1},
+	} {
+		if _, err = FitCalibration(test.points, test.degree); err == nil {
+			t.Errorf("%v, degree %d: expected an error", test.points, test.degree)
+		}
+	}
+}
+
+func TestCalibration_Validate(t *testing.T) {
+	for _, test := range []struct {
+		c  Calibration
+		ok bool
+	}{
+		{Calibration{Coeffs: []float64{12, 1.015}}, true},
+		{Calibration{Coeffs: []float64{12}}, false},
+		{Calibration{Coeffs: []float64{0, 1, 0, 0, 0}}, false},
+		{Calibration{Coeffs: []float64{300, 1}}, false},
+		{Calibration{Coeffs: []float64{0, 1.5}}, false},
+		{Calibration{Coeffs: []float64{0, 1}, Points: []CalibrationPoint{{0, 1000}}}, false},
+	} {
+		err := test.c.Validate()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: expected ok=%v, got %v", &test.c, test.ok, err)
+		}
+	}
+}
+
+func TestCalibration_String(t *testing.T) {
+	for c, s := range map[*Calibration]string{
+		nil:                                 "none",
+		{Coeffs: []float64{-12.34, 1.015}}:  "1.0150x - 12.3",
+		{Coeffs: []float64{5, 0.99, 1e-05}}: "1e-05x^2 + 0.9900x + 5.0",
+	} {
+		if c.String() != s {
+			t.Errorf("expected %q, got %q", s, c.String())
+		}
+	}
+}
+
+func TestRegenBox_Calibration(t *testing.T) {
+	conn := newEchoTransport(map[byte][]byte{
+		ReadVoltage:  []byte("1000"),
+		ReadFirmware: []byte("v0"),
+	})
+	rbx, err := NewRegenBox(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rbx.SetCalibration(&Calibration{Coeffs: []float64{5, 1.02}})
+
+	if v, err := rbx.ReadVoltage(); err != nil || v != 1025 {
+		t.Errorf("expected corrected voltage 1025, got %d (%v)", v, err)
+	}
+	if v, err := rbx.ReadRawVoltage(); err != nil || v != 1000 {
+		t.Errorf("expected raw voltage 1000, got %d (%v)", v, err)
+	}
+	sn := rbx.Snapshot()
+	if sn.Voltage != 1025 || sn.RawVoltage != 1000 {
+		t.Errorf("expected snapshot of 1025mV (1000mV raw), got %dmV (%dmV raw)", sn.Voltage, sn.RawVoltage)
+	}
+
+	rbx.SetCalibration(nil)
+	if sn = rbx.Snapshot(); sn.Voltage != 1000 || sn.RawVoltage != 1000 {
+		t.Errorf("expected uncalibrated snapshot of 1000mV, got %dmV (%dmV raw)", sn.Voltage, sn.RawVoltage)
+	}
+}
@@ -9,6 +9,7 @@ const (
 	CycleCharge    = "Charge"
 	CycleDischarge = "Discharge"
 	CycleMulti     = "Multi-cycle"
+	CycleProfile   = "Profile"
 )
 
 type CycleMessage struct {
@@ -17,6 +18,7 @@ type CycleMessage struct {
 	Status   string
 	Erronous bool
 	Final    bool
+	Capacity Capacity // measured capacity, only set when a discharge half-cycle is completed
 }
 
 func cycleMessage(t string, target int, message string, bErr bool, final bool) CycleMessage {
@@ -41,6 +43,14 @@ func cycleTimeout(t string, target int, timeout util.Duration) CycleMessage {
 	return cycleMessage(t, target, fmt.Sprintf("Didn't reach target after %s", timeout), true, true)
 }
 
+func cyclePaused(m CycleMessage) CycleMessage {
+	return cycleMessage(m.Type, m.Target, "Paused", false, false)
+}
+
+func cycleResumed(m CycleMessage) CycleMessage {
+	return cycleMessage(m.Type, m.Target, "Resumed", false, false)
+}
+
 func chargeStarted(target int) CycleMessage {
 	return cycleStarted(CycleCharge, target)
 }
@@ -57,8 +67,16 @@ func chargeReached(target int) CycleMessage {
 	return cycleReached(CycleCharge, target)
 }
 
-func dischargeReached(target int) CycleMessage {
-	return cycleReached(CycleDischarge, target)
+func dischargeReached(target int, c Capacity) CycleMessage {
+	m := cycleReached(CycleDischarge, target)
+	m.Capacity = c
+	return m
+}
+
+func multiCycleDischarged(target int, n int, of int, c Capacity) CycleMessage {
+	m := cycleMessage(CycleMulti, target, fmt.Sprintf("%s %d/%d done: %s", CycleDischarge, n, of, c), false, false)
+	m.Capacity = c
+	return m
 }
 
 func multiCycleReached(target int, n int) CycleMessage {
@@ -88,3 +106,25 @@ func dischargeError(target int, err error) CycleMessage {
 func multiCycleError(target int, err error) CycleMessage {
 	return cycleMessage(CycleMulti, target, err.Error(), true, true)
 }
+
+func profileStepStarted(name string, s Step, n int, of int) CycleMessage {
+	return cycleMessage(CycleProfile, s.Voltage, fmt.Sprintf("%s: step %d/%d, %s...", name, n, of, s), false, false)
+}
+
+func profileStepDischarged(name string, s Step, n int, of int, c Capacity) CycleMessage {
+	m := cycleMessage(CycleProfile, s.Voltage, fmt.Sprintf("%s: step %d/%d, %s done: %s", name, n, of, s, c), false, false)
+	m.Capacity = c
+	return m
+}
+
+func profileCompleted(name string, of int) CycleMessage {
+	return cycleMessage(CycleProfile, 0, fmt.Sprintf("%s: completed %d steps", name, of), false, true)
+}
+
+func profileStepTimeout(name string, s Step, n int, of int) CycleMessage {
+	return profileError(name, fmt.Errorf("step %d/%d, %s didn't reach target after %s", n, of, s, s.Timeout))
+}
+
+func profileError(name string, err error) CycleMessage {
+	return cycleMessage(CycleProfile, 0, fmt.Sprintf("%s: %s", name, err), true, true)
+}
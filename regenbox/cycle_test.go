@@ -0,0 +1,567 @@
+package regenbox
+
+import (
+	"github.com/rkjdid/util"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConfig returns a fast-paced config for mode.
+func testConfig(mode BotMode) Config {
+	cfg := DefaultConfig
+	cfg.Mode = mode
+	cfg.Ticker = util.Duration(time.Millisecond * 5)
+	cfg.UpDuration = util.Duration(time.Second * 5)
+	cfg.DownDuration = util.Duration(time.Second * 5)
+	cfg.TopVoltage = 1500
+	cfg.BottomVoltage = 900
+	cfg.NbHalfCycles = 3
+	return cfg
+}
+
+// collect reads from snaps & msgs until a final message is received.
+// If snaps is nil, snapshots aren't consumed.
+func collect(t *testing.T, snaps <-chan Snapshot, msgs <-chan CycleMessage) (voltages []int, messages []CycleMessage) {
+	timeout := time.After(time.Second * 10)
+	for {
+		select {
+		case sn := <-snaps:
+			voltages = append(voltages, sn.Voltage)
+		case msg := <-msgs:
+			messages = append(messages, msg)
+			if msg.Final {
+				return voltages, messages
+			}
+		case <-timeout:
+			t.Fatalf("no final message received after 10s (got %v)", messages)
+		}
+	}
+}
+
+func expectMessages(t *testing.T, got []CycleMessage, expected ...CycleMessage) {
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected cycle messages:\n\tgot:      %v\n\texpected: %v", got, expected)
+	}
+}
+
+func expectVoltages(t *testing.T, got []int, expected ...int) {
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected snapshot voltages:\n\tgot:      %v\n\texpected: %v", got, expected)
+	}
+}
+
+// expectIdle checks that box is stopped and that the last mode instruction sent was ModeIdle.
+func expectIdle(t *testing.T, rbx *RegenBox, fp *fakePort) {
+	if !rbx.Stopped() {
+		t.Error("box should be stopped")
+	}
+	if rbx.ChargeState() != Idle {
+		t.Errorf("expected charge state %s, got %s", Idle, rbx.ChargeState())
+	}
+	var last byte
+	for _, in := range fp.instructions() {
+		if in == ModeIdle || in == ModeCharge || in == ModeDischarge {
+			last = in
+		}
+	}
+	if last != ModeIdle {
+		t.Errorf("expected last mode instruction to be ModeIdle, got %#x", last)
+	}
+}
+
+func TestStart_Charger(t *testing.T) {
+	fp := newFakePort(1400, 1420, 1450, 1500)
+	rbx := newFakeBox(t, fp, testConfig(Charger))
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	voltages, messages := collect(t, snaps, msgs)
+	expectVoltages(t, voltages, 1400, 1420, 1450, 1500)
+	expectMessages(t, messages, chargeStarted(1500), chargeReached(1500))
+	expectIdle(t, rbx, fp)
+}
+
+func TestStart_Discharger(t *testing.T) {
+	fp := newFakePort(1200, 1000, 899)
+	rbx := newFakeBox(t, fp, testConfig(Discharger))
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	voltages, messages := collect(t, snaps, msgs)
+	expectVoltages(t, voltages, 1200, 1000, 899)
+	expectMessages(t, messages, dischargeStarted(900), dischargeReached(900, Capacity{}))
+	expectIdle(t, rbx, fp)
+}
+
+func TestStart_Cycler(t *testing.T) {
+	for _, chargeFirst := range []bool{false, true} {
+		var fp *fakePort
+		var expected []CycleMessage
+		if chargeFirst {
+			fp = newFakePort(1400, 1500, 1000, 900, 1400, 1500)
+			expected = []CycleMessage{
+				multiCycleStarted(1500, CycleCharge, 1, 3),
+				multiCycleStarted(900, CycleDischarge, 2, 3),
+				multiCycleDischarged(900, 2, 3, Capacity{}),
+				multiCycleStarted(1500, CycleCharge, 3, 3),
+				multiCycleReached(1500, 3),
+			}
+		} else {
+			fp = newFakePort(1000, 900, 1400, 1500, 1000, 900)
+			expected = []CycleMessage{
+				multiCycleStarted(900, CycleDischarge, 1, 3),
+				multiCycleDischarged(900, 1, 3, Capacity{}),
+				multiCycleStarted(1500, CycleCharge, 2, 3),
+				multiCycleStarted(900, CycleDischarge, 3, 3),
+				multiCycleDischarged(900, 3, 3, Capacity{}),
+				multiCycleReached(900, 3),
+			}
+		}
+		cfg := testConfig(Cycler)
+		cfg.ChargeFirst = chargeFirst
+		rbx := newFakeBox(t, fp, cfg)
+		err, snaps, msgs := rbx.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, messages := collect(t, snaps, msgs)
+		expectMessages(t, messages, expected...)
+		expectIdle(t, rbx, fp)
+	}
+}
+
+func TestStart_Capacity(t *testing.T) {
+	fp := newFakePort(1200, 1100, 1000, 899)
+	rbx := newFakeBox(t, fp, testConfig(Discharger))
+	rbx.SetResistor(10)
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last Snapshot
+	var messages []CycleMessage
+	for done := false; !done; {
+		select {
+		case last = <-snaps:
+		case msg := <-msgs:
+			messages = append(messages, msg)
+			done = msg.Final
+		}
+	}
+	final := messages[len(messages)-1]
+	if final.Capacity.MilliAmpHours <= 0 || final.Capacity.MilliWattHours <= 0 {
+		t.Fatalf("expected a measured capacity, got %s", final.Capacity)
+	}
+	if final.Capacity != last.Capacity || final.Capacity != rbx.Capacity() {
+		t.Errorf("final message capacity (%s) should match session capacity (%s, %s)",
+			final.Capacity, last.Capacity, rbx.Capacity())
+	}
+
+	// new session resets capacity
+	rbx.SetConfig(&Config{Mode: Charger, Ticker: util.Duration(time.Millisecond * 5), UpDuration: util.Duration(time.Second)})
+	err, snaps, msgs = rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	collect(t, snaps, msgs)
+	if c := rbx.Capacity(); c != (Capacity{}) {
+		t.Errorf("capacity should be 0 after a charge, got %s", c)
+	}
+}
+
+func TestStart_Timeout(t *testing.T) {
+	cfg := testConfig(Cycler)
+	cfg.DownDuration = util.Duration(time.Millisecond * 50)
+	fp := newFakePort(1200)
+	rbx := newFakeBox(t, fp, cfg)
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, messages := collect(t, snaps, msgs)
+	expectMessages(t, messages,
+		multiCycleStarted(900, CycleDischarge, 1, 3),
+		multiCycleTimeout(900, CycleDischarge, 1, 3, cfg.DownDuration))
+	expectIdle(t, rbx, fp)
+}
+
+func TestStart_Stalled(t *testing.T) {
+	cfg := testConfig(Charger)
+	cfg.UpDuration = util.Duration(time.Millisecond * 200)
+	fp := newFakePort(1200)
+	rbx := newFakeBox(t, fp, cfg)
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// box doesn't answer anymore, no snapshot should get through
+	fp.stall()
+	voltages, messages := collect(t, snaps, msgs)
+	expectVoltages(t, voltages)
+	expectMessages(t, messages, chargeStarted(1500), chargeTimeout(1500, cfg.UpDuration))
+}
+
+func TestStart_ReadErrors(t *testing.T) {
+	fp := newFakePort(1400, 1450, 1500)
+	// answers: ModeCharge, ReadFirmware, ReadVoltage, ModeCharge, ReadVoltage (fails)...
+	fp.readErrs = []error{nil, nil, nil, nil, errFakeRead}
+	rbx := newFakeBox(t, fp, testConfig(Charger))
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	voltages, messages := collect(t, snaps, msgs)
+	// erronous measures are skipped
+	expectVoltages(t, voltages, 1400, 1500)
+	expectMessages(t, messages, chargeStarted(1500), chargeReached(1500))
+	expectIdle(t, rbx, fp)
+	if c := rbx.Counters(); c.ReadErrors != 1 || c.WriteErrors != 0 {
+		t.Errorf("unexpected counters: %+v", c)
+	}
+}
+
+func TestStart_DetailedLog(t *testing.T) {
+	fp := newFakePort(1400, 1450, 1500)
+	fp.readErrs = []error{nil, nil, nil, nil, nil, errFakeRead}
+	cfg := testConfig(Charger)
+	cfg.DetailedLog = true
+	rbx := newFakeBox(t, fp, cfg)
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var details []Detail
+	timeout := time.After(time.Second * 10)
+	for done := false; !done; {
+		select {
+		case sn := <-snaps:
+			if sn.Detail == nil {
+				t.Fatalf("snapshot of %dmV has no detail", sn.Voltage)
+			}
+			details = append(details, *sn.Detail)
+		case msg := <-msgs:
+			done = msg.Final
+		case <-timeout:
+			t.Fatal("no final message received after 10s")
+		}
+	}
+
+	var retries int
+	for _, d := range details {
+		if d.Analog != 512 || d.Latency <= 0 {
+			t.Errorf("unexpected detail %+v", d)
+		}
+		retries += d.Retries
+	}
+	if len(details) < 2 || details[0].Retries != 0 || retries != 1 {
+		t.Errorf("expected the failed read to be counted once after first measure, got %+v", details)
+	}
+
+	// details are only read in detailed mode
+	if sn := rbx.Snapshot(); sn.Detail != nil {
+		t.Errorf("expected no detail out of a detailed session, got %+v", sn.Detail)
+	}
+}
+
+func TestStart_WriteError(t *testing.T) {
+	fp := newFakePort(1400, 1500)
+	fp.writeErrs = []error{errFakeWrite}
+	rbx := newFakeBox(t, fp, testConfig(Charger))
+	err, snaps, msgs := rbx.Start()
+	if err != errFakeWrite {
+		t.Fatalf("expected %s, got %v", errFakeWrite, err)
+	}
+	if snaps != nil || msgs != nil {
+		t.Error("channels should be nil on error")
+	}
+	if !rbx.Stopped() {
+		t.Fatal("box should still be stopped after a failed Start()")
+	}
+	if c := rbx.Counters(); c.WriteErrors != 1 {
+		t.Errorf("expected 1 write error, got %+v", c)
+	}
+
+	// box must be able to start again
+	err, snaps, msgs = rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, messages := collect(t, snaps, msgs)
+	expectMessages(t, messages, chargeStarted(1500), chargeReached(1500))
+}
+
+func TestStart_Running(t *testing.T) {
+	fp := newFakePort(1200)
+	rbx := newFakeBox(t, fp, testConfig(Charger))
+	err, _, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rbx.Stop()
+	<-msgs
+
+	if rbx.Stopped() {
+		t.Error("box should be running")
+	}
+	err, _, _ = rbx.Start()
+	if err != ErrBoxRunning {
+		t.Errorf("expected %s, got %v", ErrBoxRunning, err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	fp := newFakePort(1200)
+	rbx := newFakeBox(t, fp, testConfig(Cycler))
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-snaps
+	<-snaps
+
+	// concurrent calls to Stop must not panic, and all must wait for box to be stopped
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rbx.Stop()
+			if !rbx.Stopped() {
+				t.Error("box should be stopped when Stop() returns")
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, messages := collect(t, nil, msgs)
+	expectMessages(t, messages,
+		multiCycleStarted(900, CycleDischarge, 1, 3),
+		multiCycleError(900, ErrUserStop))
+	expectIdle(t, rbx, fp)
+
+	// stopping a stopped box is a no-op
+	rbx.Stop()
+}
+
+func TestStop_NotConsumed(t *testing.T) {
+	// nobody reads snapshots, Stop shouldn't wait for snapshotTimeout
+	fp := newFakePort(1200)
+	rbx := newFakeBox(t, fp, testConfig(Charger))
+	err, _, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+
+	t0 := time.Now()
+	rbx.Stop()
+	if d := time.Since(t0); d > time.Second {
+		t.Errorf("Stop() took too long: %s", d)
+	}
+	_, messages := collect(t, nil, msgs)
+	expectMessages(t, messages, chargeStarted(1500), chargeError(1500, ErrUserStop))
+}
+
+func TestStart_SnapshotSendTimeout(t *testing.T) {
+	defer func(d time.Duration) {
+		snapshotTimeout = d
+	}(snapshotTimeout)
+	snapshotTimeout = time.Millisecond * 30
+
+	fp := newFakePort(1200)
+	rbx := newFakeBox(t, fp, testConfig(Discharger))
+	err, _, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, messages := collect(t, nil, msgs)
+	expectMessages(t, messages, dischargeStarted(900), dischargeError(900, ErrSnapshotSendTimeout))
+	expectIdle(t, rbx, fp)
+}
+
+func TestPause(t *testing.T) {
+	cfg := testConfig(Charger)
+	cfg.UpDuration = util.Duration(time.Millisecond * 300)
+	fp := newFakePort(1200)
+	rbx := newFakeBox(t, fp, cfg)
+
+	if err := rbx.Pause(); err != ErrBoxStopped {
+		t.Errorf("expected %s, got %v", ErrBoxStopped, err)
+	}
+
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, []CycleMessage{<-msgs}, chargeStarted(1500))
+	<-snaps
+
+	if err = rbx.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	_ = rbx.Pause()
+	expectMessages(t, []CycleMessage{<-msgs}, cyclePaused(chargeStarted(1500)))
+
+	// snapshots keep flowing while paused, and timeout is suspended
+	t0 := time.Now()
+	for time.Since(t0) < time.Duration(cfg.UpDuration) {
+		sn := <-snaps
+		if !sn.Running || !sn.Paused {
+			t.Fatalf("expected a running & paused snapshot, got %+v", sn)
+		}
+	}
+	if !rbx.Paused() || rbx.Stopped() {
+		t.Fatal("box should be running & paused")
+	}
+	if rbx.ChargeState() != Idle {
+		t.Errorf("expected a paused box to be %s, got %s", Idle, rbx.ChargeState())
+	}
+
+	if err = rbx.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	fp.Lock()
+	fp.voltages = []int{1500}
+	fp.Unlock()
+	_, messages := collect(t, snaps, msgs)
+	expectMessages(t, messages, cycleResumed(chargeStarted(1500)), chargeReached(1500))
+	expectIdle(t, rbx, fp)
+
+	// charge was resumed
+	in := fp.instructions()
+	var modes []byte
+	for _, v := range in {
+		if v == ModeIdle || v == ModeCharge {
+			if len(modes) == 0 || modes[len(modes)-1] != v {
+				modes = append(modes, v)
+			}
+		}
+	}
+	expected := []byte{ModeCharge, ModeIdle, ModeCharge, ModeIdle}
+	if string(modes) != string(expected) {
+		t.Errorf("expected mode instructions %x, got %x", expected, modes)
+	}
+}
+
+func TestPause_Timeout(t *testing.T) {
+	// time spent before pause counts toward timeout
+	cfg := testConfig(Cycler)
+	cfg.DownDuration = util.Duration(time.Millisecond * 100)
+	fp := newFakePort(1200)
+	rbx := newFakeBox(t, fp, cfg)
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range snaps {
+		}
+	}()
+	<-msgs
+	time.Sleep(time.Millisecond * 60)
+	_ = rbx.Pause()
+	<-msgs
+	time.Sleep(time.Millisecond * 100)
+	t0 := time.Now()
+	_ = rbx.Resume()
+	_, messages := collect(t, nil, msgs)
+	if d := time.Since(t0); d > time.Millisecond*90 {
+		t.Errorf("expected timeout less than 90ms after resume, got %s", d)
+	}
+	expectMessages(t, messages,
+		cycleResumed(multiCycleStarted(900, CycleDischarge, 1, 3)),
+		multiCycleTimeout(900, CycleDischarge, 1, 3, cfg.DownDuration))
+
+	// stopping a paused box
+	err, snaps, msgs = rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range snaps {
+		}
+	}()
+	<-msgs
+	_ = rbx.Pause()
+	expectMessages(t, []CycleMessage{<-msgs}, cyclePaused(multiCycleStarted(900, CycleDischarge, 1, 3)))
+	rbx.Stop()
+	_, messages = collect(t, nil, msgs)
+	expectMessages(t, messages, multiCycleError(900, ErrUserStop))
+	if err = rbx.Resume(); err != ErrBoxStopped {
+		t.Errorf("expected %s, got %v", ErrBoxStopped, err)
+	}
+}
+
+func TestStartFrom(t *testing.T) {
+	fp := newFakePort(1400, 1500, 1000, 900)
+	rbx := newFakeBox(t, fp, testConfig(Cycler))
+	rbx.SetResistor(10)
+
+	// resume 2nd half-cycle (charge)
+	c := Capacity{MilliAmpHours: 100, MilliWattHours: 120}
+	err, snaps, msgs := rbx.StartFrom(Progress{Step: 1, Capacity: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, messages := collect(t, snaps, msgs)
+	if len(messages) != 4 {
+		t.Fatalf("unexpected messages: %v", messages)
+	}
+	expectMessages(t, messages[:2],
+		multiCycleStarted(1500, CycleCharge, 2, 3),
+		multiCycleStarted(900, CycleDischarge, 3, 3))
+	expectMessages(t, messages[3:], multiCycleReached(900, 3))
+	if got := rbx.Capacity(); got.MilliAmpHours <= c.MilliAmpHours {
+		t.Errorf("capacity should be added to resumed session's, got %s", got)
+	}
+	if p := rbx.Progress(); p.Step != 2 || p.Capacity != rbx.Capacity() {
+		t.Errorf("unexpected progress at end of session: %+v", p)
+	}
+
+	if err, _, _ = rbx.StartFrom(Progress{Step: 3}); err == nil {
+		t.Error("expected an error when starting from a step out of range")
+	}
+}
+
+func TestStartFrom_Elapsed(t *testing.T) {
+	cfg := testConfig(Discharger)
+	cfg.DownDuration = util.Duration(time.Second)
+	fp := newFakePort(1200)
+	rbx := newFakeBox(t, fp, cfg)
+
+	// budget already spent before resuming
+	err, snaps, msgs := rbx.StartFrom(Progress{Elapsed: util.Duration(time.Millisecond * 950)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now()
+	_, messages := collect(t, snaps, msgs)
+	if d := time.Since(t0); d > time.Millisecond*500 {
+		t.Errorf("expected timeout after ~50ms, got %s", d)
+	}
+	expectMessages(t, messages, dischargeStarted(900), dischargeTimeout(900, cfg.DownDuration))
+
+	// progress increases while running
+	cfg.DownDuration = util.Duration(time.Second * 5)
+	_ = rbx.SetConfig(&cfg)
+	err, snaps, msgs = rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-snaps
+	p1 := rbx.Progress()
+	<-snaps
+	<-snaps
+	p2 := rbx.Progress()
+	rbx.Stop()
+	collect(t, nil, msgs)
+	if p1.Step != 0 || p2.Elapsed <= p1.Elapsed {
+		t.Errorf("expected elapsed time to increase, got %s then %s", p1.Elapsed, p2.Elapsed)
+	}
+}
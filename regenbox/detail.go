@@ -0,0 +1,38 @@
+package regenbox
+
+import (
+	"time"
+)
+
+// Detail tells how a voltage was measured, so that a misbehaving cell can be told
+// apart from a misbehaving measure. See Config.DetailedLog.
+type Detail struct {
+	Analog  int           // ReadA0 answer (see Firmware.AnalogScale), -1 if it failed or isn't supported
+	Latency time.Duration // round trip of voltage read
+	Retries int           // failed & skipped answers since previous measure, see Counters
+}
+
+// detail reads analog value of rb, for a voltage read in latency.
+// Retries are counted by running session.
+func (rb *RegenBox) detail(latency time.Duration) *Detail {
+	d := &Detail{Latency: latency}
+	var err error
+	d.Analog, err = rb.ReadAnalog()
+	if err != nil {
+		d.Analog = -1
+	}
+	return d
+}
+
+// retries returns communication errors since previous call, given current counters c.
+func (s *session) retries(c Counters) int {
+	n := c.errors()
+	d := n - s.errors
+	s.errors = n
+	return int(d)
+}
+
+// errors sums errors of c that a read was missed or retried for.
+func (c Counters) errors() uint64 {
+	return c.ReadErrors + c.WriteErrors + c.ChecksumErrors + c.StaleFrames
+}
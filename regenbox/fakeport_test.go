@@ -0,0 +1,194 @@
+package regenbox
+
+import (
+	"errors"
+	"go.bug.st/serial.v1"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errFakeRead = errors.New("fake read error")
+var errFakeWrite = errors.New("fake write error")
+
+// fakePort is a scripted serial.Port speaking regenbox protocol. Each ReadVoltage
+// instruction replays the next value of voltages (the last one is repeated).
+// Errors are injected per instruction with writeErrs & readErrs, and
+// answers are held back for as long as port is stalled.
+type fakePort struct {
+	voltages  []int
+	firmware  string
+	writeErrs []error // consumed on each Write, nil entries succeed
+	readErrs  []error // consumed on each answer, nil entries succeed
+	received  []byte  // every instruction received
+	stalled   bool
+
+	buf    []byte
+	errs   []error
+	ready  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+	sync.Mutex
+}
+
+func newFakePort(voltages ...int) *fakePort {
+	return &fakePort{
+		voltages: voltages,
+		firmware: "fake",
+		ready:    make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+// newFakeBox returns a RegenBox using cfg, talking to fp through a SerialConnection.
+func newFakeBox(t *testing.T, fp *fakePort, cfg Config) *RegenBox {
+	conn := NewSerial(fp, DefaultSerialConfig, "fake", true)
+	conn.ReadTimeout = time.Millisecond * 50
+	conn.WriteTimeout = time.Millisecond * 50
+	conn.Start()
+	rbx, err := NewRegenBox(conn, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rbx
+}
+
+func (fp *fakePort) signal() {
+	select {
+	case fp.ready <- struct{}{}:
+	default:
+	}
+}
+
+// stall holds back answers until unstall is called.
+func (fp *fakePort) stall() {
+	fp.Lock()
+	fp.stalled = true
+	fp.Unlock()
+}
+
+func (fp *fakePort) unstall() {
+	fp.Lock()
+	fp.stalled = false
+	fp.Unlock()
+	fp.signal()
+}
+
+// instructions returns a copy of every instruction received so far.
+func (fp *fakePort) instructions() []byte {
+	fp.Lock()
+	defer fp.Unlock()
+	return append([]byte(nil), fp.received...)
+}
+
+func (fp *fakePort) answer(in byte) ([]byte, bool) {
+	switch in {
+	case ReadVoltage:
+		if len(fp.voltages) == 0 {
+			return []byte("0"), true
+		}
+		v := fp.voltages[0]
+		if len(fp.voltages) > 1 {
+			fp.voltages = fp.voltages[1:]
+		}
+		return []byte(strconv.Itoa(v)), true
+	case ReadA0:
+		return []byte("512"), true
+	case ReadFirmware:
+		return []byte(fp.firmware), true
+	case LedToggle:
+		return []byte{1}, true
+	case Ping, LedOn, LedOff, ModeIdle, ModeCharge, ModeDischarge:
+		return nil, true
+	}
+	return nil, false
+}
+
+func (fp *fakePort) Read(p []byte) (int, error) {
+	for {
+		fp.Lock()
+		if !fp.stalled {
+			if len(fp.errs) > 0 {
+				err := fp.errs[0]
+				fp.errs = fp.errs[1:]
+				fp.Unlock()
+				return 0, err
+			}
+			if len(fp.buf) > 0 {
+				n := copy(p, fp.buf)
+				fp.buf = fp.buf[n:]
+				fp.Unlock()
+				return n, nil
+			}
+		}
+		fp.Unlock()
+
+		select {
+		case <-fp.ready:
+		case <-fp.closed:
+			return 0, ErrClosedPort
+		}
+	}
+}
+
+func (fp *fakePort) Write(p []byte) (int, error) {
+	fp.Lock()
+	defer fp.Unlock()
+	var err error
+	if len(fp.writeErrs) > 0 {
+		err, fp.writeErrs = fp.writeErrs[0], fp.writeErrs[1:]
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, in := range p {
+		fp.received = append(fp.received, in)
+		out, ok := fp.answer(in)
+		if !ok {
+			continue
+		}
+		if len(fp.readErrs) > 0 {
+			err, fp.readErrs = fp.readErrs[0], fp.readErrs[1:]
+		}
+		if err != nil {
+			fp.errs = append(fp.errs, err)
+		} else {
+			fp.buf = append(append(fp.buf, out...), StopByte)
+		}
+	}
+	fp.signal()
+	return len(p), nil
+}
+
+func (fp *fakePort) Close() error {
+	fp.once.Do(func() {
+		close(fp.closed)
+	})
+	return nil
+}
+
+func (fp *fakePort) SetMode(mode *serial.Mode) error {
+	return nil
+}
+
+func (fp *fakePort) ResetInputBuffer() error {
+	return nil
+}
+
+func (fp *fakePort) ResetOutputBuffer() error {
+	return nil
+}
+
+func (fp *fakePort) SetDTR(dtr bool) error {
+	return nil
+}
+
+func (fp *fakePort) SetRTS(rts bool) error {
+	return nil
+}
+
+func (fp *fakePort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
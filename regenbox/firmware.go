@@ -0,0 +1,246 @@
+package regenbox
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OutdatedFirmware is the version of firmwares not answering to ReadFirmware.
+const OutdatedFirmware = "update me!"
+
+var ErrNotReopenable = errors.New("connection can't be reopened")
+var ErrFlashing = errors.New("box is being flashed")
+
+// canScale is mV per ADC count of firmwares answering raw ReadA0
+// counts, with CAN_REF (2410mV) as analog reference.
+const canScale = 2410.0 / 1023.0
+
+// Firmware describes what a firmware version is able to do, see RegisterFirmware.
+type Firmware struct {
+	Version         string
+	Known           bool    // registered version, other fields are guessed otherwise
+	Protocol        int     // 0: single byte protocol, 2 (FramedProtocol): framed protocol
+	Commands        []byte  // supported instructions
+	AnalogScale     float64 // mV per unit of ReadA0 answers, 0 if unknown
+	AveragedVoltage bool    // ReadVoltage answers an average of several reads
+	AutoAref        bool    // analog reference is measured at startup, rather than assumed to be 2410mV
+}
+
+// baseCommands are instructions supported by every versioned firmware.
+var baseCommands = []byte{
+	Ping, ReadA0, ReadVoltage, ReadFirmware,
+	LedOff, LedOn, LedToggle,
+	ModeIdle, ModeCharge, ModeDischarge,
+}
+
+var (
+	firmwares = map[string]Firmware{
+		"v0": {
+			Commands:        baseCommands,
+			AnalogScale:     canScale,
+			AveragedVoltage: true,
+		},
+		"anode": {
+			Commands:        baseCommands,
+			AnalogScale:     1, // ReadA0 converts to mV
+			AveragedVoltage: true,
+			AutoAref:        true,
+		},
+		"cathode": {
+			Commands:        baseCommands,
+			AnalogScale:     canScale, // nominal, actual reference is measured
+			AveragedVoltage: true,
+			AutoAref:        true,
+		},
+		"v2": {
+			Protocol:        FramedProtocol,
+			Commands:        baseCommands,
+			AnalogScale:     canScale,
+			AveragedVoltage: true,
+		},
+		OutdatedFirmware: {
+			// predates versioning, only core instructions are trusted
+			Commands: []byte{Ping, ReadVoltage, ModeIdle, ModeCharge, ModeDischarge},
+		},
+	}
+	firmwaresMu sync.RWMutex
+)
+
+// RegisterFirmware adds fw to known firmwares, replacing any previous fw.Version.
+func RegisterFirmware(fw Firmware) {
+	firmwaresMu.Lock()
+	firmwares[fw.Version] = fw
+	firmwaresMu.Unlock()
+}
+
+// LookupFirmware returns capabilities of firmware version. Unknown versions
+// are assumed to support base instructions, with protocol of ProtocolVersion.
+func LookupFirmware(version string) Firmware {
+	firmwaresMu.RLock()
+	fw, ok := firmwares[version]
+	firmwaresMu.RUnlock()
+	if !ok {
+		fw = Firmware{
+			Protocol: ProtocolVersion(version),
+			Commands: baseCommands,
+		}
+	}
+	fw.Version, fw.Known = version, ok
+	return fw
+}
+
+// Supports returns true if fw supports instruction cmd.
+func (fw Firmware) Supports(cmd byte) bool {
+	for _, c := range fw.Commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// Features lists what fw supports, in plain words.
+func (fw Firmware) Features() []string {
+	var features []string
+	if fw.Protocol >= FramedProtocol {
+		features = append(features, "framed protocol")
+	}
+	if fw.Supports(ReadFirmware) {
+		features = append(features, "version")
+	}
+	if fw.Supports(ReadA0) {
+		features = append(features, "analog reads")
+	}
+	if fw.AveragedVoltage {
+		features = append(features, "averaged voltage")
+	}
+	if fw.AutoAref {
+		features = append(features, "AREF auto-calibration")
+	}
+	if fw.Supports(LedToggle) {
+		features = append(features, "led")
+	}
+	return features
+}
+
+// CommandNames returns names of instructions supported by fw.
+func (fw Firmware) CommandNames() []string {
+	names := make([]string, len(fw.Commands))
+	for i, c := range fw.Commands {
+		names[i] = CommandName(c)
+	}
+	return names
+}
+
+// UnsupportedError is returned when an instruction isn't supported by firmware of a box.
+type UnsupportedError struct {
+	Firmware string
+	Cmd      byte
+}
+
+func (e UnsupportedError) Error() string {
+	return fmt.Sprintf("%s isn't supported by firmware \"%s\"", CommandName(e.Cmd), e.Firmware)
+}
+
+// reconnectTimeout is how long Flash waits for a box to answer once flashed.
+var reconnectTimeout = time.Second * 20
+
+// Flash releases serial connection of stopped rb, and calls flash with path of its
+// device, e.g. to upload a new firmware. rb then reconnects to the same device, and
+// returns its firmware as read again. rb is marked as flashing meanwhile: starting
+// it fails with ErrFlashing, and its Watcher leaves its device alone.
+func (rb *RegenBox) Flash(flash func(path string) error) (Firmware, error) {
+	rb.stopMu.Lock()
+	if rb.session != nil {
+		rb.stopMu.Unlock()
+		return Firmware{}, ErrBoxRunning
+	}
+	rb.Lock()
+	r, path, err := rb.releaseForFlash()
+	rb.Unlock()
+	rb.stopMu.Unlock()
+	if err != nil {
+		return Firmware{}, err
+	}
+	defer func() {
+		rb.Lock()
+		rb.flashing = false
+		rb.Unlock()
+	}()
+
+	flashErr := flash(path)
+
+	// reconnect, box needs some time to reboot
+	var probe *RegenBox
+	deadline := time.Now().Add(reconnectTimeout)
+	for {
+		var conn Transport
+		conn, err = r.Reopen()
+		if err == nil {
+			// test connection on a temporary box, firmware is read along
+			probe = &RegenBox{Conn: conn, state: Connected}
+			if err = probe.ping(); err == nil {
+				break
+			}
+			_ = conn.Close()
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+	if err != nil {
+		probe = nil
+		err = fmt.Errorf("couldn't reconnect once flashed: %s", err)
+	} else if probe.fw == nil {
+		if err = probe.setFirmware(); probe.fw == nil {
+			_ = probe.Conn.Close()
+			probe = nil
+			err = fmt.Errorf("couldn't read firmware once flashed: %s", err)
+		} else {
+			err = nil
+		}
+	}
+
+	// swap connection, if box didn't come back its Watcher reopens it later
+	if probe != nil {
+		rb.Lock()
+		rb.Conn = probe.Conn
+		rb.state = Connected
+		rb.firmware, rb.fw, rb.firmRetries = probe.firmware, probe.fw, probe.firmRetries
+		rb.framed, rb.seq = probe.framed, probe.seq
+		rb.Unlock()
+	}
+	if flashErr != nil {
+		return Firmware{}, flashErr
+	}
+	if err != nil {
+		return Firmware{}, err
+	}
+	return *probe.fw, nil
+}
+
+// releaseForFlash closes connection of locked rb, and marks it as flashing. It
+// returns the Reopener & path of its connection, see Flash.
+func (rb *RegenBox) releaseForFlash() (Reopener, string, error) {
+	if rb.flashing {
+		return nil, "", ErrFlashing
+	}
+	if rb.Conn == nil {
+		return nil, "", ErrDisconnected
+	}
+	r, ok := rb.Conn.(Reopener)
+	if !ok {
+		return nil, "", ErrNotReopenable
+	}
+
+	// release port, box is idle after a reset anyway
+	_ = rb.Conn.Close()
+	rb.flashing = true
+	rb.state = Disconnected
+	rb.chargeState = Idle
+	rb.resetFirmware()
+	return r, rb.Conn.Path(), nil
+}
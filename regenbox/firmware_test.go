@@ -0,0 +1,65 @@
+package regenbox
+
+import (
+	"testing"
+)
+
+func TestLookupFirmware(t *testing.T) {
+	for _, test := range []struct {
+		version  string
+		known    bool
+		protocol int
+		autoAref bool
+		led      bool
+	}{
+		{"v0", true, 0, false, true},
+		{"anode", true, 0, true, true},
+		{"cathode", true, 0, true, true},
+		{"v2", true, FramedProtocol, false, true},
+		{OutdatedFirmware, true, 0, false, false},
+		{"custom", false, 0, false, true},
+		{"v3-custom", false, 3, false, true},
+	} {
+		fw := LookupFirmware(test.version)
+		if fw.Version != test.version || fw.Known != test.known || fw.Protocol != test.protocol ||
+			fw.AutoAref != test.autoAref || fw.Supports(LedToggle) != test.led {
+			t.Errorf("%s: unexpected capabilities %+v", test.version, fw)
+		}
+	}
+}
+
+func TestRegenBox_Unsupported(t *testing.T) {
+	RegisterFirmware(Firmware{
+		Version:  "noled",
+		Commands: []byte{Ping, ReadFirmware, ReadVoltage, ModeIdle, ModeCharge, ModeDischarge},
+	})
+	conn := newEchoTransport(map[byte][]byte{
+		ReadVoltage:  []byte("1234"),
+		ReadFirmware: []byte("noled"),
+	})
+	rbx, err := NewRegenBox(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fw := rbx.Firmware()
+	if fw.Version != "noled" || !fw.Known {
+		t.Fatalf("expected known firmware \"noled\", got %+v", fw)
+	}
+	for _, f := range fw.Features() {
+		if f == "led" {
+			t.Errorf("unexpected feature %s", f)
+		}
+	}
+
+	_, err = rbx.LedToggle()
+	if e, ok := err.(UnsupportedError); !ok || e.Cmd != LedToggle || e.Firmware != "noled" {
+		t.Errorf("expected UnsupportedError for LedToggle, got %v", err)
+	}
+	if rbx.State() != Connected {
+		t.Errorf("expected state %s, got %s", Connected, rbx.State())
+	}
+	if v, err := rbx.ReadVoltage(); err != nil || v != 1234 {
+		t.Errorf("expected voltage 1234, got %d (%v)", v, err)
+	}
+}
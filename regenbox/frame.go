@@ -0,0 +1,158 @@
+package regenbox
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Framed protocol (v2), see firmware/framed.ino
+//
+// Every instruction & answer is a frame:
+//
+//	FrameStart | seq | cmd | len | payload (len bytes) | crc8(seq..payload)
+//
+// Answers repeat seq & cmd of their instruction, and carry the same
+// payload as in v0 protocol. An instruction refused by firmware is
+// answered with a Nak frame holding rejected cmd and a Nak* reason.
+//
+// Framed firmwares report a "v2" (or above) version to ReadFirmware, which is
+// always sent as a single byte: they keep answering v0 instructions until a frame
+// comes in. RegenBox switches to frames right after reading such a version.
+const (
+	FrameStart byte = 0xfe
+	Nak        byte = 0xe0
+)
+
+// Nak reasons
+const (
+	NakChecksum byte = 0x01 + iota
+	NakUnknown
+	NakLength
+)
+
+// FramedProtocol is the first protocol version using frames.
+const FramedProtocol = 2
+
+// frameOverhead is the size of a frame without payload.
+const frameOverhead = 5
+
+var ErrChecksum = errors.New("frame checksum mismatch")
+var ErrShortFrame = errors.New("frame is too short")
+var ErrStaleFrames = errors.New("too many stale frames, answer not found")
+
+// NakError is returned when firmware refuses an instruction.
+type NakError struct {
+	Cmd    byte
+	Reason byte
+}
+
+func (e NakError) Error() string {
+	var reason string
+	switch e.Reason {
+	case NakChecksum:
+		reason = "checksum mismatch"
+	case NakUnknown:
+		reason = "unknown instruction"
+	case NakLength:
+		reason = "invalid payload length"
+	default:
+		reason = fmt.Sprintf("reason 0x%02x", e.Reason)
+	}
+	return fmt.Sprintf("firmware rejected instruction 0x%02x: %s", e.Cmd, reason)
+}
+
+// Frame is an instruction or an answer of the framed protocol.
+type Frame struct {
+	Seq     byte
+	Cmd     byte
+	Payload []byte
+}
+
+// Encode returns f as sent over the wire. Payload is truncated to 255 bytes.
+func (f Frame) Encode() []byte {
+	payload := f.Payload
+	if len(payload) > 0xff {
+		payload = payload[:0xff]
+	}
+	b := make([]byte, 0, len(payload)+frameOverhead)
+	b = append(b, FrameStart, f.Seq, f.Cmd, byte(len(payload)))
+	b = append(b, payload...)
+	return append(b, CRC8(b[1:]))
+}
+
+// DecodeFrame parses b, a single frame starting with FrameStart.
+func DecodeFrame(b []byte) (Frame, error) {
+	if len(b) < frameOverhead || b[0] != FrameStart || len(b) != int(b[3])+frameOverhead {
+		return Frame{}, ErrShortFrame
+	}
+	if CRC8(b[1:len(b)-1]) != b[len(b)-1] {
+		return Frame{}, ErrChecksum
+	}
+	return Frame{
+		Seq:     b[1],
+		Cmd:     b[2],
+		Payload: append([]byte(nil), b[4:len(b)-1]...),
+	}, nil
+}
+
+// SplitFrame looks for the first complete frame in buf. Bytes preceding
+// FrameStart are skipped. If ok is false, more bytes are needed, rest
+// holds what's worth keeping of buf.
+func SplitFrame(buf []byte) (frame, rest []byte, ok bool) {
+	i := 0
+	for i < len(buf) && buf[i] != FrameStart {
+		i++
+	}
+	buf = buf[i:]
+	if len(buf) < frameOverhead-1 {
+		return nil, buf, false
+	}
+	n := int(buf[3]) + frameOverhead
+	if len(buf) < n {
+		return nil, buf, false
+	}
+	return buf[:n], buf[n:], true
+}
+
+// CRC8 computes CRC-8 of b, with polynomial 0x07 and no reflection (CRC-8/SMBUS).
+func CRC8(b []byte) byte {
+	var crc byte
+	for _, v := range b {
+		crc ^= v
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// ProtocolVersion returns protocol version of firmware, as reported by ReadFirmware:
+// N for "vN" or "vN-variant", 0 for anything else (v0, anode, cathode...).
+func ProtocolVersion(firmware string) int {
+	if !strings.HasPrefix(firmware, "v") {
+		return 0
+	}
+	s := firmware[1:]
+	if i := strings.IndexAny(s, "-."); i >= 0 {
+		s = s[:i]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Framer is an optional interface for Transports able to split their input
+// into frames rather than on StopByte. Once framed, each Read returns a
+// whole frame, FrameStart & checksum included. RegenBox sticks to v0
+// protocol with Transports that don't implement Framer.
+type Framer interface {
+	SetFramed(framed bool)
+}
@@ -0,0 +1,180 @@
+package regenbox
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCRC8(t *testing.T) {
+	// CRC-8/SMBUS check value
+	if crc := CRC8([]byte("123456789")); crc != 0xf4 {
+		t.Errorf("expected crc 0xf4, got 0x%02x", crc)
+	}
+}
+
+func TestFrame_Encode(t *testing.T) {
+	f := Frame{Seq: 7, Cmd: ReadVoltage, Payload: []byte("1234")}
+	b := f.Encode()
+	if len(b) != len(f.Payload)+frameOverhead || b[0] != FrameStart || b[3] != 4 {
+		t.Fatalf("unexpected encoding % x", b)
+	}
+
+	f2, err := DecodeFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f2.Seq != f.Seq || f2.Cmd != f.Cmd || !bytes.Equal(f2.Payload, f.Payload) {
+		t.Errorf("expected %v, got %v", f, f2)
+	}
+
+	b[5] ^= 0x10
+	if _, err = DecodeFrame(b); err != ErrChecksum {
+		t.Errorf("expected %s, got %v", ErrChecksum, err)
+	}
+	if _, err = DecodeFrame(b[:6]); err != ErrShortFrame {
+		t.Errorf("expected %s, got %v", ErrShortFrame, err)
+	}
+}
+
+func TestSplitFrame(t *testing.T) {
+	f1 := Frame{Seq: 1, Cmd: Ping}.Encode()
+	f2 := Frame{Seq: 2, Cmd: ReadFirmware, Payload: []byte{StopByte, FrameStart}}.Encode()
+
+	// garbage, a whole frame, and half of another one
+	buf := append([]byte{'v', '0', StopByte}, f1...)
+	buf = append(buf, f2[:4]...)
+	frame, rest, ok := SplitFrame(buf)
+	if !ok || !bytes.Equal(frame, f1) {
+		t.Fatalf("expected frame % x, got % x (%v)", f1, frame, ok)
+	}
+	frame, rest, ok = SplitFrame(rest)
+	if ok {
+		t.Fatalf("unexpected frame % x", frame)
+	}
+	frame, rest, ok = SplitFrame(append(rest, f2[4:]...))
+	if !ok || !bytes.Equal(frame, f2) || len(rest) != 0 {
+		t.Fatalf("expected frame % x, got % x (%v), rest: % x", f2, frame, ok, rest)
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	for fw, v := range map[string]int{
+		"v0":         0,
+		"anode":      0,
+		"cathode":    0,
+		"update me!": 0,
+		"v2":         2,
+		"v2-anode":   2,
+		"v3.1":       3,
+		"vx":         0,
+		"":           0,
+	} {
+		if got := ProtocolVersion(fw); got != v {
+			t.Errorf("%s: expected protocol %d, got %d", fw, v, got)
+		}
+	}
+}
+
+// framedTransport is a Transport answering each instruction with a fixed
+// response from its table, using frames once it's framed. Frames with a
+// wrong sequence number or checksum are sent before answers on demand.
+type framedTransport struct {
+	echoTransport
+	framed  bool
+	stale   int  // stale frames to send before next answer
+	corrupt bool // corrupt next answer
+	queue   [][]byte
+}
+
+func newFramedTransport(answers map[byte][]byte) *framedTransport {
+	return &framedTransport{echoTransport: *newEchoTransport(answers)}
+}
+
+func (t *framedTransport) SetFramed(framed bool) {
+	t.framed = framed
+}
+
+func (t *framedTransport) Write(b []byte) error {
+	if !t.framed {
+		return t.echoTransport.Write(b)
+	}
+	f, err := DecodeFrame(b)
+	if err != nil {
+		return err
+	}
+	for ; t.stale > 0; t.stale-- {
+		t.queue = append(t.queue, Frame{Seq: f.Seq - 1, Cmd: f.Cmd, Payload: []byte("stale")}.Encode())
+	}
+	answer, ok := t.answers[f.Cmd]
+	out := Frame{Seq: f.Seq, Cmd: f.Cmd, Payload: answer}.Encode()
+	if !ok {
+		out = Frame{Seq: f.Seq, Cmd: Nak, Payload: []byte{f.Cmd, NakUnknown}}.Encode()
+	}
+	if t.corrupt {
+		out[len(out)-1] ^= 0xff
+		t.corrupt = false
+	}
+	t.queue = append(t.queue, out)
+	return nil
+}
+
+func (t *framedTransport) Read() ([]byte, error) {
+	if !t.framed {
+		return t.echoTransport.Read()
+	}
+	b := t.queue[0]
+	t.queue = t.queue[1:]
+	return b, nil
+}
+
+func TestRegenBox_Framed(t *testing.T) {
+	conn := newFramedTransport(map[byte][]byte{
+		ReadVoltage:  []byte("1234"),
+		ReadFirmware: []byte("v2"),
+		Ping:         nil,
+	})
+	rbx, err := NewRegenBox(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rbx.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if fw := rbx.FirmwareVersion(); fw != "v2" {
+		t.Fatalf("expected firmware \"v2\", got \"%s\"", fw)
+	}
+	if !conn.framed || rbx.Protocol() != 2 {
+		t.Fatalf("expected framed protocol 2, got %d", rbx.Protocol())
+	}
+
+	conn.stale = 2
+	v, err := rbx.ReadVoltage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1234 {
+		t.Errorf("expected voltage 1234, got %d", v)
+	}
+	if c := rbx.Counters(); c.StaleFrames != 2 {
+		t.Errorf("expected 2 stale frames, got %d", c.StaleFrames)
+	}
+
+	conn.corrupt = true
+	if _, err = rbx.ReadVoltage(); err != ErrChecksum {
+		t.Errorf("expected %s, got %v", ErrChecksum, err)
+	}
+	if c := rbx.Counters(); c.ChecksumErrors != 1 {
+		t.Errorf("expected 1 checksum error, got %d", c.ChecksumErrors)
+	}
+
+	_, err = rbx.LedToggle()
+	if nak, ok := err.(NakError); !ok || nak.Cmd != LedToggle || nak.Reason != NakUnknown {
+		t.Errorf("expected NakError for LedToggle, got %v", err)
+	}
+
+	// a reconnected box negotiates protocol again
+	rbx.resetFirmware()
+	if conn.framed || rbx.Protocol() != 0 {
+		t.Errorf("expected v0 protocol after reset")
+	}
+}
@@ -0,0 +1,10 @@
+package regenbox
+
+// DeviceIdentity returns a stable identity of the USB serial adapter at path,
+// made of its vendor & product ids and serial number if it has one, e.g.
+// "usb:2341:0043:8573531303835140E1C1". Unlike path, it follows the box from
+// port to port. It is empty when unknown: simulated or non-USB devices, or
+// systems where it isn't looked up (only linux is).
+func DeviceIdentity(path string) string {
+	return deviceIdentity(path)
+}
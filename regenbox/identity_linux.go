@@ -0,0 +1,40 @@
+package regenbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sysfsRoot is where sysfs is mounted, see deviceIdentity.
+var sysfsRoot = "/sys"
+
+// deviceIdentity finds the USB device of tty path in sysfs, among parents of its device.
+func deviceIdentity(path string) string {
+	dev, err := filepath.EvalSymlinks(filepath.Join(sysfsRoot, "class", "tty", filepath.Base(path), "device"))
+	if err != nil {
+		return ""
+	}
+	for ; dev != filepath.Dir(dev); dev = filepath.Dir(dev) {
+		vid, err := ioutil.ReadFile(filepath.Join(dev, "idVendor"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return ""
+		}
+		pid, err := ioutil.ReadFile(filepath.Join(dev, "idProduct"))
+		if err != nil {
+			return ""
+		}
+		id := "usb:" + strings.TrimSpace(string(vid)) + ":" + strings.TrimSpace(string(pid))
+		// optional, cheap clones have none
+		if serial, err := ioutil.ReadFile(filepath.Join(dev, "serial")); err == nil {
+			if s := strings.TrimSpace(string(serial)); s != "" {
+				id += ":" + s
+			}
+		}
+		return id
+	}
+	return ""
+}
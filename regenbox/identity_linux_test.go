@@ -0,0 +1,53 @@
+package regenbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeviceIdentity(t *testing.T) {
+	root, err := ioutil.TempDir("", "goregen-sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer func(root string) { sysfsRoot = root }(sysfsRoot)
+	sysfsRoot = root
+
+	// tty is an interface of usb device, which holds ids
+	mkdev := func(tty string, dev string, files map[string]string) {
+		iface := filepath.Join(root, "devices", dev, dev+":1.0", tty)
+		if err := os.MkdirAll(iface, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range files {
+			if err := ioutil.WriteFile(filepath.Join(root, "devices", dev, name), []byte(content+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		class := filepath.Join(root, "class", "tty", tty)
+		if err := os.MkdirAll(class, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(iface, filepath.Join(class, "device")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdev("ttyUSB0", "1-1", map[string]string{"idVendor": "0403", "idProduct": "6001", "serial": "A50285BI"})
+	mkdev("ttyUSB1", "1-2", map[string]string{"idVendor": "1a86", "idProduct": "7523"})
+	mkdev("ttyS0", "serial8250", nil)
+
+	for path, expected := range map[string]string{
+		"/dev/ttyUSB0":       "usb:0403:6001:A50285BI",
+		"/dev/ttyUSB1":       "usb:1a86:7523", // no serial number
+		"/dev/ttyS0":         "",
+		"/dev/ttyACM0":       "",
+		"sim://nimh-aa?test": "",
+	} {
+		if id := DeviceIdentity(path); id != expected {
+			t.Errorf("%s: expected identity \"%s\", got \"%s\"", path, expected, id)
+		}
+	}
+}
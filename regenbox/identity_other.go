@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package regenbox
+
+func deviceIdentity(path string) string {
+	return ""
+}
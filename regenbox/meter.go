@@ -0,0 +1,57 @@
+package regenbox
+
+import (
+	"fmt"
+	"time"
+)
+
+// Capacity is an amount of charge & energy measured through discharge resistor.
+type Capacity struct {
+	MilliAmpHours  float64
+	MilliWattHours float64
+}
+
+func (c Capacity) Sub(c2 Capacity) Capacity {
+	return Capacity{
+		MilliAmpHours:  c.MilliAmpHours - c2.MilliAmpHours,
+		MilliWattHours: c.MilliWattHours - c2.MilliWattHours,
+	}
+}
+
+func (c Capacity) String() string {
+	return fmt.Sprintf("%.1fmAh / %.1fmWh", c.MilliAmpHours, c.MilliWattHours)
+}
+
+// Meter integrates current & power flowing through a Resistor (in ohms)
+// over successive snapshots. Current is only known while discharging (I = V/R),
+// charge is thus counted between 2 consecutive Discharging snapshots.
+type Meter struct {
+	Resistor float64
+	total    Capacity
+	last     Snapshot
+}
+
+// Add accounts for sn and returns total capacity measured so far.
+func (m *Meter) Add(sn Snapshot) Capacity {
+	if m.Resistor > 0 && sn.State == Connected && m.last.State == Connected &&
+		sn.ChargeState == Discharging && m.last.ChargeState == Discharging && sn.Time.After(m.last.Time) {
+		// trapezoidal rule, mV / ohms = mA
+		hours := sn.Time.Sub(m.last.Time).Hours()
+		v0, v1 := float64(m.last.Voltage), float64(sn.Voltage)
+		m.total.MilliAmpHours += (v0 + v1) / 2 / m.Resistor * hours
+		m.total.MilliWattHours += (v0*v0 + v1*v1) / 2 / m.Resistor / 1000 * hours
+	}
+	m.last = sn
+	return m.total
+}
+
+// Total returns capacity measured since last Reset.
+func (m *Meter) Total() Capacity {
+	return m.total
+}
+
+// Reset sets measured capacity back to 0.
+func (m *Meter) Reset() {
+	m.total = Capacity{}
+	m.last = Snapshot{Time: time.Now()}
+}
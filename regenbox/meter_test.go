@@ -0,0 +1,54 @@
+package regenbox
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMeter(t *testing.T) {
+	t0 := time.Now()
+	sn := func(sec int, v int, cs ChargeState) Snapshot {
+		return Snapshot{
+			Time:        t0.Add(time.Second * time.Duration(sec)),
+			Voltage:     v,
+			ChargeState: cs,
+			State:       Connected,
+		}
+	}
+
+	m := Meter{Resistor: 10}
+	for _, s := range []Snapshot{
+		sn(0, 1400, Charging),
+		sn(1800, 1300, Discharging), // previous point not discharging, not counted
+		sn(3600, 1300, Discharging), // 130mA during 30min
+		sn(5400, 1100, Discharging), // 120mA (avg) during 30min
+		{Time: t0.Add(time.Second * 6000)},
+		sn(7200, 1000, Discharging), // previous point disconnected, not counted
+		sn(9000, 1000, Idle),
+	} {
+		m.Add(s)
+	}
+
+	c := m.Total()
+	if math.Abs(c.MilliAmpHours-125) > 1e-9 {
+		t.Errorf("expected 125mAh, got %f", c.MilliAmpHours)
+	}
+	// 30min * 1.3V*130mA + 30min * (1.3V*130mA + 1.1V*110mA) / 2
+	if expected := 0.5*169 + 0.5*(169+121)/2; math.Abs(c.MilliWattHours-expected) > 1e-9 {
+		t.Errorf("expected %fmWh, got %f", expected, c.MilliWattHours)
+	}
+
+	m.Reset()
+	if m.Total() != (Capacity{}) {
+		t.Errorf("expected empty capacity after Reset(), got %s", m.Total())
+	}
+
+	// no resistor, no measure
+	m = Meter{}
+	m.Add(sn(0, 1300, Discharging))
+	m.Add(sn(3600, 1300, Discharging))
+	if m.Total() != (Capacity{}) {
+		t.Errorf("expected empty capacity without resistor, got %s", m.Total())
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !race
+// +build !race
+
+package regenbox
+
+const raceEnabled = false
@@ -0,0 +1,409 @@
+package regenbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rkjdid/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var ErrNoProfile = errors.New("no profile set")
+
+type StepType byte
+
+const (
+	StepCharge    StepType = StepType(iota) // Charge until Voltage is reached
+	StepDischarge                           // Discharge until Voltage is reached
+	StepRest                                // Stay idle for Duration
+	StepHold                                // Charge whenever voltage drops below Voltage, for Duration
+	StepRepeat                              // Run Steps Count times
+)
+
+// maxSteps is the maximum number of steps of a profile, once repeats are expanded.
+const maxSteps = 10000
+
+// ProfileExts are the extensions of profile files, which are TOML or JSON encoded.
+var ProfileExts = []string{".toml", ".json"}
+
+// Profile is a named sequence of steps, run by a RegenBox in Profiler mode.
+type Profile struct {
+	Name        string // defaults to file name when loaded with LoadProfile
+	Description string
+	Steps       []Step
+}
+
+// Step is a single instruction of a Profile. A step also ends as soon
+// as one of its stop conditions (StopAbove, StopBelow) is met.
+type Step struct {
+	Type      StepType
+	Voltage   int           // Charge & Discharge: target voltage, Hold: voltage maintained (mV)
+	Duration  util.Duration // Rest & Hold: how long the step lasts
+	Timeout   util.Duration // Charge & Discharge: maximum duration before failing (0: no timeout)
+	StopAbove int           // Ends step once voltage is above or equal to this value (mV, 0: unset)
+	StopBelow int           // Ends step once voltage is below or equal to this value (mV, 0: unset)
+	Count     int           // Repeat: number of times Steps are run
+	Steps     []Step        `toml:",omitempty" json:",omitempty"` // Repeat: steps to repeat
+
+	label string
+}
+
+func (s Step) String() string {
+	if s.label != "" {
+		return s.label
+	}
+	switch s.Type {
+	case StepCharge, StepDischarge:
+		return fmt.Sprintf("%s to %dmV", s.Type, s.Voltage)
+	case StepRest:
+		return fmt.Sprintf("%s %s", s.Type, s.Duration)
+	case StepHold:
+		return fmt.Sprintf("%s %dmV for %s", s.Type, s.Voltage, s.Duration)
+	case StepRepeat:
+		return fmt.Sprintf("%s %d times %d steps", s.Type, s.Count, len(s.Steps))
+	}
+	return s.Type.String()
+}
+
+// stopped returns true if a stop condition of s is met by voltage v.
+func (s Step) stopped(v int) bool {
+	return s.StopAbove > 0 && v >= s.StopAbove || s.StopBelow > 0 && v <= s.StopBelow
+}
+
+func (s Step) validate() error {
+	switch s.Type {
+	case StepCharge, StepDischarge:
+		if s.Voltage <= 0 {
+			return fmt.Errorf("%s step: Voltage must be set", s.Type)
+		}
+	case StepRest:
+		if s.Duration <= 0 {
+			return fmt.Errorf("%s step: Duration must be set", s.Type)
+		}
+	case StepHold:
+		if s.Voltage <= 0 || s.Duration <= 0 {
+			return fmt.Errorf("%s step: Voltage & Duration must be set", s.Type)
+		}
+	case StepRepeat:
+		if s.Count <= 0 || len(s.Steps) == 0 {
+			return fmt.Errorf("%s step: Count & Steps must be set", s.Type)
+		}
+	default:
+		return fmt.Errorf("unknown step type %s", s.Type)
+	}
+	if s.Timeout < 0 || s.StopAbove < 0 || s.StopBelow < 0 {
+		return fmt.Errorf("%s step: Timeout, StopAbove & StopBelow must be positive", s.Type)
+	}
+	return nil
+}
+
+// Flatten validates p and returns its steps with repeats expanded.
+func (p Profile) Flatten() ([]Step, error) {
+	return flatten(p.Steps, "")
+}
+
+func flatten(steps []Step, suffix string) (flat []Step, err error) {
+	for _, s := range steps {
+		err = s.validate()
+		if err != nil {
+			return nil, err
+		}
+		if s.Type != StepRepeat {
+			s.label = s.String() + suffix
+			flat = append(flat, s)
+			continue
+		}
+		for i := 1; i <= s.Count; i++ {
+			sub, err := flatten(s.Steps, fmt.Sprintf(" (%d/%d)%s", i, s.Count, suffix))
+			if err != nil {
+				return nil, err
+			}
+			flat = append(flat, sub...)
+			if len(flat) > maxSteps {
+				return nil, fmt.Errorf("profile has more than %d steps", maxSteps)
+			}
+		}
+	}
+	return flat, nil
+}
+
+func isProfileExt(ext string) bool {
+	for _, v := range ProfileExts {
+		if v == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadProfile reads a profile from fpath, decoded from JSON if fpath
+// has a .json extension, or from TOML otherwise.
+func LoadProfile(fpath string) (*Profile, error) {
+	var p Profile
+	var err error
+	if filepath.Ext(fpath) == ".json" {
+		var b []byte
+		b, err = ioutil.ReadFile(fpath)
+		if err == nil {
+			err = json.Unmarshal(b, &p)
+		}
+	} else {
+		err = util.ReadTomlFile(&p, fpath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.Name == "" {
+		p.Name = strings.TrimSuffix(filepath.Base(fpath), filepath.Ext(fpath))
+	}
+	_, err = p.Flatten()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fpath, err)
+	}
+	return &p, nil
+}
+
+// FindProfile loads profile name from dir, trying each of ProfileExts.
+func FindProfile(dir string, name string) (*Profile, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid profile name \"%s\"", name)
+	}
+	for _, ext := range ProfileExts {
+		p, err := LoadProfile(filepath.Join(dir, name+ext))
+		if err == nil || !os.IsNotExist(err) {
+			return p, err
+		}
+	}
+	return nil, fmt.Errorf("profile \"%s\" not found in \"%s\"", name, dir)
+}
+
+// ListProfiles loads every profile from dir, sorted by name.
+// Erronous profiles are skipped, their errors are returned along.
+func ListProfiles(dir string) (profiles []*Profile, errs []error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, []error{err}
+	}
+	for _, fi := range files {
+		if fi.IsDir() || !isProfileExt(filepath.Ext(fi.Name())) {
+			continue
+		}
+		p, err := LoadProfile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	return profiles, errs
+}
+
+// reporter builds cycle messages while a program is running,
+// n is the index of current step.
+type reporter struct {
+	started   func(n int) (CycleMessage, bool)
+	completed func(n int, c Capacity) (CycleMessage, bool)
+	final     func(n int, err error) CycleMessage
+}
+
+// program is a flat list of steps, and how to report their progress.
+type program struct {
+	steps  []Step
+	report reporter
+}
+
+// program compiles cfg.Mode (or profile in Profiler mode) to a program.
+func (cfg Config) program(rb *RegenBox, profile *Profile) (prog program, err error) {
+	switch cfg.Mode {
+	case Charger:
+		prog.steps = []Step{{Type: StepCharge, Voltage: cfg.TopVoltage, Timeout: cfg.UpDuration}}
+		prog.report = reporter{
+			started: func(int) (CycleMessage, bool) {
+				return chargeStarted(cfg.TopVoltage), true
+			},
+			final: func(_ int, err error) CycleMessage {
+				if err == nil {
+					return chargeReached(cfg.TopVoltage)
+				} else if err == ErrCycleTimeout {
+					return chargeTimeout(cfg.TopVoltage, cfg.UpDuration)
+				}
+				return chargeError(cfg.TopVoltage, err)
+			},
+		}
+	case Discharger:
+		prog.steps = []Step{{Type: StepDischarge, Voltage: cfg.BottomVoltage, Timeout: cfg.DownDuration}}
+		prog.report = reporter{
+			started: func(int) (CycleMessage, bool) {
+				return dischargeStarted(cfg.BottomVoltage), true
+			},
+			final: func(_ int, err error) CycleMessage {
+				if err == nil {
+					return dischargeReached(cfg.BottomVoltage, rb.Capacity())
+				} else if err == ErrCycleTimeout {
+					return dischargeTimeout(cfg.BottomVoltage, cfg.DownDuration)
+				}
+				return dischargeError(cfg.BottomVoltage, err)
+			},
+		}
+	case Cycler:
+		charge := cfg.ChargeFirst
+		for i := 0; i < cfg.NbHalfCycles; i++ {
+			if charge {
+				prog.steps = append(prog.steps, Step{Type: StepCharge, Voltage: cfg.TopVoltage, Timeout: cfg.UpDuration})
+			} else {
+				prog.steps = append(prog.steps, Step{Type: StepDischarge, Voltage: cfg.BottomVoltage, Timeout: cfg.DownDuration})
+			}
+			charge = !charge
+		}
+		cycleType := func(s Step) string {
+			if s.Type == StepCharge {
+				return CycleCharge
+			}
+			return CycleDischarge
+		}
+		of := len(prog.steps)
+		target := func(n int) int {
+			if n < 0 {
+				return 0
+			}
+			return prog.steps[n].Voltage
+		}
+		prog.report = reporter{
+			started: func(n int) (CycleMessage, bool) {
+				return multiCycleStarted(target(n), cycleType(prog.steps[n]), n+1, of), true
+			},
+			completed: func(n int, c Capacity) (CycleMessage, bool) {
+				if prog.steps[n].Type != StepDischarge {
+					return CycleMessage{}, false
+				}
+				return multiCycleDischarged(target(n), n+1, of, c), true
+			},
+			final: func(n int, err error) CycleMessage {
+				if err == nil {
+					return multiCycleReached(target(n), of)
+				} else if err == ErrCycleTimeout {
+					return multiCycleTimeout(target(n), cycleType(prog.steps[n]), n+1, of, prog.steps[n].Timeout)
+				}
+				return multiCycleError(target(n), err)
+			},
+		}
+	case Profiler:
+		if profile == nil {
+			return prog, ErrNoProfile
+		}
+		prog.steps, err = profile.Flatten()
+		if err != nil {
+			return prog, err
+		}
+		name, of := profile.Name, len(prog.steps)
+		prog.report = reporter{
+			started: func(n int) (CycleMessage, bool) {
+				return profileStepStarted(name, prog.steps[n], n+1, of), true
+			},
+			completed: func(n int, c Capacity) (CycleMessage, bool) {
+				if prog.steps[n].Type != StepDischarge {
+					return CycleMessage{}, false
+				}
+				return profileStepDischarged(name, prog.steps[n], n+1, of, c), true
+			},
+			final: func(n int, err error) CycleMessage {
+				if err == nil {
+					return profileCompleted(name, of)
+				} else if err == ErrCycleTimeout {
+					return profileStepTimeout(name, prog.steps[n], n+1, of)
+				}
+				return profileError(name, err)
+			},
+		}
+	default:
+		return prog, fmt.Errorf("unknown mode %s", cfg.Mode)
+	}
+	if prog.report.completed == nil {
+		prog.report.completed = func(int, Capacity) (CycleMessage, bool) {
+			return CycleMessage{}, false
+		}
+	}
+	return prog, nil
+}
+
+// chargeMode returns the mode a box starts step s with.
+func (s Step) chargeMode() byte {
+	switch s.Type {
+	case StepCharge:
+		return ModeCharge
+	case StepDischarge:
+		return ModeDischarge
+	}
+	return ModeIdle
+}
+
+// runProgram runs each step of prog, sending progress messages
+// through session's msgChan, and returns the final message.
+func (rb *RegenBox) runProgram(s *session, prog program) CycleMessage {
+	for n := rb.Progress().Step; n < len(prog.steps); n++ {
+		step := prog.steps[n]
+		if m, ok := prog.report.started(n); ok {
+			s.send(m)
+		}
+		c0 := s.startStep(rb, n)
+		err := rb.runStep(s, step)
+		if err != nil {
+			return prog.report.final(n, err)
+		}
+		if m, ok := prog.report.completed(n, rb.Capacity().Sub(c0)); ok {
+			s.send(m)
+		}
+	}
+	return prog.report.final(len(prog.steps)-1, nil)
+}
+
+// runStep runs a single step until its target or one of its stop conditions is reached.
+func (rb *RegenBox) runStep(sess *session, s Step) error {
+	mode := s.chargeMode()
+	if rb.ChargeState() != ChargeState(mode) {
+		err := rb.SetChargeMode(mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	var duration util.Duration
+	var stopCond func(v int) bool
+	switch s.Type {
+	case StepCharge:
+		duration, stopCond = s.Timeout, topReached(s.Voltage)
+	case StepDischarge:
+		duration, stopCond = s.Timeout, bottomReached(s.Voltage)
+	case StepRest:
+		duration, stopCond = s.Duration, func(int) bool { return false }
+	case StepHold:
+		duration = s.Duration
+		stopCond = func(v int) bool {
+			// errors are ignored, mode is set again on next tick
+			if v < s.Voltage && rb.ChargeState() != Charging {
+				_ = rb.SetCharge()
+			} else if v >= s.Voltage && rb.ChargeState() != Idle {
+				_ = rb.SetIdle()
+			}
+			return false
+		}
+	default:
+		return fmt.Errorf("unexpected step type %s", s.Type)
+	}
+
+	err := rb.doCycle(sess, duration, func(v int) bool {
+		return stopCond(v) || s.stopped(v)
+	})
+	if err == ErrCycleTimeout && (s.Type == StepRest || s.Type == StepHold) {
+		// step duration is over
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,218 @@
+package regenbox
+
+import (
+	"github.com/rkjdid/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testProfileToml = `
+Description = "test"
+
+[[Steps]]
+  Type = "Discharge"
+  Voltage = 1000
+
+[[Steps]]
+  Type = "Repeat"
+  Count = 2
+
+  [[Steps.Steps]]
+    Type = "Charge"
+    Voltage = 1400
+    Timeout = "1h"
+
+  [[Steps.Steps]]
+    Type = "Rest"
+    Duration = "30m"
+`
+
+const testProfileJson = `{
+	"Name": "json profile",
+	"Steps": [
+		{"Type": "Hold", "Voltage": 1400, "Duration": "1h", "StopBelow": 1000}
+	]
+}`
+
+func TestLoadProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"conditioning.toml": testProfileToml,
+		"hold.json":         testProfileJson,
+		"broken.toml":       "[[Steps]]\nType = \"Charge\"\n",
+		"readme.txt":        "not a profile",
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := FindProfile(dir, "conditioning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "conditioning" || p.Description != "test" {
+		t.Errorf("unexpected profile name & description: \"%s\", \"%s\"", p.Name, p.Description)
+	}
+	steps, err := p.Flatten()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, s := range steps {
+		labels = append(labels, s.String())
+	}
+	expected := []string{
+		"Discharge to 1000mV",
+		"Charge to 1400mV (1/2)",
+		"Rest 30m0s (1/2)",
+		"Charge to 1400mV (2/2)",
+		"Rest 30m0s (2/2)",
+	}
+	if len(labels) != len(expected) {
+		t.Fatalf("expected steps %v, got %v", expected, labels)
+	}
+	for i := range labels {
+		if labels[i] != expected[i] {
+			t.Errorf("step %d: expected \"%s\", got \"%s\"", i, expected[i], labels[i])
+		}
+	}
+	if steps[1].Timeout != util.Duration(time.Hour) {
+		t.Errorf("expected Timeout 1h, got %s", steps[1].Timeout)
+	}
+
+	p, err = FindProfile(dir, "hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "json profile" || len(p.Steps) != 1 || p.Steps[0].Type != StepHold || p.Steps[0].StopBelow != 1000 {
+		t.Errorf("unexpected json profile: %+v", p)
+	}
+
+	if _, err = FindProfile(dir, "broken"); err == nil {
+		t.Error("expected an error for a step without Voltage")
+	}
+	if _, err = FindProfile(dir, "missing"); err == nil {
+		t.Error("expected an error for missing profile")
+	}
+	if _, err = FindProfile(dir, "../hold"); err == nil {
+		t.Error("expected an error for invalid profile name")
+	}
+
+	profiles, errs := ListProfiles(dir)
+	if len(profiles) != 2 || len(errs) != 1 {
+		t.Errorf("expected 2 profiles & 1 error, got %d & %v", len(profiles), errs)
+	}
+}
+
+func TestProfile_Flatten(t *testing.T) {
+	for _, p := range []Profile{
+		{Steps: []Step{{Type: StepRest}}},
+		{Steps: []Step{{Type: StepHold, Voltage: 1400}}},
+		{Steps: []Step{{Type: StepRepeat, Count: 2}}},
+		{Steps: []Step{{Type: StepCharge, Voltage: 1400, StopBelow: -1}}},
+		{Steps: []Step{{Type: StepType(42)}}},
+		{Steps: []Step{{Type: StepRepeat, Count: maxSteps, Steps: []Step{
+			{Type: StepRest, Duration: 1}, {Type: StepRest, Duration: 1},
+		}}}},
+	} {
+		if _, err := p.Flatten(); err == nil {
+			t.Errorf("expected an error for %+v", p.Steps)
+		}
+	}
+}
+
+func TestStart_Profile(t *testing.T) {
+	fp := newFakePort(1200, 999, 1100, 1100, 1100, 1100, 1300, 1400)
+	cfg := testConfig(Profiler)
+	rbx := newFakeBox(t, fp, cfg)
+
+	err, _, _ := rbx.Start()
+	if err != ErrNoProfile {
+		t.Fatalf("expected %s, got %v", ErrNoProfile, err)
+	}
+
+	p := &Profile{Name: "test", Steps: []Step{
+		{Type: StepDischarge, Voltage: 1000},
+		{Type: StepRest, Duration: util.Duration(time.Millisecond * 18), StopAbove: 1500},
+		{Type: StepCharge, Voltage: 1400, Timeout: util.Duration(time.Second)},
+	}}
+	steps, _ := p.Flatten()
+	rbx.SetProfile(p)
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	voltages, messages := collect(t, snaps, msgs)
+	expectVoltages(t, voltages[:2], 1200, 999)
+	expectVoltages(t, voltages[len(voltages)-2:], 1300, 1400)
+	expectMessages(t, messages,
+		profileStepStarted("test", steps[0], 1, 3),
+		profileStepDischarged("test", steps[0], 1, 3, Capacity{}),
+		profileStepStarted("test", steps[1], 2, 3),
+		profileStepStarted("test", steps[2], 3, 3),
+		profileCompleted("test", 3))
+	expectIdle(t, rbx, fp)
+}
+
+func TestStart_ProfileStop(t *testing.T) {
+	// stop conditions end a step, timeout of a charge fails
+	fp := newFakePort(1200, 1100, 1000)
+	rbx := newFakeBox(t, fp, testConfig(Profiler))
+	p := &Profile{Name: "test", Steps: []Step{
+		{Type: StepRest, Duration: util.Duration(time.Hour), StopBelow: 1100},
+		{Type: StepCharge, Voltage: 1400, Timeout: util.Duration(time.Millisecond * 30)},
+	}}
+	steps, _ := p.Flatten()
+	rbx.SetProfile(p)
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, messages := collect(t, snaps, msgs)
+	expectMessages(t, messages,
+		profileStepStarted("test", steps[0], 1, 2),
+		profileStepStarted("test", steps[1], 2, 2),
+		profileStepTimeout("test", steps[1], 2, 2))
+	expectIdle(t, rbx, fp)
+}
+
+func TestStart_ProfileHold(t *testing.T) {
+	fp := newFakePort(1300, 1450, 1380, 1420)
+	rbx := newFakeBox(t, fp, testConfig(Profiler))
+	rbx.SetProfile(&Profile{Name: "hold", Steps: []Step{
+		{Type: StepHold, Voltage: 1400, Duration: util.Duration(time.Millisecond * 100)},
+	}})
+	err, snaps, msgs := rbx.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, messages := collect(t, snaps, msgs)
+	expectMessages(t, messages,
+		profileStepStarted("hold", Step{Type: StepHold, Voltage: 1400, Duration: util.Duration(time.Millisecond * 100)}, 1, 1),
+		profileCompleted("hold", 1))
+
+	// box charges when below 1400mV, idles otherwise
+	var modes []byte
+	for _, in := range fp.instructions() {
+		if in != ModeIdle && in != ModeCharge && in != ModeDischarge {
+			continue
+		}
+		if len(modes) == 0 || modes[len(modes)-1] != in {
+			modes = append(modes, in)
+		}
+	}
+	expected := []byte{ModeIdle, ModeCharge, ModeIdle, ModeCharge, ModeIdle}
+	if string(modes) != string(expected) {
+		t.Errorf("expected mode instructions %x, got %x", expected, modes)
+	}
+	expectIdle(t, rbx, fp)
+}
@@ -1,6 +1,8 @@
 package regenbox
 
-// see firmware/firmware.ino
+import "fmt"
+
+// see firmware/firmware.ino, and frame.go for framed protocol (v2)
 
 const (
 	Ping     byte = 0xa0
@@ -36,3 +38,24 @@ const (
 	ModeCharge
 	ModeDischarge
 )
+
+var commandNames = map[byte]string{
+	Ping:          "Ping",
+	ReadA0:        "ReadA0",
+	ReadVoltage:   "ReadVoltage",
+	ReadFirmware:  "ReadFirmware",
+	LedOff:        "LedOff",
+	LedOn:         "LedOn",
+	LedToggle:     "LedToggle",
+	ModeIdle:      "ModeIdle",
+	ModeCharge:    "ModeCharge",
+	ModeDischarge: "ModeDischarge",
+}
+
+// CommandName returns name of instruction cmd, or its hex value if unknown.
+func CommandName(cmd byte) string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", cmd)
+}
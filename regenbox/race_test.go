@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package regenbox
+
+// raceEnabled is set when testing with -race, see testAutoConnect.
+const raceEnabled = true
@@ -2,10 +2,12 @@ package regenbox
 
 import (
 	"errors"
+	"fmt"
 	"github.com/rkjdid/util"
 	"log"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,7 +20,7 @@ var ErrUserStop = errors.New("Stopped by user")
 var ErrSnapshotSendTimeout = errors.New("Snapshot chan send timeout")
 var ErrFirmwareOutdated = errors.New("Firmware is probably out of date")
 
-//go:generate stringer -type=State,ChargeState,BotMode -output=types_string.go
+//go:generate stringer -type=State,ChargeState,BotMode,StepType -trimprefix=Step -output=types_string.go
 type State byte
 type ChargeState byte
 type BotMode byte
@@ -42,40 +44,56 @@ const (
 	Charger    BotMode = BotMode(iota) // Charge until TopVoltage is reached, then idle
 	Discharger                         // Discharge until BottomVoltage is reached, then idle
 	Cycler                             // Do cycles up to NbCycles between Bottom & TopValues, then idle
+	Profiler                           // Run steps of a Profile (see SetProfile), then idle
 )
 
 type Snapshot struct {
 	Time        time.Time
 	Voltage     int
+	RawVoltage  int // Voltage before calibration, see SetCalibration
 	ChargeState ChargeState
 	State       State
 	Firmware    string
+	Running     bool     // a session is running (see Start)
+	Paused      bool     // running session is paused (see Pause)
+	Capacity    Capacity // measured since start of current (or last) session
+	Detail      *Detail  `json:",omitempty"` // only set in detailed mode, see Config.DetailedLog
 }
 
 type Config struct {
 	Mode          BotMode       // Auto-mode lets the box do charge cycles using the following config values
-	NbHalfCycles  int           // In auto-mode: number of half-cycles to do before halting auto-mode (0: no-limit holdem)
+	NbHalfCycles  int           // In auto-mode: number of half-cycles to do before halting auto-mode (at least 1 in Cycler mode)
 	UpDuration    util.Duration // In auto-mode: maximum time for an up-cycle before taking action (?)
 	DownDuration  util.Duration // In auto-mode: maximum time for a down-cycle before taking action (?)
 	TopVoltage    int           // In auto-mode: target top voltage before switching charge-cycle
 	BottomVoltage int           // In auto-mode: target bottom voltage before switching charge-cycle
 	Ticker        util.Duration // In auto-mode: sleep interval in second between each measure
 	ChargeFirst   bool          // In auto-mode: start auto-run with a charge-cycle (false: discharge)
+	Profile       string        // In Profiler mode: name of profile to run
+	DetailedLog   bool          // In auto-mode: also record analog reads, read latency & retries of every measure
 }
 
 type RegenBox struct {
+	counters Counters // first for 64-bit alignment of atomic operations
 	sync.Mutex
-	Conn        *SerialConnection
-	config      *Config
+	Conn        Transport
+	config      Config
 	chargeState ChargeState
 	state       State
 	wg          sync.WaitGroup
 	firmware    []byte
+	fw          *Firmware // capabilities of firmware, nil until it's read
 	firmRetries int
-
-	stop     chan struct{}
-	snapChan chan Snapshot
-	msgChan  chan CycleMessage
+	framed      bool // talking framed protocol, see frame.go
+	seq         byte // sequence number of last frame sent
+	meter       Meter
+	profile     *Profile
+	calibration *Calibration // corrects voltages read, nil if box isn't calibrated
+	flashing    bool         // connection is released to flash a firmware, see Flash
+
+	session      *session
+	lastProgress Progress
+	stopMu       sync.Mutex
 }
 
 var DefaultConfig = Config{
@@ -94,7 +112,9 @@ func NewConfig() *Config {
 	return &cfg
 }
 
-func NewRegenBox(conn *SerialConnection, cfg *Config) (rb *RegenBox, err error) {
+// NewRegenBox creates a RegenBox talking through conn. If conn is nil,
+// the first available serial regenbox is searched for (see FindSerial).
+func NewRegenBox(conn Transport, cfg *Config) (rb *RegenBox, err error) {
 	if conn == nil {
 		conn, err = FindSerial(nil)
 	}
@@ -104,22 +124,31 @@ func NewRegenBox(conn *SerialConnection, cfg *Config) (rb *RegenBox, err error)
 
 	rb = &RegenBox{
 		Conn:        conn,
-		config:      cfg,
+		config:      *cfg,
 		chargeState: Idle,
 		state:       Connected,
 	}
 	if conn == nil {
 		rb.state = Disconnected
+	} else {
+		select {
+		case <-conn.Closed():
+			rb.state = Disconnected
+		default:
+		}
 	}
 	return rb, err
 }
 
 const (
 	pingRetries     = 30
-	snapshotTimeout = time.Duration(time.Second * 5)
 	firmwareRetries = 5
 )
 
+// snapshotTimeout is how long a running box waits for
+// its snapshots to be consumed before giving up.
+var snapshotTimeout = time.Duration(time.Second * 5)
+
 // TestConnection sends a ping every testConnPoll,
 // and returns on success or after pingRetries tries.
 func (rb *RegenBox) TestConnection() (_ time.Duration, err error) {
@@ -132,198 +161,235 @@ func (rb *RegenBox) TestConnection() (_ time.Duration, err error) {
 	return time.Since(t0), err
 }
 
-func (rb *RegenBox) doCycle(tickerDuration util.Duration, maxDuration util.Duration, stopCond func(v int) bool) error {
-	timeout := time.NewTimer(time.Duration(maxDuration))
-	ticker := time.NewTicker(time.Duration(tickerDuration))
-	var sn Snapshot
+// doCycle sends a snapshot through session's snapChan every tick, until stopCond is
+// reached, maxDuration is elapsed (0: no limit), or session is stopped (which returns ErrUserStop).
+// While session is paused, box is idle, stopCond isn't checked and maxDuration is suspended.
+func (rb *RegenBox) doCycle(s *session, maxDuration util.Duration, stopCond func(v int) bool) error {
+	var (
+		timer   *time.Timer
+		timeout <-chan time.Time
+		// time spent in step, not counting pauses. It isn't 0 when a step is resumed (see StartFrom)
+		elapsed     = time.Duration(rb.Progress().Elapsed)
+		activeSince = time.Now()
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	if maxDuration > 0 {
+		timer = time.NewTimer(time.Duration(maxDuration) - elapsed)
+		timeout = timer.C
+	}
+	ticker := time.NewTicker(time.Duration(s.ticker))
+	defer ticker.Stop()
+
+	var (
+		sn     Snapshot
+		paused bool
+		mode   = byte(rb.ChargeState())
+	)
+	// togglePause applies pause state change, if any
+	togglePause := func() {
+		rb.stopMu.Lock()
+		p := s.paused
+		rb.stopMu.Unlock()
+		if p == paused {
+			return
+		}
+		paused = p
+		if paused {
+			elapsed += time.Since(activeSince)
+			if timer != nil {
+				timer.Stop()
+				timeout = nil
+			}
+			mode = byte(rb.ChargeState())
+			_ = rb.SetIdle()
+			s.msgChan <- cyclePaused(s.current)
+		} else {
+			activeSince = time.Now()
+			if timer != nil {
+				timer = time.NewTimer(time.Duration(maxDuration) - elapsed)
+				timeout = timer.C
+			}
+			_ = rb.SetChargeMode(mode)
+			s.msgChan <- cycleResumed(s.current)
+		}
+	}
+	togglePause()
+
 	for {
 		select {
-		case <-rb.stop:
+		case <-s.stop:
 			return ErrUserStop
-		case <-timeout.C:
+		case <-timeout:
 			return ErrCycleTimeout
+		case <-s.notify:
+			togglePause()
+			continue
 		case <-ticker.C:
 		}
 
-		sn = rb.Snapshot()
+		sn = rb.snapshot(s.detailed)
 		if sn.State != Connected {
 			// need error-less state here, todo something?
 			continue
 		}
+		if sn.Detail != nil {
+			sn.Detail.Retries = s.retries(rb.Counters())
+		}
+
+		sn.Capacity = rb.measure(sn)
+		if paused {
+			s.update(rb, elapsed, sn.Capacity)
+		} else {
+			s.update(rb, elapsed+time.Since(activeSince), sn.Capacity)
+		}
 
 		// repeat charge state, just in case (e.g. usb connect drop)
-		_ = rb.SetChargeMode(byte(rb.chargeState))
+		if paused {
+			_ = rb.SetIdle()
+		} else {
+			_ = rb.SetChargeMode(byte(rb.ChargeState()))
+		}
 
 		// send snapshot through the pipe
 		select {
-		case rb.snapChan <- sn:
+		case s.snapChan <- sn:
+		case <-s.stop:
+			return ErrUserStop
 		case <-time.After(snapshotTimeout):
 			return ErrSnapshotSendTimeout
 		}
 
-		if stopCond(sn.Voltage) {
+		if !paused && stopCond(sn.Voltage) {
 			return nil
 		}
 	}
 }
 
-func (rb *RegenBox) topReached(i int) bool {
-	return i >= rb.config.TopVoltage
+func topReached(target int) func(int) bool {
+	return func(i int) bool {
+		return i >= target
+	}
 }
 
-func (rb *RegenBox) bottomReached(i int) bool {
-	return i <= rb.config.BottomVoltage
+func bottomReached(target int) func(int) bool {
+	return func(i int) bool {
+		return i <= target
+	}
 }
 
 // Start initiates a regen session, it returns a chan for snapshots,
 // and a chan for end of cycles messages. If returned error is not nil, channels are nil.
+// The final CycleMessage is sent once the box is back to idle and Stopped() is true.
 func (rb *RegenBox) Start() (error, <-chan Snapshot, <-chan CycleMessage) {
-	if !rb.Stopped() {
+	return rb.StartFrom(Progress{})
+}
+
+// StartFrom initiates a regen session from p, as returned by Progress() during a
+// previous session with the same config & profile. See Start for return values.
+func (rb *RegenBox) StartFrom(p Progress) (error, <-chan Snapshot, <-chan CycleMessage) {
+	rb.stopMu.Lock()
+	defer rb.stopMu.Unlock()
+	if rb.session != nil {
 		return ErrBoxRunning, nil, nil
 	}
 
-	rb.snapChan = make(chan Snapshot)
-	rb.msgChan = make(chan CycleMessage, 36)
-	rb.stop = make(chan struct{})
-	clean := func() {
-		defer rb.wg.Done()
-		rb.stop = nil
-		var err error
-		for i := 0; i < 3; i++ {
-			err = rb.SetIdle()
-			if err == nil {
-				return
-			}
-			<-time.After(time.Millisecond * 250)
-		}
-		log.Println("error setting idle mode:", err)
+	// work on a copy, config might be changed once box is stopped
+	rb.Lock()
+	if rb.flashing {
+		rb.Unlock()
+		return ErrFlashing, nil, nil
 	}
-
-	var m CycleMessage
-	switch rb.config.Mode {
-	case Charger:
-		err := rb.SetCharge()
+	cfg := rb.config
+	profile := rb.profile
+	rb.Unlock()
+	prog, err := cfg.program(rb, profile)
+	if err != nil {
+		return err, nil, nil
+	}
+	if p.Step < 0 || p.Step > 0 && p.Step >= len(prog.steps) {
+		return fmt.Errorf("can't start from step %d, program has %d steps", p.Step+1, len(prog.steps)), nil, nil
+	}
+	// set first step's mode right away, so that errors are returned early
+	if len(prog.steps) > 0 {
+		err = rb.SetChargeMode(prog.steps[p.Step].chargeMode())
 		if err != nil {
 			return err, nil, nil
 		}
+	}
 
-		rb.msgChan <- chargeStarted(rb.config.TopVoltage)
-		rb.wg.Add(1)
-		go func() {
-			defer clean()
-			err = rb.doCycle(rb.config.Ticker, rb.config.UpDuration, rb.topReached)
-			if err == nil {
-				m = chargeReached(rb.config.TopVoltage)
-			} else if err == ErrCycleTimeout {
-				m = chargeTimeout(rb.config.TopVoltage, rb.config.UpDuration)
-			} else {
-				m = chargeError(rb.config.TopVoltage, err)
-			}
-			rb.msgChan <- m
-		}()
-	case Discharger:
-		err := rb.SetDischarge()
-		if err != nil {
-			return err, nil, nil
-		}
+	rb.Lock()
+	rb.meter.Reset()
+	rb.meter.total = p.Capacity
+	rb.Unlock()
+	s := newSession(cfg.Ticker)
+	s.progress = p
+	if cfg.DetailedLog {
+		s.detailed = true
+		s.errors = rb.Counters().errors()
+	}
+	rb.session = s
+	rb.wg.Add(1)
+	go func() {
+		defer rb.wg.Done()
+		m := rb.runProgram(s, prog)
 
-		rb.msgChan <- dischargeStarted(rb.config.BottomVoltage)
-		rb.wg.Add(1)
-		go func() {
-			defer clean()
-			err = rb.doCycle(rb.config.Ticker, rb.config.DownDuration, rb.bottomReached)
+		var err error
+		for i := 0; i < 3; i++ {
+			err = rb.SetIdle()
 			if err == nil {
-				m = dischargeReached(rb.config.BottomVoltage)
-			} else if err == ErrCycleTimeout {
-				m = dischargeTimeout(rb.config.BottomVoltage, rb.config.DownDuration)
-			} else {
-				m = dischargeError(rb.config.BottomVoltage, err)
+				break
 			}
-			rb.msgChan <- m
-		}()
-	case Cycler:
-		var err error
-		if rb.config.ChargeFirst {
-			err = rb.SetCharge()
-		} else {
-			err = rb.SetDischarge()
+			<-time.After(time.Millisecond * 250)
 		}
 		if err != nil {
-			return err, nil, nil
+			log.Println("error setting idle mode:", err)
 		}
 
-		rb.wg.Add(1)
-		go func() {
-			defer clean()
-
-			var (
-				err          error
-				i, target    int
-				duration     util.Duration
-				currentCycle string
-				nbCycles     = rb.config.NbHalfCycles
-			)
-			if rb.config.ChargeFirst {
-				currentCycle = CycleDischarge
-			}
-
-			for i = 1; i <= nbCycles; i++ {
-				if currentCycle == CycleDischarge {
-					err = rb.SetCharge()
-					if err != nil {
-						break
-					}
-					currentCycle = CycleCharge
-					target = rb.config.TopVoltage
-					duration = rb.config.UpDuration
-					rb.msgChan <- multiCycleStarted(target, currentCycle, i, nbCycles)
-					err = rb.doCycle(rb.config.Ticker, duration, rb.topReached)
-				} else {
-					err = rb.SetDischarge()
-					if err != nil {
-						break
-					}
-					currentCycle = CycleDischarge
-					target = rb.config.BottomVoltage
-					duration = rb.config.DownDuration
-
-					rb.msgChan <- multiCycleStarted(target, currentCycle, i, nbCycles)
-					err = rb.doCycle(rb.config.Ticker, rb.config.DownDuration, rb.bottomReached)
-				}
-				if err != nil {
-					break
-				}
-			}
-			if err == nil {
-				m = multiCycleReached(target, nbCycles)
-			} else if err == ErrCycleTimeout {
-				m = multiCycleTimeout(target, currentCycle, i, nbCycles, duration)
-			} else {
-				m = multiCycleError(target, err)
-			}
-			rb.msgChan <- m
-		}()
-	}
+		rb.stopMu.Lock()
+		rb.lastProgress = s.progress
+		rb.session = nil
+		rb.stopMu.Unlock()
+		s.msgChan <- m
+	}()
 
-	return nil, rb.snapChan, rb.msgChan
+	return nil, s.snapChan, s.msgChan
 }
 
 // Stops the box, and wait until Start() loop returns.
+// It is safe to call Stop concurrently, or on a stopped box.
 func (rb *RegenBox) Stop() {
-	if rb.Stopped() {
+	rb.stopMu.Lock()
+	if rb.session == nil {
+		rb.stopMu.Unlock()
 		return
 	}
-	close(rb.stop)
+	select {
+	case <-rb.session.stop:
+	default:
+		close(rb.session.stop)
+	}
+	rb.stopMu.Unlock()
 	rb.wg.Wait()
 }
 
 // Stopped returns false while box is running
 func (rb *RegenBox) Stopped() bool {
-	return rb.stop == nil
+	rb.stopMu.Lock()
+	defer rb.stopMu.Unlock()
+	return rb.session == nil
 }
 
 // Snapshot retreives the state of rb at a given time.
 func (rb *RegenBox) Snapshot() Snapshot {
+	return rb.snapshot(false)
+}
+
+// snapshot retreives the state of rb, along with its Detail if detailed.
+func (rb *RegenBox) snapshot(detailed bool) Snapshot {
 	s := Snapshot{
 		Time:     time.Now(),
 		State:    rb.State(),
@@ -332,24 +398,88 @@ func (rb *RegenBox) Snapshot() Snapshot {
 	if s.State == NilBox {
 		return s
 	}
+	rb.stopMu.Lock()
+	s.Running = rb.session != nil
+	s.Paused = s.Running && rb.session.paused
+	rb.stopMu.Unlock()
 	var err error
-	s.Voltage, err = rb.ReadVoltage()
+	t0 := time.Now()
+	s.RawVoltage, err = rb.ReadRawVoltage()
+	latency := time.Since(t0)
+	s.Voltage = s.RawVoltage
 	if err != nil {
-		s.State = rb.state // update state, it should contain an error
+		s.State = rb.State() // update state, it should contain an error
+	} else {
+		s.Voltage = rb.Calibration().Apply(s.RawVoltage)
+		if detailed {
+			s.Detail = rb.detail(latency)
+		}
 	}
 	s.ChargeState = rb.ChargeState()
+	s.Capacity = rb.Capacity()
 	return s
 }
 
+// measure accounts for sn in rb's meter, and returns capacity measured during session.
+func (rb *RegenBox) measure(sn Snapshot) Capacity {
+	rb.Lock()
+	defer rb.Unlock()
+	return rb.meter.Add(sn)
+}
+
+// Capacity returns capacity measured since start of current (or last) session.
+func (rb *RegenBox) Capacity() Capacity {
+	rb.Lock()
+	defer rb.Unlock()
+	return rb.meter.Total()
+}
+
+// Resistor returns discharge resistor value in ohms.
+func (rb *RegenBox) Resistor() float64 {
+	rb.Lock()
+	defer rb.Unlock()
+	return rb.meter.Resistor
+}
+
+// SetResistor sets discharge resistor value in ohms, which is needed to measure
+// capacity during discharge. Capacity isn't measured when ohms is 0.
+func (rb *RegenBox) SetResistor(ohms float64) {
+	rb.Lock()
+	rb.meter.Resistor = ohms
+	rb.Unlock()
+}
+
+// Config returns a copy of config of rb.
 func (rb *RegenBox) Config() Config {
-	return *rb.config
+	rb.Lock()
+	defer rb.Unlock()
+	return rb.config
 }
 
+// SetConfig sets a copy of cfg as config of rb, it is
+// taken into account on next call to Start().
 func (rb *RegenBox) SetConfig(cfg *Config) error {
-	rb.config = cfg
+	rb.Lock()
+	rb.config = *cfg
+	rb.Unlock()
 	return nil
 }
 
+// Profile returns profile run in Profiler mode, or nil.
+func (rb *RegenBox) Profile() *Profile {
+	rb.Lock()
+	defer rb.Unlock()
+	return rb.profile
+}
+
+// SetProfile sets profile to run in Profiler mode, it is
+// taken into account on next call to Start().
+func (rb *RegenBox) SetProfile(p *Profile) {
+	rb.Lock()
+	rb.profile = p
+	rb.Unlock()
+}
+
 func (rb *RegenBox) LedToggle() (bool, error) {
 	rb.Lock()
 	res, err := rb.talk(LedToggle)
@@ -376,8 +506,18 @@ func (rb *RegenBox) ReadAnalog() (int, error) {
 	return strconv.Atoi(string(res))
 }
 
-// ReadVoltage retreives voltage from battery on A0 in mV.
+// ReadVoltage retreives voltage from battery on A0 in mV,
+// corrected by calibration of rb if any.
 func (rb *RegenBox) ReadVoltage() (int, error) {
+	v, err := rb.ReadRawVoltage()
+	if err != nil {
+		return v, err
+	}
+	return rb.Calibration().Apply(v), nil
+}
+
+// ReadRawVoltage returns voltage of battery as read by box, regardless of calibration.
+func (rb *RegenBox) ReadRawVoltage() (int, error) {
 	rb.Lock()
 	res, err := rb.talk(ReadVoltage)
 	rb.Unlock()
@@ -387,7 +527,33 @@ func (rb *RegenBox) ReadVoltage() (int, error) {
 	return strconv.Atoi(string(res))
 }
 
+// SetCalibration sets correction of voltages read by rb, nil to read raw voltages.
+func (rb *RegenBox) SetCalibration(c *Calibration) {
+	rb.Lock()
+	rb.calibration = c
+	rb.Unlock()
+}
+
+// Calibration returns correction of voltages read by rb, or nil.
+func (rb *RegenBox) Calibration() *Calibration {
+	rb.Lock()
+	defer rb.Unlock()
+	return rb.calibration
+}
+
+// Path returns path of device rb is connected to, or "" if it has no connection.
+func (rb *RegenBox) Path() string {
+	rb.Lock()
+	defer rb.Unlock()
+	if rb.Conn == nil {
+		return ""
+	}
+	return rb.Conn.Path()
+}
+
 func (rb *RegenBox) FirmwareVersion() string {
+	rb.Lock()
+	defer rb.Unlock()
 	if rb.firmware == nil && rb.state == Connected {
 		rb.setFirmware()
 	}
@@ -407,6 +573,8 @@ func (rb *RegenBox) SetIdle() error {
 }
 
 func (rb *RegenBox) ChargeState() ChargeState {
+	rb.Lock()
+	defer rb.Unlock()
 	return rb.chargeState
 }
 
@@ -414,17 +582,19 @@ func (rb *RegenBox) State() State {
 	if rb == nil {
 		return NilBox
 	}
+	rb.Lock()
+	defer rb.Unlock()
 	return rb.state
 }
 
 // SetChargeMode sends mode instruction to regenbox.
 // /!\ This works because values match between
-//    - ModeIdle/ModeCharge/ModeDischarge from protocol.go
-//    - Idle/Charging/Discharging ChargeState from regenbox.go
+//   - ModeIdle/ModeCharge/ModeDischarge from protocol.go
+//   - Idle/Charging/Discharging ChargeState from regenbox.go
 func (rb *RegenBox) SetChargeMode(mode byte) error {
 	rb.Lock()
+	defer rb.Unlock()
 	_, err := rb.talk(mode)
-	rb.Unlock()
 	if err != nil {
 		return err
 	}
@@ -436,17 +606,74 @@ func (rb *RegenBox) SetChargeMode(mode byte) error {
 func (rb *RegenBox) setFirmware() error {
 	if rb.firmRetries > firmwareRetries {
 		log.Println("firmware is out of date, please update at https://github.com/solar3s/goregen")
-		rb.firmware = []byte("update me!")
+		rb.firmware = []byte(OutdatedFirmware)
+		fw := LookupFirmware(OutdatedFirmware)
+		rb.fw = &fw
 		return ErrFirmwareOutdated
 	}
+	// firmware is unknown, so is protocol
+	rb.setFramed(false)
 	var err error
 	rb.firmware, err = rb.talk(ReadFirmware)
-	if err == nil {
-		rb.firmRetries = 0
-	} else {
+	if err != nil {
 		rb.firmRetries++
+		return err
+	}
+	rb.firmRetries = 0
+	fw := LookupFirmware(string(rb.firmware))
+	rb.fw = &fw
+	if !fw.Known {
+		log.Printf("unknown firmware \"%s\", assuming it supports base instructions", rb.firmware)
+	}
+	if fw.Protocol >= FramedProtocol {
+		if _, ok := rb.Conn.(Framer); ok {
+			rb.setFramed(true)
+			log.Printf("firmware %s talks framed protocol", rb.firmware)
+		}
+	}
+	return nil
+}
+
+// setFramed switches protocol of rb and rb.Conn, if it's a Framer.
+func (rb *RegenBox) setFramed(framed bool) {
+	rb.framed = false
+	if f, ok := rb.Conn.(Framer); ok {
+		f.SetFramed(framed)
+		rb.framed = framed
 	}
-	return err
+}
+
+// resetFirmware forgets firmware of rb, after a reconnection. It is
+// read again on next ping, along with protocol switch if needed.
+func (rb *RegenBox) resetFirmware() {
+	rb.firmware = nil
+	rb.fw = nil
+	rb.firmRetries = 0
+	rb.setFramed(false)
+}
+
+// Protocol returns protocol version used with firmware of rb.
+func (rb *RegenBox) Protocol() int {
+	rb.Lock()
+	defer rb.Unlock()
+	if rb.framed && rb.fw != nil {
+		return rb.fw.Protocol
+	}
+	return 0
+}
+
+// Firmware returns capabilities of firmware of rb, its
+// Version is empty if it couldn't be read (yet).
+func (rb *RegenBox) Firmware() Firmware {
+	rb.Lock()
+	defer rb.Unlock()
+	if rb.fw == nil && rb.state == Connected {
+		rb.setFirmware()
+	}
+	if rb.fw == nil {
+		return Firmware{}
+	}
+	return *rb.fw
 }
 
 // ping sends a ping to regenbox, returning error if something's wrong
@@ -473,21 +700,91 @@ func (rb *RegenBox) talk(b byte) ([]byte, error) {
 	if rb.Conn == nil || rb.state == Disconnected {
 		return nil, ErrDisconnected
 	}
+	if rb.fw != nil && !rb.fw.Supports(b) {
+		return nil, UnsupportedError{Firmware: rb.fw.Version, Cmd: b}
+	}
+	if rb.framed {
+		return rb.talkFramed(b)
+	}
 	err := rb.Conn.Write([]byte{b})
 	if err != nil {
 		rb.state = WriteError
+		atomic.AddUint64(&rb.counters.WriteErrors, 1)
 		return nil, err
 	}
 	return rb.read()
 }
 
+// maxStaleFrames is how many unexpected frames are skipped waiting for an answer.
+const maxStaleFrames = 8
+
+// talkFramed sends cmd in a new frame, and returns payload of its
+// answer. Answers to previous frames (e.g. after a read timeout) are skipped.
+func (rb *RegenBox) talkFramed(cmd byte) ([]byte, error) {
+	rb.seq++
+	err := rb.Conn.Write(Frame{Seq: rb.seq, Cmd: cmd}.Encode())
+	if err != nil {
+		rb.state = WriteError
+		atomic.AddUint64(&rb.counters.WriteErrors, 1)
+		return nil, err
+	}
+	for i := 0; i < maxStaleFrames; i++ {
+		buf, err := rb.read()
+		if err != nil {
+			return nil, err
+		}
+		f, err := DecodeFrame(buf)
+		if err != nil {
+			rb.state = ReadError
+			atomic.AddUint64(&rb.counters.ChecksumErrors, 1)
+			return nil, err
+		}
+		if f.Seq != rb.seq || f.Cmd != cmd && f.Cmd != Nak {
+			atomic.AddUint64(&rb.counters.StaleFrames, 1)
+			continue
+		}
+		if f.Cmd == Nak {
+			nak := NakError{Cmd: cmd}
+			if len(f.Payload) > 1 {
+				nak.Reason = f.Payload[1]
+			}
+			return nil, nak
+		}
+		return f.Payload, nil
+	}
+	rb.state = ReadError
+	atomic.AddUint64(&rb.counters.ReadErrors, 1)
+	return nil, ErrStaleFrames
+}
+
 // read reads from rb.Conn then returnes CRLF-trimmed response
 func (rb *RegenBox) read() (buf []byte, err error) {
 	buf, err = rb.Conn.Read()
 	if err != nil {
 		rb.state = ReadError
+		atomic.AddUint64(&rb.counters.ReadErrors, 1)
 		return buf, err
 	}
 	rb.state = Connected
 	return buf, nil
 }
+
+// Counters counts communication errors & reconnections of a RegenBox since its creation.
+type Counters struct {
+	ReadErrors     uint64
+	WriteErrors    uint64
+	Reconnections  uint64 // successful reconnections by Watcher.WatchConn
+	ChecksumErrors uint64 // corrupted frames, in framed protocol
+	StaleFrames    uint64 // frames skipped as they didn't answer current instruction
+}
+
+// Counters returns communication counters of rb.
+func (rb *RegenBox) Counters() Counters {
+	return Counters{
+		ReadErrors:     atomic.LoadUint64(&rb.counters.ReadErrors),
+		WriteErrors:    atomic.LoadUint64(&rb.counters.WriteErrors),
+		Reconnections:  atomic.LoadUint64(&rb.counters.Reconnections),
+		ChecksumErrors: atomic.LoadUint64(&rb.counters.ChecksumErrors),
+		StaleFrames:    atomic.LoadUint64(&rb.counters.StaleFrames),
+	}
+}
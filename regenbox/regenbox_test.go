@@ -1,6 +1,7 @@
 package regenbox
 
 import (
+	"github.com/rkjdid/util"
 	"sync"
 	"testing"
 	"time"
@@ -13,10 +14,16 @@ func testAutoConnect(tb testing.TB) *RegenBox {
 	if rb != nil {
 		return rb
 	}
+	if raceEnabled {
+		// Close of go.bug.st/serial.v1 ports isn't synchronized with a pending Read,
+		// which probing serial ports for a box triggers
+		tb.Skip("serial autodetection races in go.bug.st/serial.v1")
+	}
 
 	var err error
 	rb, err = NewRegenBox(nil, nil)
 	if err != nil {
+		rb = nil
 		tb.Skip(err)
 	}
 	return rb
@@ -67,3 +74,107 @@ func BenchmarkReadVoltage(b *testing.B) {
 	b.Logf("b.N: %d", b.N)
 	b.Logf("average voltage: %d", total/b.N)
 }
+
+// echoTransport is a minimal Transport answering each instruction
+// with a fixed response from its table.
+type echoTransport struct {
+	answers   map[byte][]byte
+	last      byte
+	writeErr  error
+	closeChan chan struct{}
+}
+
+func newEchoTransport(answers map[byte][]byte) *echoTransport {
+	return &echoTransport{answers: answers, closeChan: make(chan struct{})}
+}
+
+func (t *echoTransport) Write(b []byte) error {
+	if t.writeErr != nil {
+		return t.writeErr
+	}
+	t.last = b[0]
+	return nil
+}
+
+func (t *echoTransport) Read() ([]byte, error) {
+	return t.answers[t.last], nil
+}
+
+func (t *echoTransport) Close() error {
+	close(t.closeChan)
+	return nil
+}
+
+func (t *echoTransport) Closed() <-chan struct{} {
+	return t.closeChan
+}
+
+func (t *echoTransport) Path() string {
+	return "echo"
+}
+
+func TestRegenBox_Transport(t *testing.T) {
+	conn := newEchoTransport(map[byte][]byte{
+		ReadVoltage:  []byte("1234"),
+		ReadFirmware: []byte("echo"),
+	})
+	rbx, err := NewRegenBox(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = rbx.SetCharge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn := rbx.Snapshot()
+	if sn.State != Connected {
+		t.Errorf("expected state %s, got %s", Connected, sn.State)
+	}
+	if sn.Voltage != 1234 {
+		t.Errorf("expected voltage 1234, got %d", sn.Voltage)
+	}
+	if sn.ChargeState != Charging {
+		t.Errorf("expected charge state %s, got %s", Charging, sn.ChargeState)
+	}
+	if sn.Firmware != "echo" {
+		t.Errorf("expected firmware \"echo\", got \"%s\"", sn.Firmware)
+	}
+
+	conn.writeErr = ErrClosedPort
+	if err = rbx.Ping(); err != ErrClosedPort {
+		t.Errorf("expected %s, got %v", ErrClosedPort, err)
+	}
+	if rbx.State() != WriteError {
+		t.Errorf("expected state %s, got %s", WriteError, rbx.State())
+	}
+}
+
+func TestRegenBox_Config(t *testing.T) {
+	rbx, err := NewRegenBox(newEchoTransport(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := NewConfig()
+	cfg.TopVoltage = 1450
+	_ = rbx.SetConfig(cfg)
+	cfg.TopVoltage = 1500
+	if c := rbx.Config(); c.TopVoltage != 1450 {
+		t.Errorf("expected config to be copied, got top voltage %d", c.TopVoltage)
+	}
+
+	// see go test -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c := rbx.Config()
+			c.Ticker = util.Duration(i)
+			_ = rbx.SetConfig(&c)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_ = rbx.Config()
+	}
+	<-done
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"go.bug.st/serial.v1"
 	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +31,7 @@ type SerialConnection struct {
 	path   string
 	locked bool
 	config serial.Mode
+	framed int32 // read frames rather than StopByte-terminated answers, see SetFramed
 
 	rdChan    chan []byte
 	wrChan    chan []byte
@@ -53,6 +56,14 @@ func NewSerial(port serial.Port, config serial.Mode, name string, lockPort bool)
 	}
 }
 
+// NewClosedSerial returns an already closed SerialConnection locked on name,
+// for a device that couldn't be opened yet: see Reopen, and Watcher.
+func NewClosedSerial(name string, config serial.Mode) *SerialConnection {
+	sc := NewSerial(nil, config, name, true)
+	close(sc.closeChan)
+	return sc
+}
+
 // Start begins the two routines responsible
 // for reading and writing on serial port.
 func (sc *SerialConnection) Start() {
@@ -127,32 +138,80 @@ func (sc *SerialConnection) Path() string {
 	return sc.path
 }
 
+// Reopen opens and starts a new SerialConnection to sc.Path(), using the
+// same serial config. If sc wasn't locked to its port, any available
+// regenbox is searched for instead (see FindSerial).
+func (sc *SerialConnection) Reopen() (Transport, error) {
+	if !sc.locked {
+		return FindSerial(&sc.config)
+	}
+	port, err := openPort(sc.path, &sc.config)
+	if err != nil {
+		return nil, err
+	}
+	conn := NewSerial(port, sc.config, sc.path, true)
+	conn.Start()
+	return conn, nil
+}
+
+// SetFramed switches sc to framed protocol, see Framer.
+func (sc *SerialConnection) SetFramed(framed bool) {
+	var v int32
+	if framed {
+		v = 1
+	}
+	atomic.StoreInt32(&sc.framed, v)
+}
+
+// split returns the first answer of buf, according to current protocol.
+func (sc *SerialConnection) split(buf []byte) (answer, rest []byte, ok bool) {
+	if atomic.LoadInt32(&sc.framed) == 1 {
+		return SplitFrame(buf)
+	}
+	for i, b := range buf {
+		if b == StopByte {
+			// do not send stop-byte
+			return buf[:i], buf[i+1:], true
+		}
+	}
+	return nil, buf, false
+}
+
 func (sc *SerialConnection) readRoutine() {
+	var buf []byte
+	b := make([]byte, 32)
 	for {
-		b := make([]byte, 32)
 		i, err := sc.Port.Read(b)
+		buf = append(buf, b[:i]...)
 
-		// read until last byte is a stop
-		j := i
-		for err == nil && j > 0 && b[i-1] != StopByte {
-			j, err = sc.Port.Read(b[i:])
-			i += j
-		}
-
-		// do not send stop-byte
-		if i > 0 && b[i-1] == StopByte {
-			i -= 1
+		var answers [][]byte
+		if err != nil {
+			// send whatever was read along with error
+			answers, buf = [][]byte{buf}, nil
+		} else {
+			for {
+				answer, rest, ok := sc.split(buf)
+				if !ok {
+					break
+				}
+				answers = append(answers, answer)
+				buf = rest
+			}
 		}
+		// copy remaining bytes, answers share buf's array
+		buf = append([]byte(nil), buf...)
 
-		select {
-		case sc.rdChan <- b[:i]:
-		case <-sc.Closed():
-			return
-		}
-		select {
-		case sc.errChan <- err:
-		case <-sc.Closed():
-			return
+		for _, answer := range answers {
+			select {
+			case sc.rdChan <- answer:
+			case <-sc.Closed():
+				return
+			}
+			select {
+			case sc.errChan <- err:
+			case <-sc.Closed():
+				return
+			}
 		}
 	}
 }
@@ -176,7 +235,7 @@ func (sc *SerialConnection) writeRoutine() {
 
 // FindSerial tries to connect to first available serial port (platform independant hopefully).
 // If config is nil, DefaultSerialMode is used.
-func FindSerial(config *serial.Mode) (*SerialConnection, error) {
+func FindSerial(config *serial.Mode) (Transport, error) {
 	ports, err := serial.GetPortsList()
 	if err != nil {
 		return nil, err
@@ -194,8 +253,10 @@ func FindSerial(config *serial.Mode) (*SerialConnection, error) {
 			conn.WriteTimeout = time.Millisecond * 50
 			conn.Start()
 			// create a temporary box to test connection
-			rb := &RegenBox{Conn: conn, config: new(Config), state: Connected}
+			rb := &RegenBox{Conn: conn, state: Connected}
 			t, err := rb.TestConnection()
+			// box using conn negotiates protocol again
+			conn.SetFramed(false)
 			if err == nil {
 				conn.ReadTimeout = DefaultTimeout
 				conn.WriteTimeout = DefaultTimeout
@@ -213,8 +274,40 @@ func FindSerial(config *serial.Mode) (*SerialConnection, error) {
 	return nil, err
 }
 
+// OpenPortName opens serial port name using DefaultSerialConfig. Names such
+// as "scheme://..." are handled by a PortOpener if one was registered for scheme.
 func OpenPortName(name string) (port serial.Port, config serial.Mode, err error) {
 	config = DefaultSerialConfig
-	port, err = serial.Open(name, &config)
+	port, err = openPort(name, &config)
 	return port, config, err
 }
+
+// PortOpener opens a serial.Port from its name, see RegisterPortOpener.
+type PortOpener func(name string, mode *serial.Mode) (serial.Port, error)
+
+var (
+	portOpeners   = make(map[string]PortOpener)
+	portOpenersMu sync.RWMutex
+)
+
+// RegisterPortOpener makes open responsible for device names starting with
+// scheme followed by "://". This allows for non-hardware ports (simulators,
+// network bridges...) to be used everywhere a serial device path is expected.
+func RegisterPortOpener(scheme string, open PortOpener) {
+	portOpenersMu.Lock()
+	portOpeners[scheme] = open
+	portOpenersMu.Unlock()
+}
+
+// openPort opens name with its registered PortOpener if any, or as a regular serial port.
+func openPort(name string, mode *serial.Mode) (serial.Port, error) {
+	if i := strings.Index(name, "://"); i > 0 {
+		portOpenersMu.RLock()
+		open, ok := portOpeners[name[:i]]
+		portOpenersMu.RUnlock()
+		if ok {
+			return open(name, mode)
+		}
+	}
+	return serial.Open(name, mode)
+}
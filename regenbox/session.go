@@ -0,0 +1,117 @@
+package regenbox
+
+import (
+	"errors"
+	"github.com/rkjdid/util"
+	"time"
+)
+
+var ErrBoxStopped = errors.New("box isn't running")
+
+// session holds the state of a running Start() call.
+type session struct {
+	stop     chan struct{}
+	notify   chan struct{} // signals a change of paused
+	paused   bool          // guarded by RegenBox.stopMu
+	snapChan chan Snapshot
+	msgChan  chan CycleMessage
+	ticker   util.Duration
+	current  CycleMessage // last progress message, Type & Target are reused by pause messages
+	progress Progress     // guarded by RegenBox.stopMu
+	detailed bool         // snapshots carry a Detail, see Config.DetailedLog
+	errors   uint64       // communication errors at previous measure, in detailed mode
+}
+
+// Progress locates a running session within its steps, see RegenBox.StartFrom.
+type Progress struct {
+	Step         int           // index of current step (half-cycle in Cycler mode)
+	Elapsed      util.Duration // time spent in current step, pauses excluded
+	Capacity     Capacity      // measured since start of session
+	StepCapacity Capacity      // measured since start of current step
+}
+
+func newSession(ticker util.Duration) *session {
+	return &session{
+		stop:     make(chan struct{}),
+		notify:   make(chan struct{}, 1),
+		snapChan: make(chan Snapshot),
+		msgChan:  make(chan CycleMessage, 36),
+		ticker:   ticker,
+	}
+}
+
+// send sends a progress message.
+func (s *session) send(m CycleMessage) {
+	s.current = m
+	s.msgChan <- m
+}
+
+// startStep updates progress for step n, and returns session's
+// capacity at the start of step (which may have been resumed).
+func (s *session) startStep(rb *RegenBox, n int) Capacity {
+	rb.stopMu.Lock()
+	defer rb.stopMu.Unlock()
+	if n != s.progress.Step {
+		s.progress.Step = n
+		s.progress.Elapsed = 0
+		s.progress.StepCapacity = Capacity{}
+	}
+	return s.progress.Capacity.Sub(s.progress.StepCapacity)
+}
+
+// update updates progress within current step.
+func (s *session) update(rb *RegenBox, elapsed time.Duration, c Capacity) {
+	rb.stopMu.Lock()
+	defer rb.stopMu.Unlock()
+	c0 := s.progress.Capacity.Sub(s.progress.StepCapacity)
+	s.progress.Elapsed = util.Duration(elapsed)
+	s.progress.Capacity = c
+	s.progress.StepCapacity = c.Sub(c0)
+}
+
+// Progress returns progress of running session, or of last session if box is stopped.
+func (rb *RegenBox) Progress() Progress {
+	rb.stopMu.Lock()
+	defer rb.stopMu.Unlock()
+	if rb.session == nil {
+		return rb.lastProgress
+	}
+	return rb.session.progress
+}
+
+// Pause idles a running box, until Resume is called. Progress of the
+// session is kept: current step, measures & remaining time before timeout.
+// Snapshots are still sent while paused. Pausing a paused box is a no-op.
+func (rb *RegenBox) Pause() error {
+	return rb.setPaused(true)
+}
+
+// Resume continues a paused session from where it was paused.
+// Resuming a box that isn't paused is a no-op.
+func (rb *RegenBox) Resume() error {
+	return rb.setPaused(false)
+}
+
+// Paused returns true if box is running & paused.
+func (rb *RegenBox) Paused() bool {
+	rb.stopMu.Lock()
+	defer rb.stopMu.Unlock()
+	return rb.session != nil && rb.session.paused
+}
+
+func (rb *RegenBox) setPaused(paused bool) error {
+	rb.stopMu.Lock()
+	defer rb.stopMu.Unlock()
+	if rb.session == nil {
+		return ErrBoxStopped
+	}
+	if rb.session.paused == paused {
+		return nil
+	}
+	rb.session.paused = paused
+	select {
+	case rb.session.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
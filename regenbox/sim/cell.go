@@ -0,0 +1,120 @@
+package sim
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// point is an open-circuit voltage (mV) for a given state of charge.
+type point struct {
+	soc float64
+	ocv float64
+}
+
+// Cell describes a battery model, its open-circuit voltage is
+// interpolated from ocv curve depending on its state of charge (0: empty, 1: full).
+// Cells might be overcharged up to MaxSoC, which is where voltage rises
+// sharply, as charge-termination algorithms expect.
+type Cell struct {
+	Name             string
+	Capacity         float64 // in mAh
+	InternalResistor float64 // in ohms
+	ChargeCurrent    float64 // in mA, default charge current
+	ChargeEfficiency float64 // ratio of charge actually stored
+	MaxSoC           float64 // maximum state of charge (overcharge)
+	ocv              []point
+}
+
+var cells = map[string]Cell{
+	"nimh-aa": {
+		Name:             "nimh-aa",
+		Capacity:         2000,
+		InternalResistor: 0.1,
+		ChargeCurrent:    300,
+		ChargeEfficiency: 0.9,
+		MaxSoC:           1.1,
+		ocv:              nimhCurve,
+	},
+	"nimh-aaa": {
+		Name:             "nimh-aaa",
+		Capacity:         800,
+		InternalResistor: 0.15,
+		ChargeCurrent:    150,
+		ChargeEfficiency: 0.9,
+		MaxSoC:           1.1,
+		ocv:              nimhCurve,
+	},
+	"alkaline-aa": {
+		Name:             "alkaline-aa",
+		Capacity:         2500,
+		InternalResistor: 0.2,
+		ChargeCurrent:    100,
+		ChargeEfficiency: 0.5,
+		MaxSoC:           1,
+		ocv:              alkalineCurve,
+	},
+	"alkaline-aaa": {
+		Name:             "alkaline-aaa",
+		Capacity:         1100,
+		InternalResistor: 0.3,
+		ChargeCurrent:    60,
+		ChargeEfficiency: 0.5,
+		MaxSoC:           1,
+		ocv:              alkalineCurve,
+	},
+}
+
+var nimhCurve = []point{
+	{0, 900},
+	{0.05, 1150},
+	{0.1, 1200},
+	{0.3, 1240},
+	{0.6, 1270},
+	{0.9, 1310},
+	{1, 1380},
+	{1.05, 1420},
+	{1.1, 1490},
+}
+
+var alkalineCurve = []point{
+	{0, 800},
+	{0.1, 1050},
+	{0.3, 1200},
+	{0.6, 1320},
+	{0.9, 1480},
+	{1, 1580},
+}
+
+// LookupCell returns the Cell model registered as name (e.g. "nimh-aa").
+func LookupCell(name string) (Cell, error) {
+	c, ok := cells[strings.ToLower(name)]
+	if !ok {
+		return c, fmt.Errorf("unknown cell model \"%s\" (available: %s)", name, strings.Join(CellNames(), ", "))
+	}
+	return c, nil
+}
+
+// CellNames lists available cell models.
+func CellNames() []string {
+	var names []string
+	for k := range cells {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OCV returns open-circuit voltage in mV at state of charge soc.
+func (c Cell) OCV(soc float64) float64 {
+	if soc <= c.ocv[0].soc {
+		return c.ocv[0].ocv
+	}
+	for i := 1; i < len(c.ocv); i++ {
+		p0, p1 := c.ocv[i-1], c.ocv[i]
+		if soc <= p1.soc {
+			return p0.ocv + (soc-p0.soc)*(p1.ocv-p0.ocv)/(p1.soc-p0.soc)
+		}
+	}
+	return c.ocv[len(c.ocv)-1].ocv
+}
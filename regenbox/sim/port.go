@@ -0,0 +1,143 @@
+package sim
+
+import (
+	"github.com/solar3s/goregen/regenbox"
+	"go.bug.st/serial.v1"
+	"sync"
+)
+
+// port is a serial.Port connected to a simulated Box.
+type port struct {
+	box    *Box
+	buf    []byte
+	in     []byte // incoming frame, in framed protocol
+	ready  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+	sync.Mutex
+}
+
+// Port returns a new serial.Port connected to b.
+func (b *Box) Port() serial.Port {
+	return &port{
+		box:    b,
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// Read blocks until at least one byte is available, or port is closed.
+func (p *port) Read(buf []byte) (int, error) {
+	for {
+		p.Lock()
+		if len(p.buf) > 0 {
+			n := copy(buf, p.buf)
+			p.buf = p.buf[n:]
+			p.Unlock()
+			return n, nil
+		}
+		p.Unlock()
+
+		select {
+		case <-p.ready:
+		case <-p.closed:
+			return 0, regenbox.ErrClosedPort
+		}
+	}
+}
+
+// Write processes each byte of buf as an instruction to the simulated box.
+func (p *port) Write(buf []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, regenbox.ErrClosedPort
+	default:
+	}
+
+	framed := regenbox.ProtocolVersion(p.box.Firmware) >= regenbox.FramedProtocol
+	for _, in := range buf {
+		if framed && (len(p.in) > 0 || in == regenbox.FrameStart) {
+			p.in = append(p.in, in)
+			p.handleFrame()
+			continue
+		}
+		out, ok := p.box.handle(in)
+		if !ok {
+			continue
+		}
+		p.send(append(out, regenbox.StopByte))
+	}
+	return len(buf), nil
+}
+
+// handleFrame answers frame being received, once it's complete.
+func (p *port) handleFrame() {
+	frame, _, ok := regenbox.SplitFrame(p.in)
+	if !ok {
+		return
+	}
+	p.in = nil
+	f, err := regenbox.DecodeFrame(frame)
+	if err != nil {
+		p.send(regenbox.Frame{Seq: frame[1], Cmd: regenbox.Nak,
+			Payload: []byte{frame[2], regenbox.NakChecksum}}.Encode())
+		return
+	}
+	if len(f.Payload) > 0 {
+		p.send(regenbox.Frame{Seq: f.Seq, Cmd: regenbox.Nak,
+			Payload: []byte{f.Cmd, regenbox.NakLength}}.Encode())
+		return
+	}
+	out, ok := p.box.handle(f.Cmd)
+	if !ok {
+		p.send(regenbox.Frame{Seq: f.Seq, Cmd: regenbox.Nak,
+			Payload: []byte{f.Cmd, regenbox.NakUnknown}}.Encode())
+		return
+	}
+	p.send(regenbox.Frame{Seq: f.Seq, Cmd: f.Cmd, Payload: out}.Encode())
+}
+
+// send makes b available to Read.
+func (p *port) send(b []byte) {
+	p.Lock()
+	p.buf = append(p.buf, b...)
+	p.Unlock()
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (p *port) Close() error {
+	p.once.Do(func() {
+		close(p.closed)
+	})
+	return nil
+}
+
+func (p *port) SetMode(mode *serial.Mode) error {
+	return nil
+}
+
+func (p *port) ResetInputBuffer() error {
+	p.Lock()
+	p.buf = nil
+	p.Unlock()
+	return nil
+}
+
+func (p *port) ResetOutputBuffer() error {
+	return nil
+}
+
+func (p *port) SetDTR(dtr bool) error {
+	return nil
+}
+
+func (p *port) SetRTS(rts bool) error {
+	return nil
+}
+
+func (p *port) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{CTS: true, DSR: true}, nil
+}
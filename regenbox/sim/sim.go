@@ -0,0 +1,310 @@
+// Package sim provides a software RegenBox, answering the byte protocol
+// of firmware/firmware.ino on top of a simulated battery cell. With a
+// "v2" firmware, it also answers the framed protocol of firmware/framed.ino.
+//
+// Importing this package registers the "sim" scheme to regenbox.OpenPortName,
+// so a simulated box is used anywhere a device path is expected:
+//
+//	goregen -dev "sim://nimh-aa?speed=600"
+//
+// Host part of the name selects the cell model (see CellNames), query
+// parameters tune the simulation:
+//
+//	speed     time-scale factor, 600 makes 1 second last 10 minutes (default 1)
+//	resistor  discharge resistor in ohms (default 10)
+//	charge    charge current in mA (default depends on cell model)
+//	soc       initial state of charge, 0: empty, 1: full (default 0.5)
+//	firmware  firmware version to report (default "sim"), "v2" talks framed protocol
+//	aref      actual analog reference in mV (default 2410), read voltages are off by 2410/aref
+//
+// Boxes are kept by name, reopening a closed port (as regenbox.Watcher
+// does) connects back to the same battery.
+package sim
+
+import (
+	"fmt"
+	"github.com/solar3s/goregen/regenbox"
+	"go.bug.st/serial.v1"
+	"math"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Scheme is the device name prefix handled by this package.
+const Scheme = "sim"
+
+const (
+	DefaultFirmware = "sim"
+	DefaultResistor = 10
+	DefaultSoC      = 0.5
+	DefaultSpeed    = 1
+)
+
+// firmware's CAN_REF & CAN_BITSIZE, used to compute raw A0 readings
+const (
+	canRef     = 2410
+	canBitSize = 1023
+)
+
+// pin instructions as defined in firmware/firmware.ino
+const (
+	pinDischargeOff byte = 0x30
+	pinDischargeOn  byte = 0x31
+	pinChargeOff    byte = 0x40
+	pinChargeOn     byte = 0x41
+)
+
+// maxStep is the maximum simulated time between two integration steps.
+const maxStep = time.Minute
+
+var (
+	boxes   = make(map[string]*Box)
+	boxesMu sync.Mutex
+)
+
+func init() {
+	regenbox.RegisterPortOpener(Scheme, Open)
+	regenbox.RegisterFirmware(regenbox.Firmware{
+		Version:     DefaultFirmware,
+		Commands:    regenbox.LookupFirmware("v0").Commands,
+		AnalogScale: float64(canRef) / canBitSize,
+	})
+}
+
+// Box is a simulated RegenBox and its battery.
+type Box struct {
+	Name          string
+	Cell          Cell
+	Resistor      float64 // discharge resistor in ohms
+	ChargeCurrent float64 // in mA
+	Speed         float64 // time-scale factor
+	Firmware      string
+	Aref          float64 // actual analog reference in mV, firmware assumes canRef
+
+	soc       float64
+	charge    bool
+	discharge bool
+	led       bool
+	last      time.Time
+	sync.Mutex
+}
+
+// NewBox creates a simulated box from name, without registering it.
+func NewBox(name string) (*Box, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != Scheme {
+		return nil, fmt.Errorf("invalid scheme \"%s\", expecting \"%s\"", u.Scheme, Scheme)
+	}
+	cell, err := LookupCell(u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Box{
+		Name:          name,
+		Cell:          cell,
+		Resistor:      DefaultResistor,
+		ChargeCurrent: cell.ChargeCurrent,
+		Speed:         DefaultSpeed,
+		Firmware:      DefaultFirmware,
+		Aref:          canRef,
+		soc:           DefaultSoC,
+		last:          time.Now(),
+	}
+
+	q := u.Query()
+	for _, v := range []struct {
+		key string
+		val *float64
+	}{
+		{"speed", &b.Speed},
+		{"resistor", &b.Resistor},
+		{"charge", &b.ChargeCurrent},
+		{"soc", &b.soc},
+		{"aref", &b.Aref},
+	} {
+		s := q.Get(v.key)
+		if s == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f < 0 {
+			return nil, fmt.Errorf("invalid %s value \"%s\"", v.key, s)
+		}
+		*v.val = f
+	}
+	if b.Resistor == 0 {
+		return nil, fmt.Errorf("resistor value must not be 0")
+	}
+	if b.Aref == 0 {
+		return nil, fmt.Errorf("aref value must not be 0")
+	}
+	if fw := q.Get("firmware"); fw != "" {
+		b.Firmware = fw
+	}
+	b.soc = math.Min(b.soc, b.Cell.MaxSoC)
+	return b, nil
+}
+
+// Lookup returns the box registered as name, creating it if needed.
+func Lookup(name string) (*Box, error) {
+	boxesMu.Lock()
+	defer boxesMu.Unlock()
+	if b, ok := boxes[name]; ok {
+		return b, nil
+	}
+	b, err := NewBox(name)
+	if err != nil {
+		return nil, err
+	}
+	boxes[name] = b
+	return b, nil
+}
+
+// Open returns a new serial.Port connected to box name (see Lookup),
+// it is a regenbox.PortOpener. mode is ignored.
+func Open(name string, _ *serial.Mode) (serial.Port, error) {
+	b, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.Port(), nil
+}
+
+// WithResistor returns name with its resistor parameter
+// set to ohms, unless name already specifies one.
+func WithResistor(name string, ohms float64) string {
+	u, err := url.Parse(name)
+	if err != nil || ohms <= 0 {
+		return name
+	}
+	q := u.Query()
+	if q.Get("resistor") != "" {
+		return name
+	}
+	q.Set("resistor", strconv.FormatFloat(ohms, 'f', -1, 64))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// SoC returns the current state of charge of simulated battery.
+func (b *Box) SoC() float64 {
+	b.Lock()
+	defer b.Unlock()
+	b.advance()
+	return b.soc
+}
+
+// Voltage returns the current voltage at battery's terminals in mV.
+func (b *Box) Voltage() int {
+	b.Lock()
+	defer b.Unlock()
+	b.advance()
+	return int(b.voltage())
+}
+
+// ChargeState returns the current charge state of the box.
+func (b *Box) ChargeState() regenbox.ChargeState {
+	b.Lock()
+	defer b.Unlock()
+	switch {
+	case b.charge && !b.discharge:
+		return regenbox.Charging
+	case b.discharge && !b.charge:
+		return regenbox.Discharging
+	}
+	return regenbox.Idle
+}
+
+// dischargeCurrent returns current flowing through discharge resistor in mA.
+func (b *Box) dischargeCurrent() float64 {
+	return b.Cell.OCV(b.soc) / (b.Resistor + b.Cell.InternalResistor)
+}
+
+// voltage computes terminal voltage from current state.
+func (b *Box) voltage() float64 {
+	switch {
+	case b.charge && !b.discharge:
+		return b.Cell.OCV(b.soc) + b.ChargeCurrent*b.Cell.InternalResistor
+	case b.discharge && !b.charge:
+		return b.dischargeCurrent() * b.Resistor
+	}
+	return b.Cell.OCV(b.soc)
+}
+
+// advance integrates charge & discharge currents
+// since last call, with regard to b.Speed.
+func (b *Box) advance() {
+	now := time.Now()
+	elapsed := time.Duration(float64(now.Sub(b.last)) * b.Speed)
+	b.last = now
+
+	for elapsed > 0 {
+		step := elapsed
+		if step > maxStep {
+			step = maxStep
+		}
+		elapsed -= step
+
+		hours := step.Hours()
+		if b.charge {
+			b.soc += b.ChargeCurrent * hours * b.Cell.ChargeEfficiency / b.Cell.Capacity
+		}
+		if b.discharge {
+			b.soc -= b.dischargeCurrent() * hours / b.Cell.Capacity
+		}
+		b.soc = math.Max(0, math.Min(b.soc, b.Cell.MaxSoC))
+	}
+}
+
+// handle processes a single instruction, returning its answer. If ok is
+// false, instruction is unknown and nothing must be written (not even StopByte).
+func (b *Box) handle(in byte) (out []byte, ok bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.advance()
+
+	switch in {
+	case regenbox.ReadFirmware:
+		out = []byte(b.Firmware)
+	case regenbox.ReadA0:
+		out = []byte(strconv.Itoa(int(b.voltage() * canBitSize / b.Aref)))
+	case regenbox.ReadVoltage:
+		out = []byte(strconv.Itoa(int(b.voltage() * canRef / b.Aref)))
+	case regenbox.LedOff:
+		b.led = false
+	case regenbox.LedOn:
+		b.led = true
+	case regenbox.LedToggle:
+		b.led = !b.led
+		if b.led {
+			out = []byte{1}
+		} else {
+			out = []byte{0}
+		}
+	case pinDischargeOff:
+		b.discharge = false
+	case pinDischargeOn:
+		b.discharge = true
+	case pinChargeOff:
+		b.charge = false
+	case pinChargeOn:
+		b.charge = true
+	case regenbox.ModeIdle:
+		b.charge, b.discharge = false, false
+	case regenbox.ModeCharge:
+		b.charge, b.discharge = true, false
+	case regenbox.ModeDischarge:
+		b.charge, b.discharge = false, true
+	case regenbox.Ping:
+	default:
+		// do not talk to strangers
+		return nil, false
+	}
+	return out, true
+}
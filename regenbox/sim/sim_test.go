@@ -0,0 +1,260 @@
+package sim
+
+import (
+	"fmt"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/regenbox"
+	"testing"
+	"time"
+)
+
+var testId int
+
+// testBox connects a new RegenBox to a freshly simulated box named
+// after model & params, just as main does with a regular device path.
+func testBox(t *testing.T, model string, params string) (*regenbox.RegenBox, *Box) {
+	testId++
+	name := fmt.Sprintf("sim://%s?id=%d&%s", model, testId, params)
+	port, cfg, err := regenbox.OpenPortName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := regenbox.NewSerial(port, cfg, name, true)
+	conn.Start()
+	rb, err := regenbox.NewRegenBox(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, err := Lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rb, box
+}
+
+func TestBox_Protocol(t *testing.T) {
+	rb, box := testBox(t, "nimh-aa", "soc=1")
+	defer rb.Conn.Close()
+
+	if err := rb.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if fw := rb.FirmwareVersion(); fw != DefaultFirmware {
+		t.Errorf("expected firmware \"%s\", got \"%s\"", DefaultFirmware, fw)
+	}
+	if fw := rb.Firmware(); !fw.Known || fw.AnalogScale == 0 {
+		t.Errorf("expected registered firmware, got %+v", fw)
+	}
+
+	led, err := rb.LedToggle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if led2, _ := rb.LedToggle(); led2 == led {
+		t.Error("wrong return value for LedToggle()")
+	}
+
+	v, err := rb.ReadVoltage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != box.Voltage() {
+		t.Errorf("expected voltage %dmV, got %dmV", box.Voltage(), v)
+	}
+	if v < 1300 || v > 1450 {
+		t.Errorf("unexpected voltage for a fully charged NiMH: %dmV", v)
+	}
+
+	a0, err := rb.ReadAnalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a0 != v*canBitSize/canRef {
+		t.Errorf("expected A0 value %d, got %d", v*canBitSize/canRef, a0)
+	}
+
+	for _, mode := range []regenbox.ChargeState{regenbox.Charging, regenbox.Discharging, regenbox.Idle} {
+		if err := rb.SetChargeMode(byte(mode)); err != nil {
+			t.Fatal(err)
+		}
+		if box.ChargeState() != mode {
+			t.Errorf("expected simulated box to be %s, got %s", mode, box.ChargeState())
+		}
+	}
+}
+
+func TestBox_FramedProtocol(t *testing.T) {
+	rb, box := testBox(t, "nimh-aa", "soc=1&firmware=v2")
+	defer rb.Conn.Close()
+
+	if err := rb.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if fw := rb.FirmwareVersion(); fw != "v2" {
+		t.Errorf("expected firmware \"v2\", got \"%s\"", fw)
+	}
+	if p := rb.Protocol(); p != regenbox.FramedProtocol {
+		t.Fatalf("expected protocol %d, got %d", regenbox.FramedProtocol, p)
+	}
+
+	led, err := rb.LedToggle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if led2, _ := rb.LedToggle(); led2 == led {
+		t.Error("wrong return value for LedToggle()")
+	}
+	if err = rb.SetCharge(); err != nil {
+		t.Fatal(err)
+	}
+	if cs := box.ChargeState(); cs != regenbox.Charging {
+		t.Errorf("expected charge state %s, got %s", regenbox.Charging, cs)
+	}
+	v, err := rb.ReadVoltage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != box.Voltage() {
+		t.Errorf("expected voltage %dmV, got %dmV", box.Voltage(), v)
+	}
+	if c := rb.Counters(); c.ChecksumErrors != 0 || c.StaleFrames != 0 {
+		t.Errorf("unexpected frame errors: %+v", c)
+	}
+}
+
+func TestBox_Modes(t *testing.T) {
+	for _, v := range []struct {
+		model  string
+		mode   regenbox.BotMode
+		soc    float64
+		target int
+	}{
+		{"nimh-aa", regenbox.Charger, 0.9, 1450},
+		{"nimh-aaa", regenbox.Discharger, 0.1, 1000},
+		{"alkaline-aa", regenbox.Charger, 0.8, 1550},
+		{"alkaline-aaa", regenbox.Discharger, 0.2, 1000},
+	} {
+		rb, box := testBox(t, v.model, fmt.Sprintf("speed=100000&soc=%f", v.soc))
+		cfg := regenbox.DefaultConfig
+		cfg.Mode = v.mode
+		cfg.TopVoltage = v.target
+		cfg.BottomVoltage = v.target
+		cfg.Ticker = util.Duration(time.Millisecond * 10)
+		cfg.UpDuration = util.Duration(time.Second * 5)
+		cfg.DownDuration = util.Duration(time.Second * 5)
+		_ = rb.SetConfig(&cfg)
+
+		err, snaps, msgs := rb.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var last regenbox.Snapshot
+	loop:
+		for {
+			select {
+			case last = <-snaps:
+			case msg := <-msgs:
+				if msg.Final {
+					if msg.Erronous {
+						t.Errorf("%s %s: %s", v.model, v.mode, msg.Status)
+					}
+					break loop
+				}
+			}
+		}
+		rb.Stop()
+
+		if v.mode == regenbox.Charger && last.Voltage < v.target ||
+			v.mode == regenbox.Discharger && last.Voltage > v.target {
+			t.Errorf("%s %s: last measure %dmV didn't reach %dmV", v.model, v.mode, last.Voltage, v.target)
+		}
+		if box.ChargeState() != regenbox.Idle {
+			t.Errorf("%s %s: box should be idle after completion, got %s", v.model, v.mode, box.ChargeState())
+		}
+		rb.Conn.Close()
+	}
+}
+
+func TestBox_Calibration(t *testing.T) {
+	// boxes read 2% low, calibration corrects it
+	var points []regenbox.CalibrationPoint
+	var rbs []*regenbox.RegenBox
+	var boxes []*Box
+	for _, soc := range []string{"0.05", "1"} {
+		rb, box := testBox(t, "nimh-aa", "aref=2459&soc="+soc)
+		defer rb.Conn.Close()
+		raw, err := rb.ReadRawVoltage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw >= box.Voltage()-20 {
+			t.Fatalf("expected box to read 2%% low, got %dmV for %dmV", raw, box.Voltage())
+		}
+		points = append(points, regenbox.CalibrationPoint{Raw: raw, Reference: box.Voltage()})
+		rbs, boxes = append(rbs, rb), append(boxes, box)
+	}
+	c, err := regenbox.FitCalibration(points, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, rb := range rbs {
+		rb.SetCalibration(c)
+		v, err := rb.ReadVoltage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := v - boxes[i].Voltage(); d < -1 || d > 1 {
+			t.Errorf("expected calibrated voltage %dmV, got %dmV (%s)", boxes[i].Voltage(), v, c)
+		}
+	}
+}
+
+func TestWithResistor(t *testing.T) {
+	for _, v := range []struct {
+		in, out string
+	}{
+		{"sim://nimh-aa", "sim://nimh-aa?resistor=4.7"},
+		{"sim://nimh-aa?speed=600", "sim://nimh-aa?resistor=4.7&speed=600"},
+		{"sim://nimh-aa?resistor=10", "sim://nimh-aa?resistor=10"},
+	} {
+		if s := WithResistor(v.in, 4.7); s != v.out {
+			t.Errorf("WithResistor(\"%s\"): expected \"%s\", got \"%s\"", v.in, v.out, s)
+		}
+	}
+}
+
+func TestBox_Flash(t *testing.T) {
+	rb, box := testBox(t, "nimh-aa", "")
+	defer func() { _ = rb.Conn.Close() }()
+
+	if fw := rb.FirmwareVersion(); fw != DefaultFirmware {
+		t.Fatalf("expected firmware \"%s\", got \"%s\"", DefaultFirmware, fw)
+	}
+	fw, err := rb.Flash(func(path string) error {
+		if path != box.Name {
+			t.Errorf("expected port %s, got %s", box.Name, path)
+		}
+		// box isn't locked while flashing
+		if st := rb.State(); st != regenbox.Disconnected {
+			t.Errorf("expected state %s while flashing, got %s", regenbox.Disconnected, st)
+		}
+		if err, _, _ := rb.Start(); err != regenbox.ErrFlashing {
+			t.Errorf("expected %s while flashing, got %v", regenbox.ErrFlashing, err)
+		}
+		if _, err := rb.Flash(func(string) error { return nil }); err != regenbox.ErrFlashing {
+			t.Errorf("expected %s while flashing, got %v", regenbox.ErrFlashing, err)
+		}
+		box.Firmware = "v2"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fw.Version != "v2" || rb.Protocol() != regenbox.FramedProtocol {
+		t.Errorf("expected framed firmware v2, got %+v (protocol %d)", fw, rb.Protocol())
+	}
+	if _, err = rb.ReadVoltage(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,27 @@
+package regenbox
+
+// Transport is the link between a RegenBox and its hardware (or anything
+// pretending to be). Each Write sends a raw instruction, and the following
+// Read returns its answer, stripped from protocol's StopByte.
+//
+// SerialConnection is the reference implementation.
+type Transport interface {
+	// Write sends b, returning any error that occured meanwhile.
+	Write(b []byte) error
+	// Read returns the next answer from the other end.
+	Read() ([]byte, error)
+	// Close terminates the connection, further calls to Read
+	// or Write must return an error (ErrClosedPort).
+	Close() error
+	// Closed is closed after a call to Close.
+	Closed() <-chan struct{}
+	// Path returns a human-readable address for the connection.
+	Path() string
+}
+
+// Reopener is an optional interface for Transports that are able to
+// restore a new connection to the same endpoint after being closed. When
+// a Transport doesn't implement Reopener, Watcher falls back to FindSerial.
+type Reopener interface {
+	Reopen() (Transport, error)
+}
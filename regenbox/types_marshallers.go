@@ -144,3 +144,46 @@ func (m *BotMode) UnmarshalText(b []byte) error {
 	}
 	return fmt.Errorf("unexpected error in UnmarshalText for '%s' (go generate?)", m)
 }
+
+// ---- type StepType byte
+
+func (st StepType) MarshalJSON() ([]byte, error) {
+	b, err := st.MarshalText()
+	if err == nil {
+		b = []byte(fmt.Sprintf("\"%s\"", string(b)))
+	}
+	return b, err
+}
+
+func (st *StepType) UnmarshalJSON(data []byte) error {
+	dataLength := len(data)
+	if data[0] != '"' || data[dataLength-1] != '"' {
+		return errors.New("StepType.UnmarshalJSON: Invalid JSON provided")
+	}
+	return st.UnmarshalText(data[1 : dataLength-1])
+}
+
+func (st StepType) MarshalText() ([]byte, error) {
+	return []byte(st.String()), nil
+}
+
+func (st *StepType) UnmarshalText(b []byte) error {
+	str := string(b)
+	idx := strings.Index(_StepType_name, str)
+	if idx < 0 {
+		i, err := strconv.Atoi(str)
+		if err == nil {
+			*st = StepType(i)
+			return nil
+		}
+		return fmt.Errorf("Cannot unmarshall \"%s\" to StepType. Is it mispelled?", str)
+	}
+
+	for i, v := range _StepType_index {
+		if int(v) == idx {
+			*st = StepType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected error in UnmarshalText for '%s' (go generate?)", st)
+}
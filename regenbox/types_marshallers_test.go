@@ -18,6 +18,7 @@ func TestTypesMarshallers(t *testing.T) {
 		s        State
 		ch       ChargeState
 		m        BotMode
+		st       StepType
 		expected string
 		b        []byte
 		err      error
@@ -48,6 +49,14 @@ func TestTypesMarshallers(t *testing.T) {
 		t.Error(err)
 	}
 	expect(t, "BotMode_MarshallJSON", string(b), string(expected))
+
+	st = StepType(StepRest)
+	expected = fmt.Sprintf("\"%s\"", st)
+	b, err = json.Marshal(st)
+	if err != nil {
+		t.Error(err)
+	}
+	expect(t, "StepType_MarshallJSON", string(b), string(expected))
 }
 
 func TestUnmarshallers(t *testing.T) {
@@ -55,6 +64,7 @@ func TestUnmarshallers(t *testing.T) {
 		s   State
 		ch  ChargeState
 		m   BotMode
+		st  StepType
 		b   *bytes.Buffer
 		dec *json.Decoder
 		err error
@@ -89,4 +99,14 @@ func TestUnmarshallers(t *testing.T) {
 	} else {
 		expect(t, "BotMode_UnmarshallJSON", m.String(), Charger.String())
 	}
+
+	b = new(bytes.Buffer)
+	b.WriteString("\"Discharge\"")
+	dec = json.NewDecoder(b)
+	err = dec.Decode(&st)
+	if err != nil {
+		t.Error(err)
+	} else {
+		expect(t, "StepType_UnmarshallJSON", st.String(), StepDischarge.String())
+	}
 }
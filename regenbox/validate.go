@@ -0,0 +1,143 @@
+package regenbox
+
+import (
+	"fmt"
+	"github.com/rkjdid/util"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxVoltage is the highest voltage a RegenBox measures (mV), its analog reference.
+const MaxVoltage = 2410
+
+// MinTicker is the shortest interval between measures.
+const MinTicker = util.Duration(time.Millisecond * 100)
+
+// FieldError is an invalid value of a config field.
+type FieldError struct {
+	Field   string // path of field, e.g. "Regenbox.TopVoltage"
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError lists invalid fields of a config, see Config.Validate.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+// Add adds an error on field.
+func (e *ValidationError) Add(field string, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Merge adds errors of err, a ValidationError, with their field prefixed by prefix.
+func (e *ValidationError) Merge(prefix string, err error) {
+	if err == nil {
+		return
+	}
+	ve, ok := err.(ValidationError)
+	if !ok {
+		e.Add(strings.TrimSuffix(prefix, "."), "%s", err)
+		return
+	}
+	for _, fe := range ve {
+		fe.Field = prefix + fe.Field
+		*e = append(*e, fe)
+	}
+}
+
+// Err returns e, or nil if it's empty.
+func (e ValidationError) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Chemistry holds safe voltage limits of a battery chemistry, per cell.
+type Chemistry struct {
+	Name       string
+	MinVoltage int // lowest voltage of discharges (mV)
+	MaxVoltage int // highest voltage of charges (mV)
+}
+
+// Chemistries are the known battery chemistries, by name.
+var Chemistries = map[string]Chemistry{
+	"alkaline": {Name: "alkaline", MinVoltage: 900, MaxVoltage: 1700},
+	"nicd":     {Name: "nicd", MinVoltage: 900, MaxVoltage: 1600},
+	"nimh":     {Name: "nimh", MinVoltage: 900, MaxVoltage: 1600},
+}
+
+// LookupChemistry returns the chemistry registered as name, case-insensitively.
+func LookupChemistry(name string) (Chemistry, bool) {
+	c, ok := Chemistries[strings.ToLower(name)]
+	return c, ok
+}
+
+// ChemistryNames returns names of known chemistries, sorted.
+func ChemistryNames() []string {
+	var names []string
+	for name := range Chemistries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks cfg, it returns a ValidationError listing its invalid fields.
+func (cfg *Config) Validate() error {
+	return cfg.ValidateFor(Chemistry{})
+}
+
+// ValidateFor checks cfg like Validate does, and that its voltages
+// are within limits of chem, unless it's the zero Chemistry.
+func (cfg *Config) ValidateFor(chem Chemistry) error {
+	var errs ValidationError
+	if cfg.Mode > Profiler {
+		errs.Add("Mode", "unknown mode %d, expected Charger, Discharger, Cycler or Profiler", cfg.Mode)
+	}
+
+	if cfg.TopVoltage <= 0 || cfg.TopVoltage > MaxVoltage {
+		errs.Add("TopVoltage", "must be between 1 and %dmV, got %dmV", MaxVoltage, cfg.TopVoltage)
+	} else if chem.Name != "" && cfg.TopVoltage > chem.MaxVoltage {
+		errs.Add("TopVoltage", "%dmV is above %dmV, the maximum charge voltage of %s batteries",
+			cfg.TopVoltage, chem.MaxVoltage, chem.Name)
+	}
+	if cfg.BottomVoltage <= 0 {
+		errs.Add("BottomVoltage", "must be positive, got %dmV", cfg.BottomVoltage)
+	} else if cfg.BottomVoltage >= cfg.TopVoltage {
+		errs.Add("BottomVoltage", "must be below TopVoltage (%dmV), got %dmV", cfg.TopVoltage, cfg.BottomVoltage)
+	} else if chem.Name != "" && cfg.BottomVoltage < chem.MinVoltage {
+		errs.Add("BottomVoltage", "%dmV is below %dmV, the minimum discharge voltage of %s batteries",
+			cfg.BottomVoltage, chem.MinVoltage, chem.Name)
+	}
+
+	if cfg.NbHalfCycles < 0 {
+		errs.Add("NbHalfCycles", "must not be negative, got %d", cfg.NbHalfCycles)
+	} else if cfg.NbHalfCycles == 0 && cfg.Mode == Cycler {
+		errs.Add("NbHalfCycles", "must be at least 1 in Cycler mode")
+	}
+	if cfg.UpDuration <= 0 {
+		errs.Add("UpDuration", "must be positive, got %s", cfg.UpDuration)
+	}
+	if cfg.DownDuration <= 0 {
+		errs.Add("DownDuration", "must be positive, got %s", cfg.DownDuration)
+	}
+	if cfg.Ticker < MinTicker {
+		errs.Add("Ticker", "must be at least %s, got %s", MinTicker, cfg.Ticker)
+	}
+	if cfg.Mode == Profiler && cfg.Profile == "" {
+		errs.Add("Profile", "must be set in Profiler mode")
+	}
+	return errs.Err()
+}
@@ -0,0 +1,90 @@
+package regenbox
+
+import (
+	"github.com/rkjdid/util"
+	"sort"
+	"testing"
+	"time"
+)
+
+// fields returns invalid fields of err, sorted.
+func fields(t *testing.T, err error) []string {
+	if err == nil {
+		return nil
+	}
+	ve, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("expected a ValidationError, got %T: %s", err, err)
+	}
+	var names []string
+	for _, fe := range ve {
+		names = append(names, fe.Field)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestConfig_Validate(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		set    func(cfg *Config)
+		chem   string
+		fields []string
+	}{
+		{"default", func(cfg *Config) {}, "", nil},
+		{"top below bottom", func(cfg *Config) { cfg.TopVoltage, cfg.BottomVoltage = 1000, 1200 }, "", []string{"BottomVoltage"}},
+		{"top above reference", func(cfg *Config) { cfg.TopVoltage = 3000 }, "", []string{"TopVoltage"}},
+		{"no half-cycle in Cycler mode", func(cfg *Config) { cfg.Mode, cfg.NbHalfCycles = Cycler, 0 }, "", []string{"NbHalfCycles"}},
+		{"no half-cycle in Charger mode", func(cfg *Config) { cfg.NbHalfCycles = 0 }, "", nil},
+		{"negative ticker", func(cfg *Config) { cfg.Ticker = util.Duration(-time.Second) }, "", []string{"Ticker"}},
+		{"short ticker", func(cfg *Config) { cfg.Ticker = util.Duration(time.Millisecond) }, "", []string{"Ticker"}},
+		{"durations", func(cfg *Config) { cfg.UpDuration, cfg.DownDuration = 0, 0 }, "", []string{"DownDuration", "UpDuration"}},
+		{"no profile", func(cfg *Config) { cfg.Mode = Profiler }, "", []string{"Profile"}},
+		{"unknown mode", func(cfg *Config) { cfg.Mode = BotMode(9) }, "", []string{"Mode"}},
+		{"nimh overcharge", func(cfg *Config) { cfg.TopVoltage = 1700 }, "nimh", []string{"TopVoltage"}},
+		{"nimh deep discharge", func(cfg *Config) { cfg.BottomVoltage = 800 }, "NiMH", []string{"BottomVoltage"}},
+		{"alkaline", func(cfg *Config) { cfg.TopVoltage = 1700 }, "alkaline", nil},
+	} {
+		cfg := NewConfig()
+		test.set(cfg)
+		var err error
+		if test.chem == "" {
+			err = cfg.Validate()
+		} else {
+			chem, ok := LookupChemistry(test.chem)
+			if !ok {
+				t.Fatalf("%s: unknown chemistry %s", test.name, test.chem)
+			}
+			err = cfg.ValidateFor(chem)
+		}
+		got := fields(t, err)
+		if len(got) != len(test.fields) {
+			t.Errorf("%s: expected invalid fields %v, got %v (%v)", test.name, test.fields, got, err)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.fields[i] {
+				t.Errorf("%s: expected invalid fields %v, got %v (%v)", test.name, test.fields, got, err)
+				break
+			}
+		}
+	}
+}
+
+func TestValidationError_Merge(t *testing.T) {
+	cfg := NewConfig()
+	cfg.TopVoltage = 0
+	var errs ValidationError
+	errs.Add("Resistor", "must be positive")
+	errs.Merge("Regenbox.", cfg.Validate())
+	errs.Merge("Regenbox.", nil)
+
+	expected := "invalid config: Resistor: must be positive; Regenbox.TopVoltage: must be between 1 and 2410mV, got 0mV; " +
+		"Regenbox.BottomVoltage: must be below TopVoltage (0mV), got 900mV"
+	if errs.Error() != expected {
+		t.Errorf("expected \"%s\", got \"%s\"", expected, errs.Error())
+	}
+	if (ValidationError{}).Err() != nil {
+		t.Error("expected nil error from empty ValidationError")
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"github.com/rkjdid/util"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Watcher struct {
 	rbox   *RegenBox
-	cfg    *WatcherConfig
+	cfg    WatcherConfig
+	cfgMu  sync.Mutex
 	stopCh chan struct{}
 	wg     sync.WaitGroup
 }
@@ -28,10 +30,24 @@ func NewWatcher(box *RegenBox, cfg *WatcherConfig) *Watcher {
 	}
 	return &Watcher{
 		rbox: box,
-		cfg:  cfg,
+		cfg:  *cfg,
 	}
 }
 
+// Config returns current config of w.
+func (w *Watcher) Config() WatcherConfig {
+	w.cfgMu.Lock()
+	defer w.cfgMu.Unlock()
+	return w.cfg
+}
+
+// SetConfig sets config of w, it applies from next poll on.
+func (w *Watcher) SetConfig(cfg WatcherConfig) {
+	w.cfgMu.Lock()
+	w.cfg = cfg
+	w.cfgMu.Unlock()
+}
+
 func (w *Watcher) Stop() {
 	if w.stopCh == nil {
 		return
@@ -52,42 +68,44 @@ func (w *Watcher) WatchConn() {
 		)
 		for {
 			select {
-			case <-time.After(time.Duration(w.cfg.ConnPollRate)):
+			case <-time.After(time.Duration(w.Config().ConnPollRate)):
 			case <-w.stopCh:
 				w.stopCh = nil
 				return
 			}
 
 			w.rbox.Lock()
+			if w.rbox.flashing {
+				// device belongs to flasher until it's done
+				w.rbox.Unlock()
+				continue
+			}
 			err = w.rbox.ping()
 			if err != nil && st == Connected {
-				log.Printf("closing serial connection to \"%s\": %s", w.rbox.Conn.path, err)
+				log.Printf("closing serial connection to \"%s\": %s", w.rbox.Conn.Path(), err)
 				w.rbox.Conn.Close()
 			}
 
-			switch st = w.rbox.State(); st {
+			switch st = w.rbox.state; st {
 			case Connected:
 			// pass
 			default:
-				var conn *SerialConnection
-				if w.rbox.Conn != nil && w.rbox.Conn.locked {
-					port, cfg, err := OpenPortName(w.rbox.Conn.path)
-					if port == nil || err != nil {
-						// high-verbosity log
-						break
-					}
-					conn = NewSerial(port, cfg, w.rbox.Conn.path, true)
+				var conn Transport
+				if r, ok := w.rbox.Conn.(Reopener); ok {
+					conn, err = r.Reopen()
 				} else {
 					conn, err = FindSerial(nil)
-					if err != nil {
-						// high-verbosity log
-						break
-					}
+				}
+				if err != nil {
+					// high-verbosity log
+					break
 				}
 
 				w.rbox.Conn = conn
 				w.rbox.state = Connected
+				w.rbox.resetFirmware()
 				st = Connected
+				atomic.AddUint64(&w.rbox.counters.Reconnections, 1)
 
 				// Restore current charge state.
 				// If that fails here, rb.doCycle will
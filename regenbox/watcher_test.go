@@ -0,0 +1,51 @@
+package regenbox
+
+import (
+	"errors"
+	"github.com/rkjdid/util"
+	"go.bug.st/serial.v1"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatcher_ClosedSerial(t *testing.T) {
+	var opened int32
+	RegisterPortOpener("fakewatch", func(name string, mode *serial.Mode) (serial.Port, error) {
+		// device is unplugged on first attempt
+		if atomic.AddInt32(&opened, 1) == 1 {
+			return nil, errors.New("no such device")
+		}
+		return newFakePort(1200), nil
+	})
+
+	conn := NewClosedSerial("fakewatch://box", DefaultSerialConfig)
+	rbx, err := NewRegenBox(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rbx.State() != Disconnected {
+		t.Fatalf("expected state %s, got %s", Disconnected, rbx.State())
+	}
+	if err = conn.Close(); err != ErrClosedPort {
+		t.Errorf("expected %s, got %v", ErrClosedPort, err)
+	}
+
+	w := NewWatcher(rbx, &WatcherConfig{ConnPollRate: util.Duration(time.Millisecond * 10)})
+	w.WatchConn()
+	defer w.Stop()
+
+	deadline := time.Now().Add(time.Second * 2)
+	for rbx.State() != Connected {
+		if time.Now().After(deadline) {
+			t.Fatalf("box not reconnected after %d attempts, state %s", atomic.LoadInt32(&opened), rbx.State())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := atomic.LoadInt32(&opened); n < 2 {
+		t.Errorf("expected at least 2 open attempts, got %d", n)
+	}
+	if rbx.Snapshot().Voltage != 1200 {
+		t.Errorf("expected voltage 1200, got %d", rbx.Snapshot().Voltage)
+	}
+}
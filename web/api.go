@@ -0,0 +1,473 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/regenbox"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIPrefix is the root of current REST API version.
+const APIPrefix = "/api/v1"
+
+// Pagination of chart log listings.
+const (
+	APIDefaultLimit = 50
+	APIMaxLimit     = 500
+)
+
+// APIError is the body of every failed API request.
+type APIError struct {
+	Status int                   // http status code
+	Error  string                // what went wrong
+	Fields []regenbox.FieldError `json:",omitempty"` // invalid fields, when config is rejected
+}
+
+// APIInfo describes goregen server.
+type APIInfo struct {
+	Version string
+	Boxes   []string // Id of every box
+}
+
+// APIBox is a box, its last snapshot & running session.
+type APIBox struct {
+	Id       string
+	Device   string // serial port, or simulator url
+	Snapshot regenbox.Snapshot
+	Session  *APISession `json:",omitempty"` // running session, if any
+}
+
+// APISession is the session running on a box.
+type APISession struct {
+	CycleType   string
+	Profile     string                 `json:",omitempty"` // name of profile, in Profiler mode
+	Started     time.Time              // when session was first started
+	Paused      bool                   //
+	Progress    regenbox.Progress      // current step & measured capacity
+	LastMessage *regenbox.CycleMessage `json:",omitempty"` // last cycle message of box
+}
+
+// APIBoxConfig is the configuration of a box, only provided values are changed on PATCH.
+type APIBoxConfig struct {
+	Battery  Battery
+	Resistor util.Float
+	Regenbox regenbox.Config
+}
+
+// APIFirmware describes firmware of a box.
+type APIFirmware struct {
+	Version         string // empty if box isn't connected
+	Protocol        int    // 0 for single byte protocol, 2 for framed protocol
+	State           regenbox.State
+	Known           bool     // registered version, capabilities are guessed otherwise
+	Features        []string // supported features, in plain words
+	Commands        []string // supported instructions
+	AnalogScale     float64  // mV per unit of raw analog reads, 0 if unknown
+	AveragedVoltage bool     // voltage is an average of several reads
+	AutoAref        bool     // analog reference is measured by firmware
+}
+
+// APIChartLog summarizes a saved chart log, without its measures.
+type APIChartLog struct {
+	Name      string // file name, identifies chart log in urls
+	StartTime time.Time
+	EndTime   time.Time
+	Interval  util.Duration // between two measures
+	Header    ChartLogHeader
+}
+
+// APIChartLogPage is a page of chart logs, most recent first.
+type APIChartLogPage struct {
+	Total  int // number of chart logs of box
+	Offset int
+	Limit  int
+	Items  []APIChartLog
+}
+
+// writeJSON encodes v as json body of a response with status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v == nil {
+		return
+	}
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("api: error encoding response:", err)
+	}
+}
+
+// apiError writes an APIError with status & formatted message.
+func apiError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, APIError{Status: status, Error: fmt.Sprintf(format, args...)})
+}
+
+// apiBox returns the box of {id} route variable, an error is written to w if there is none.
+func (s *Server) apiBox(w http.ResponseWriter, r *http.Request) (*Box, bool) {
+	id := mux.Vars(r)["id"]
+	b, err := s.Boxes.Get(id)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "%s \"%s\"", err, id)
+		return nil, false
+	}
+	return b, true
+}
+
+func (s *Server) apiBoxResource(b *Box) APIBox {
+	return APIBox{
+		Id:       b.Id,
+		Device:   b.Config().Device,
+		Snapshot: b.Regenbox.Snapshot(),
+		Session:  apiSession(b),
+	}
+}
+
+// apiSession returns running session of b, or nil.
+func apiSession(b *Box) *APISession {
+	sess := b.Session()
+	if sess == nil {
+		return nil
+	}
+	as := &APISession{
+		CycleType:   cycleType(sess.Config.Mode),
+		Started:     sess.Measures.Start,
+		Paused:      b.Regenbox.Paused(),
+		Progress:    b.Regenbox.Progress(),
+		LastMessage: b.CycleMessage(),
+	}
+	if sess.Profile != nil {
+		as.Profile = sess.Profile.Name
+	}
+	return as
+}
+
+// APIInfo GET /api/v1
+func (s *Server) APIInfo(w http.ResponseWriter, r *http.Request) {
+	info := APIInfo{Version: s.Config.Web.version, Boxes: []string{}}
+	for _, b := range s.Boxes.List() {
+		info.Boxes = append(info.Boxes, b.Id)
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// APIBoxes GET /api/v1/boxes
+func (s *Server) APIBoxes(w http.ResponseWriter, r *http.Request) {
+	boxes := []APIBox{}
+	for _, b := range s.Boxes.List() {
+		boxes = append(boxes, s.apiBoxResource(b))
+	}
+	writeJSON(w, http.StatusOK, boxes)
+}
+
+// APIBox GET /api/v1/boxes/{id}
+func (s *Server) APIBox(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.apiBox(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.apiBoxResource(b))
+}
+
+// APISnapshot GET /api/v1/boxes/{id}/snapshot
+func (s *Server) APISnapshot(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.apiBox(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, b.Regenbox.Snapshot())
+}
+
+// APIFirmware GET /api/v1/boxes/{id}/firmware
+func (s *Server) APIFirmware(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.apiBox(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, apiFirmware(b, b.Regenbox.Firmware()))
+}
+
+// APIConfig GET & PATCH /api/v1/boxes/{id}/config, PATCH saves config file if ?save=true.
+func (s *Server) APIConfig(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.apiBox(w, r)
+	if !ok {
+		return
+	}
+	bc := b.Config()
+	if r.Method == http.MethodPatch {
+		// decode over current config, only provided values are changed
+		cfg := APIBoxConfig{Battery: bc.Battery, Resistor: bc.Resistor, Regenbox: bc.Regenbox}
+		err := json.NewDecoder(r.Body).Decode(&cfg)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "couldn't decode config: %s", err)
+			return
+		}
+		bc.Battery, bc.Resistor, bc.Regenbox = cfg.Battery, cfg.Resistor, cfg.Regenbox
+		save, _ := strconv.ParseBool(r.URL.Query().Get("save"))
+		err = s.setBoxConfig(b, bc, save)
+		if ve, ok := err.(regenbox.ValidationError); ok {
+			writeJSON(w, http.StatusUnprocessableEntity, APIError{
+				Status: http.StatusUnprocessableEntity, Error: ve.Error(), Fields: ve})
+			return
+		} else if err == regenbox.ErrBoxRunning {
+			apiError(w, http.StatusConflict, "box must be stopped first")
+			return
+		} else if err != nil {
+			apiError(w, http.StatusUnprocessableEntity, "%s", err)
+			return
+		}
+		bc = b.Config()
+	}
+	writeJSON(w, http.StatusOK, APIBoxConfig{Battery: bc.Battery, Resistor: bc.Resistor, Regenbox: bc.Regenbox})
+}
+
+// APISession GET /api/v1/boxes/{id}/session
+func (s *Server) APISession(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.apiBox(w, r)
+	if !ok {
+		return
+	}
+	sess := apiSession(b)
+	if sess == nil {
+		apiError(w, http.StatusNotFound, "no session running on box \"%s\"", b.Id)
+		return
+	}
+	writeJSON(w, http.StatusOK, sess)
+}
+
+// APIStartSession POST /api/v1/boxes/{id}/session
+func (s *Server) APIStartSession(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.apiBox(w, r)
+	if !ok {
+		return
+	}
+	if !b.Regenbox.Stopped() {
+		apiError(w, http.StatusConflict, "%s", regenbox.ErrBoxRunning)
+		return
+	}
+	err := s.loadProfile(b)
+	if err != nil {
+		apiError(w, http.StatusUnprocessableEntity, "%s", err)
+		return
+	}
+	err = s.startSession(b, NewSession(b, s.liveConfig().User))
+	if err == regenbox.ErrBoxRunning {
+		apiError(w, http.StatusConflict, "%s", err)
+		return
+	} else if err != nil {
+		apiError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, apiSession(b))
+}
+
+// APIStopSession DELETE /api/v1/boxes/{id}/session
+func (s *Server) APIStopSession(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.apiBox(w, r)
+	if !ok {
+		return
+	}
+	if b.Regenbox.Stopped() {
+		apiError(w, http.StatusNotFound, "no session running on box \"%s\"", b.Id)
+		return
+	}
+	b.Regenbox.Stop()
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+// APIPauseSession POST /api/v1/boxes/{id}/session/pause
+func (s *Server) APIPauseSession(w http.ResponseWriter, r *http.Request) {
+	s.apiSetPaused(w, r, true)
+}
+
+// APIResumeSession POST /api/v1/boxes/{id}/session/resume
+func (s *Server) APIResumeSession(w http.ResponseWriter, r *http.Request) {
+	s.apiSetPaused(w, r, false)
+}
+
+func (s *Server) apiSetPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	b, ok := s.apiBox(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	if paused {
+		err = b.Regenbox.Pause()
+	} else {
+		err = b.Regenbox.Resume()
+	}
+	if err == regenbox.ErrBoxStopped {
+		apiError(w, http.StatusNotFound, "no session running on box \"%s\"", b.Id)
+		return
+	} else if err != nil {
+		apiError(w, http.StatusConflict, "%s", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiSession(b))
+}
+
+// ChartLogSummaries lists chart logs in dir, most recent first.
+func ChartLogSummaries(dir string) ([]APIChartLog, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	logs := []APIChartLog{}
+	for _, fi := range files {
+		if fi.IsDir() || isSessionFile(fi.Name()) {
+			continue
+		}
+		var cl ChartLog
+		err = util.ReadTomlFile(&cl, filepath.Join(dir, fi.Name()))
+		if err != nil {
+			log.Printf("error parsing chart log: %s", err)
+			continue
+		}
+		logs = append(logs, APIChartLog{
+			Name:      fi.Name(),
+			StartTime: cl.Measures.Start,
+			EndTime:   cl.Measures.End,
+			Interval:  cl.Measures.Interval,
+			Header:    cl.Header(),
+		})
+	}
+	sort.SliceStable(logs, func(i, j int) bool {
+		return logs[i].StartTime.After(logs[j].StartTime)
+	})
+	return logs, nil
+}
+
+// queryInt returns int value of query parameter key, def if unset.
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s \"%s\", expected a positive integer", key, v)
+	}
+	return n, nil
+}
+
+// APIChartLogs GET /api/v1/boxes/{id}/chartlogs?offset=&limit=
+func (s *Server) APIChartLogs(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.apiBox(w, r)
+	if !ok {
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	limit, err := queryInt(r, "limit", APIDefaultLimit)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if limit == 0 || limit > APIMaxLimit {
+		limit = APIMaxLimit
+	}
+
+	logs, err := ChartLogSummaries(b.DataDir())
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "couldn't list chart logs: %s", err)
+		return
+	}
+	page := APIChartLogPage{Total: len(logs), Offset: offset, Limit: limit, Items: []APIChartLog{}}
+	if offset < len(logs) {
+		end := offset + limit
+		if end > len(logs) {
+			end = len(logs)
+		}
+		page.Items = logs[offset:end]
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// apiChartLog reads chart log {name} of box {id}, an error is written to w if it fails.
+func (s *Server) apiChartLog(w http.ResponseWriter, r *http.Request) (*ChartLog, string, bool) {
+	b, ok := s.apiBox(w, r)
+	if !ok {
+		return nil, "", false
+	}
+	name := mux.Vars(r)["name"]
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") || isSessionFile(name) {
+		apiError(w, http.StatusNotFound, "no chart log \"%s\"", name)
+		return nil, "", false
+	}
+	var cl ChartLog
+	err := util.ReadTomlFile(&cl, filepath.Join(b.DataDir(), name))
+	if os.IsNotExist(err) {
+		apiError(w, http.StatusNotFound, "no chart log \"%s\"", name)
+		return nil, "", false
+	} else if err != nil {
+		apiError(w, http.StatusInternalServerError, "couldn't read chart log \"%s\": %s", name, err)
+		return nil, "", false
+	}
+	return &cl, name, true
+}
+
+// APIChartLog GET /api/v1/boxes/{id}/chartlogs/{name}
+func (s *Server) APIChartLog(w http.ResponseWriter, r *http.Request) {
+	cl, _, ok := s.apiChartLog(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, cl)
+}
+
+// APIChartLogExport GET /api/v1/boxes/{id}/chartlogs/{name}/export?format=
+func (s *Server) APIChartLogExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportCSV
+	}
+	if !IsExportFormat(format) {
+		apiError(w, http.StatusBadRequest, "unknown export format \"%s\", expected one of %s",
+			format, strings.Join(ExportFormats, ", "))
+		return
+	}
+	cl, name, ok := s.apiChartLog(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", ExportContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", ExportFileName(name, format)))
+	err := cl.Export(w, format)
+	if err != nil {
+		log.Printf("api: error exporting %s: %s", name, err)
+	}
+}
+
+// APIProfiles GET /api/v1/profiles
+func (s *Server) APIProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, errs := regenbox.ListProfiles(s.liveConfig().Web.ProfilesDir)
+	for _, err := range errs {
+		log.Println("error loading profile:", err)
+	}
+	if profiles == nil {
+		profiles = []*regenbox.Profile{}
+	}
+	writeJSON(w, http.StatusOK, profiles)
+}
+
+// APIOpenAPI GET /api/v1/openapi.json
+func (s *Server) APIOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.openAPI)
+}
+
+// apiNotFound answers unknown API urls.
+func apiNotFound(w http.ResponseWriter, r *http.Request) {
+	apiError(w, http.StatusNotFound, "no such endpoint %s %s", r.Method, r.URL.Path)
+}
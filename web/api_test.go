@@ -0,0 +1,261 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/rkjdid/util"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// api sends method on path of API, and decodes its json response to v (if not nil).
+// Test fails unless response has status.
+func (ts *testServer) api(t *testing.T, method string, path string, body string, status int, v interface{}) {
+	t.Helper()
+	resp, data := ts.request(t, method, APIPrefix+path, body, "Content-Type", "application/json")
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: expected status %d, got %d: %s", method, path, status, resp.StatusCode, data)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("%s %s: unexpected content type \"%s\"", method, path, ct)
+	}
+	if v == nil {
+		return
+	}
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		t.Fatalf("%s %s: invalid response %s: %s", method, path, data, err)
+	}
+}
+
+func TestAPI_Errors(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.Close()
+	box := "/boxes/" + testBox
+	for _, test := range []struct {
+		method, path, body string
+		status             int
+		fields             []string // expected invalid fields
+	}{
+		{"GET", "/nope", "", http.StatusNotFound, nil},
+		{"PUT", "/boxes", "", http.StatusMethodNotAllowed, nil},
+		{"GET", "/boxes/nope", "", http.StatusNotFound, nil},
+		{"GET", box + "/session", "", http.StatusNotFound, nil},
+		{"DELETE", box + "/session", "", http.StatusNotFound, nil},
+		{"POST", box + "/session/pause", "", http.StatusNotFound, nil},
+		{"PATCH", box + "/config", `{"Regenbox": `, http.StatusBadRequest, nil},
+		{"PATCH", box + "/config", `{"Regenbox": {"TopVoltage": 99999, "Ticker": "0s"}}`, http.StatusUnprocessableEntity,
+			[]string{"Regenbox.TopVoltage", "Regenbox.Ticker"}},
+		{"GET", box + "/chartlogs?offset=-1", "", http.StatusBadRequest, nil},
+		{"GET", box + "/chartlogs?limit=ten", "", http.StatusBadRequest, nil},
+		{"GET", box + "/chartlogs/nope.log", "", http.StatusNotFound, nil},
+		{"GET", box + "/chartlogs/" + SessionFile, "", http.StatusNotFound, nil},
+		{"GET", box + "/chartlogs/.config.toml", "", http.StatusNotFound, nil},
+		{"GET", box + "/chartlogs/nope.log/export?format=xml", "", http.StatusBadRequest, nil},
+	} {
+		var apiErr APIError
+		ts.api(t, test.method, test.path, test.body, test.status, &apiErr)
+		if apiErr.Status != test.status || apiErr.Error == "" {
+			t.Errorf("%s %s: unexpected error %+v", test.method, test.path, apiErr)
+		}
+		if len(apiErr.Fields) != len(test.fields) {
+			t.Errorf("%s %s: expected fields %v, got %+v", test.method, test.path, test.fields, apiErr.Fields)
+			continue
+		}
+		for i, f := range apiErr.Fields {
+			if f.Field != test.fields[i] {
+				t.Errorf("%s %s: expected field %s, got %+v", test.method, test.path, test.fields[i], f)
+			}
+		}
+	}
+}
+
+func TestAPI_Session(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.Close()
+	box := "/boxes/" + testBox
+
+	var info APIInfo
+	ts.api(t, "GET", "", "", http.StatusOK, &info)
+	if info.Version != "test" || len(info.Boxes) != 1 || info.Boxes[0] != testBox {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	var cfg APIBoxConfig
+	ts.api(t, "PATCH", box+"/config", `{"Regenbox": {"Mode": "Discharger"}}`, http.StatusOK, &cfg)
+	if cfg.Regenbox.Mode.String() != "Discharger" || cfg.Resistor != 4 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	var sess APISession
+	ts.api(t, "POST", box+"/session", "", http.StatusCreated, &sess)
+	if sess.CycleType != "Discharge" || sess.Started.IsZero() || sess.Paused {
+		t.Errorf("unexpected session %+v", sess)
+	}
+	ts.api(t, "POST", box+"/session", "", http.StatusConflict, nil)
+	ts.api(t, "PATCH", box+"/config", `{"Resistor": 10}`, http.StatusConflict, nil)
+
+	var apiBox APIBox
+	ts.api(t, "GET", box, "", http.StatusOK, &apiBox)
+	if apiBox.Id != testBox || apiBox.Session == nil || !apiBox.Snapshot.Running {
+		t.Errorf("unexpected box %+v", apiBox)
+	}
+
+	ts.api(t, "POST", box+"/session/pause", "", http.StatusOK, &sess)
+	if !sess.Paused {
+		t.Error("session should be paused")
+	}
+	ts.api(t, "POST", box+"/session/resume", "", http.StatusOK, &sess)
+	if sess.Paused {
+		t.Error("session should be resumed")
+	}
+
+	// wait for a few measures, so that a chart log is saved
+	time.Sleep(time.Millisecond * 350)
+	resp, data := ts.request(t, "DELETE", APIPrefix+box+"/session", "")
+	if resp.StatusCode != http.StatusNoContent || len(data) != 0 {
+		t.Fatalf("unexpected stop response %s: %s", resp.Status, data)
+	}
+	var page APIChartLogPage
+	for i := 0; i < 20 && page.Total == 0; i++ {
+		time.Sleep(time.Millisecond * 50)
+		ts.api(t, "GET", box+"/chartlogs", "", http.StatusOK, &page)
+	}
+	if page.Total != 1 || page.Items[0].Header.Reason == "" {
+		t.Fatalf("expected chart log of stopped session, got %+v", page)
+	}
+	var cl ChartLog
+	ts.api(t, "GET", box+"/chartlogs/"+page.Items[0].Name, "", http.StatusOK, &cl)
+	if len(cl.Measures.Data) == 0 || cl.CycleType != "Discharge" {
+		t.Errorf("unexpected %s chart log of %d measures", cl.CycleType, len(cl.Measures.Data))
+	}
+}
+
+func TestAPI_ChartLogs(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.Close()
+	box := "/boxes/" + testBox
+	b, _ := ts.srv.Boxes.Get(testBox)
+
+	// chart logs started every hour, in random order
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var names []string
+	for _, h := range []int{3, 0, 4, 1, 2} {
+		cl := &ChartLog{Resistor: 4, CycleType: "Discharge"}
+		cl.Measures.Data = []int{1200, 1190}
+		cl.Measures.Interval = util.Duration(time.Second)
+		cl.Measures.Start = start.Add(time.Duration(h) * time.Hour)
+		cl.Measures.End = cl.Measures.Start.Add(time.Second)
+		err := util.WriteTomlFile(cl, filepath.Join(b.DataDir(), cl.FileName()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, cl.FileName())
+	}
+
+	for _, test := range []struct {
+		query string
+		limit int
+		hours []int // of returned logs
+	}{
+		{"", APIDefaultLimit, []int{4, 3, 2, 1, 0}},
+		{"?limit=2", 2, []int{4, 3}},
+		{"?offset=2&limit=2", 2, []int{2, 1}},
+		{"?offset=4", APIDefaultLimit, []int{0}},
+		{"?offset=10", APIDefaultLimit, []int{}},
+		{"?limit=0", APIMaxLimit, []int{4, 3, 2, 1, 0}},
+		{"?limit=100000", APIMaxLimit, []int{4, 3, 2, 1, 0}},
+	} {
+		var page APIChartLogPage
+		ts.api(t, "GET", box+"/chartlogs"+test.query, "", http.StatusOK, &page)
+		if page.Total != 5 || page.Limit != test.limit || page.Items == nil || len(page.Items) != len(test.hours) {
+			t.Errorf("%s: unexpected page %+v", test.query, page)
+			continue
+		}
+		for i, h := range test.hours {
+			if !page.Items[i].StartTime.Equal(start.Add(time.Duration(h) * time.Hour)) {
+				t.Errorf("%s: expected log started at %dh in position %d, got %s", test.query, h, i, page.Items[i].StartTime)
+			}
+		}
+	}
+
+	resp, data := ts.request(t, "GET", APIPrefix+box+"/chartlogs/"+names[0]+"/export?format=tsv", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != ExportContentType(ExportTSV) {
+		t.Fatalf("unexpected export %s (%s)", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	if cd := resp.Header.Get("Content-Disposition"); !strings.Contains(cd, ExportFileName(names[0], ExportTSV)) {
+		t.Errorf("unexpected Content-Disposition \"%s\"", cd)
+	}
+	if !strings.Contains(string(data), strings.Join(exportColumns, "\t")) {
+		t.Errorf("export misses columns:\n%s", data)
+	}
+}
+
+// TestAPI_OpenAPI checks that openapi.json documents every route of the API, and only them.
+func TestAPI_OpenAPI(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.Close()
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage
+		Components struct {
+			Schemas map[string]json.RawMessage
+		}
+	}
+	ts.api(t, "GET", "/openapi.json", "", http.StatusOK, &doc)
+
+	documented := make(map[string]bool)
+	for path, item := range doc.Paths {
+		for method := range item {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+	routed := make(map[string]bool)
+	err := ts.srv.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, APIPrefix) {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path = strings.TrimPrefix(path, APIPrefix)
+		if path == "" {
+			path = "/"
+		}
+		for _, m := range methods {
+			if m != "HEAD" {
+				routed[m+" "+path] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for op := range routed {
+		if !documented[op] {
+			t.Errorf("%s isn't documented", op)
+		}
+	}
+	for op := range documented {
+		if !routed[op] {
+			t.Errorf("%s is documented but isn't routed", op)
+		}
+	}
+
+	// every referenced schema is described
+	raw, _ := json.Marshal(doc.Paths)
+	for _, s := range doc.Components.Schemas {
+		raw = append(raw, s...)
+	}
+	for _, ref := range strings.Split(string(raw), `"$ref":"#/components/schemas/`)[1:] {
+		name := ref[:strings.IndexByte(ref, '"')]
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("schema %s is referenced but not described", name)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package web
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestAssets checks that assets.go is up to date with static folder, see README.md.
+func TestAssets(t *testing.T) {
+	onDisk := make(map[string]bool)
+	err := filepath.Walk("static", func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			// e.g. lib/ links to node_modules, which isn't installed
+			t.Logf("skipping %s: %s", path, err)
+			return nil
+		}
+		name := filepath.ToSlash(path)
+		onDisk[name] = true
+		asset, err := Asset(name)
+		if err != nil {
+			t.Errorf("%s isn't embedded, run go generate", name)
+		} else if !bytes.Equal(asset, data) {
+			t.Errorf("embedded %s is outdated, run go generate", name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range AssetNames() {
+		if _, err := os.Lstat(filepath.FromSlash(name)); err != nil {
+			t.Errorf("%s is embedded but was removed, run go generate", name)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/rkjdid/util"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role grants access to endpoints, each role is granted access of lower roles.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // read-only access
+	RoleOperator Role = "operator" // start, stop, pause & configure boxes
+)
+
+var roleLevels = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+}
+
+const sessionCookie = "goregen_session"
+
+// AuthConfig configures authentication of web interface, which is
+// disabled if there is neither a PasswordFile nor Tokens.
+type AuthConfig struct {
+	PasswordFile string        // one "name:bcrypt hash:role" line per user, see goregen passwd
+	Tokens       []TokenConfig `toml:",omitempty"`
+	SessionTTL   util.Duration // lifetime of login sessions
+}
+
+// TokenConfig is an API token, sent in "Authorization: Bearer <token>" headers.
+type TokenConfig struct {
+	Name string
+	Role Role
+	Hash string // hex encoded sha256 of token, see goregen token
+}
+
+var DefaultAuthConfig = AuthConfig{
+	SessionTTL: util.Duration(time.Hour * 24 * 7),
+}
+
+// Identity is an authenticated user or token.
+type Identity struct {
+	Name string
+	Role Role
+}
+
+type identityKey struct{}
+
+// Enabled is true if authentication is configured.
+func (cfg AuthConfig) Enabled() bool {
+	return cfg.PasswordFile != "" || len(cfg.Tokens) > 0
+}
+
+// Valid returns an error if r isn't a known role.
+func (r Role) Valid() error {
+	if _, ok := roleLevels[r]; !ok {
+		return fmt.Errorf("unknown role \"%s\", expected %s or %s", r, RoleViewer, RoleOperator)
+	}
+	return nil
+}
+
+// Allows is true if r is granted access of role.
+func (r Role) Allows(role Role) bool {
+	return roleLevels[r] > 0 && roleLevels[r] >= roleLevels[role]
+}
+
+// HashPassword returns bcrypt hash of password.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// NewToken generates a random API token, and its hash to be saved in TokenConfig.
+func NewToken() (token string, hash string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type passwordEntry struct {
+	hash string
+	role Role
+}
+
+// readPasswordFile parses users of password file at path.
+func readPasswordFile(path string) (map[string]passwordEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]passwordEntry)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"name:hash:role\"", path, n)
+		}
+		role := Role(fields[2])
+		if err := role.Valid(); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		users[fields[0]] = passwordEntry{hash: fields[1], role: role}
+	}
+	return users, scanner.Err()
+}
+
+// SetPassword adds or replaces user name in password file at path.
+func SetPassword(path string, name string, password string, role Role) error {
+	if name == "" || strings.ContainsAny(name, ":\n") {
+		return fmt.Errorf("invalid user name \"%s\"", name)
+	}
+	if err := role.Valid(); err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line != "" && !strings.HasPrefix(line, name+":") {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, fmt.Sprintf("%s:%s:%s", name, hash, role))
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// authenticator checks credentials & holds login sessions.
+type authenticator struct {
+	cfg      AuthConfig
+	users    map[string]passwordEntry
+	sessions map[string]authSession
+	sync.Mutex
+}
+
+type authSession struct {
+	Identity
+	expires time.Time
+}
+
+func newAuthenticator(cfg AuthConfig) (*authenticator, error) {
+	if time.Duration(cfg.SessionTTL) <= 0 {
+		cfg.SessionTTL = DefaultAuthConfig.SessionTTL
+	}
+	a := &authenticator{
+		cfg:      cfg,
+		users:    make(map[string]passwordEntry),
+		sessions: make(map[string]authSession),
+	}
+	if cfg.PasswordFile != "" {
+		users, err := readPasswordFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		a.users = users
+	}
+	for _, t := range cfg.Tokens {
+		if err := t.Role.Valid(); err != nil {
+			return nil, fmt.Errorf("token \"%s\": %s", t.Name, err)
+		}
+	}
+	return a, nil
+}
+
+// dummyHash is compared to passwords of unknown users, so that login
+// takes as long for them as for known ones, see login.
+const dummyHash = "$2a$10$g6lLQlxSMcyAVPVaQ5jAi.VnasP//OA/z7j92DfpIEj0EPgAqBZH2"
+
+// login checks name & password, and returns a new session id.
+func (a *authenticator) login(name string, password string) (string, bool) {
+	user, ok := a.users[name]
+	hash := user.hash
+	if !ok {
+		hash = dummyHash
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil || !ok {
+		return "", false
+	}
+	id, _, err := NewToken()
+	if err != nil {
+		log.Println("error generating session id:", err)
+		return "", false
+	}
+	a.Lock()
+	a.sessions[id] = authSession{
+		Identity: Identity{Name: name, Role: user.role},
+		expires:  time.Now().Add(time.Duration(a.cfg.SessionTTL)),
+	}
+	a.Unlock()
+	return id, true
+}
+
+func (a *authenticator) logout(id string) {
+	a.Lock()
+	delete(a.sessions, id)
+	a.Unlock()
+}
+
+// identify authenticates r from its bearer token, or its session cookie.
+func (a *authenticator) identify(r *http.Request) (Identity, bool) {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		hash := []byte(hashToken(strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))))
+		for _, t := range a.cfg.Tokens {
+			if subtle.ConstantTimeCompare(hash, []byte(strings.ToLower(t.Hash))) == 1 {
+				return Identity{Name: t.Name, Role: t.Role}, true
+			}
+		}
+		return Identity{}, false
+	}
+
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return Identity{}, false
+	}
+	a.Lock()
+	defer a.Unlock()
+	sess, ok := a.sessions[c.Value]
+	if !ok {
+		return Identity{}, false
+	}
+	if time.Now().After(sess.expires) {
+		delete(a.sessions, c.Value)
+		return Identity{}, false
+	}
+	return sess.Identity, true
+}
+
+// requestIdentity returns identity of authenticated r, or nil.
+func requestIdentity(r *http.Request) *Identity {
+	id, _ := r.Context().Value(identityKey{}).(*Identity)
+	return id
+}
+
+// authorize wraps h, which is only served to identities allowed role. Unauthenticated
+// pages are redirected to login page, other requests get a 401 or 403 status.
+func (s *Server) authorize(role Role, page bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		id, ok := s.auth.identify(r)
+		if !ok {
+			if page {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="goregen"`)
+			authError(w, r, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if !id.Role.Allows(role) {
+			authError(w, r, http.StatusForbidden, fmt.Sprintf("%s role required", role))
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, &id)))
+	})
+}
+
+// authError writes error, as an APIError for API requests.
+func authError(w http.ResponseWriter, r *http.Request, status int, error string) {
+	if strings.HasPrefix(r.URL.Path, APIPrefix) {
+		apiError(w, status, "%s", error)
+		return
+	}
+	http.Error(w, error, status)
+}
+
+// Login GET: serves login page, POST: checks credentials & sets session cookie.
+func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	if s.auth == nil {
+		http.Redirect(w, r, next, http.StatusFound)
+		return
+	}
+
+	data := s.templateData()
+	data.Next = next
+	if r.Method == http.MethodPost {
+		id, ok := s.auth.login(r.PostFormValue("name"), r.PostFormValue("password"))
+		if ok {
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    id,
+				Path:     "/",
+				MaxAge:   int(time.Duration(s.auth.cfg.SessionTTL).Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, next, http.StatusFound)
+			return
+		}
+		log.Printf("login: failed attempt for \"%s\" from %s", r.PostFormValue("name"), r.RemoteAddr)
+		data.Error = fmt.Errorf("invalid name or password")
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	r.URL.Path = "html/login.html"
+	s.makeTplHandler([]string{"html/login.html"}, data, s.tplFuncs).ServeHTTP(w, r)
+}
+
+// Logout ends session of request & redirects to login page.
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil && s.auth != nil {
+		s.auth.logout(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
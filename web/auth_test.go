@@ -0,0 +1,274 @@
+package web
+
+import (
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRole_Allows(t *testing.T) {
+	for _, test := range []struct {
+		role, required Role
+		allowed        bool
+	}{
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleOperator, false},
+		{RoleOperator, RoleViewer, true},
+		{RoleOperator, RoleOperator, true},
+		{Role("admin"), RoleViewer, false},
+		{Role(""), RoleViewer, false},
+	} {
+		if test.role.Allows(test.required) != test.allowed {
+			t.Errorf("%s allows %s: expected %v", test.role, test.required, test.allowed)
+		}
+	}
+}
+
+func TestNewToken(t *testing.T) {
+	token, hash, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 64 || hash != hashToken(token) || hash == token {
+		t.Errorf("unexpected token %s & hash %s", token, hash)
+	}
+	if other, _, _ := NewToken(); other == token {
+		t.Error("tokens should be random")
+	}
+}
+
+func TestSetPassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goregen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "passwd")
+
+	for _, u := range []struct {
+		name, password string
+		role           Role
+	}{
+		{"alice", "a", RoleViewer},
+		{"bob", "b", RoleOperator},
+		{"alice", "c", RoleOperator}, // replaces first entry
+	} {
+		if err = SetPassword(path, u.name, u.password, u.role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, err := readPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["alice"].role != RoleOperator || users["bob"].role != RoleOperator {
+		t.Fatalf("unexpected users: %v", users)
+	}
+	a, err := newAuthenticator(AuthConfig{PasswordFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.login("alice", "a"); ok {
+		t.Error("replaced password still valid")
+	}
+	if _, ok := a.login("alice", "c"); !ok {
+		t.Error("new password rejected")
+	}
+
+	for _, name := range []string{"", "a:b", "a\nb"} {
+		if err = SetPassword(path, name, "x", RoleViewer); err == nil {
+			t.Errorf("expected invalid name \"%s\" to be rejected", name)
+		}
+	}
+	if err = SetPassword(path, "carol", "x", Role("admin")); err == nil {
+		t.Error("expected unknown role to be rejected")
+	}
+
+	for _, content := range []string{"alice:hash", "alice:hash:admin"} {
+		err = ioutil.WriteFile(path, []byte("# comment\n\n"+content+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = readPasswordFile(path); err == nil || !strings.Contains(err.Error(), ":3:") {
+			t.Errorf("%s: expected an error on line 3, got %v", content, err)
+		}
+	}
+}
+
+// newAuthServer serves a test box with users viewer & operator (password "secret"),
+// and tokens of both roles.
+func newAuthServer(t *testing.T) (ts *testServer, viewerToken string, operatorToken string) {
+	viewerToken, viewerHash, _ := NewToken()
+	operatorToken, operatorHash, _ := NewToken()
+	ts = newTestServer(t, func(cfg *Config) {
+		path := filepath.Join(filepath.Dir(cfg.Web.DataDir), "passwd")
+		for _, role := range []Role{RoleViewer, RoleOperator} {
+			if err := SetPassword(path, string(role), "secret", role); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cfg.Web.Auth.PasswordFile = path
+		cfg.Web.Auth.Tokens = []TokenConfig{
+			{Name: "grafana", Role: RoleViewer, Hash: viewerHash},
+			{Name: "ci", Role: RoleOperator, Hash: strings.ToUpper(operatorHash)},
+		}
+	})
+	return ts, viewerToken, operatorToken
+}
+
+func TestServer_AuthTokens(t *testing.T) {
+	ts, viewer, operator := newAuthServer(t)
+	defer ts.Close()
+
+	for _, test := range []struct {
+		method, path string
+		token        string
+		status       int
+	}{
+		// unauthenticated
+		{"GET", "/", "", http.StatusFound},
+		{"GET", "/charts", "", http.StatusFound},
+		{"GET", "/snapshot", "", http.StatusUnauthorized},
+		{"GET", "/metrics", "", http.StatusUnauthorized},
+		{"GET", APIPrefix + "/boxes", "", http.StatusUnauthorized},
+		{"GET", APIPrefix + "/boxes", "invalid", http.StatusUnauthorized},
+		{"GET", "/login", "", http.StatusOK},
+		{"GET", "/static/css/dashboard.css", "", http.StatusOK},
+
+		// viewer
+		{"GET", "/", viewer, http.StatusOK},
+		{"GET", "/metrics", viewer, http.StatusOK},
+		{"GET", APIPrefix + "/boxes/" + testBox, viewer, http.StatusOK},
+		{"POST", "/box/" + testBox + "/stop", viewer, http.StatusForbidden},
+		{"DELETE", APIPrefix + "/boxes/" + testBox + "/session", viewer, http.StatusForbidden},
+		{"GET", "/debug/pprof/", viewer, http.StatusForbidden},
+
+		// operator, whose token hash is configured in upper case
+		{"GET", APIPrefix + "/boxes/" + testBox, operator, http.StatusOK},
+		{"POST", "/box/" + testBox + "/stop", operator, http.StatusOK},
+		{"HEAD", "/box/" + testBox + "/stop", operator, http.StatusMethodNotAllowed},            // state changes are POST only
+		{"DELETE", APIPrefix + "/boxes/" + testBox + "/session", operator, http.StatusNotFound}, // none running
+		{"GET", "/debug/pprof/", operator, http.StatusOK},
+	} {
+		var headers []string
+		if test.token != "" {
+			headers = []string{"Authorization", "Bearer " + test.token}
+		}
+		resp, body := ts.request(t, test.method, test.path, "", headers...)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: expected status %d, got %d (%s)", test.method, test.path, test.status, resp.StatusCode, body)
+			continue
+		}
+		switch {
+		case test.status == http.StatusFound:
+			expected := "/login?next=" + url.QueryEscape(test.path)
+			if loc := resp.Header.Get("Location"); loc != expected {
+				t.Errorf("%s %s: expected redirect to %s, got %s", test.method, test.path, expected, loc)
+			}
+		case test.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "":
+			t.Errorf("%s %s: WWW-Authenticate header missing", test.method, test.path)
+		}
+
+		// API errors are json
+		if strings.HasPrefix(test.path, APIPrefix) && test.status >= 400 {
+			var apiErr APIError
+			err := json.Unmarshal(body, &apiErr)
+			if err != nil || apiErr.Status != test.status || apiErr.Error == "" {
+				t.Errorf("%s %s: unexpected error %s (%v)", test.method, test.path, body, err)
+			}
+		}
+	}
+}
+
+func TestServer_AuthLogin(t *testing.T) {
+	ts, _, _ := newAuthServer(t)
+	defer ts.Close()
+	login := func(name string, password string, next string) *http.Response {
+		form := url.Values{"name": {name}, "password": {password}, "next": {next}}
+		resp, _ := ts.request(t, "POST", "/login", form.Encode(),
+			"Content-Type", "application/x-www-form-urlencoded")
+		return resp
+	}
+
+	if resp := login("viewer", "wrong", "/"); resp.StatusCode != http.StatusUnauthorized || len(resp.Cookies()) > 0 {
+		t.Errorf("expected failed login, got %s", resp.Status)
+	}
+	if resp := login("nobody", "secret", "/"); resp.StatusCode != http.StatusUnauthorized || len(resp.Cookies()) > 0 {
+		t.Errorf("expected failed login of unknown user, got %s", resp.Status)
+	}
+
+	// next must be local
+	resp := login("viewer", "secret", "//example.com/")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/" {
+		t.Errorf("expected redirect to /, got %s to %s", resp.Status, resp.Header.Get("Location"))
+	}
+
+	resp = login("operator", "secret", "/charts")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/charts" {
+		t.Fatalf("expected redirect to /charts, got %s to %s", resp.Status, resp.Header.Get("Location"))
+	}
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly || cookie.MaxAge != int((time.Hour*24*7).Seconds()) {
+		t.Fatalf("unexpected session cookie %v", cookie)
+	}
+	withCookie := []string{"Cookie", sessionCookie + "=" + cookie.Value}
+	if resp, _ = ts.request(t, "POST", "/box/"+testBox+"/stop", "", withCookie...); resp.StatusCode != http.StatusOK {
+		t.Errorf("operator session: expected status 200, got %s", resp.Status)
+	}
+
+	// expired sessions are dropped
+	ts.srv.auth.Lock()
+	sess := ts.srv.auth.sessions[cookie.Value]
+	sess.expires = time.Now().Add(-time.Second)
+	ts.srv.auth.sessions[cookie.Value] = sess
+	ts.srv.auth.Unlock()
+	if resp, _ = ts.request(t, "GET", "/", "", withCookie...); resp.StatusCode != http.StatusFound {
+		t.Errorf("expired session: expected redirect to login, got %s", resp.Status)
+	}
+	if resp, _ = ts.request(t, "GET", APIPrefix+"/boxes", "", withCookie...); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expired session: expected status 401, got %s", resp.Status)
+	}
+	ts.srv.auth.Lock()
+	_, ok := ts.srv.auth.sessions[cookie.Value]
+	ts.srv.auth.Unlock()
+	if ok {
+		t.Error("expired session wasn't removed")
+	}
+
+	// logout ends session
+	resp = login("viewer", "secret", "/")
+	withCookie = []string{"Cookie", sessionCookie + "=" + resp.Cookies()[0].Value}
+	if resp, _ = ts.request(t, "GET", "/", "", withCookie...); resp.StatusCode != http.StatusOK {
+		t.Fatalf("viewer session: expected status 200, got %s", resp.Status)
+	}
+	ts.request(t, "POST", "/logout", "", withCookie...)
+	if resp, _ = ts.request(t, "GET", "/", "", withCookie...); resp.StatusCode != http.StatusFound {
+		t.Errorf("after logout: expected redirect to login, got %s", resp.Status)
+	}
+}
+
+func TestAuthenticator_LoginUnknown(t *testing.T) {
+	// same cost as HashPassword, for login to take as long as for known users
+	if cost, err := bcrypt.Cost([]byte(dummyHash)); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("expected dummy hash of cost %d, got %d (%v)", bcrypt.DefaultCost, cost, err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte("")) == nil {
+		t.Error("dummy hash matches empty password")
+	}
+	a := &authenticator{users: map[string]passwordEntry{}}
+	if _, ok := a.login("nobody", ""); ok {
+		t.Error("unknown user logged in")
+	}
+}
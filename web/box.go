@@ -0,0 +1,240 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/regenbox"
+	"log"
+	"sync"
+)
+
+var ErrUnknownBox = errors.New("unknown box")
+
+// Box is a RegenBox managed by goregen, along with its own
+// configuration, live data and cycle messages subscribers.
+type Box struct {
+	Id       string
+	Regenbox *regenbox.RegenBox
+	Watcher  *regenbox.Watcher
+
+	config       BoxConfig
+	dataDir      string
+	liveData     *util.TimeSeries
+	liveDataPath string
+	live         regenbox.Snapshot // last snapshot of live ticker
+	cycleMsg     *regenbox.CycleMessage
+	resume       *Session   // interrupted session to resume when server starts
+	pending      *BoxConfig // config reloaded while running, applied once stopped
+	session      *Session   // running session, if any
+	cycleSubs    map[int]chan regenbox.CycleMessage
+	subId        int
+	sync.Mutex
+}
+
+// NewBox creates a Box from its config, a RegenBox and its Watcher (which may be nil).
+func NewBox(cfg BoxConfig, rbox *regenbox.RegenBox, watcher *regenbox.Watcher) *Box {
+	rbox.SetResistor(float64(cfg.Resistor))
+	rbox.SetCalibration(cfg.Calibration)
+	return &Box{
+		Id:        cfg.Id,
+		Regenbox:  rbox,
+		Watcher:   watcher,
+		config:    cfg,
+		cycleSubs: make(map[int]chan regenbox.CycleMessage),
+	}
+}
+
+// Config returns a copy of box config, with current RegenBox config.
+func (b *Box) Config() BoxConfig {
+	b.Lock()
+	defer b.Unlock()
+	cfg := b.config
+	cfg.Regenbox = b.Regenbox.Config()
+	return cfg
+}
+
+// SetConfig sets box config, and RegenBox config along.
+func (b *Box) SetConfig(cfg BoxConfig) error {
+	b.Lock()
+	defer b.Unlock()
+	rbCfg := cfg.Regenbox
+	err := b.Regenbox.SetConfig(&rbCfg)
+	if err != nil {
+		return err
+	}
+	b.Regenbox.SetResistor(float64(cfg.Resistor))
+	b.Regenbox.SetCalibration(cfg.Calibration)
+	cfg.Id = b.Id
+	b.config = cfg
+	return nil
+}
+
+// Identity returns identity of device of b (see regenbox.DeviceIdentity),
+// or "id:" followed by its Id when it has none.
+func (b *Box) Identity() string {
+	if id := regenbox.DeviceIdentity(b.Regenbox.Path()); id != "" {
+		return id
+	}
+	return "id:" + b.Id
+}
+
+// checkCalibration warns if calibration of b was measured on another device
+// than the one it's connected to, e.g. once boxes were swapped between ports.
+func (b *Box) checkCalibration() {
+	c := b.Regenbox.Calibration()
+	if c == nil || c.Identity == "" {
+		return
+	}
+	if id := b.Identity(); id != c.Identity {
+		log.Printf("%s: warning: calibration was measured on box \"%s\", connected box is \"%s\", see goregen calibrate",
+			b.Id, c.Identity, id)
+	}
+}
+
+// CycleMessage returns last cycle message received, or nil.
+func (b *Box) CycleMessage() *regenbox.CycleMessage {
+	b.Lock()
+	defer b.Unlock()
+	return b.cycleMsg
+}
+
+// LiveSnapshot returns the last snapshot of b taken by its live ticker, so that
+// readers don't query box on their own. Box is queried once if it didn't tick yet.
+func (b *Box) LiveSnapshot() regenbox.Snapshot {
+	b.Lock()
+	sn := b.live
+	b.Unlock()
+	if sn.Time.IsZero() {
+		sn = b.Regenbox.Snapshot()
+		b.setLive(sn)
+	}
+	return sn
+}
+
+func (b *Box) setLive(sn regenbox.Snapshot) {
+	b.Lock()
+	b.live = sn
+	b.Unlock()
+}
+
+// DataDir is where chart logs of b are saved.
+func (b *Box) DataDir() string {
+	return b.dataDir
+}
+
+// Session returns the running session of b, or nil.
+func (b *Box) Session() *Session {
+	b.Lock()
+	defer b.Unlock()
+	return b.session
+}
+
+func (b *Box) setSession(sess *Session) {
+	b.Lock()
+	b.session = sess
+	b.Unlock()
+}
+
+// ResumeOnStart makes server resume interrupted sess when it starts.
+func (b *Box) ResumeOnStart(sess *Session) {
+	b.Lock()
+	b.resume = sess
+	b.Unlock()
+}
+
+// SubscribeCycles returns a chan receiving each cycle message of b.
+func (b *Box) SubscribeCycles() (int, chan regenbox.CycleMessage) {
+	b.Lock()
+	defer b.Unlock()
+	ch := make(chan regenbox.CycleMessage, 10)
+	id := b.subId
+	b.cycleSubs[id] = ch
+	b.subId++
+	return id, ch
+}
+
+func (b *Box) UnsubscribeCycles(id int) {
+	b.Lock()
+	delete(b.cycleSubs, id)
+	b.Unlock()
+}
+
+// broadcast saves msg as last cycle message and sends it to all subscribers.
+func (b *Box) broadcast(msg regenbox.CycleMessage) {
+	b.Lock()
+	defer b.Unlock()
+	b.cycleMsg = &msg
+	for i, ch := range b.cycleSubs {
+		if len(ch) == cap(ch) {
+			log.Printf("%s: killing full chan %d", b.Id, i)
+			delete(b.cycleSubs, i)
+		} else {
+			ch <- msg
+		}
+	}
+}
+
+// Registry holds boxes by Id, keeping their registration order.
+type Registry struct {
+	boxes map[string]*Box
+	ids   []string
+	sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		boxes: make(map[string]*Box),
+	}
+}
+
+// Add registers b, its Id must be unique.
+func (r *Registry) Add(b *Box) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.boxes[b.Id]; ok {
+		return fmt.Errorf("box \"%s\" is already registered", b.Id)
+	}
+	r.boxes[b.Id] = b
+	r.ids = append(r.ids, b.Id)
+	return nil
+}
+
+// Get returns box with id, or ErrUnknownBox.
+func (r *Registry) Get(id string) (*Box, error) {
+	r.RLock()
+	defer r.RUnlock()
+	b, ok := r.boxes[id]
+	if !ok {
+		return nil, ErrUnknownBox
+	}
+	return b, nil
+}
+
+// Default returns the first registered box, or nil.
+func (r *Registry) Default() *Box {
+	r.RLock()
+	defer r.RUnlock()
+	if len(r.ids) == 0 {
+		return nil
+	}
+	return r.boxes[r.ids[0]]
+}
+
+// List returns all boxes in registration order.
+func (r *Registry) List() []*Box {
+	r.RLock()
+	defer r.RUnlock()
+	boxes := make([]*Box, len(r.ids))
+	for i, id := range r.ids {
+		boxes[i] = r.boxes[id]
+	}
+	return boxes
+}
+
+// Len returns the number of registered boxes.
+func (r *Registry) Len() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.ids)
+}
@@ -0,0 +1,87 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/solar3s/goregen/regenbox"
+	"log"
+	"net/http"
+)
+
+// APICalibration is the voltage calibration of a box.
+type APICalibration struct {
+	*regenbox.Calibration
+	Formula  string // corrected voltage as a polynomial of raw voltage x, e.g. "1.0125x - 12.3"
+	MaxError int    // largest difference between Points & their corrected voltage (mV)
+}
+
+// APICalibrate fits a calibration to reference voltages measured with a multimeter.
+type APICalibrate struct {
+	Points []regenbox.CalibrationPoint
+	Degree int // 1 for a linear correction (default), up to regenbox.MaxCalibrationDegree
+}
+
+func apiCalibration(c *regenbox.Calibration) APICalibration {
+	return APICalibration{Calibration: c, Formula: c.String(), MaxError: c.MaxError()}
+}
+
+// setCalibration sets calibration c (nil to remove it) to stopped box b, and saves config file.
+func (s *Server) setCalibration(b *Box, c *regenbox.Calibration) error {
+	bc := b.Config()
+	if c != nil {
+		c.Identity = b.Identity()
+	}
+	bc.Calibration = c
+	err := s.setBoxConfig(b, bc, true)
+	if err == nil {
+		log.Printf("%s: calibration set to %s", b.Id, c)
+	}
+	return err
+}
+
+// APICalibration GET, PUT & DELETE /api/v1/boxes/{id}/calibration. PUT fits
+// a calibration to provided points, changes are saved to config file.
+func (s *Server) APICalibration(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.apiBox(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		req := APICalibrate{Degree: 1}
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "couldn't decode calibration: %s", err)
+			return
+		}
+		var c *regenbox.Calibration
+		c, err = regenbox.FitCalibration(req.Points, req.Degree)
+		if err == nil {
+			err = s.setCalibration(b, c)
+		}
+	case http.MethodDelete:
+		err = s.setCalibration(b, nil)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	if ve, ok := err.(regenbox.ValidationError); ok {
+		writeJSON(w, http.StatusUnprocessableEntity, APIError{
+			Status: http.StatusUnprocessableEntity, Error: ve.Error(), Fields: ve})
+		return
+	} else if err == regenbox.ErrBoxRunning {
+		apiError(w, http.StatusConflict, "box must be stopped first")
+		return
+	} else if err != nil {
+		apiError(w, http.StatusUnprocessableEntity, "%s", err)
+		return
+	}
+	c := b.Config().Calibration
+	if c == nil {
+		apiError(w, http.StatusNotFound, "%s", regenbox.ErrNotCalibrated)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiCalibration(c))
+}
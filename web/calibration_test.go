@@ -0,0 +1,63 @@
+package web
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logBuffer collects logs, written by other goroutines of server too.
+type logBuffer struct {
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestAPI_CalibrationIdentity(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.Close()
+	b, _ := ts.srv.Boxes.Get(testBox)
+
+	var cal APICalibration
+	ts.api(t, "PUT", "/boxes/"+testBox+"/calibration",
+		`{"Points": [{"Raw": 1000, "Reference": 1010}, {"Raw": 1400, "Reference": 1415}]}`, http.StatusOK, &cal)
+	// simulated box has no usb identity
+	if cal.Calibration == nil || cal.Identity != "id:"+testBox {
+		t.Fatalf("expected calibration of identity \"id:%s\", got %+v", testBox, cal.Calibration)
+	}
+	if c := ts.srv.liveConfig().Boxes[0].Calibration; c == nil || c.Identity != cal.Identity {
+		t.Errorf("expected identity saved to config, got %+v", c)
+	}
+
+	var buf logBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	b.checkCalibration()
+	if strings.Contains(buf.String(), "warning") {
+		t.Errorf("unexpected warning for calibrated box: %s", buf.String())
+	}
+
+	// box plugged in place of calibrated one
+	c := *b.Regenbox.Calibration()
+	c.Identity = "usb:0403:6001:A50285BI"
+	b.Regenbox.SetCalibration(&c)
+	b.checkCalibration()
+	if !strings.Contains(buf.String(), "warning: calibration was measured on box \"usb:0403:6001:A50285BI\"") {
+		t.Errorf("expected warning about calibrated box, got \"%s\"", buf.String())
+	}
+}
@@ -6,20 +6,105 @@ import (
 	"github.com/solar3s/goregen/regenbox"
 	"io/ioutil"
 	"log"
+	"math"
 	"path/filepath"
 	"time"
 )
 
 type ChartLog struct {
-	User          User
-	Battery       Battery
-	Resistor      util.Float
-	CycleType     string
-	TargetReached bool
-	Reason        string
-	TotalDuration util.Duration
-	Config        regenbox.Config
-	Measures      util.TimeSeries
+	Box            string // Id of the box that produced this log
+	User           User
+	Battery        Battery
+	Resistor       util.Float
+	CycleType      string
+	TargetReached  bool
+	Reason         string
+	TotalDuration  util.Duration // running time, Gaps excluded
+	MilliAmpHours  float64       // measured during discharge
+	MilliWattHours float64
+	Config         regenbox.Config
+	Measures       util.TimeSeries
+	Gaps           []Gap                 `toml:",omitempty"` // downtime of a resumed session
+	ChargeStates   []ChargeStateChange   `toml:",omitempty"`
+	Capacities     *CapacitySeries       `toml:",omitempty"` // cumulative capacity at every measure
+	Calibration    *regenbox.Calibration `toml:",omitempty"` // of box, Measures are corrected by it
+	RawMeasures    []int                 `toml:",omitempty"` // Measures.Data before calibration, if calibrated
+	Details        *DetailSeries         `toml:",omitempty"` // of every measure, in detailed mode
+}
+
+// CapacitySeries records capacity measured since start of
+// session (see regenbox.Meter) at every measure of a ChartLog.
+type CapacitySeries struct {
+	MilliAmpHours  []float64
+	MilliWattHours []float64
+}
+
+// add appends c to cs, rounded to µAh & µWh.
+func (cs *CapacitySeries) add(c regenbox.Capacity) {
+	cs.MilliAmpHours = append(cs.MilliAmpHours, math.Round(c.MilliAmpHours*1000)/1000)
+	cs.MilliWattHours = append(cs.MilliWattHours, math.Round(c.MilliWattHours*1000)/1000)
+}
+
+// has returns true if cs holds capacity of measure i, cs may be nil.
+func (cs *CapacitySeries) has(i int) bool {
+	return cs != nil && i < len(cs.MilliAmpHours) && i < len(cs.MilliWattHours)
+}
+
+// DetailSeries records how each measure of a ChartLog was read, in detailed mode
+// (see regenbox.Config.DetailedLog). Values are -1 for measures without detail.
+type DetailSeries struct {
+	AnalogScale float64 // mV per unit of Analog, 0 if unknown
+	Analog      []int   // raw analog reads, see regenbox.Detail
+	LatencyUs   []int   // round trips of voltage reads, in µs
+	Retries     []int   // failed & skipped answers since previous measure
+}
+
+// add appends d to ds, d may be nil.
+func (ds *DetailSeries) add(d *regenbox.Detail) {
+	if d == nil {
+		d = &regenbox.Detail{Analog: -1, Latency: -time.Microsecond, Retries: -1}
+	}
+	ds.Analog = append(ds.Analog, d.Analog)
+	ds.LatencyUs = append(ds.LatencyUs, int(d.Latency/time.Microsecond))
+	ds.Retries = append(ds.Retries, d.Retries)
+}
+
+// has returns true if ds holds detail of measure i, ds may be nil.
+func (ds *DetailSeries) has(i int) bool {
+	return ds != nil && i < len(ds.Analog) && i < len(ds.LatencyUs) && i < len(ds.Retries) && ds.Retries[i] >= 0
+}
+
+// ChargeStateChange records ChargeState of box from Index of ChartLog.Measures.Data.
+type ChargeStateChange struct {
+	Index       int
+	ChargeState regenbox.ChargeState
+}
+
+// Gap records downtime of a session interrupted & resumed before measure Index
+// of ChartLog.Measures.Data, which otherwise are evenly spaced by their Interval.
+type Gap struct {
+	Index    int
+	Duration util.Duration
+}
+
+// offset returns time of measure i since start of cl, gaps included.
+func (cl *ChartLog) offset(i int) time.Duration {
+	d := time.Duration(i) * time.Duration(cl.Measures.Interval)
+	for _, g := range cl.Gaps {
+		if g.Index <= i {
+			d += time.Duration(g.Duration)
+		}
+	}
+	return d
+}
+
+// downtime sums durations of gaps.
+func downtime(gaps []Gap) time.Duration {
+	var d time.Duration
+	for _, g := range gaps {
+		d += time.Duration(g.Duration)
+	}
+	return d
 }
 
 func (cl ChartLog) Info() ChartLogInfo {
@@ -76,6 +161,9 @@ func ListChartLogs(dir string) (err error, infos []ChartLogInfo) {
 		return err, nil
 	}
 	for _, fi := range files {
+		if isSessionFile(fi.Name()) {
+			continue
+		}
 		var fpath = filepath.Join(dir, fi.Name())
 		var cl ChartLog
 		err = util.ReadTomlFile(&cl, fpath)
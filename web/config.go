@@ -1,9 +1,14 @@
 package web
 
 import (
+	"fmt"
 	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/firmware"
 	"github.com/solar3s/goregen/regenbox"
 	"go.bug.st/serial.v1"
+	"net"
+	"path/filepath"
+	"strings"
 )
 
 var DefaultConfig = Config{
@@ -14,6 +19,7 @@ var DefaultConfig = Config{
 	Regenbox: regenbox.DefaultConfig,
 	Watcher:  regenbox.DefaultWatcherConfig,
 	Serial:   regenbox.DefaultSerialConfig,
+	MQTT:     DefaultMQTTConfig,
 }
 
 type Config struct {
@@ -25,6 +31,25 @@ type Config struct {
 	Watcher  regenbox.WatcherConfig
 	Device   string
 	Serial   serial.Mode
+	MQTT     MQTTConfig
+	Firmware FirmwareConfig
+
+	Calibration *regenbox.Calibration `toml:",omitempty"` // of single box, see BoxConfig
+
+	Boxes    []BoxConfig     `toml:",omitempty"`
+	Webhooks []WebhookConfig `toml:",omitempty"`
+}
+
+// BoxConfig holds settings specific to one RegenBox. When several
+// boxes are managed by goregen, each one is configured in a [[Boxes]] section.
+type BoxConfig struct {
+	Id       string // identifies box in urls & data directory, defaults to device name
+	Device   string // path to serial port, searched automatically if empty
+	Battery  Battery
+	Resistor util.Float
+	Regenbox regenbox.Config
+
+	Calibration *regenbox.Calibration `toml:",omitempty"` // correction of voltages, measured by "goregen calibrate"
 }
 
 type User struct {
@@ -33,13 +58,169 @@ type User struct {
 }
 
 type Battery struct {
-	BetaRef string // as provided by Regenbox
-	Type    string // AAA, AA...
-	Voltage int    // in millivolts
-	Brand   string // Duracell...
-	Model   string // Ultra
+	BetaRef   string // as provided by Regenbox
+	Type      string // AAA, AA...
+	Chemistry string // alkaline, nimh or nicd, limits voltages of Regenbox config if set
+	Voltage   int    // in millivolts
+	Brand     string // Duracell...
+	Model     string // Ultra
 }
 
 var NoBattery = Battery{}
 
 var NoName = User{}
+
+// SingleBox is true when no [[Boxes]] are configured, top-level
+// Device, Battery, Resistor & Regenbox values are then used for the only box.
+func (cfg *Config) SingleBox() bool {
+	return len(cfg.Boxes) == 0
+}
+
+// BoxConfigs returns the configuration of each box, with their Id set.
+func (cfg *Config) BoxConfigs() []BoxConfig {
+	if cfg.SingleBox() {
+		bc := BoxConfig{
+			Device:      cfg.Device,
+			Battery:     cfg.Battery,
+			Resistor:    cfg.Resistor,
+			Regenbox:    cfg.Regenbox,
+			Calibration: cfg.Calibration,
+		}
+		bc.Id = bc.defaultId(0)
+		return []BoxConfig{bc}
+	}
+
+	var boxes = make([]BoxConfig, len(cfg.Boxes))
+	var ids = make(map[string]bool)
+	for i, bc := range cfg.Boxes {
+		if bc.Id == "" {
+			bc.Id = bc.defaultId(i)
+		}
+		// ensure unicity
+		id := bc.Id
+		for n := 2; ids[id]; n++ {
+			id = fmt.Sprintf("%s-%d", bc.Id, n)
+		}
+		bc.Id = id
+		ids[id] = true
+		boxes[i] = bc
+	}
+	return boxes
+}
+
+// SetBoxConfig saves bc in place of the box with the same Id.
+func (cfg *Config) SetBoxConfig(bc BoxConfig) error {
+	if cfg.SingleBox() {
+		cfg.Device = bc.Device
+		cfg.Battery = bc.Battery
+		cfg.Resistor = bc.Resistor
+		cfg.Regenbox = bc.Regenbox
+		cfg.Calibration = bc.Calibration
+		return nil
+	}
+	for i, v := range cfg.BoxConfigs() {
+		if v.Id == bc.Id {
+			// don't save generated ids
+			bc.Id = cfg.Boxes[i].Id
+			cfg.Boxes[i] = bc
+			return nil
+		}
+	}
+	return fmt.Errorf("no box with id \"%s\" in config", bc.Id)
+}
+
+// SetCalibration sets voltage calibration of box id, nil to remove it.
+func (cfg *Config) SetCalibration(id string, c *regenbox.Calibration) error {
+	if cfg.SingleBox() {
+		cfg.Calibration = c
+		return nil
+	}
+	for i, bc := range cfg.BoxConfigs() {
+		if bc.Id == id {
+			cfg.Boxes[i].Calibration = c
+			return nil
+		}
+	}
+	return fmt.Errorf("no box with id \"%s\" in config", id)
+}
+
+// BoxDataDir returns the directory where chart logs of box id are saved.
+func (cfg *Config) BoxDataDir(id string) string {
+	if cfg.SingleBox() {
+		return cfg.Web.DataDir
+	}
+	return filepath.Join(cfg.Web.DataDir, id)
+}
+
+// defaultId computes an Id from bc.Device, or from index i if bc.Device is empty.
+func (bc BoxConfig) defaultId(i int) string {
+	if bc.Device == "" {
+		return fmt.Sprintf("box%d", i)
+	}
+	return strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '-'
+	}, filepath.Base(bc.Device)), "-")
+}
+
+// Validate checks cfg, it returns a regenbox.ValidationError listing its invalid fields.
+func (cfg *Config) Validate() error {
+	var errs regenbox.ValidationError
+	for i, bc := range cfg.BoxConfigs() {
+		prefix := ""
+		if !cfg.SingleBox() {
+			prefix = fmt.Sprintf("Boxes[%d].", i)
+			if i > 0 && bc.Device == "" {
+				errs.Add(prefix+"Device", "must be set when several boxes are configured")
+			}
+		}
+		errs.Merge(prefix, bc.Validate())
+	}
+	if _, _, err := net.SplitHostPort(cfg.Web.ListenAddr); err != nil {
+		errs.Add("Web.ListenAddr", "expected host:port, got \"%s\"", cfg.Web.ListenAddr)
+	}
+	if cfg.Web.WebsocketInterval <= 0 {
+		errs.Add("Web.WebsocketInterval", "must be positive, got %s", cfg.Web.WebsocketInterval)
+	}
+	if (cfg.Web.TLS.CertFile == "") != (cfg.Web.TLS.KeyFile == "") {
+		errs.Add("Web.TLS", "CertFile & KeyFile must be set together")
+	}
+	if cfg.Watcher.ConnPollRate <= 0 {
+		errs.Add("Watcher.ConnPollRate", "must be positive, got %s", cfg.Watcher.ConnPollRate)
+	}
+	if cfg.MQTT.Broker != "" && cfg.MQTT.Commands && cfg.MQTT.Username == "" {
+		errs.Add("MQTT.Commands", "require Username, so that broker restricts who sends commands")
+	}
+	if _, err := firmware.LookupBoard(cfg.Firmware.Board); err != nil {
+		errs.Add("Firmware.Board", "%s", err)
+	}
+	return errs.Err()
+}
+
+// Validate checks bc, with voltages of its Regenbox config within limits of Battery.Chemistry.
+func (bc BoxConfig) Validate() error {
+	var errs regenbox.ValidationError
+	if bc.Resistor <= 0 {
+		errs.Add("Resistor", "must be positive (ohms), got %v", bc.Resistor)
+	}
+	if bc.Battery.Voltage < 0 {
+		errs.Add("Battery.Voltage", "must not be negative, got %dmV", bc.Battery.Voltage)
+	}
+	var chem regenbox.Chemistry
+	if bc.Battery.Chemistry != "" {
+		var ok bool
+		chem, ok = regenbox.LookupChemistry(bc.Battery.Chemistry)
+		if !ok {
+			errs.Add("Battery.Chemistry", "unknown chemistry \"%s\", expected one of %s",
+				bc.Battery.Chemistry, strings.Join(regenbox.ChemistryNames(), ", "))
+		}
+	}
+	errs.Merge("Regenbox.", bc.Regenbox.ValidateFor(chem))
+	if bc.Calibration != nil {
+		errs.Merge("Calibration.", bc.Calibration.Validate())
+	}
+	return errs.Err()
+}
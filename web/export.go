@@ -0,0 +1,218 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/regenbox"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chart log export formats.
+const (
+	ExportCSV  = "csv"
+	ExportTSV  = "tsv"
+	ExportJSON = "json"
+)
+
+var ExportFormats = []string{ExportCSV, ExportTSV, ExportJSON}
+
+var exportContentTypes = map[string]string{
+	ExportCSV:  "text/csv; charset=utf-8",
+	ExportTSV:  "text/tab-separated-values; charset=utf-8",
+	ExportJSON: "application/json",
+}
+
+// exportColumns are the header of csv & tsv exports.
+var exportColumns = []string{"time", "elapsed_s", "voltage_mV", "charge_state", "current_mA", "raw_voltage_mV",
+	"analog", "latency_us", "retries", "capacity_mAh", "capacity_mWh"}
+
+// ChartLogHeader holds a ChartLog metadata, without its measures.
+type ChartLogHeader struct {
+	Box            string
+	User           User
+	Battery        Battery
+	Resistor       util.Float
+	CycleType      string
+	TargetReached  bool
+	Reason         string
+	TotalDuration  util.Duration
+	MilliAmpHours  float64
+	MilliWattHours float64
+	Config         regenbox.Config
+	Calibration    *regenbox.Calibration `toml:",omitempty" json:",omitempty"`
+	AnalogScale    float64               `toml:",omitempty" json:",omitempty"` // mV per unit of Analog measures, in detailed logs
+	Gaps           []Gap                 `toml:",omitempty" json:",omitempty"` // downtime of a resumed session, Measure times include it
+}
+
+// Measure is a single measure of a ChartLog, as exported.
+type Measure struct {
+	Time           time.Time
+	Elapsed        float64  // in seconds since start of log
+	Voltage        int      // in mV
+	ChargeState    string   `json:",omitempty"` // empty if unknown, in logs saved by older versions
+	Current        *float64 `json:",omitempty"` // in mA, only known while idle or discharging
+	RawVoltage     *int     `json:",omitempty"` // in mV before calibration, only set in logs of calibrated boxes
+	Analog         *int     `json:",omitempty"` // raw analog read, this and following are only set in detailed logs
+	LatencyUs      *int     `json:",omitempty"` // round trip of voltage read, in µs
+	Retries        *int     `json:",omitempty"` // failed & skipped answers since previous measure
+	MilliAmpHours  *float64 `json:",omitempty"` // measured since start of log, not in logs saved by older versions
+	MilliWattHours *float64 `json:",omitempty"`
+}
+
+// IsExportFormat returns true if format is one of ExportFormats.
+func IsExportFormat(format string) bool {
+	_, ok := exportContentTypes[format]
+	return ok
+}
+
+// ExportContentType returns the mime type of format.
+func ExportContentType(format string) string {
+	return exportContentTypes[format]
+}
+
+// ExportFileName returns name of chart log file fname, exported to format.
+func ExportFileName(fname string, format string) string {
+	return strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname)) + "." + format
+}
+
+// Header returns metadata of cl.
+func (cl *ChartLog) Header() ChartLogHeader {
+	h := ChartLogHeader{
+		Box:            cl.Box,
+		User:           cl.User,
+		Battery:        cl.Battery,
+		Resistor:       cl.Resistor,
+		CycleType:      cl.CycleType,
+		TargetReached:  cl.TargetReached,
+		Reason:         cl.Reason,
+		TotalDuration:  cl.TotalDuration,
+		MilliAmpHours:  cl.MilliAmpHours,
+		MilliWattHours: cl.MilliWattHours,
+		Config:         cl.Config,
+		Calibration:    cl.Calibration,
+		Gaps:           cl.Gaps,
+	}
+	if cl.Details != nil {
+		h.AnalogScale = cl.Details.AnalogScale
+	}
+	return h
+}
+
+// Rows returns measures of cl, with their absolute time & derived current.
+// Measures are assumed to be evenly spaced by cl.Measures.Interval, apart from cl.Gaps.
+func (cl *ChartLog) Rows() []Measure {
+	rows := make([]Measure, len(cl.Measures.Data))
+	var cs int // index in cl.ChargeStates
+	for i, v := range cl.Measures.Data {
+		elapsed := cl.offset(i)
+		m := Measure{
+			Time:    cl.Measures.Start.Add(elapsed),
+			Elapsed: elapsed.Seconds(),
+			Voltage: v,
+		}
+		for cs+1 < len(cl.ChargeStates) && cl.ChargeStates[cs+1].Index <= i {
+			cs++
+		}
+		if cs < len(cl.ChargeStates) && cl.ChargeStates[cs].Index <= i {
+			state := cl.ChargeStates[cs].ChargeState
+			m.ChargeState = state.String()
+			var current float64
+			switch {
+			case state == regenbox.Idle:
+				m.Current = &current
+			case state == regenbox.Discharging && cl.Resistor > 0:
+				// mV / ohms = mA
+				current = float64(v) / float64(cl.Resistor)
+				m.Current = &current
+			}
+		}
+		if i < len(cl.RawMeasures) {
+			raw := cl.RawMeasures[i]
+			m.RawVoltage = &raw
+		}
+		if cs := cl.Capacities; cs.has(i) {
+			m.MilliAmpHours, m.MilliWattHours = &cs.MilliAmpHours[i], &cs.MilliWattHours[i]
+		}
+		if ds := cl.Details; ds.has(i) {
+			m.Analog, m.LatencyUs, m.Retries = &ds.Analog[i], &ds.LatencyUs[i], &ds.Retries[i]
+		}
+		rows[i] = m
+	}
+	return rows
+}
+
+// Export writes cl to w in format, one of ExportFormats.
+// Csv & tsv exports start with metadata as a block of #-commented toml.
+func (cl *ChartLog) Export(w io.Writer, format string) error {
+	switch format {
+	case ExportJSON:
+		return json.NewEncoder(w).Encode(struct {
+			ChartLogHeader
+			Measures []Measure
+		}{cl.Header(), cl.Rows()})
+	case ExportCSV, ExportTSV:
+		return cl.exportCSV(w, format == ExportTSV)
+	}
+	return fmt.Errorf("unknown export format \"%s\", expected one of %s", format, strings.Join(ExportFormats, ", "))
+}
+
+func (cl *ChartLog) exportCSV(w io.Writer, tabs bool) error {
+	var header bytes.Buffer
+	err := util.WriteToml(cl.Header(), &header)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	scanner := bufio.NewScanner(&header)
+	for scanner.Scan() {
+		fmt.Fprintf(bw, "# %s\n", scanner.Text())
+	}
+
+	cw := csv.NewWriter(bw)
+	if tabs {
+		cw.Comma = '\t'
+	}
+	_ = cw.Write(exportColumns)
+	for _, m := range cl.Rows() {
+		var current, raw, analog, latency, retries, mAh, mWh string
+		if m.Current != nil {
+			current = strconv.FormatFloat(*m.Current, 'f', 3, 64)
+		}
+		if m.RawVoltage != nil {
+			raw = strconv.Itoa(*m.RawVoltage)
+		}
+		if m.Retries != nil {
+			analog, latency, retries = strconv.Itoa(*m.Analog), strconv.Itoa(*m.LatencyUs), strconv.Itoa(*m.Retries)
+		}
+		if m.MilliAmpHours != nil {
+			mAh = strconv.FormatFloat(*m.MilliAmpHours, 'f', 3, 64)
+			mWh = strconv.FormatFloat(*m.MilliWattHours, 'f', 3, 64)
+		}
+		_ = cw.Write([]string{
+			m.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+			strconv.FormatFloat(m.Elapsed, 'f', 3, 64),
+			strconv.Itoa(m.Voltage),
+			m.ChargeState,
+			current,
+			raw,
+			analog,
+			latency,
+			retries,
+			mAh,
+			mWh,
+		})
+	}
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,199 @@
+package web
+
+import (
+	"bytes"
+	"encoding/csv"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/regenbox"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testChartLog returns a discharge log of voltages, measured every second.
+func testChartLog(voltages ...int) *ChartLog {
+	cl := &ChartLog{
+		Resistor:     4,
+		ChargeStates: []ChargeStateChange{{Index: 0, ChargeState: regenbox.Discharging}},
+		Capacities:   &CapacitySeries{},
+	}
+	cl.Measures.Start = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	cl.Measures.Interval = util.Duration(time.Second)
+	var c regenbox.Capacity
+	for _, v := range voltages {
+		cl.Measures.Data = append(cl.Measures.Data, v)
+		c.MilliAmpHours += float64(v) / 4 / 3600
+		c.MilliWattHours += float64(v*v) / 4 / 3600 / 1000
+		cl.Capacities.add(c)
+	}
+	return cl
+}
+
+func TestChartLog_Rows(t *testing.T) {
+	cl := testChartLog(1200, 1190, 1180)
+	rows := cl.Rows()
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	last := rows[2]
+	if last.Elapsed != 2 || !last.Time.Equal(cl.Measures.Start.Add(time.Second*2)) {
+		t.Errorf("unexpected time of last row: %s (%vs)", last.Time, last.Elapsed)
+	}
+	if last.Current == nil || *last.Current != 295 {
+		t.Errorf("expected current of 295mA, got %v", last.Current)
+	}
+	if last.MilliAmpHours == nil || *last.MilliAmpHours != 0.248 {
+		t.Errorf("expected cumulative capacity of 0.248mAh, got %+v", last)
+	}
+
+	// older logs have no capacity series
+	cl.Capacities = nil
+	if m := cl.Rows()[2]; m.MilliAmpHours != nil || m.MilliWattHours != nil {
+		t.Errorf("expected no capacity, got %v & %v", m.MilliAmpHours, m.MilliWattHours)
+	}
+}
+
+func TestChartLog_Export(t *testing.T) {
+	cl := testChartLog(1200, 1190)
+	var buf bytes.Buffer
+	err := cl.Export(&buf, ExportCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, l := range strings.Split(buf.String(), "\n") {
+		if !strings.HasPrefix(l, "#") {
+			lines = append(lines, l)
+		}
+	}
+	records, err := csv.NewReader(strings.NewReader(strings.Join(lines, "\n"))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ",") != strings.Join(exportColumns, ",") {
+		t.Fatalf("unexpected csv: %v", records)
+	}
+	row := make(map[string]string)
+	for i, col := range records[0] {
+		row[col] = records[2][i]
+	}
+	for col, v := range map[string]string{
+		"elapsed_s":      "1.000",
+		"voltage_mV":     "1190",
+		"charge_state":   "Discharging",
+		"current_mA":     "297.500",
+		"raw_voltage_mV": "",
+		"capacity_mAh":   "0.166",
+	} {
+		if row[col] != v {
+			t.Errorf("%s: expected \"%s\", got \"%s\"", col, v, row[col])
+		}
+	}
+
+	if err = cl.Export(&buf, "xml"); err == nil {
+		t.Error("expected an error on unknown format")
+	}
+}
+
+func TestChartLog_Gaps(t *testing.T) {
+	cl := testChartLog(1200, 1190, 1180, 1170)
+	cl.Gaps = []Gap{{Index: 2, Duration: util.Duration(time.Hour)}}
+	rows := cl.Rows()
+	if rows[1].Elapsed != 1 {
+		t.Errorf("expected 1s elapsed before gap, got %vs", rows[1].Elapsed)
+	}
+	if !rows[2].Time.Equal(cl.Measures.Start.Add(time.Hour+2*time.Second)) || rows[3].Elapsed != 3603 {
+		t.Errorf("expected gap in time of rows after it, got %s (%vs) & %s (%vs)",
+			rows[2].Time, rows[2].Elapsed, rows[3].Time, rows[3].Elapsed)
+	}
+}
+
+func TestSession_Resume(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	sess := &Session{Measures: &util.TimeSeries{Start: start, End: start, Interval: util.Duration(time.Second)}}
+
+	// nothing measured yet, session simply starts over
+	sess.Resume(start.Add(time.Minute))
+	if len(sess.Gaps) != 0 || !sess.Measures.Start.Equal(start.Add(time.Minute)) {
+		t.Fatalf("unexpected resume of empty session: %v, %s", sess.Gaps, sess.Measures.Start)
+	}
+
+	sess.Measures.Data = []int{1200, 1190}
+	sess.Measures.Start, sess.Measures.End = start, start.Add(time.Second)
+	sess.Resume(start.Add(time.Second + time.Hour))
+	if len(sess.Gaps) != 1 || sess.Gaps[0].Index != 2 || sess.Gaps[0].Duration != util.Duration(time.Hour) {
+		t.Fatalf("unexpected gaps: %v", sess.Gaps)
+	}
+	sess.Measures.Add(1180)
+	sess.Measures.End = start.Add(time.Hour + 2*time.Second)
+	cl := sess.ChartLog(false, "Interrupted")
+	if cl.TotalDuration != util.Duration(2*time.Second) {
+		t.Errorf("expected 2s runtime without downtime, got %s", cl.TotalDuration)
+	}
+	if rows := cl.Rows(); !rows[2].Time.Equal(cl.Measures.End) {
+		t.Errorf("expected last row at end of log, got %s", rows[2].Time)
+	}
+}
+
+func TestSession_Checkpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goregen-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, SessionFile)
+
+	sess := &Session{Measures: util.NewTimeSeries(0, util.Duration(time.Second))}
+	sess.Measures.Add(1200)
+	if err = sess.Checkpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	saved := sess.Saved
+	if saved.IsZero() {
+		t.Fatal("expected first checkpoint to be saved")
+	}
+
+	// throttled within CheckpointInterval
+	sess.Measures.Add(1190)
+	if err = sess.Checkpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !sess.Saved.Equal(saved) {
+		t.Errorf("expected checkpoint to be throttled, saved at %s", sess.Saved)
+	}
+	loaded, err := LoadSession(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Measures.Data) != 1 {
+		t.Errorf("expected 1 measure in %s, got %v", fname, loaded.Measures.Data)
+	}
+
+	// saved on a new step
+	sess.Progress.Step++
+	if err = sess.Checkpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err = LoadSession(dir); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Progress.Step != 1 || len(loaded.Measures.Data) != 2 {
+		t.Errorf("expected step 1 with 2 measures, got step %d, %v", loaded.Progress.Step, loaded.Measures.Data)
+	}
+
+	// saved once CheckpointInterval elapsed
+	sess.Measures.Add(1180)
+	sess.Saved = sess.Saved.Add(-CheckpointInterval)
+	if err = sess.Checkpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err = LoadSession(dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Measures.Data) != 3 {
+		t.Errorf("expected 3 measures, got %v", loaded.Measures.Data)
+	}
+}
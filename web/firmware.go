@@ -0,0 +1,82 @@
+package web
+
+import (
+	"github.com/solar3s/goregen/firmware"
+	"github.com/solar3s/goregen/regenbox"
+	"log"
+	"net/http"
+)
+
+// FirmwareConfig configures firmware uploads, see package firmware.
+type FirmwareConfig struct {
+	Avrdude string // path to avrdude executable, searched in PATH if empty
+	Board   string // nano (old bootloader), nano-new or uno, defaults to nano
+}
+
+// FlashFirmware uploads prebuilt firmware variant to stopped box b with avrdude, and
+// checks it once b is reconnected. If variant is empty, current firmware is flashed
+// again if it's a known variant, else firmware.DefaultVariant.
+func FlashFirmware(b *Box, cfg FirmwareConfig, variant string) (regenbox.Firmware, error) {
+	board, err := firmware.LookupBoard(cfg.Board)
+	if err != nil {
+		return regenbox.Firmware{}, err
+	}
+	variant = firmware.TargetVariant(variant, b.Regenbox.FirmwareVersion())
+	img, err := firmware.Image(variant)
+	if err != nil {
+		return regenbox.Firmware{}, err
+	}
+	if !b.Regenbox.Stopped() {
+		return regenbox.Firmware{}, regenbox.ErrBoxRunning
+	}
+
+	log.Printf("%s: flashing firmware %s...", b.Id, variant)
+	fw, err := firmware.Flash(b.Regenbox, firmware.Avrdude{Path: cfg.Avrdude, Board: board}, variant, img)
+	if err != nil {
+		log.Printf("%s: error flashing firmware %s: %s", b.Id, variant, err)
+		return fw, err
+	}
+	log.Printf("%s: flashed firmware %s", b.Id, fw.Version)
+	return fw, nil
+}
+
+// apiFirmware describes firmware fw of b.
+func apiFirmware(b *Box, fw regenbox.Firmware) APIFirmware {
+	return APIFirmware{
+		Version:         fw.Version,
+		Protocol:        b.Regenbox.Protocol(),
+		State:           b.Regenbox.State(),
+		Known:           fw.Known,
+		Features:        fw.Features(),
+		Commands:        fw.CommandNames(),
+		AnalogScale:     fw.AnalogScale,
+		AveragedVoltage: fw.AveragedVoltage,
+		AutoAref:        fw.AutoAref,
+	}
+}
+
+// APIFlashFirmware POST /api/v1/boxes/{id}/firmware/flash?variant=v0
+func (s *Server) APIFlashFirmware(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.apiBox(w, r)
+	if !ok {
+		return
+	}
+	variant := r.URL.Query().Get("variant")
+	if variant != "" {
+		if _, err := firmware.LookupVariant(variant); err != nil {
+			apiError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+	}
+	fw, err := FlashFirmware(b, s.liveConfig().Firmware, variant)
+	switch err {
+	case nil:
+		writeJSON(w, http.StatusOK, apiFirmware(b, fw))
+	case regenbox.ErrBoxRunning:
+		apiError(w, http.StatusConflict, "%s", err)
+	case firmware.ErrNoImage:
+		apiError(w, http.StatusNotImplemented, "%s", err)
+	default:
+		apiError(w, http.StatusInternalServerError, "%s", err)
+	}
+}
@@ -0,0 +1,165 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/solar3s/goregen/regenbox"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// boxMetrics is the state of a box at the time /metrics is scraped,
+// its snapshot is the last one of live ticker (see Box.LiveSnapshot).
+type boxMetrics struct {
+	id       string
+	snapshot regenbox.Snapshot
+	progress regenbox.Progress
+	counters regenbox.Counters
+	started  time.Time // start of running session, zero if none
+}
+
+// metricsWriter writes metrics in Prometheus text exposition format.
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+// family writes header of metric name, its samples must follow.
+func (mw *metricsWriter) family(name string, typ string, help string) {
+	fmt.Fprintf(mw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes value of metric name, labels are key & value pairs.
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	mw.WriteString(name)
+	if len(labels) > 0 {
+		mw.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.WriteByte(',')
+			}
+			fmt.Fprintf(mw, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		mw.WriteByte('}')
+	}
+	mw.WriteByte(' ')
+	mw.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	mw.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Metrics exposes state & measures of every box in Prometheus text format.
+func (s *Server) Metrics(w http.ResponseWriter, r *http.Request) {
+	var boxes []boxMetrics
+	for _, b := range s.Boxes.List() {
+		bm := boxMetrics{
+			id:       b.Id,
+			snapshot: b.LiveSnapshot(),
+			progress: b.Regenbox.Progress(),
+			counters: b.Regenbox.Counters(),
+		}
+		if sess := b.Session(); sess != nil {
+			bm.started = sess.Measures.Start
+		}
+		boxes = append(boxes, bm)
+	}
+
+	var mw metricsWriter
+	mw.family("goregen_info", "gauge", "Version of goregen.")
+	mw.sample("goregen_info", 1, "version", s.Config.Web.version)
+
+	gauge := func(name string, help string, value func(bm boxMetrics) float64) {
+		mw.family(name, "gauge", help)
+		for _, bm := range boxes {
+			mw.sample(name, value(bm), "box", bm.id)
+		}
+	}
+	counter := func(name string, help string, value func(bm boxMetrics) uint64) {
+		mw.family(name, "counter", help)
+		for _, bm := range boxes {
+			mw.sample(name, float64(value(bm)), "box", bm.id)
+		}
+	}
+
+	gauge("goregen_box_voltage_millivolts", "Last voltage measured by box.", func(bm boxMetrics) float64 {
+		return float64(bm.snapshot.Voltage)
+	})
+
+	mw.family("goregen_box_charge_state", "gauge", "Charge state of box, 1 for current state.")
+	for _, bm := range boxes {
+		for _, st := range []regenbox.ChargeState{regenbox.Idle, regenbox.Charging, regenbox.Discharging} {
+			mw.sample("goregen_box_charge_state", boolValue(bm.snapshot.ChargeState == st),
+				"box", bm.id, "state", st.String())
+		}
+	}
+
+	mw.family("goregen_box_connection_state", "gauge", "Connection state of box, 1 for current state.")
+	for _, bm := range boxes {
+		for st := regenbox.Disconnected; st <= regenbox.NilBox; st++ {
+			mw.sample("goregen_box_connection_state", boolValue(bm.snapshot.State == st),
+				"box", bm.id, "state", st.String())
+		}
+	}
+
+	mw.family("goregen_box_firmware_info", "gauge", "Firmware version of box.")
+	for _, bm := range boxes {
+		mw.sample("goregen_box_firmware_info", 1, "box", bm.id, "firmware", bm.snapshot.Firmware)
+	}
+
+	gauge("goregen_box_running", "1 if a session is running on box.", func(bm boxMetrics) float64 {
+		return boolValue(bm.snapshot.Running)
+	})
+	gauge("goregen_box_paused", "1 if running session of box is paused.", func(bm boxMetrics) float64 {
+		return boolValue(bm.snapshot.Paused)
+	})
+	gauge("goregen_box_step", "Index of current (or last) step of session, half-cycle in Cycler mode, from 0.", func(bm boxMetrics) float64 {
+		return float64(bm.progress.Step)
+	})
+	gauge("goregen_box_step_elapsed_seconds", "Time spent in current (or last) step of session, pauses excluded.", func(bm boxMetrics) float64 {
+		return time.Duration(bm.progress.Elapsed).Seconds()
+	})
+	gauge("goregen_box_session_elapsed_seconds", "Time since start of running session, 0 if none.", func(bm boxMetrics) float64 {
+		if bm.started.IsZero() {
+			return 0
+		}
+		return time.Since(bm.started).Seconds()
+	})
+	gauge("goregen_box_capacity_milliamp_hours", "Charge measured through discharge resistor since start of current (or last) session.", func(bm boxMetrics) float64 {
+		return bm.snapshot.Capacity.MilliAmpHours
+	})
+	gauge("goregen_box_capacity_milliwatt_hours", "Energy measured through discharge resistor since start of current (or last) session.", func(bm boxMetrics) float64 {
+		return bm.snapshot.Capacity.MilliWattHours
+	})
+
+	counter("goregen_box_serial_read_errors_total", "Errors reading from box.", func(bm boxMetrics) uint64 {
+		return bm.counters.ReadErrors
+	})
+	counter("goregen_box_serial_write_errors_total", "Errors writing to box.", func(bm boxMetrics) uint64 {
+		return bm.counters.WriteErrors
+	})
+	counter("goregen_box_reconnections_total", "Reconnections to box by connection watcher.", func(bm boxMetrics) uint64 {
+		return bm.counters.Reconnections
+	})
+	counter("goregen_box_serial_checksum_errors_total", "Corrupted frames read from box, in framed protocol.", func(bm boxMetrics) uint64 {
+		return bm.counters.ChecksumErrors
+	})
+	counter("goregen_box_serial_stale_frames_total", "Frames from box skipped as they didn't answer current instruction.", func(bm boxMetrics) uint64 {
+		return bm.counters.StaleFrames
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, err := mw.WriteTo(w)
+	if err != nil {
+		log.Println("error writing metrics:", err)
+	}
+}
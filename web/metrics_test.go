@@ -0,0 +1,105 @@
+package web
+
+import (
+	"bufio"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/regenbox"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	var mw metricsWriter
+	mw.family("goregen_box_voltage_millivolts", "gauge", "Last voltage measured by box.")
+	mw.sample("goregen_box_voltage_millivolts", 1234.5, "box", `a"b\c`, "state", "x\ny")
+	mw.sample("goregen_info", 1)
+	expected := `# HELP goregen_box_voltage_millivolts Last voltage measured by box.
+# TYPE goregen_box_voltage_millivolts gauge
+goregen_box_voltage_millivolts{box="a\"b\\c",state="x\ny"} 1234.5
+goregen_info 1
+`
+	if mw.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", mw.String(), expected)
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Boxes[0].Regenbox.Ticker = util.Duration(time.Hour) // keep snapshot set below
+	})
+	defer ts.Close()
+	b, _ := ts.srv.Boxes.Get(testBox)
+	b.setLive(regenbox.Snapshot{
+		Time:        time.Now(),
+		Voltage:     1234,
+		ChargeState: regenbox.Charging,
+		State:       regenbox.Connected,
+		Firmware:    "sim",
+	})
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type \"%s\"", ct)
+	}
+
+	// every sample follows HELP & TYPE of its family
+	samples := make(map[string]string)
+	types := make(map[string]string)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			if len(fields) != 4 || (fields[3] != "gauge" && fields[3] != "counter") {
+				t.Errorf("invalid TYPE line: %s", line)
+				continue
+			}
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Errorf("invalid sample: %s", line)
+			continue
+		}
+		name := line[:i]
+		if j := strings.IndexByte(name, '{'); j >= 0 {
+			name = name[:j]
+		}
+		if types[name] == "" {
+			t.Errorf("sample of undeclared family: %s", line)
+		}
+		if types[name] == "counter" && !strings.HasSuffix(name, "_total") {
+			t.Errorf("counter %s should end with _total", name)
+		}
+		samples[line[:i]] = line[i+1:]
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// values come from live snapshot
+	for sample, v := range map[string]string{
+		`goregen_info{version="test"}`:                              "1",
+		`goregen_box_voltage_millivolts{box="sim"}`:                 "1234",
+		`goregen_box_charge_state{box="sim",state="Charging"}`:      "1",
+		`goregen_box_charge_state{box="sim",state="Idle"}`:          "0",
+		`goregen_box_connection_state{box="sim",state="Connected"}`: "1",
+		`goregen_box_firmware_info{box="sim",firmware="sim"}`:       "1",
+		`goregen_box_running{box="sim"}`:                            "0",
+		`goregen_box_serial_read_errors_total{box="sim"}`:           "0",
+	} {
+		if samples[sample] != v {
+			t.Errorf("expected %s %s, got \"%s\"", sample, v, samples[sample])
+		}
+	}
+}
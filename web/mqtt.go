@@ -0,0 +1,218 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/regenbox"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MQTTConfig configures the optional MQTT client. For each box, snapshots & cycle
+// messages are published under <Topic>/<box Id>/, and if Commands is set, commands
+// are received on <Topic>/<box Id>/cmd. Commands aren't authenticated by goregen:
+// anyone allowed to publish on that topic by broker controls boxes.
+type MQTTConfig struct {
+	Broker         string // tcp://host:1883, ssl://host:8883 or ws://host:port/path, MQTT is disabled if empty
+	ClientId       string
+	Username       string
+	Password       string
+	Topic          string        // root of every topic
+	QoS            byte          // 0, 1 or 2
+	Retain         bool          // retain published snapshots, for late subscribers
+	ReconnectDelay util.Duration // delay between connection attempts
+	Commands       bool          // subscribe to commands, requires Username so that broker ACLs apply
+}
+
+var DefaultMQTTConfig = MQTTConfig{
+	ClientId:       "goregen",
+	Topic:          "goregen",
+	ReconnectDelay: util.Duration(time.Second * 10),
+}
+
+// MQTTCommand is received on <Topic>/<box Id>/cmd, either as json or as
+// a bare command name (e.g. "start"). Command is one of start, stop,
+// pause, resume or config.
+type MQTTCommand struct {
+	Command string
+	Config  json.RawMessage // config command: regenbox config, only provided values are set
+	Save    bool            // config command: save config file
+}
+
+// MQTTResult is published on <Topic>/<box Id>/result after each command.
+type MQTTResult struct {
+	Command string
+	Error   string           `json:",omitempty"`
+	Config  *regenbox.Config `json:",omitempty"`
+}
+
+type mqttClient struct {
+	srv    *Server
+	cfg    MQTTConfig
+	client mqtt.Client
+}
+
+// startMQTT connects to broker in background (retrying until success), then
+// publishes snapshots & cycle messages of every box, and listens to commands.
+func (s *Server) startMQTT(cfg MQTTConfig) *mqttClient {
+	if cfg.Topic == "" {
+		cfg.Topic = DefaultMQTTConfig.Topic
+	}
+	if time.Duration(cfg.ReconnectDelay) <= 0 {
+		cfg.ReconnectDelay = DefaultMQTTConfig.ReconnectDelay
+	}
+	mc := &mqttClient{srv: s, cfg: cfg}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientId).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetWill(mc.topic("status"), "offline", cfg.QoS, true).
+		SetOnConnectHandler(mc.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("mqtt: connection to %s lost: %s", cfg.Broker, err)
+		})
+	mc.client = mqtt.NewClient(opts)
+
+	go func() {
+		for {
+			token := mc.client.Connect()
+			token.Wait()
+			if token.Error() == nil {
+				return
+			}
+			log.Printf("mqtt: couldn't connect to %s: %s", cfg.Broker, token.Error())
+			<-time.After(time.Duration(cfg.ReconnectDelay))
+		}
+	}()
+
+	for _, b := range s.Boxes.List() {
+		go mc.publishCycles(b)
+	}
+	return mc
+}
+
+func (mc *mqttClient) topic(parts ...string) string {
+	return strings.Join(append([]string{mc.cfg.Topic}, parts...), "/")
+}
+
+// onConnect announces goregen & (re)subscribes to commands of every box, if enabled.
+func (mc *mqttClient) onConnect(c mqtt.Client) {
+	log.Printf("mqtt: connected to %s", mc.cfg.Broker)
+	c.Publish(mc.topic("status"), mc.cfg.QoS, true, "online")
+	if !mc.cfg.Commands {
+		return
+	}
+	for _, b := range mc.srv.Boxes.List() {
+		b := b
+		token := c.Subscribe(mc.topic(b.Id, "cmd"), mc.cfg.QoS, func(_ mqtt.Client, msg mqtt.Message) {
+			mc.handleCommand(b, msg.Payload())
+		})
+		if token.Wait() && token.Error() != nil {
+			log.Printf("mqtt: %s: couldn't subscribe to commands: %s", b.Id, token.Error())
+		}
+	}
+}
+
+func (mc *mqttClient) publish(topic string, retained bool, payload interface{}) {
+	if !mc.client.IsConnected() {
+		return
+	}
+	mc.client.Publish(topic, mc.cfg.QoS, retained, payload)
+}
+
+func (mc *mqttClient) publishJson(topic string, retained bool, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("mqtt: error encoding %s: %s", topic, err)
+		return
+	}
+	mc.publish(topic, retained, data)
+}
+
+// publishSnapshot publishes sn as a whole, and its main values on their own topic.
+func (mc *mqttClient) publishSnapshot(b *Box, sn regenbox.Snapshot) {
+	mc.publishJson(mc.topic(b.Id, "snapshot"), mc.cfg.Retain, sn)
+	mc.publish(mc.topic(b.Id, "state"), mc.cfg.Retain, sn.State.String())
+	if sn.State != regenbox.Connected {
+		return
+	}
+	mc.publish(mc.topic(b.Id, "voltage"), mc.cfg.Retain, strconv.Itoa(sn.Voltage))
+	mc.publish(mc.topic(b.Id, "charge_state"), mc.cfg.Retain, sn.ChargeState.String())
+}
+
+// publishCycles publishes every cycle message of b, as long as goregen runs.
+func (mc *mqttClient) publishCycles(b *Box) {
+	_, ch := b.SubscribeCycles()
+	for msg := range ch {
+		mc.publishJson(mc.topic(b.Id, "cycle"), false, msg)
+	}
+}
+
+// handleCommand runs command in payload on b, and publishes its result.
+func (mc *mqttClient) handleCommand(b *Box, payload []byte) {
+	var cmd MQTTCommand
+	payload = bytes.TrimSpace(payload)
+	if bytes.HasPrefix(payload, []byte("{")) {
+		err := json.Unmarshal(payload, &cmd)
+		if err != nil {
+			mc.publishJson(mc.topic(b.Id, "result"), false, MQTTResult{Error: "couldn't decode command: " + err.Error()})
+			return
+		}
+	} else {
+		cmd.Command = string(payload)
+	}
+	cmd.Command = strings.ToLower(cmd.Command)
+	log.Printf("mqtt: %s: received command \"%s\"", b.Id, cmd.Command)
+
+	res := MQTTResult{Command: cmd.Command}
+	err := mc.run(b, cmd, &res)
+	if err != nil {
+		log.Printf("mqtt: %s: %s: %s", b.Id, cmd.Command, err)
+		res.Error = err.Error()
+	}
+	mc.publishJson(mc.topic(b.Id, "result"), false, res)
+}
+
+func (mc *mqttClient) run(b *Box, cmd MQTTCommand, res *MQTTResult) error {
+	s := mc.srv
+	switch cmd.Command {
+	case "start":
+		err := s.loadProfile(b)
+		if err != nil {
+			return err
+		}
+		return s.startSession(b, NewSession(b, s.liveConfig().User))
+	case "stop":
+		b.Regenbox.Stop()
+		return nil
+	case "pause":
+		return b.Regenbox.Pause()
+	case "resume":
+		return b.Regenbox.Resume()
+	case "config":
+		// copy current config, this allows for setting only a subset of the whole config
+		bc := b.Config()
+		if len(cmd.Config) > 0 {
+			err := json.Unmarshal(cmd.Config, &bc.Regenbox)
+			if err != nil {
+				return fmt.Errorf("couldn't decode config: %s", err)
+			}
+			err = s.setBoxConfig(b, bc, cmd.Save)
+			if err != nil {
+				return err
+			}
+		}
+		cfg := b.Regenbox.Config()
+		res.Config = &cfg
+		return nil
+	}
+	return fmt.Errorf("unknown command \"%s\"", cmd.Command)
+}
@@ -0,0 +1,201 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/solar3s/goregen/regenbox"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMQTT is a connected mqtt.Client, recording publications & subscriptions.
+type fakeMQTT struct {
+	mqtt.Client // unimplemented methods panic
+	published   []fakePublication
+	subscribed  map[string]mqtt.MessageHandler
+	sync.Mutex
+}
+
+type fakePublication struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+type fakeToken struct{}
+
+func (fakeToken) Wait() bool                     { return true }
+func (fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (fakeToken) Error() error                   { return nil }
+
+type fakeMessage struct {
+	mqtt.Message
+	payload []byte
+}
+
+func (m fakeMessage) Payload() []byte { return m.payload }
+
+func (c *fakeMQTT) IsConnected() bool { return true }
+
+func (c *fakeMQTT) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.Lock()
+	defer c.Unlock()
+	p := fakePublication{topic: topic, retained: retained}
+	switch v := payload.(type) {
+	case string:
+		p.payload = v
+	case []byte:
+		p.payload = string(v)
+	}
+	c.published = append(c.published, p)
+	return fakeToken{}
+}
+
+func (c *fakeMQTT) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.Lock()
+	defer c.Unlock()
+	if c.subscribed == nil {
+		c.subscribed = make(map[string]mqtt.MessageHandler)
+	}
+	c.subscribed[topic] = callback
+	return fakeToken{}
+}
+
+// send delivers payload to subscriber of topic, it returns false if there is none.
+func (c *fakeMQTT) send(topic string, payload string) bool {
+	c.Lock()
+	h, ok := c.subscribed[topic]
+	c.Unlock()
+	if ok {
+		h(c, fakeMessage{payload: []byte(payload)})
+	}
+	return ok
+}
+
+// last returns payload last published on topic, and flushes publications.
+func (c *fakeMQTT) last(topic string) (fakePublication, bool) {
+	c.Lock()
+	defer c.Unlock()
+	var p fakePublication
+	var ok bool
+	for _, pub := range c.published {
+		if pub.topic == topic {
+			p, ok = pub, true
+		}
+	}
+	c.published = nil
+	return p, ok
+}
+
+func TestMQTT_PublishSnapshot(t *testing.T) {
+	client := &fakeMQTT{}
+	mc := &mqttClient{cfg: MQTTConfig{Topic: "regen", Retain: true}, client: client}
+	b := &Box{Id: "box0"}
+
+	mc.publishSnapshot(b, regenbox.Snapshot{Voltage: 1234, ChargeState: regenbox.Charging, State: regenbox.Connected})
+	expected := map[string]string{
+		"regen/box0/state":        "Connected",
+		"regen/box0/voltage":      "1234",
+		"regen/box0/charge_state": "Charging",
+	}
+	if len(client.published) != len(expected)+1 {
+		t.Errorf("expected %d publications, got %v", len(expected)+1, client.published)
+	}
+	for _, p := range client.published {
+		if !p.retained {
+			t.Errorf("%s should be retained", p.topic)
+		}
+		if p.topic == "regen/box0/snapshot" {
+			var sn regenbox.Snapshot
+			err := json.Unmarshal([]byte(p.payload), &sn)
+			if err != nil || sn.Voltage != 1234 {
+				t.Errorf("unexpected snapshot %s (%v)", p.payload, err)
+			}
+		} else if expected[p.topic] != p.payload {
+			t.Errorf("%s: expected \"%s\", got \"%s\"", p.topic, expected[p.topic], p.payload)
+		}
+	}
+
+	// only state is known of disconnected boxes
+	client.published = nil
+	mc.publishSnapshot(b, regenbox.Snapshot{State: regenbox.Disconnected})
+	if _, ok := client.last("regen/box0/voltage"); ok {
+		t.Error("voltage of disconnected box shouldn't be published")
+	}
+}
+
+func TestMQTT_Commands(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.Close()
+	b, _ := ts.srv.Boxes.Get(testBox)
+	client := &fakeMQTT{}
+	mc := &mqttClient{srv: ts.srv, cfg: DefaultMQTTConfig, client: client}
+	cmdTopic, resultTopic := "goregen/"+testBox+"/cmd", "goregen/"+testBox+"/result"
+
+	// commands are disabled by default
+	mc.onConnect(client)
+	if client.send(cmdTopic, "start") {
+		t.Fatal("commands shouldn't be subscribed to unless enabled")
+	}
+
+	mc.cfg.Commands = true
+	mc.onConnect(client)
+	for _, test := range []struct {
+		payload string
+		err     string // expected in result
+		check   func(res MQTTResult) bool
+	}{
+		{payload: `{"Command": "config", "Config": {"Mode": "Discharger"}}`, check: func(res MQTTResult) bool {
+			return res.Config != nil && res.Config.Mode == regenbox.Discharger
+		}},
+		{payload: " START\n", check: func(res MQTTResult) bool {
+			return res.Command == "start" && b.Session() != nil && !b.Regenbox.Stopped()
+		}},
+		{payload: "start", err: regenbox.ErrBoxRunning.Error()},
+		{payload: `{"Command": "config", "Config": {"Mode": "Charger"}}`, err: regenbox.ErrBoxRunning.Error()},
+		{payload: "pause", check: func(res MQTTResult) bool {
+			return b.Regenbox.Snapshot().Paused
+		}},
+		{payload: "resume", check: func(res MQTTResult) bool {
+			return !b.Regenbox.Snapshot().Paused
+		}},
+		{payload: "stop"},
+		{payload: "reboot", err: "unknown command"},
+		{payload: `{"Command": `, err: "couldn't decode command"},
+	} {
+		client.send(cmdTopic, test.payload)
+		p, ok := client.last(resultTopic)
+		if !ok {
+			t.Errorf("%s: no result published", test.payload)
+			continue
+		}
+		var res MQTTResult
+		err := json.Unmarshal([]byte(p.payload), &res)
+		if err != nil {
+			t.Errorf("%s: invalid result %s", test.payload, p.payload)
+			continue
+		}
+		if test.err == "" && res.Error != "" || !strings.Contains(res.Error, test.err) {
+			t.Errorf("%s: expected error \"%s\", got \"%s\"", test.payload, test.err, res.Error)
+		}
+		if test.check != nil && !test.check(res) {
+			t.Errorf("%s: unexpected result %+v", test.payload, res)
+		}
+	}
+}
+
+func TestConfig_ValidateMQTT(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.MQTT.Broker = "tcp://localhost:1883"
+	cfg.MQTT.Commands = true
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "MQTT.Commands") {
+		t.Errorf("expected commands without Username to be rejected, got %v", err)
+	}
+	cfg.MQTT.Username = "goregen"
+	if err = cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,381 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/firmware"
+	"github.com/solar3s/goregen/regenbox"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiRoute is an endpoint of the REST API, which is both registered
+// on the router and described in the OpenAPI document from this.
+type apiRoute struct {
+	method   string
+	path     string // relative to APIPrefix, with {variables}
+	role     Role   // required role when authentication is enabled
+	tag      string
+	summary  string
+	query    []apiParam
+	body     interface{} // value of request body type, nil if none
+	status   int         // status of successful response
+	result   interface{} // value of response body type, nil if none
+	produces []string    // content types of response, application/json if empty
+	handler  http.HandlerFunc
+}
+
+// apiParam is a query parameter of an apiRoute.
+type apiParam struct {
+	name        string
+	typ         string // OpenAPI type of value
+	description string
+	enum        []string
+}
+
+// apiRoutes lists every endpoint of the REST API.
+func (s *Server) apiRoutes() []apiRoute {
+	exportFormats := apiParam{"format", "string", "export format, defaults to csv", ExportFormats}
+	var exportTypes []string
+	for _, f := range ExportFormats {
+		exportTypes = append(exportTypes, ExportContentType(f))
+	}
+	return []apiRoute{
+		{"GET", "", RoleViewer, "server", "Version of goregen & Id of every box.",
+			nil, nil, http.StatusOK, APIInfo{}, nil, s.APIInfo},
+		{"GET", "/openapi.json", RoleViewer, "server", "This document.",
+			nil, nil, http.StatusOK, map[string]interface{}{}, nil, s.APIOpenAPI},
+		{"GET", "/profiles", RoleViewer, "server", "Profiles available in Profiler mode.",
+			nil, nil, http.StatusOK, []*regenbox.Profile{}, nil, s.APIProfiles},
+		{"GET", "/boxes", RoleViewer, "boxes", "Every box, with its last snapshot & running session.",
+			nil, nil, http.StatusOK, []APIBox{}, nil, s.APIBoxes},
+		{"GET", "/boxes/{id}", RoleViewer, "boxes", "A box, with its last snapshot & running session.",
+			nil, nil, http.StatusOK, APIBox{}, nil, s.APIBox},
+		{"GET", "/boxes/{id}/snapshot", RoleViewer, "boxes", "Current state & measures of a box.",
+			nil, nil, http.StatusOK, regenbox.Snapshot{}, nil, s.APISnapshot},
+		{"GET", "/boxes/{id}/firmware", RoleViewer, "boxes", "Firmware of a box.",
+			nil, nil, http.StatusOK, APIFirmware{}, nil, s.APIFirmware},
+		{"POST", "/boxes/{id}/firmware/flash", RoleOperator, "boxes",
+			"Uploads a prebuilt firmware to a stopped box with avrdude, and checks it once box is reconnected.",
+			[]apiParam{{"variant", "string", "firmware variant, defaults to current one if known, else " +
+				firmware.DefaultVariant, firmware.VariantNames()}},
+			nil, http.StatusOK, APIFirmware{}, nil, s.APIFlashFirmware},
+		{"GET", "/boxes/{id}/config", RoleViewer, "config", "Configuration of a box.",
+			nil, nil, http.StatusOK, APIBoxConfig{}, nil, s.APIConfig},
+		{"PATCH", "/boxes/{id}/config", RoleOperator, "config", "Changes provided configuration values of a stopped box.",
+			[]apiParam{{"save", "boolean", "also save configuration file", nil}},
+			APIBoxConfig{}, http.StatusOK, APIBoxConfig{}, nil, s.APIConfig},
+		{"GET", "/boxes/{id}/calibration", RoleViewer, "config", "Voltage calibration of a box.",
+			nil, nil, http.StatusOK, APICalibration{}, nil, s.APICalibration},
+		{"PUT", "/boxes/{id}/calibration", RoleOperator, "config",
+			"Fits voltage calibration of a stopped box to reference voltages, and saves configuration file.",
+			nil, APICalibrate{}, http.StatusOK, APICalibration{}, nil, s.APICalibration},
+		{"DELETE", "/boxes/{id}/calibration", RoleOperator, "config",
+			"Removes voltage calibration of a stopped box, and saves configuration file.",
+			nil, nil, http.StatusNoContent, nil, nil, s.APICalibration},
+		{"GET", "/boxes/{id}/session", RoleViewer, "sessions", "Session running on a box.",
+			nil, nil, http.StatusOK, APISession{}, nil, s.APISession},
+		{"POST", "/boxes/{id}/session", RoleOperator, "sessions", "Starts a session with current configuration of a box.",
+			nil, nil, http.StatusCreated, APISession{}, nil, s.APIStartSession},
+		{"DELETE", "/boxes/{id}/session", RoleOperator, "sessions", "Stops session running on a box.",
+			nil, nil, http.StatusNoContent, nil, nil, s.APIStopSession},
+		{"POST", "/boxes/{id}/session/pause", RoleOperator, "sessions", "Pauses session running on a box.",
+			nil, nil, http.StatusOK, APISession{}, nil, s.APIPauseSession},
+		{"POST", "/boxes/{id}/session/resume", RoleOperator, "sessions", "Resumes paused session of a box.",
+			nil, nil, http.StatusOK, APISession{}, nil, s.APIResumeSession},
+		{"GET", "/boxes/{id}/chartlogs", RoleViewer, "chartlogs", "Chart logs of a box, most recent first.",
+			[]apiParam{
+				{"offset", "integer", "number of chart logs to skip", nil},
+				{"limit", "integer", "maximum number of chart logs, " + strconv.Itoa(APIDefaultLimit) +
+					" by default, up to " + strconv.Itoa(APIMaxLimit), nil},
+			}, nil, http.StatusOK, APIChartLogPage{}, nil, s.APIChartLogs},
+		{"GET", "/boxes/{id}/chartlogs/{name}", RoleViewer, "chartlogs", "A chart log, with its measures.",
+			nil, nil, http.StatusOK, ChartLog{}, nil, s.APIChartLog},
+		{"GET", "/boxes/{id}/chartlogs/{name}/export", RoleViewer, "chartlogs", "A chart log, exported as an attachment.",
+			[]apiParam{exportFormats}, nil, http.StatusOK, nil, exportTypes, s.APIChartLogExport},
+	}
+}
+
+// registerAPI registers API routes on router, and generates their OpenAPI document.
+func (s *Server) registerAPI(router *mux.Router, verbose bool) {
+	api := router.PathPrefix(APIPrefix).Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(apiNotFound)
+	api.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiError(w, http.StatusMethodNotAllowed, "method %s not allowed on %s", r.Method, r.URL.Path)
+	})
+	routes := s.apiRoutes()
+	for _, rt := range routes {
+		methods := []string{rt.method}
+		if rt.method == "GET" {
+			methods = append(methods, "HEAD")
+		}
+		h := Logger(s.authorize(rt.role, false, rt.handler), "api", verbose)
+		api.Handle(rt.path, h).Methods(methods...)
+		if rt.path == "" {
+			api.Handle("/", h).Methods(methods...)
+		}
+	}
+	s.openAPI = openAPIDocument(s.Config.Web.version, routes)
+}
+
+var pathVariable = regexp.MustCompile(`{([^}]+)}`)
+
+// openAPIDocument describes routes as an OpenAPI 3 document.
+func openAPIDocument(version string, routes []apiRoute) map[string]interface{} {
+	g := &schemaGenerator{
+		schemas: make(map[string]interface{}),
+		names:   make(map[reflect.Type]string),
+	}
+	errorResponse := map[string]interface{}{
+		"description": "error",
+		"content":     jsonContent(g.schema(reflect.TypeOf(APIError{}))),
+	}
+
+	paths := make(map[string]interface{})
+	for _, rt := range routes {
+		path := rt.path
+		if path == "" {
+			path = "/"
+		}
+		var params []interface{}
+		for _, m := range pathVariable.FindAllStringSubmatch(rt.path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, p := range rt.query {
+			schema := map[string]interface{}{"type": p.typ}
+			if len(p.enum) > 0 {
+				schema["enum"] = p.enum
+			}
+			params = append(params, map[string]interface{}{
+				"name": p.name, "in": "query", "description": p.description, "schema": schema,
+			})
+		}
+
+		success := map[string]interface{}{"description": http.StatusText(rt.status)}
+		switch {
+		case len(rt.produces) > 0:
+			content := make(map[string]interface{})
+			for _, typ := range rt.produces {
+				content[typ] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+			}
+			success["content"] = content
+		case rt.result != nil:
+			success["content"] = jsonContent(g.schema(reflect.TypeOf(rt.result)))
+		}
+
+		op := map[string]interface{}{
+			"summary":        rt.summary,
+			"operationId":    operationId(rt),
+			"tags":           []string{rt.tag},
+			"x-goregen-role": rt.role,
+			"responses":      map[string]interface{}{strconv.Itoa(rt.status): success, "default": errorResponse},
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if rt.body != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(g.schema(reflect.TypeOf(rt.body))),
+			}
+		}
+
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(rt.method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "goregen",
+			"version": version,
+			"description": "REST API of goregen. When authentication is enabled, requests need a session " +
+				"cookie (see /login) or an API token, and the role in x-goregen-role.",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": APIPrefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"token":   map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": sessionCookie},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"token": []string{}},
+			map[string]interface{}{"session": []string{}},
+		},
+	}
+}
+
+// operationId derives a unique name for rt, e.g. "postBoxesByIdSessionPause".
+func operationId(rt apiRoute) string {
+	id := strings.ToLower(rt.method)
+	for _, part := range strings.Split(rt.path, "/") {
+		if part == "" {
+			continue
+		}
+		if strings.HasPrefix(part, "{") {
+			v := strings.Trim(part, "{}")
+			part = "by" + strings.ToUpper(v[:1]) + v[1:]
+		}
+		part = strings.TrimSuffix(part, ".json")
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	if rt.path == "" {
+		id += "Info"
+	}
+	return id
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// enumValues lists values of types marshalled as strings.
+var enumValues = map[reflect.Type][]string{
+	reflect.TypeOf(regenbox.BotMode(0)): {
+		regenbox.Charger.String(), regenbox.Discharger.String(), regenbox.Cycler.String(), regenbox.Profiler.String(),
+	},
+	reflect.TypeOf(regenbox.ChargeState(0)): {
+		regenbox.Idle.String(), regenbox.Charging.String(), regenbox.Discharging.String(),
+	},
+	reflect.TypeOf(regenbox.State(0)): {
+		regenbox.Disconnected.String(), regenbox.Connected.String(), regenbox.WriteError.String(),
+		regenbox.ReadError.String(), regenbox.UnexpectedError.String(), regenbox.NilBox.String(),
+	},
+	reflect.TypeOf(regenbox.StepType(0)): {
+		regenbox.StepCharge.String(), regenbox.StepDischarge.String(), regenbox.StepRest.String(),
+		regenbox.StepHold.String(), regenbox.StepRepeat.String(),
+	},
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(util.Duration(0))
+	floatType    = reflect.TypeOf(util.Float(0))
+	rawType      = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaGenerator builds schemas of go types as encoded by encoding/json,
+// named structs are described once in components.
+type schemaGenerator struct {
+	schemas map[string]interface{}
+	names   map[reflect.Type]string
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		return g.schema(t.Elem())
+	}
+	if values, ok := enumValues[t]; ok {
+		return map[string]interface{}{"type": "string", "enum": values}
+	}
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]interface{}{"type": "string", "example": "1h30m0s"}
+	case floatType:
+		return map[string]interface{}{"type": "number"}
+	case rawType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + g.component(t)}
+	}
+	return map[string]interface{}{}
+}
+
+// component describes named struct t in components, once, and returns its name.
+func (g *schemaGenerator) component(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if _, taken := g.schemas[name]; taken {
+		name = t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:] + "." + name
+	}
+	g.names[t] = name
+	g.schemas[name] = nil // reserved, for recursive types
+	g.schemas[name] = g.object(t)
+	return name
+}
+
+// object describes fields of struct t, embedded structs are inlined.
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	g.fields(t, props, &required)
+	obj := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		obj["required"] = required
+	}
+	return obj
+}
+
+func (g *schemaGenerator) fields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, opts = tag[:i], tag[i:]
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.fields(ft, props, required)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package web
+
+import (
+	"fmt"
+	"github.com/rkjdid/util"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// configPollRate is how often config file is checked for changes, see WatchConfig.
+const configPollRate = time.Second * 2
+
+// WatchConfig reloads config file whenever it's modified, until stop is closed.
+func (s *Server) WatchConfig(stop <-chan struct{}) {
+	var modTime time.Time
+	if fi, err := os.Stat(s.cfgPath); err == nil {
+		modTime = fi.ModTime()
+	}
+	s.Lock()
+	if s.fileConfig == nil {
+		s.fileConfig, _ = readConfigFile(s.cfgPath)
+	}
+	s.Unlock()
+
+	ticker := time.NewTicker(configPollRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		fi, err := os.Stat(s.cfgPath)
+		if err != nil || fi.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = fi.ModTime()
+		err = s.Reload()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// readConfigFile reads config at path.
+func readConfigFile(path string) (*Config, error) {
+	var cfg *Config
+	err := util.ReadTomlFile(&cfg, path)
+	return cfg, err
+}
+
+// Reload reads config file again and applies its changes live: User, Watcher,
+// Web.WebsocketInterval, StaticDir & ProfilesDir, and Battery, Resistor & Regenbox
+// of boxes. Regenbox & Resistor changes of a running box are applied once it's
+// stopped. Other changes are logged, as they need a restart of goregen.
+func (s *Server) Reload() error {
+	cfg, err := readConfigFile(s.cfgPath)
+	if err != nil {
+		return fmt.Errorf("config reload: error reading \"%s\": %s", s.cfgPath, err)
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return fmt.Errorf("config reload: %s, nothing applied", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	// changes are relative to config file as previously read, so that
+	// command line overrides & changes made from web UI are kept
+	prev := s.fileConfig
+	if prev == nil {
+		prev = s.Config
+	}
+	s.fileConfig = cfg
+	live := s.Config
+	var changes []string
+
+	changed := func(a, b interface{}) bool {
+		return !reflect.DeepEqual(a, b)
+	}
+	restart := func(name string, a, b interface{}) {
+		if changed(a, b) {
+			log.Printf("config reload: %s changed, restart goregen to apply it", name)
+		}
+	}
+	apply := func(name string, a, b interface{}) bool {
+		if changed(a, b) {
+			changes = append(changes, name)
+			return true
+		}
+		return false
+	}
+
+	// needs a restart
+	restart("Web.ListenAddr", prev.Web.ListenAddr, cfg.Web.ListenAddr)
+	restart("Web.DataDir", prev.Web.DataDir, cfg.Web.DataDir)
+	restart("Web.Auth", prev.Web.Auth, cfg.Web.Auth)
+	restart("Web.TLS", prev.Web.TLS, cfg.Web.TLS)
+	restart("Serial", prev.Serial, cfg.Serial)
+	restart("MQTT", prev.MQTT, cfg.MQTT)
+	restart("Webhooks", prev.Webhooks, cfg.Webhooks)
+
+	// applied live
+	if apply("User", prev.User, cfg.User) {
+		live.User = cfg.User
+	}
+	if apply("Watcher.ConnPollRate", prev.Watcher, cfg.Watcher) {
+		live.Watcher = cfg.Watcher
+		for _, b := range s.Boxes.List() {
+			if b.Watcher != nil {
+				b.Watcher.SetConfig(cfg.Watcher)
+			}
+		}
+	}
+	if apply("Web.WebsocketInterval", prev.Web.WebsocketInterval, cfg.Web.WebsocketInterval) {
+		live.Web.WebsocketInterval = cfg.Web.WebsocketInterval
+	}
+	if apply("Web.StaticDir", prev.Web.StaticDir, cfg.Web.StaticDir) {
+		live.Web.StaticDir = cfg.Web.StaticDir
+	}
+	if apply("Web.ProfilesDir", prev.Web.ProfilesDir, cfg.Web.ProfilesDir) {
+		live.Web.ProfilesDir = cfg.Web.ProfilesDir
+	}
+	if apply("Firmware", prev.Firmware, cfg.Firmware) {
+		live.Firmware = cfg.Firmware
+	}
+
+	// boxes, in registration order
+	boxes, prevConfigs, configs := s.Boxes.List(), prev.BoxConfigs(), cfg.BoxConfigs()
+	if len(configs) != len(prevConfigs) {
+		log.Printf("config reload: number of boxes changed, restart goregen to apply it")
+	}
+	for i, bc := range configs {
+		if i >= len(prevConfigs) || i >= len(boxes) {
+			break
+		}
+		p, b := prevConfigs[i], boxes[i]
+		restart(b.Id+": Id & Device", [2]string{p.Id, p.Device}, [2]string{bc.Id, bc.Device})
+		cur := b.Config()
+		if apply(b.Id+": Battery", p.Battery, bc.Battery) {
+			b.Lock()
+			b.config.Battery = bc.Battery
+			b.Unlock()
+			cur.Battery = bc.Battery
+		}
+		if !changed(p.Resistor, bc.Resistor) && !changed(p.Regenbox, bc.Regenbox) {
+			continue
+		}
+		cur.Resistor, cur.Regenbox = bc.Resistor, bc.Regenbox
+		if !b.Regenbox.Stopped() {
+			log.Printf("config reload: %s is running, its Regenbox & Resistor changes will be applied once it's stopped", b.Id)
+			b.Lock()
+			b.pending = &cur
+			b.Unlock()
+			continue
+		}
+		apply(b.Id+": Resistor", p.Resistor, bc.Resistor)
+		apply(b.Id+": Regenbox", p.Regenbox, bc.Regenbox)
+		err = b.SetConfig(cur)
+		if err != nil {
+			log.Printf("config reload: %s: error setting config: %s", b.Id, err)
+		}
+	}
+	// keep config of boxes as currently applied
+	for _, b := range boxes {
+		_ = live.SetBoxConfig(b.Config())
+	}
+
+	if len(changes) > 0 {
+		log.Printf("config reload: applied %s", strings.Join(changes, ", "))
+	} else {
+		log.Println("config reload: no changes applied")
+	}
+	return nil
+}
+
+// applyPending applies config reloaded while b was running, if any.
+func (s *Server) applyPending(b *Box) {
+	b.Lock()
+	bc := b.pending
+	b.pending = nil
+	b.Unlock()
+	if bc == nil {
+		return
+	}
+	err := s.setBoxConfig(b, *bc, false)
+	if err != nil {
+		log.Printf("%s: couldn't apply reloaded config: %s", b.Id, err)
+		return
+	}
+	log.Printf("%s: applied reloaded Regenbox & Resistor config", b.Id)
+}
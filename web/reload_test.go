@@ -0,0 +1,68 @@
+package web
+
+import (
+	"fmt"
+	"github.com/rkjdid/util"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestServer_Reload reloads config while pages are served, see go test -race.
+func TestServer_Reload(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.Close()
+	s := ts.srv
+	cfg := s.liveConfig()
+	if err := util.WriteTomlFile(cfg, s.cfgPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, path := range []string{"/", "/charts", "/profiles", APIPrefix + "/profiles", "/static/css/dashboard.css"} {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, body := ts.request(t, "GET", path, "")
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("%s: expected status 200, got %s: %s", path, resp.Status, body)
+					return
+				}
+			}
+		}(path)
+	}
+
+	for i := 1; i <= 5; i++ {
+		cfg.User.Name = fmt.Sprint("user", i)
+		cfg.Web.WebsocketInterval = util.Duration(time.Duration(i) * time.Second)
+		cfg.Web.ProfilesDir = filepath.Join(ts.dir, fmt.Sprint("profiles", i))
+		cfg.Watcher.ConnPollRate = util.Duration(time.Duration(i) * time.Second)
+		if err := util.WriteTomlFile(cfg, s.cfgPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	close(stop)
+	wg.Wait()
+
+	live := s.liveConfig()
+	if live.User.Name != "user5" || live.Web.WebsocketInterval != util.Duration(5*time.Second) ||
+		live.Web.ProfilesDir != cfg.Web.ProfilesDir || live.Watcher != cfg.Watcher {
+		t.Errorf("reloaded config not applied: %+v, %+v, %+v", live.User, live.Web, live.Watcher)
+	}
+}
@@ -1,11 +1,13 @@
 package web
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/firmware"
 	"github.com/solar3s/goregen/regenbox"
 	"html/template"
 	"io"
@@ -15,12 +17,15 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	_ "net/http/pprof"
 )
 
+//go:generate go-bindata -pkg web -o assets.go -modtime 1500000000 static/...
+
 const liveInterval = util.Duration(time.Second * 15)
 const livePointsDefault = 2400
 const liveMinFrame = time.Hour * 4
@@ -30,7 +35,10 @@ type ServerConfig struct {
 	ListenAddr        string
 	StaticDir         string
 	DataDir           string
+	ProfilesDir       string // where profiles run in Profiler mode are searched for
 	WebsocketInterval util.Duration
+	Auth              AuthConfig
+	TLS               TLSConfig
 
 	verbose bool
 	version string
@@ -40,22 +48,25 @@ var DefaultServerConfig = ServerConfig{
 	ListenAddr:        "localhost:3636",
 	StaticDir:         "static",
 	DataDir:           "data",
+	ProfilesDir:       "profiles",
 	WebsocketInterval: util.Duration(time.Second),
+	Auth:              DefaultAuthConfig,
 }
 
 type Server struct {
-	Config   *Config
-	Regenbox *regenbox.RegenBox
-
-	liveDataPath string
-	liveData     *util.TimeSeries
-	cfgPath      string
-	router       *mux.Router
-	wsUpgrader   *websocket.Upgrader
-	tplFuncs     template.FuncMap
-	tplData      TemplateData
-	cycleSubs    map[int]chan regenbox.CycleMessage
-	subId        int
+	Config *Config
+	Boxes  *Registry
+
+	cfgPath    string
+	router     *mux.Router
+	wsUpgrader *websocket.Upgrader
+	tplFuncs   template.FuncMap
+	tplData    TemplateData
+	mqtt       *mqttClient // nil if MQTT is disabled
+	webhooks   []*webhook
+	auth       *authenticator // nil if authentication is disabled
+	openAPI    map[string]interface{}
+	fileConfig *Config // config file as last read, see Reload
 	sync.Mutex
 }
 
@@ -73,6 +84,11 @@ var ChartsLink = Link{
 	Name: "Charts",
 }
 
+var DashboardLink = Link{
+	Href: "/",
+	Name: "Dashboard",
+}
+
 type TemplateData struct {
 	*Config
 	Link      Link
@@ -82,20 +98,33 @@ type TemplateData struct {
 	Error     error
 	Version   string
 	Firmware  string
+	BoxId     string // current box
+	Prefix    string // url prefix for current box endpoints, empty in single-box mode
+	Boxes     []*Box
+	Profiles  []*regenbox.Profile
+	Variants  []firmware.Variant // firmwares available for flashing
+	Identity  *Identity          // authenticated user, nil if authentication is disabled
+	Next      string             // login page: where to redirect after login
 }
 
-// StartServer starts a new http.Server using provided version, RegenBox & Config.
+// StartServer starts a new http.Server using provided version, RegenBoxes & Config.
 // It either doesn't return or panics (http.Listen)
-func StartServer(version string, rbox *regenbox.RegenBox, cfg *Config, cfgPath string, verbose bool) {
+func StartServer(version string, boxes *Registry, cfg *Config, cfgPath string, verbose bool) {
+	NewServer(version, boxes, cfg, cfgPath, verbose).ListenAndServe()
+}
+
+// NewServer creates a Server using provided version, RegenBoxes & Config,
+// and starts monitoring its boxes, see ListenAndServe.
+func NewServer(version string, boxes *Registry, cfg *Config, cfgPath string, verbose bool) *Server {
 	if cfg == nil {
 		cfg = &DefaultConfig
 	}
 	cfg.Web.version = version
 	cfg.Web.verbose = verbose
 	srv := &Server{
-		Config:   cfg,
-		Regenbox: rbox,
-		cfgPath:  cfgPath,
+		Config:  cfg,
+		Boxes:   boxes,
+		cfgPath: cfgPath,
 	}
 	srv.wsUpgrader = &websocket.Upgrader{
 		ReadBufferSize:  1024,
@@ -107,117 +136,282 @@ func StartServer(version string, rbox *regenbox.RegenBox, cfg *Config, cfgPath s
 		"html": srv.RenderHtml,
 	}
 	srv.tplData = TemplateData{
-		srv.Config, ChartsLink, cfg.Web.DataDir, nil, nil, nil, version, rbox.FirmwareVersion(),
+		Config:   srv.Config,
+		Link:     ChartsLink,
+		DataDir:  cfg.Web.DataDir,
+		Version:  version,
+		Variants: firmware.Variants,
 	}
-	srv.cycleSubs = make(map[int]chan regenbox.CycleMessage)
 
-	srv.liveDataPath = filepath.Join(filepath.Dir(srv.cfgPath), liveLog)
+	if cfg.Web.Auth.Enabled() {
+		auth, err := newAuthenticator(cfg.Web.Auth)
+		if err != nil {
+			log.Fatalf("error loading authentication config: %s", err)
+		}
+		srv.auth = auth
+	}
+	srv.webhooks = startWebhooks(cfg.Webhooks)
+	if cfg.MQTT.Broker != "" {
+		srv.mqtt = srv.startMQTT(cfg.MQTT)
+	}
+	for _, b := range boxes.List() {
+		srv.initBox(b)
+	}
+
+	// router
+	srv.router = mux.NewRouter()
+
+	// pprof handlers
+	srv.router.PathPrefix("/debug/pprof/").Handler(srv.authorize(RoleOperator, false, http.DefaultServeMux))
+
+	// shh
+	srv.router.Handle("/favicon.ico", http.RedirectHandler("/static/img/icon.png", 302))
+
+	// register endpoints
+	srv.router.PathPrefix("/static/").Handler(
+		http.StripPrefix("/static/", Logger(http.HandlerFunc(srv.Static), "static", verbose))).
+		Methods("GET", "HEAD")
+	srv.router.Handle("/login",
+		Logger(http.HandlerFunc(srv.Login), "login", verbose)).
+		Methods("GET", "POST", "HEAD")
+	srv.router.Handle("/logout",
+		Logger(http.HandlerFunc(srv.Logout), "logout", verbose)).
+		Methods("GET", "POST", "HEAD")
+
+	// handle registers an endpoint allowed to role, pages redirect to login page
+	handle := func(path string, role Role, page bool, h http.HandlerFunc, name string, methods ...string) {
+		srv.router.Handle(path, Logger(srv.authorize(role, page, h), name, verbose)).Methods(methods...)
+	}
+
+	// box endpoints, at root for default box, and under /box/{id} for every box
+	for _, prefix := range []string{"", "/box/{id}"} {
+		handle(prefix+"/websocket", RoleViewer, false, srv.Websocket, "ws-snapshot", "GET", "HEAD")
+		handle(prefix+"/config", RoleViewer, false, srv.RegenboxConfigHandler, "config", "GET", "HEAD")
+		handle(prefix+"/config", RoleOperator, false, srv.RegenboxConfigHandler, "config", "POST")
+		handle(prefix+"/start", RoleOperator, false, srv.StartRegenbox, "start", "POST")
+		handle(prefix+"/stop", RoleOperator, false, srv.StopRegenbox, "stop", "POST")
+		handle(prefix+"/pause", RoleOperator, false, srv.PauseRegenbox, "pause", "POST")
+		handle(prefix+"/resume", RoleOperator, false, srv.ResumeRegenbox, "resume", "POST")
+		handle(prefix+"/chart/{path}", RoleViewer, false, srv.Chart, "chart", "GET", "HEAD")
+		handle(prefix+"/chart/{path}/export", RoleViewer, false, srv.ChartExport, "export", "GET", "HEAD")
+		handle(prefix+"/data", RoleViewer, false, srv.LiveData, "livedata", "GET", "HEAD")
+		handle(prefix+"/snapshot", RoleViewer, false, srv.Snapshot, "snapshot", "GET", "HEAD")
+		handle(prefix+"/profiles", RoleViewer, false, srv.Profiles, "profiles", "GET", "HEAD")
+		handle(prefix+"/charts", RoleViewer, true, srv.Charts, "charts", "GET", "HEAD")
+	}
+	srv.registerAPI(srv.router, verbose)
+	handle("/metrics", RoleViewer, false, srv.Metrics, "metrics", "GET", "HEAD")
+	handle("/box/{id}/", RoleViewer, true, srv.BoxHome, "web", "GET", "HEAD")
+	handle("/", RoleViewer, true, srv.Home, "web", "GET", "HEAD")
+	return srv
+}
+
+// ServeHTTP serves r with routes of s, e.g. behind another server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves s on Web.ListenAddr, over https if Web.TLS is enabled.
+// It either doesn't return or panics (http.Listen)
+func (s *Server) ListenAndServe() {
+	cfg := s.Config
+	// http root handle on gorilla router
+	httpServer := &http.Server{
+		Handler:      s.router,
+		Addr:         cfg.Web.ListenAddr,
+		WriteTimeout: 4 * time.Second,
+		ReadTimeout:  4 * time.Second,
+	}
+	if !cfg.Web.TLS.Enabled {
+		if err := httpServer.ListenAndServe(); err != nil {
+			log.Fatal("http.ListenAndServer:", err)
+		}
+		return
+	}
+
+	cert, err := loadCert(cfg.Web.TLS, cfg.Web.ListenAddr, filepath.Dir(s.cfgPath))
+	if err != nil {
+		log.Fatalf("error loading TLS certificate: %s", err)
+	}
+	httpServer.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.Web.TLS.RedirectAddr != "" {
+		go func() {
+			log.Printf("redirecting http://%s to https", cfg.Web.TLS.RedirectAddr)
+			redirect := &http.Server{
+				Handler:      redirectToHTTPS(cfg.Web.ListenAddr),
+				Addr:         cfg.Web.TLS.RedirectAddr,
+				WriteTimeout: 4 * time.Second,
+				ReadTimeout:  4 * time.Second,
+			}
+			if err := redirect.ListenAndServe(); err != nil {
+				log.Fatal("http.ListenAndServe (redirect):", err)
+			}
+		}()
+	}
+	if err := httpServer.ListenAndServeTLS("", ""); err != nil {
+		log.Fatal("http.ListenAndServeTLS:", err)
+	}
+}
+
+// initBox sets b's data directories, loads its previous live data and starts voltage monitoring.
+func (s *Server) initBox(b *Box) {
+	b.dataDir = s.Config.BoxDataDir(b.Id)
+	if s.Config.SingleBox() {
+		b.liveDataPath = filepath.Join(filepath.Dir(s.cfgPath), liveLog)
+	} else {
+		b.liveDataPath = filepath.Join(filepath.Dir(s.cfgPath),
+			fmt.Sprintf("%s_%s", strings.TrimSuffix(liveLog, filepath.Ext(liveLog)), b.Id)+filepath.Ext(liveLog))
+	}
+	err := os.MkdirAll(b.dataDir, 0755)
+	if err != nil {
+		log.Printf("%s: couldn't mkdir data directory \"%s\": %s", b.Id, b.dataDir, err)
+	}
 
 	// load live interval config item
-	if time.Duration(srv.Config.Regenbox.Ticker) < time.Millisecond*100 {
-		log.Printf("provided ticker interval (%s) is below minimum (100ms), setting to default (%s)",
-			srv.Config.Regenbox.Ticker, liveInterval)
-		srv.Config.Regenbox.Ticker = liveInterval
+	cfg := b.Config()
+	if time.Duration(cfg.Regenbox.Ticker) < time.Millisecond*100 {
+		log.Printf("%s: provided ticker interval (%s) is below minimum (100ms), setting to default (%s)",
+			b.Id, cfg.Regenbox.Ticker, liveInterval)
+		cfg.Regenbox.Ticker = liveInterval
+		_ = b.SetConfig(cfg)
 	}
 	livePoints := livePointsDefault
-	if time.Duration(srv.Config.Regenbox.Ticker)*time.Duration(livePoints) < liveMinFrame {
-		livePoints = int(liveMinFrame / time.Duration(srv.Config.Regenbox.Ticker))
+	if time.Duration(cfg.Regenbox.Ticker)*time.Duration(livePoints) < liveMinFrame {
+		livePoints = int(liveMinFrame / time.Duration(cfg.Regenbox.Ticker))
 	}
 
 	// load previous live data
-	err := util.ReadTomlFile(&srv.liveData, srv.liveDataPath)
+	err = util.ReadTomlFile(&b.liveData, b.liveDataPath)
 	if err != nil {
-		srv.liveData = util.NewTimeSeries(livePoints, srv.Config.Regenbox.Ticker)
+		b.liveData = util.NewTimeSeries(livePoints, cfg.Regenbox.Ticker)
 	} else {
 		// shift start time relative to now
-		srv.liveData.ResetStartTime()
+		b.liveData.ResetStartTime()
 		// set max length, which is unexported
-		srv.liveData.SetMaxLength(livePoints)
+		b.liveData.SetMaxLength(livePoints)
 		// reset ticker interval
-		srv.liveData.Interval = srv.Config.Regenbox.Ticker
+		b.liveData.Interval = cfg.Regenbox.Ticker
 	}
 
 	// start voltage monitoring
 	go func() {
-		ticker := time.NewTicker(time.Duration(srv.liveData.Interval))
+		ticker := time.NewTicker(time.Duration(b.liveData.Interval))
 		var sn regenbox.Snapshot
+		var state = regenbox.Disconnected
 		for range ticker.C {
-			sn = srv.Regenbox.Snapshot()
+			sn = b.Regenbox.Snapshot()
+			b.setLive(sn)
+			// on each (re)connection, box may be another one
+			if sn.State == regenbox.Connected && state != regenbox.Connected {
+				b.checkCalibration()
+			}
+			state = sn.State
+			if s.mqtt != nil {
+				s.mqtt.publishSnapshot(b, sn)
+			}
 
 			// skip if box isn't connected
 			if sn.State != regenbox.Connected {
 				continue
 			}
-			srv.liveData.Add(sn.Voltage)
+			b.liveData.Add(sn.Voltage)
 
 			// save to file every 10ticks
-			err := util.WriteTomlFile(srv.liveData, srv.liveDataPath)
+			err := util.WriteTomlFile(b.liveData, b.liveDataPath)
 			if err != nil {
-				log.Println("couldn't save live datalog:", err)
+				log.Printf("%s: couldn't save live datalog: %s", b.Id, err)
 			}
 		}
 	}()
 
-	// router
-	srv.router = mux.NewRouter()
+	// resume interrupted session
+	b.Lock()
+	sess := b.resume
+	b.resume = nil
+	b.Unlock()
+	if sess != nil {
+		err = s.resumeSession(b, sess)
+		if err != nil {
+			log.Printf("%s: couldn't resume interrupted session: %s", b.Id, err)
+		} else {
+			log.Printf("%s: resumed interrupted session at step %d (%s elapsed)", b.Id, sess.Progress.Step+1, sess.Progress.Elapsed)
+		}
+	}
+}
 
-	// pprof handlers
-	srv.router.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
+// box returns the box targeted by r, which is the default box unless an {id} is
+// part of the route. If no box is found, an error is written to w and ok is false.
+func (s *Server) box(w http.ResponseWriter, r *http.Request) (b *Box, ok bool) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		b = s.Boxes.Default()
+		if b == nil {
+			http.Error(w, ErrUnknownBox.Error(), http.StatusNotFound)
+			return nil, false
+		}
+		return b, true
+	}
+	b, err := s.Boxes.Get(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s \"%s\"", err, id), http.StatusNotFound)
+		return nil, false
+	}
+	return b, true
+}
 
-	// shh
-	srv.router.Handle("/favicon.ico", http.RedirectHandler("/static/img/icon.png", 302))
+// liveConfig returns a copy of s.Config, safe to read while
+// it's changed by Reload or from web UI.
+func (s *Server) liveConfig() Config {
+	s.Lock()
+	defer s.Unlock()
+	return *s.Config
+}
 
-	// register endpoints
-	srv.router.PathPrefix("/static/").Handler(
-		http.StripPrefix("/static/", Logger(http.HandlerFunc(srv.Static), "static", verbose))).
-		Methods("GET", "HEAD")
-	srv.router.Handle("/websocket",
-		Logger(http.HandlerFunc(srv.Websocket), "ws-snapshot", verbose)).
-		Methods("GET", "HEAD")
-	srv.router.Handle("/config",
-		Logger(http.HandlerFunc(srv.RegenboxConfigHandler), "config", verbose)).
-		Methods("GET", "POST", "HEAD")
-	srv.router.Handle("/start",
-		Logger(http.HandlerFunc(srv.StartRegenbox), "start", verbose)).
-		Methods("POST", "HEAD")
-	srv.router.Handle("/stop",
-		Logger(http.HandlerFunc(srv.StopRegenbox), "stop", verbose)).
-		Methods("POST", "HEAD")
-	srv.router.Handle("/chart/{path}",
-		Logger(http.HandlerFunc(srv.Chart), "chart", verbose)).
-		Methods("GET", "HEAD")
-	srv.router.Handle("/data",
-		Logger(http.HandlerFunc(srv.LiveData), "livedata", verbose)).
-		Methods("GET", "HEAD")
-	srv.router.Handle("/snapshot",
-		Logger(http.HandlerFunc(srv.Snapshot), "snapshot", verbose)).
-		Methods("GET", "HEAD")
-	srv.router.Handle("/charts",
-		Logger(http.HandlerFunc(srv.Charts), "charts", verbose)).
-		Methods("GET", "HEAD")
-	srv.router.Handle("/",
-		Logger(http.HandlerFunc(srv.Home), "web", verbose)).
-		Methods("GET", "HEAD")
+// templateData returns s.tplData, with a copy of live config.
+func (s *Server) templateData() TemplateData {
+	cfg := s.liveConfig()
+	data := s.tplData
+	data.Config = &cfg
+	return data
+}
 
-	// http root handle on gorilla router
-	httpServer := &http.Server{
-		Handler:      srv.router,
-		Addr:         srv.Config.Web.ListenAddr,
-		WriteTimeout: 4 * time.Second,
-		ReadTimeout:  4 * time.Second,
-	}
-	if err := httpServer.ListenAndServe(); err != nil {
-		log.Fatal("http.ListenAndServer:", err)
+// boxTplData returns template data for box b, where box
+// config values override their top-level counterparts.
+func (s *Server) boxTplData(b *Box) TemplateData {
+	bc := b.Config()
+	data := s.templateData()
+	data.Device = bc.Device
+	data.Battery = bc.Battery
+	data.Resistor = bc.Resistor
+	data.Regenbox = bc.Regenbox
+	data.Calibration = bc.Calibration
+	data.DataDir = b.DataDir()
+	data.CycleMsg = b.CycleMessage()
+	data.Firmware = b.Regenbox.FirmwareVersion()
+	data.BoxId = b.Id
+	data.Boxes = s.Boxes.List()
+	if !data.SingleBox() {
+		data.Prefix = "/box/" + b.Id
 	}
+	return data
 }
 
 // Websocket is the handler to initiate a websocket connection
 // that keeps track of regenbox state and live measurements.
 func (s *Server) Websocket(w http.ResponseWriter, r *http.Request) {
-	var interval = time.Duration(s.Config.Web.WebsocketInterval)
+	b, ok := s.box(w, r)
+	if !ok {
+		return
+	}
+	var interval = time.Duration(s.liveConfig().Web.WebsocketInterval)
+	var poll bool // interval is set by client, rather than following config
 	if v, ok := r.URL.Query()["poll"]; ok {
 		if d, err := time.ParseDuration(v[0]); err == nil {
 			interval = d
+			poll = true
 		}
 	}
 	conn, err := s.wsUpgrader.Upgrade(w, r, nil)
@@ -228,27 +422,22 @@ func (s *Server) Websocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if s.Config.Web.verbose {
-		log.Printf("websocket - subscription from %s (pollrate: %s)", conn.RemoteAddr(), interval)
+		log.Printf("websocket - subscription from %s to %s (pollrate: %s)", conn.RemoteAddr(), b.Id, interval)
 	}
 
-	go func(conn *websocket.Conn, s *Server) {
+	go func(conn *websocket.Conn, b *Box) {
 		var err error
 		// subscribe to live ticker
-		liveId, liveCh := s.liveData.Subscribe()
+		liveId, liveCh := b.liveData.Subscribe()
 		// start state ticker
 		ticker := time.NewTicker(interval)
 		// subscribe to cycle ticker
-		s.Lock()
-		cycleCh := make(chan regenbox.CycleMessage, 10)
-		cycleId := s.subId
-		s.cycleSubs[cycleId] = cycleCh
-		s.subId++
-		s.Unlock()
+		cycleId, cycleCh := b.SubscribeCycles()
 
 		data := struct {
 			Type string
 			Data interface{}
-		}{"state", s.Regenbox.Snapshot()}
+		}{"state", b.Regenbox.Snapshot()}
 		for {
 			// send regenbox state asap
 			err = conn.WriteJSON(data)
@@ -258,18 +447,22 @@ func (s *Server) Websocket(w http.ResponseWriter, r *http.Request) {
 				}
 				conn.Close()
 				ticker.Stop()
-				s.liveData.Unsubscribe(liveId)
-				s.Lock()
-				delete(s.cycleSubs, cycleId)
-				s.Unlock()
+				b.liveData.Unsubscribe(liveId)
+				b.UnsubscribeCycles(cycleId)
 				return
 			}
 
 			select {
 			case <-ticker.C:
 				// type: regenbox.Snapshot
-				data.Data = s.Regenbox.Snapshot()
+				data.Data = b.Regenbox.Snapshot()
 				data.Type = "state"
+				// follow reloaded config
+				if d := time.Duration(s.liveConfig().Web.WebsocketInterval); !poll && d != interval {
+					interval = d
+					ticker.Stop()
+					ticker = time.NewTicker(interval)
+				}
 			case x := <-liveCh:
 				// type: int
 				data.Data = x
@@ -280,43 +473,40 @@ func (s *Server) Websocket(w http.ResponseWriter, r *http.Request) {
 				data.Type = "cycle"
 			}
 		}
-	}(conn, s)
+	}(conn, b)
 }
 
-// RegenboxConfigHandler POST: s.Regenbox.SetConfig() (json encoded),
-//                             Regenbox's must be stopped first
-//                       GET: gets current s.Regenbox.Config()
+// RegenboxConfigHandler POST: b.Regenbox.SetConfig() (json encoded),
+// Regenbox's must be stopped first. GET: gets current b.Regenbox.Config()
 func (s *Server) RegenboxConfigHandler(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.box(w, r)
+	if !ok {
+		return
+	}
 	switch r.Method {
 	case http.MethodPost:
 		// copy current config, this allows for setting only a subset of the whole config
-		var cfg regenbox.Config = s.Regenbox.Config()
-		err := json.NewDecoder(r.Body).Decode(&cfg)
+		var bc = b.Config()
+		err := json.NewDecoder(r.Body).Decode(&bc.Regenbox)
 		if err != nil {
 			log.Println("error decoding json:", err)
 			http.Error(w, "couldn't decode provided json", http.StatusUnprocessableEntity)
 			return
 		}
 
-		if !s.Regenbox.Stopped() {
+		_, save := r.URL.Query()["save"]
+		err = s.setBoxConfig(b, bc, save)
+		if ve, ok := err.(regenbox.ValidationError); ok {
+			writeJSON(w, http.StatusUnprocessableEntity, APIError{
+				Status: http.StatusUnprocessableEntity, Error: ve.Error(), Fields: ve})
+			return
+		} else if err == regenbox.ErrBoxRunning {
 			http.Error(w, "regenbox must be stopped first", http.StatusConflict)
 			return
-		}
-		err = s.Regenbox.SetConfig(&cfg)
-		if err != nil {
-			log.Println("error setting config:", err)
+		} else if err != nil {
 			http.Error(w, "error setting config", http.StatusInternalServerError)
 			return
 		}
-		s.Config.Regenbox = cfg
-
-		if _, ok := r.URL.Query()["save"]; ok {
-			// save newly set config
-			err = util.WriteTomlFile(s.Config, s.cfgPath)
-			if err != nil {
-				log.Println("error writing config:", err)
-			}
-		}
 		break
 	case http.MethodGet:
 		break
@@ -327,90 +517,218 @@ func (s *Server) RegenboxConfigHandler(w http.ResponseWriter, r *http.Request) {
 
 	// encode regenbox config regardless of http method
 	w.WriteHeader(200)
-	_ = json.NewEncoder(w).Encode(s.Regenbox.Config())
+	_ = json.NewEncoder(w).Encode(b.Regenbox.Config())
 	return
 }
 
+// setBoxConfig sets bc to stopped box b, and saves config file along if save is true.
+func (s *Server) setBoxConfig(b *Box, bc BoxConfig, save bool) error {
+	if !b.Regenbox.Stopped() {
+		return regenbox.ErrBoxRunning
+	}
+	err := bc.Validate()
+	if err != nil {
+		return err
+	}
+	err = b.SetConfig(bc)
+	if err != nil {
+		log.Println("error setting config:", err)
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	err = s.Config.SetBoxConfig(bc)
+	if err != nil {
+		log.Println("error updating config:", err)
+	} else if save {
+		// save newly set config
+		err = util.WriteTomlFile(s.Config, s.cfgPath)
+		if err != nil {
+			log.Println("error writing config:", err)
+		} else {
+			// not to be reloaded as changes
+			s.fileConfig, _ = readConfigFile(s.cfgPath)
+		}
+	}
+	return nil
+}
+
+// loadProfile loads profile configured for b from Web.ProfilesDir, when in Profiler mode.
+func (s *Server) loadProfile(b *Box) error {
+	if b.Regenbox.Config().Mode != regenbox.Profiler {
+		return nil
+	}
+	p, err := regenbox.FindProfile(s.liveConfig().Web.ProfilesDir, b.Regenbox.Config().Profile)
+	if err != nil {
+		return err
+	}
+	b.Regenbox.SetProfile(p)
+	return nil
+}
+
 func (s *Server) StartRegenbox(w http.ResponseWriter, r *http.Request) {
-	err, snaps, messages := s.Regenbox.Start()
+	b, ok := s.box(w, r)
+	if !ok {
+		return
+	}
+	err := s.loadProfile(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	err = s.startSession(b, NewSession(b, s.liveConfig().User))
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	w.Write([]byte("regenbox started"))
+}
 
-	go func(cfg Config) {
-		datalog := util.NewTimeSeries(0, cfg.Regenbox.Ticker)
+// startSession starts b from sess progress, and records measures until
+// session is over. sess is checkpointed to b data directory regularly
+// (see Session.Checkpoint), and saved as a ChartLog once completed.
+func (s *Server) startSession(b *Box, sess *Session) error {
+	err, snaps, messages := b.Regenbox.StartFrom(sess.Progress)
+	if err != nil {
+		return err
+	}
+	b.setSession(sess)
 
+	go func() {
 		var sn regenbox.Snapshot
 		var msg regenbox.CycleMessage
 		for {
 			select {
 			case sn = <-snaps:
 				if s.Config.Web.verbose {
-					log.Println(sn)
+					log.Println(b.Id, sn)
 				}
 				// add to chart
-				datalog.Add(sn.Voltage)
+				sess.Add(sn)
+				sess.Progress = b.Regenbox.Progress()
+				err := sess.Checkpoint(b.DataDir())
+				if err != nil {
+					log.Printf("%s: couldn't save session checkpoint: %s", b.Id, err)
+				}
 			case msg = <-messages:
-				s.tplData.CycleMsg = &msg
 				if !msg.Final {
-					log.Printf("%s: %s - target: %dmV", msg.Type, msg.Status, msg.Target)
+					log.Printf("%s: %s: %s - target: %dmV", b.Id, msg.Type, msg.Status, msg.Target)
 				} else {
-					log.Printf("%s: %s", msg.Type, msg.Status)
+					log.Printf("%s: %s: %s", b.Id, msg.Type, msg.Status)
 				}
 
-				s.Lock()
 				// broadcast message
-				for i, ch := range s.cycleSubs {
-					if len(ch) == cap(ch) {
-						log.Printf("killing full chan %d", i)
-						delete(s.cycleSubs, i)
-					} else {
-						ch <- msg
-					}
-				}
-				s.Unlock()
+				b.broadcast(msg)
 
 				if msg.Final == true {
-					if len(datalog.Data) == 0 {
-						log.Print("Charge log empty, nothing was saved.")
-						return
+					b.setSession(nil)
+					s.applyPending(b)
+					err := RemoveSession(b.DataDir())
+					if err != nil {
+						log.Printf("%s: couldn't remove session checkpoint: %s", b.Id, err)
 					}
-					chart := ChartLog{
-						User:          cfg.User,
-						Battery:       cfg.Battery,
-						Resistor:      cfg.Resistor,
-						CycleType:     msg.Type,
-						TargetReached: !msg.Erronous,
-						TotalDuration: util.Duration(datalog.End.Round(time.Second).Sub(datalog.Start.Round(time.Second))),
-						Reason:        msg.Status,
-						Config:        cfg.Regenbox,
-						Measures:      *datalog,
+					payload := WebhookPayload{Box: b.Id, Time: time.Now(), Message: msg}
+					if len(sess.Measures.Data) == 0 {
+						log.Printf("%s: Charge log empty, nothing was saved.", b.Id)
+						s.notify(payload)
+						return
 					}
-					fname := filepath.Join(cfg.Web.DataDir, chart.FileName())
-					err := util.WriteTomlFile(chart, fname)
+					sess.CycleType = msg.Type
+					sess.Progress = b.Regenbox.Progress()
+					chart := sess.ChartLog(!msg.Erronous, msg.Status)
+					fname := filepath.Join(b.DataDir(), chart.FileName())
+					err = util.WriteTomlFile(chart, fname)
 					if err == nil {
-						log.Printf("Saved chart log: %s", fname)
+						log.Printf("%s: Saved chart log: %s", b.Id, fname)
+						header := chart.Header()
+						payload.ChartLog = &header
+						payload.FileName = chart.FileName()
 					} else {
-						log.Printf("Couldn't save chart log %s: %s", fname, err)
+						log.Printf("%s: Couldn't save chart log %s: %s", b.Id, fname, err)
 						log.Println(chart)
 					}
+					s.notify(payload)
 					return
 				}
+				s.notify(WebhookPayload{Box: b.Id, Time: time.Now(), Message: msg})
 			}
 		}
-	}(*s.Config)
+	}()
+	return nil
+}
+
+// resumeSession restores config of interrupted sess to b, and starts it again.
+func (s *Server) resumeSession(b *Box, sess *Session) error {
+	cfg := b.Config()
+	cfg.Battery = sess.Battery
+	cfg.Resistor = sess.Resistor
+	cfg.Regenbox = sess.Config
+	err := b.SetConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if sess.Profile != nil {
+		b.Regenbox.SetProfile(sess.Profile)
+	}
+	sess.Resume(time.Now())
+	return s.startSession(b, sess)
 }
 
 func (s *Server) StopRegenbox(w http.ResponseWriter, r *http.Request) {
-	s.Regenbox.Stop()
+	b, ok := s.box(w, r)
+	if !ok {
+		return
+	}
+	b.Regenbox.Stop()
 	w.Write([]byte("regenbox stopped"))
 }
 
+func (s *Server) PauseRegenbox(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.box(w, r)
+	if !ok {
+		return
+	}
+	err := b.Regenbox.Pause()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Write([]byte("regenbox paused"))
+}
+
+func (s *Server) ResumeRegenbox(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.box(w, r)
+	if !ok {
+		return
+	}
+	err := b.Regenbox.Resume()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Write([]byte("regenbox resumed"))
+}
+
+// Profiles encodes profiles available in Web.ProfilesDir as json to w.
+func (s *Server) Profiles(w http.ResponseWriter, r *http.Request) {
+	profiles, errs := regenbox.ListProfiles(s.liveConfig().Web.ProfilesDir)
+	for _, err := range errs {
+		log.Println("error loading profile:", err)
+	}
+	if profiles == nil {
+		profiles = []*regenbox.Profile{}
+	}
+	_ = json.NewEncoder(w).Encode(profiles)
+}
+
 // LiveData encodes live measurement log as json to w.
 func (s *Server) LiveData(w http.ResponseWriter, r *http.Request) {
-	err := json.NewEncoder(w).Encode(s.liveData.Padded())
+	b, ok := s.box(w, r)
+	if !ok {
+		return
+	}
+	err := json.NewEncoder(w).Encode(b.liveData.Padded())
 	if err != nil {
 		log.Println(err)
 	}
@@ -418,25 +736,75 @@ func (s *Server) LiveData(w http.ResponseWriter, r *http.Request) {
 
 // Chart encodes ChartLog from path as json to w.
 func (s *Server) Chart(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.box(w, r)
+	if !ok {
+		return
+	}
 	var cl ChartLog
-	err := util.ReadTomlFile(&cl, filepath.Join(s.Config.Web.DataDir, mux.Vars(r)["path"]))
-	if err == nil {
-		err = json.NewEncoder(w).Encode(cl)
+	err := util.ReadTomlFile(&cl, filepath.Join(b.DataDir(), mux.Vars(r)["path"]))
+	if err != nil {
+		log.Println(err)
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
 	}
+	err = json.NewEncoder(w).Encode(cl)
 	if err != nil {
 		log.Println(err)
 	}
 }
 
+// ChartExport writes chart log at path as an attachment, in format
+// from url query (csv by default), see ExportFormats.
+func (s *Server) ChartExport(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.box(w, r)
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportCSV
+	}
+	if !IsExportFormat(format) {
+		http.Error(w, fmt.Sprintf("unknown export format \"%s\", expected one of %s",
+			format, strings.Join(ExportFormats, ", ")), http.StatusBadRequest)
+		return
+	}
+	fname := mux.Vars(r)["path"]
+	var cl ChartLog
+	err := util.ReadTomlFile(&cl, filepath.Join(b.DataDir(), fname))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, err.Error(), 500)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", ExportContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", ExportFileName(fname, format)))
+	err = cl.Export(w, format)
+	if err != nil {
+		log.Printf("%s: error exporting %s: %s", b.Id, fname, err)
+	}
+}
+
 // Snapshot encodes snapshot as json to w.
 func (s *Server) Snapshot(w http.ResponseWriter, r *http.Request) {
-	_ = json.NewEncoder(w).Encode(s.Regenbox.Snapshot())
+	b, ok := s.box(w, r)
+	if !ok {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(b.Regenbox.Snapshot())
 }
 
 // Static server
 func (s *Server) Static(w http.ResponseWriter, r *http.Request) {
 	var err error
-	var tpath = filepath.Join(s.Config.Web.StaticDir, r.URL.Path)
+	var tpath = filepath.Join(s.liveConfig().Web.StaticDir, r.URL.Path)
 
 	// from s.Static folder
 	if f, err := os.Open(tpath); err == nil {
@@ -467,24 +835,56 @@ func (s *Server) Static(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-// Home serves homepage
+// Home serves homepage, which is a dashboard of all boxes
+// when there are several of them, or default box's page.
 func (s *Server) Home(w http.ResponseWriter, r *http.Request) {
+	if s.Boxes.Len() > 1 {
+		s.Dashboard(w, r)
+		return
+	}
+	s.BoxHome(w, r)
+}
+
+// BoxHome serves live page of a box
+func (s *Server) BoxHome(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.box(w, r)
+	if !ok {
+		return
+	}
 	r.URL.Path = "html/base.html"
 	tplFiles := []string{"html/base.html", "html/home.html"}
-	data := s.tplData
-	data.Link = ChartsLink
+	data := s.boxTplData(b)
+	data.Identity = requestIdentity(r)
+	data.Link = Link{Href: data.Prefix + ChartsLink.Href, Name: ChartsLink.Name}
+	data.Profiles, _ = regenbox.ListProfiles(data.Web.ProfilesDir)
+	s.makeTplHandler(tplFiles, data, s.tplFuncs).ServeHTTP(w, r)
+}
+
+// Dashboard serves an overview of all boxes
+func (s *Server) Dashboard(w http.ResponseWriter, r *http.Request) {
+	r.URL.Path = "html/base.html"
+	tplFiles := []string{"html/base.html", "html/dashboard.html"}
+	data := s.templateData()
+	data.Identity = requestIdentity(r)
+	data.Link = DashboardLink
+	data.Boxes = s.Boxes.List()
 	s.makeTplHandler(tplFiles, data, s.tplFuncs).ServeHTTP(w, r)
 }
 
 // Explorer page
 func (s *Server) Charts(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.box(w, r)
+	if !ok {
+		return
+	}
 	r.URL.Path = "html/base.html"
 	tplFiles := []string{"html/base.html", "html/charts.html"}
-	data := s.tplData
-	data.Link = HomeLink
-	data.Error, data.ChartLogs = ListChartLogs(s.Config.Web.DataDir)
+	data := s.boxTplData(b)
+	data.Identity = requestIdentity(r)
+	data.Link = Link{Href: data.Prefix + HomeLink.Href, Name: HomeLink.Name}
+	data.Error, data.ChartLogs = ListChartLogs(b.DataDir())
 	if s.Config.Web.verbose {
-		log.Printf("/charts: loaded %d chart log-infos from \"%s\"", len(data.ChartLogs), s.Config.Web.DataDir)
+		log.Printf("/charts: loaded %d chart log-infos from \"%s\"", len(data.ChartLogs), b.DataDir())
 	}
 	s.makeTplHandler(tplFiles, data, s.tplFuncs).ServeHTTP(w, r)
 }
@@ -495,14 +895,15 @@ func (s *Server) Charts(w http.ResponseWriter, r *http.Request) {
 func (s *Server) makeTplHandler(templates []string, tplData interface{}, tplFuncs template.FuncMap) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var err error
+		var staticDir = s.liveConfig().Web.StaticDir
 		var fsTemplates = make([]string, len(templates))
 		var assetsTemplates = make([]string, len(templates))
 		for i, v := range templates {
-			fsTemplates[i] = filepath.Join(s.Config.Web.StaticDir, v)
+			fsTemplates[i] = filepath.Join(staticDir, v)
 			assetsTemplates[i] = path.Join("static", v)
 		}
 		if tplData == nil {
-			tplData = s.tplData
+			tplData = s.templateData()
 		}
 		if tplFuncs == nil {
 			tplFuncs = s.tplFuncs
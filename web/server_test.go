@@ -0,0 +1,101 @@
+package web
+
+import (
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/regenbox"
+	"github.com/solar3s/goregen/regenbox/sim"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBox is the Id of the box served by newTestServer.
+const testBox = "sim"
+
+// testServer is a Server listening on a local address, see newTestServer.
+type testServer struct {
+	*httptest.Server
+	srv *Server
+	dir string
+}
+
+// newTestServer serves a simulated box in a temporary directory, with
+// DefaultConfig modified by configure (if not nil). It must be closed.
+func newTestServer(t *testing.T, configure func(cfg *Config)) *testServer {
+	dir, err := ioutil.TempDir("", "goregen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig
+	cfg.Web.DataDir = filepath.Join(dir, "data")
+	cfg.Web.StaticDir = filepath.Join(dir, "static") // serve embedded assets
+	cfg.Web.ProfilesDir = filepath.Join(dir, "profiles")
+	cfg.Regenbox.Ticker = util.Duration(100 * time.Millisecond)
+	cfg.Boxes = []BoxConfig{{
+		Id:       testBox,
+		Device:   sim.Scheme + "://nimh-aa?speed=600&test=" + t.Name(), // new battery for each test
+		Battery:  cfg.Battery,
+		Resistor: 4,
+		Regenbox: cfg.Regenbox,
+	}}
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	boxes := NewRegistry()
+	for _, bc := range cfg.BoxConfigs() {
+		port, mode, err := regenbox.OpenPortName(sim.WithResistor(bc.Device, float64(bc.Resistor)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := regenbox.NewSerial(port, mode, bc.Device, false)
+		conn.Start()
+		rbox, err := regenbox.NewRegenBox(conn, &bc.Regenbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = boxes.Add(NewBox(bc, rbox, nil))
+	}
+
+	srv := NewServer("test", boxes, &cfg, filepath.Join(dir, "config.toml"), false)
+	return &testServer{Server: httptest.NewServer(srv.router), srv: srv, dir: dir}
+}
+
+// request sends method on path of ts with body & headers (key & value pairs),
+// and returns response & its body. Redirects aren't followed.
+func (ts *testServer) request(t *testing.T, method string, path string, body string, headers ...string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// Close stops server & running sessions, and removes its directory.
+func (ts *testServer) Close() {
+	ts.Server.Close()
+	for _, b := range ts.srv.Boxes.List() {
+		b.Regenbox.Stop()
+	}
+	_ = os.RemoveAll(ts.dir)
+}
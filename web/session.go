@@ -0,0 +1,221 @@
+package web
+
+import (
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/regenbox"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SessionFile is the name of a box's running session checkpoint, in its data directory.
+const SessionFile = "session.toml"
+
+// CheckpointInterval is the minimum time between two checkpoints of a
+// running session, see Session.Checkpoint.
+var CheckpointInterval = time.Minute
+
+// Session is a checkpoint of a running session, saved regularly so that
+// a session interrupted by a crash or a reboot can be resumed, or
+// finalized as a ChartLog on next launch.
+type Session struct {
+	Box          string
+	User         User
+	Battery      Battery
+	Resistor     util.Float
+	CycleType    string
+	Config       regenbox.Config
+	Profile      *regenbox.Profile `toml:",omitempty"` // only set in Profiler mode
+	Progress     regenbox.Progress
+	Saved        time.Time // time of last checkpoint
+	Measures     *util.TimeSeries
+	Gaps         []Gap                 `toml:",omitempty"` // downtime between interruptions & resumes
+	ChargeStates []ChargeStateChange   `toml:",omitempty"`
+	Capacities   *CapacitySeries       `toml:",omitempty"` // cumulative capacity at every measure
+	Calibration  *regenbox.Calibration `toml:",omitempty"` // of box, Measures are corrected by it
+	RawMeasures  []int                 `toml:",omitempty"` // Measures before calibration, if calibrated
+	Details      *DetailSeries         `toml:",omitempty"` // of every measure, in detailed mode
+
+	savedStep int // Progress.Step of last checkpoint
+}
+
+// NewSession creates a session for box b, with its current config & profile.
+func NewSession(b *Box, user User) *Session {
+	cfg := b.Config()
+	sess := &Session{
+		Box:         b.Id,
+		User:        user,
+		Battery:     cfg.Battery,
+		Resistor:    cfg.Resistor,
+		CycleType:   cycleType(cfg.Regenbox.Mode),
+		Config:      cfg.Regenbox,
+		Measures:    util.NewTimeSeries(0, cfg.Regenbox.Ticker),
+		Capacities:  &CapacitySeries{},
+		Calibration: cfg.Calibration,
+	}
+	if cfg.Regenbox.Mode == regenbox.Profiler {
+		sess.Profile = b.Regenbox.Profile()
+	}
+	if cfg.Regenbox.DetailedLog {
+		sess.Details = &DetailSeries{AnalogScale: b.Regenbox.Firmware().AnalogScale}
+	}
+	return sess
+}
+
+// LoadSession reads session checkpoint from dir. If there is none,
+// returned error satisfies os.IsNotExist.
+func LoadSession(dir string) (*Session, error) {
+	var sess Session
+	err := util.ReadTomlFile(&sess, filepath.Join(dir, SessionFile))
+	if err != nil {
+		return nil, err
+	}
+	if sess.Measures == nil {
+		sess.Measures = util.NewTimeSeries(0, sess.Config.Ticker)
+	}
+	return &sess, nil
+}
+
+// Add records voltage, charge state & capacity of sn, and its detail in detailed mode.
+func (sess *Session) Add(sn regenbox.Snapshot) {
+	n := len(sess.ChargeStates)
+	if n == 0 || sess.ChargeStates[n-1].ChargeState != sn.ChargeState {
+		sess.ChargeStates = append(sess.ChargeStates, ChargeStateChange{
+			Index:       len(sess.Measures.Data),
+			ChargeState: sn.ChargeState,
+		})
+	}
+	sess.Measures.Add(sn.Voltage)
+	if sess.Capacities != nil {
+		sess.Capacities.add(sn.Capacity)
+	}
+	if sess.Calibration != nil {
+		sess.RawMeasures = append(sess.RawMeasures, sn.RawVoltage)
+	}
+	if sess.Details != nil {
+		sess.Details.add(sn.Detail)
+	}
+}
+
+// Resume records downtime of sess since its last measure, before it's resumed at t.
+func (sess *Session) Resume(t time.Time) {
+	m := sess.Measures
+	if len(m.Data) == 0 {
+		m.Start, m.End = t, t
+		return
+	}
+	if d := t.Sub(m.End); d > 0 {
+		sess.Gaps = append(sess.Gaps, Gap{Index: len(m.Data), Duration: util.Duration(d)})
+		m.End = t
+	}
+}
+
+// Checkpoint saves sess to dir if CheckpointInterval elapsed since its last
+// checkpoint, or if it moved on to another step since then. Measures taken
+// in between are lost on a crash, and accounted for as downtime on resume.
+func (sess *Session) Checkpoint(dir string) error {
+	if sess.Progress.Step == sess.savedStep && time.Since(sess.Saved) < CheckpointInterval {
+		return nil
+	}
+	return sess.Save(dir)
+}
+
+// Save writes sess to dir. File is written aside & renamed, so that
+// a previous checkpoint is never left truncated.
+func (sess *Session) Save(dir string) error {
+	sess.Saved = time.Now()
+	fname := filepath.Join(dir, SessionFile)
+	tmp := fname + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = util.WriteToml(sess, fd)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, fname)
+	if err == nil {
+		sess.savedStep = sess.Progress.Step
+	}
+	return err
+}
+
+// ChartLog converts sess to a ChartLog, ended for reason.
+func (sess *Session) ChartLog(targetReached bool, reason string) *ChartLog {
+	chart := &ChartLog{
+		Box:            sess.Box,
+		User:           sess.User,
+		Battery:        sess.Battery,
+		Resistor:       sess.Resistor,
+		CycleType:      sess.CycleType,
+		TargetReached:  targetReached,
+		Reason:         reason,
+		MilliAmpHours:  sess.Progress.Capacity.MilliAmpHours,
+		MilliWattHours: sess.Progress.Capacity.MilliWattHours,
+		Config:         sess.Config,
+		Gaps:           sess.Gaps,
+		ChargeStates:   sess.ChargeStates,
+		Capacities:     sess.Capacities,
+		Calibration:    sess.Calibration,
+		RawMeasures:    sess.RawMeasures,
+		Details:        sess.Details,
+	}
+	m := sess.Measures
+	chart.Measures.Start, chart.Measures.End = m.Start, m.End
+	chart.Measures.Interval, chart.Measures.Data = m.Interval, m.Data
+	chart.TotalDuration = util.Duration(m.End.Round(time.Second).Sub(m.Start.Round(time.Second)) - downtime(sess.Gaps))
+	return chart
+}
+
+// RemoveSession deletes session checkpoint from dir, if any.
+func RemoveSession(dir string) error {
+	err := os.Remove(filepath.Join(dir, SessionFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// FinalizeSession saves sess as an interrupted ChartLog in dir, and removes
+// its checkpoint. Returned path is empty if sess had no measures to save.
+func FinalizeSession(dir string, sess *Session) (string, error) {
+	var fname string
+	if len(sess.Measures.Data) > 0 {
+		chart := sess.ChartLog(false, "Interrupted")
+		fname = filepath.Join(dir, chart.FileName())
+		err := util.WriteTomlFile(chart, fname)
+		if err != nil {
+			return "", err
+		}
+	}
+	return fname, RemoveSession(dir)
+}
+
+// isSessionFile is true for session checkpoint & its temporary file.
+func isSessionFile(name string) bool {
+	return strings.HasPrefix(name, SessionFile)
+}
+
+// cycleType returns the CycleMessage.Type of sessions run in mode.
+func cycleType(mode regenbox.BotMode) string {
+	switch mode {
+	case regenbox.Charger:
+		return regenbox.CycleCharge
+	case regenbox.Discharger:
+		return regenbox.CycleDischarge
+	case regenbox.Cycler:
+		return regenbox.CycleMulti
+	case regenbox.Profiler:
+		return regenbox.CycleProfile
+	}
+	return mode.String()
+}
@@ -72,7 +72,8 @@ liveChart.initFrom = function(url, selector) {
 		});
 };
 
-liveChart.init = function (selector, data, reverse, intervalSec) {
+// gaps, if set, holds seconds of downtime before each measure of data.
+liveChart.init = function (selector, data, reverse, intervalSec, gaps) {
 	if (this.svg) {
 		// clear first
 		d3.select(selector).html("");
@@ -106,7 +107,11 @@ liveChart.init = function (selector, data, reverse, intervalSec) {
 	};
 
 	var normalAxis = function(d) {
-		return moment.duration(d*intervalSec, "seconds").format("h[h]m[m]s[s]");
+		var sec = d*intervalSec;
+		for (var i = 0; gaps && i <= d && i < gaps.length; i++) {
+			sec += gaps[i];
+		}
+		return moment.duration(sec, "seconds").format("h[h]m[m]s[s]");
 	};
 
 	// x axis
@@ -120,3 +125,68 @@ liveChart.init = function (selector, data, reverse, intervalSec) {
 		.attr("dy", ".15em")
 		.attr("transform", "rotate(-45)");
 };
+
+// drawSeries draws data as an extra line of chart, in class cls. Values are
+// plotted on voltage axis, unless unit is set: they get their own axis then,
+// right-aligned next to previous ones. Null values are left as gaps.
+liveChart.drawSeries = function (data, cls, unit) {
+	var svg = this.svg;
+	var y = svg.y;
+	if (unit) {
+		y = d3.scaleLinear()
+			.domain([0, d3.max(data) || 1])
+			.range([svg.height, 0]);
+		svg.axes = (svg.axes || 0) + 1;
+		svg.g.append("g")
+			.attr("class", "axis axis--right " + cls)
+			.attr("transform", "translate(" + (svg.width - (svg.axes - 1) * 50) + ",0)")
+			.call(d3.axisLeft(y).ticks(5).tickFormat(function (d) {
+				return d + unit;
+			}));
+	}
+	var line = d3.line()
+		.defined(function (d) {
+			return d !== null;
+		})
+		.x(function (d, i) {
+			return svg.x(i);
+		})
+		.y(function (d) {
+			return y(d);
+		});
+	svg.g.append("g")
+		.attr("clip-path", "url(#clip)")
+		.append("path")
+		.datum(data)
+		.attr("class", "series " + cls)
+		.attr("d", line);
+};
+
+// drawMarks marks measures of data greater than 0 with
+// vertical lines of class cls, titled by title(value).
+liveChart.drawMarks = function (data, cls, title) {
+	var svg = this.svg;
+	var marks = [];
+	data.forEach(function (d, i) {
+		if (d > 0) {
+			marks.push({i: i, d: d});
+		}
+	});
+	svg.g.append("g")
+		.attr("class", "marks " + cls)
+		.selectAll("line")
+		.data(marks)
+		.enter().append("line")
+		.attr("x1", function (m) {
+			return svg.x(m.i);
+		})
+		.attr("x2", function (m) {
+			return svg.x(m.i);
+		})
+		.attr("y1", 0)
+		.attr("y2", svg.height)
+		.append("title")
+		.text(function (m) {
+			return title(m.d);
+		});
+};
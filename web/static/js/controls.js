@@ -16,6 +16,111 @@ function rbCycle() {
 	}, rbStart);
 }
 
+function rbProfile() {
+	setConfig({
+		Mode: "Profiler",
+		Profile: d3.select('select.profile').property('value')
+	}, rbStart);
+}
+
+// alertError alerts error message of a failed api request.
+function alertError(what, xhr) {
+	var res = xhr.target || xhr;
+	var err = {};
+	try {
+		err = JSON.parse(res.response);
+	} catch (e) {}
+	alert(what + ': ' + (err.Error || res.statusText));
+}
+
+function rbFlash() {
+	var variant = d3.select('select.variant').property('value');
+	if (!confirm('Upload firmware ' + variant + ' to box? It will be unavailable for a few seconds.')) {
+		return;
+	}
+	d3.selectAll('.ctrl').attr('disabled', '');
+	d3.selectAll('.vFirmware').html('flashing ' + variant + '...');
+	d3.request('/api/v1/boxes/' + encodeURIComponent(boxId) + '/firmware/flash?variant=' + encodeURIComponent(variant))
+		.on('error', function(xhr) {
+			console.warn('error in flash', xhr);
+			alertError('Firmware update failed', xhr);
+			d3.selectAll('.ctrl.cUp').attr('disabled', null);
+		})
+		.post(function(xhr) {
+			var fw = JSON.parse(xhr.response);
+			alert('Box now runs firmware ' + fw.Version);
+			d3.selectAll('.ctrl.cUp').attr('disabled', null);
+		});
+}
+
+var calPoints = [];
+
+function calibrationUrl() {
+	return '/api/v1/boxes/' + encodeURIComponent(boxId) + '/calibration';
+}
+
+// calAddPoint records voltage read by box, along with voltage read on a multimeter.
+function calAddPoint() {
+	d3.json('/api/v1/boxes/' + encodeURIComponent(boxId) + '/snapshot', function(err, sn) {
+		if (err) {
+			console.warn('error reading voltage', err);
+			return;
+		}
+		var ref = prompt('Box reads ' + sn['RawVoltage'] + 'mV, voltage read on multimeter (mV):');
+		if (ref === null) {
+			return;
+		}
+		ref = parseInt(ref, 10);
+		if (!(ref > 0)) {
+			alert('expected a voltage in mV, e.g. 1312');
+			return;
+		}
+		calPoints.push({Raw: sn['RawVoltage'], Reference: ref});
+		renderCalPoints();
+	});
+}
+
+function renderCalPoints() {
+	var rows = d3.select('table.calPoints').selectAll('tr').data(calPoints);
+	rows.exit().remove();
+	rows.enter().append('tr').merge(rows).html(function(p, i) {
+		return '<td>' + (i + 1) + '.</td><td>box ' + p.Raw + 'mV</td><td>multimeter ' + p.Reference + 'mV</td>';
+	});
+}
+
+function showCalibration(cal) {
+	d3.selectAll('.calFormula').html(cal ? cal.Formula + ' (max error ' + cal.MaxError + 'mV)' : 'none');
+}
+
+function calSave() {
+	var cal = {Points: calPoints, Degree: Number(d3.select('select.calDegree').property('value'))};
+	d3.request(calibrationUrl())
+		.header('Content-Type', 'application/json')
+		.on('error', function(xhr) {
+			console.warn('error in calSave', xhr);
+			alertError('Calibration failed', xhr);
+		})
+		.send('PUT', JSON.stringify(cal), function(xhr) {
+			showCalibration(JSON.parse(xhr.response));
+			calPoints = [];
+			renderCalPoints();
+		});
+}
+
+function calRemove() {
+	if (!confirm('Remove calibration of box? Voltages will be read as is.')) {
+		return;
+	}
+	d3.request(calibrationUrl())
+		.on('error', function(xhr) {
+			console.warn('error in calRemove', xhr);
+			alertError('Removing calibration failed', xhr);
+		})
+		.send('DELETE', function() {
+			showCalibration(null);
+		});
+}
+
 function setConfig(cfg, callback) {
 	if (typeof(cfg) === 'object') {
 		cfg = JSON.stringify(cfg);
@@ -24,11 +129,19 @@ function setConfig(cfg, callback) {
 		throw new Error('expecting cfg to be a string, got ', typeof(cfg));
 	}
 
-	d3.request('/config?save')
+	d3.request(boxPrefix + '/config?save')
 		.header('Content-Type', 'application/json')
 		.mimeType('application/json')
 		.on('error', function(xhr) {
 			console.warn('error in setConfig', xhr);
+			var res = xhr.target || xhr;
+			if (res.status === 422) {
+				// rejected config, list invalid fields
+				var err = JSON.parse(res.response);
+				alert(err.Fields.map(function(f) {
+					return f.Field + ': ' + f.Message;
+				}).join('\n'));
+			}
 		})
 		.post(cfg, function(xhr) {
 			cfg = JSON.parse(xhr.response);
@@ -40,28 +153,59 @@ function setConfig(cfg, callback) {
 			d3.selectAll('.cfgBottomVoltage').html(cfg.BottomVoltage);
 			d3.selectAll('.cfgTicker').html(cfg.Ticker);
 			d3.selectAll('.cfgChargeFirst').html(cfg.ChargeFirst);
+			d3.selectAll('.cfgProfile').html(cfg.Profile);
+			d3.selectAll('.cfgDetailedLog').html(cfg.DetailedLog ? 'true' : 'false');
+			d3.selectAll('.cDetailed').property('checked', cfg.DetailedLog);
 			callback(cfg);
 		});
 }
 
+function rbDetailed(e) {
+	setConfig({
+		DetailedLog: e.checked
+	}, function () {});
+}
+
 function rbStop() {
-	d3.request('/stop')
+	d3.request(boxPrefix + '/stop')
 		.on('error', function (xhr) {
 			console.warn('error in stop', xhr);
 		})
 		.post({}, function() {
 			d3.selectAll('.ctrl.cUp').attr('disabled', null);
-			d3.selectAll('.ctrl.cDown').attr('disabled', '');
+			d3.selectAll('.ctrl.cDown, .ctrl.cPause, .ctrl.cResume').attr('disabled', '');
 		});
 }
 
 function rbStart() {
-	d3.request('/start')
+	d3.request(boxPrefix + '/start')
 		.on('error', function (xhr) {
 			console.warn('error in start', xhr);
 		})
 		.post({}, function() {
-			d3.selectAll('.ctrl.cUp').attr('disabled', '');
-			d3.selectAll('.ctrl.cDown').attr('disabled', null);
+			d3.selectAll('.ctrl.cUp, .ctrl.cResume').attr('disabled', '');
+			d3.selectAll('.ctrl.cDown, .ctrl.cPause').attr('disabled', null);
 		});
-}
\ No newline at end of file
+}
+
+function rbPause() {
+	d3.request(boxPrefix + '/pause')
+		.on('error', function (xhr) {
+			console.warn('error in pause', xhr);
+		})
+		.post({}, function() {
+			d3.selectAll('.ctrl.cPause').attr('disabled', '');
+			d3.selectAll('.ctrl.cResume').attr('disabled', null);
+		});
+}
+
+function rbResume() {
+	d3.request(boxPrefix + '/resume')
+		.on('error', function (xhr) {
+			console.warn('error in resume', xhr);
+		})
+		.post({}, function() {
+			d3.selectAll('.ctrl.cPause').attr('disabled', null);
+			d3.selectAll('.ctrl.cResume').attr('disabled', '');
+		});
+}
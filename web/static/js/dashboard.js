@@ -0,0 +1,59 @@
+var dashboard = {};
+
+// init opens a websocket for each box listed in page, and previews first box live data.
+dashboard.init = function(addr) {
+	this.listenAddr = addr;
+	var boxes = d3.selectAll('table.box').nodes();
+	boxes.forEach(function (node) {
+		dashboard.connect(node.dataset['box']);
+	});
+	if (boxes.length > 0) {
+		this.select(boxes[0].dataset['box']);
+	}
+};
+
+// select shows live data of box id on chart.
+dashboard.select = function(id) {
+	d3.selectAll('table.box').classed('selected', function () {
+		return this.dataset['box'] === id;
+	});
+	this.selected = id;
+	liveChart.initFrom('/box/' + id + '/data', '#chart');
+};
+
+dashboard.connect = function(id) {
+	var sel = function (cls) {
+		return d3.selectAll('table.box[data-box="' + id + '"] ' + cls);
+	};
+	var scheme = location.protocol === 'https:' ? 'wss://' : 'ws://';
+	var ws = new WebSocket(scheme + (location.host || this.listenAddr) + '/box/' + id + '/websocket');
+	ws.onmessage = function (e) {
+		var v = JSON.parse(e.data);
+		switch (v.Type) {
+			case "ticker":
+				if (dashboard.selected === id && liveChart.tick) {
+					liveChart.tick(v.Data);
+				}
+				return;
+			case "state":
+				sel('.vState').html(v.Data['State']);
+				if (v.Data['State'] !== 'Connected') {
+					sel('.vVoltage').html('-');
+					sel('.vChargeState').html('-');
+					return;
+				}
+				sel('.vVoltage').html(v.Data['Voltage'] + 'mV');
+				sel('.vChargeState').html(v.Data['ChargeState']);
+				return;
+			case "cycle":
+				sel('.cycleREC').classed('hidden', v.Data['Final']);
+				sel('.cyStatus').html(v.Data['Status']);
+				return;
+		}
+	};
+	ws.onclose = function () {
+		sel('.vState').html('no connection to goregen');
+		sel('.vVoltage').html('-');
+		sel('.vChargeState').html('-');
+	};
+};
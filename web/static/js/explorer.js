@@ -1,3 +1,6 @@
+// chart log shown by explorer
+var chartData;
+
 function explorerChange(e) {
 	if (e.selectedOptions.length < 1) {
 		return;
@@ -8,7 +11,12 @@ function explorerChange(e) {
 		return;
 	}
 
-	d3.request('/chart/' + opt.value)
+	var exportUrl = boxPrefix + '/chart/' + opt.value + '/export?format=';
+	d3.selectAll('.cyExport').html(['csv', 'tsv', 'json'].map(function (f) {
+		return '<a href="' + exportUrl + f + '">' + f + '</a>';
+	}).join(' / '));
+
+	d3.request(boxPrefix + '/chart/' + opt.value)
 		.header('Content-Type', 'application/json')
 		.mimeType('application/json')
 		.on('error', function (xhr) {
@@ -20,13 +28,46 @@ function explorerChange(e) {
 }
 
 function updateChart(data) {
+	chartData = data;
 	var measures = data["Measures"];
-	var interval = ((Date.parse(measures["End"]) - Date.parse(measures["Start"])) / 1000) / measures.Data.length;
-	liveChart.init("#chart", measures.Data, false, interval);
+
+	// downtime of resumed sessions, in seconds at index of measure following it
+	var gaps = measures.Data.map(function () {
+		return 0;
+	});
+	var downtime = 0;
+	(data["Gaps"] || []).forEach(function (g) {
+		gaps[g.Index] += parseDuration(g.Duration);
+		downtime += parseDuration(g.Duration);
+	});
+	var interval = ((Date.parse(measures["End"]) - Date.parse(measures["Start"])) / 1000 - downtime) / measures.Data.length;
+	liveChart.init("#chart", measures.Data, false, interval, gaps);
+	liveChart.drawMarks(gaps, 'gaps', function (sec) {
+		return 'interrupted for ' + moment.duration(sec, "seconds").format("h[h]m[m]s[s]");
+	});
+
+	// cumulative capacity, not in logs saved by older versions
+	var capacities = data["Capacities"];
+	d3.selectAll('.capToggle').attr('disabled', capacities ? null : '');
+	if (capacities && d3.select('.capToggle').property('checked')) {
+		liveChart.drawSeries(capacities.MilliAmpHours, 'capacity', 'mAh');
+	}
+
+	// detailed logs, see toggles of their extra series
+	var details = data["Details"];
+	d3.selectAll('.dtToggle').attr('disabled', details ? null : '');
+	if (details) {
+		drawDetails(details);
+	}
 
 	d3.selectAll('.cyType').html(data.CycleType);
 	d3.selectAll('.cyStatus').html(data.Reason);
 	d3.selectAll('.cyRuntime').html(data.TotalDuration);
+	if (data.MilliAmpHours) {
+		d3.selectAll('.cyCapacity').html(data.MilliAmpHours.toFixed(1) + 'mAh / ' + data.MilliWattHours.toFixed(1) + 'mWh');
+	} else {
+		d3.selectAll('.cyCapacity').html('-');
+	}
 	d3.selectAll('.cyInterval').html(measures.Interval);
 	d3.selectAll('.cyStart').html(measures.Start);
 	d3.selectAll('.cyEnd').html(measures.End);
@@ -40,6 +81,8 @@ function updateChart(data) {
 	d3.selectAll('.cfgBottomVoltage').html(cfg.BottomVoltage);
 	d3.selectAll('.cfgTicker').html(cfg.Ticker);
 	d3.selectAll('.cfgChargeFirst').html(cfg.ChargeFirst);
+	d3.selectAll('.cfgProfile').html(cfg.Profile);
+	d3.selectAll('.cfgDetailedLog').html(cfg.DetailedLog ? 'true' : 'false');
 
 	var user = data["User"];
 	d3.selectAll(".userId").html(user.BetaId);
@@ -62,3 +105,43 @@ function updateChart(data) {
 		d3.selectAll(".resValue").html("");
 	}
 }
+
+// drawDetails draws series of a detailed log that are toggled on.
+function drawDetails(details) {
+	if (d3.select('.dtAnalog').property('checked')) {
+		// in mV if firmware scale is known, else in ADC counts
+		var scale = details.AnalogScale;
+		liveChart.drawSeries(details.Analog.map(function (v) {
+			return v < 0 ? null : (scale ? v * scale : v);
+		}), 'analog', scale ? null : ' counts');
+	}
+	if (d3.select('.dtLatency').property('checked')) {
+		liveChart.drawSeries(details.LatencyUs.map(function (v) {
+			return v < 0 ? null : v / 1000;
+		}), 'latency', 'ms');
+	}
+	if (d3.select('.dtRetries').property('checked')) {
+		liveChart.drawMarks(details.Retries, 'retries', function (n) {
+			return n + ' failed or skipped answers';
+		});
+	}
+}
+
+// parseDuration returns seconds of Go formatted duration s, e.g. "1h2m3.5s".
+function parseDuration(s) {
+	var units = {h: 3600, m: 60, s: 1, ms: 1e-3, us: 1e-6, 'µs': 1e-6, ns: 1e-9};
+	var sec = 0;
+	var re = /([0-9.]+)(h|ms|m|s|us|µs|ns)/g;
+	var match;
+	while ((match = re.exec(s)) !== null) {
+		sec += parseFloat(match[1]) * units[match[2]];
+	}
+	return s.charAt(0) === '-' ? -sec : sec;
+}
+
+// toggleDetails redraws chart, after a series was toggled.
+function toggleDetails() {
+	if (chartData) {
+		updateChart(chartData);
+	}
+}
@@ -1,12 +1,45 @@
 var stateSocket = {};
-stateSocket.init = function(addr) {
+
+// wsUrl returns url of websocket path on goregen server, over wss when page is served with https.
+function wsUrl(addr, path) {
+	var scheme = location.protocol === 'https:' ? 'wss://' : 'ws://';
+	return scheme + (location.host || addr) + path;
+}
+
+// formatCapacity formats MilliAmpHours & MilliWattHours values of v.
+function formatCapacity(v) {
+	return v['MilliAmpHours'].toFixed(1) + 'mAh / ' + v['MilliWattHours'].toFixed(1) + 'mWh';
+}
+
+// loadFeatures lists features supported by firmware of current box.
+stateSocket.loadFeatures = function() {
+	if (!boxId) {
+		return;
+	}
+	d3.json('/api/v1/boxes/' + encodeURIComponent(boxId) + '/firmware', function(err, fw) {
+		if (err) {
+			console.warn('error loading firmware features', err);
+			return;
+		}
+		var features = fw['Features'] || [];
+		if (!fw['Known']) {
+			features.push('unknown firmware');
+		}
+		d3.selectAll('.vFeatures').html(features.length ? features.join(', ') : '-');
+	});
+};
+
+stateSocket.init = function(addr, prefix) {
 	if (addr) {
 		this.listenAddr = addr;
 	}
+	if (prefix !== undefined) {
+		this.prefix = prefix;
+	}
 	this.reconnectButton = '<button onclick="stateSocket.init();">Reconnect</button>';
 	d3.selectAll('.ctrl').attr('disabled', true);
 	d3.selectAll('.ws').html('connecting...');
-	var ws = new WebSocket('ws://' + this.listenAddr + '/websocket');
+	var ws = new WebSocket(wsUrl(this.listenAddr, (this.prefix || '') + '/websocket'));
 	var wsError = setTimeout(function () {
 		d3.selectAll('.vState').html('no connection to goregen');
 		var err = 'couldn\'t connect to goregen server, is it running?';
@@ -34,8 +67,12 @@ stateSocket.start = function() {
 	var clearRegenboxState = function() {
 		d3.selectAll('.vVoltage').html('-');
 		d3.selectAll('.vRawVoltage').html('');
+		d3.selectAll('.vCalRaw').html('-');
 		d3.selectAll('.vChargeState').html('-');
 		d3.selectAll('.vFirmware').html('-');
+		d3.selectAll('.vFeatures').html('-');
+		stateSocket.firmware = undefined;
+		d3.selectAll('.vCapacity').html('-');
 		d3.selectAll('.ctrl').attr('disabled', '');
 	};
 
@@ -60,10 +97,19 @@ stateSocket.start = function() {
 				var charge = v.Data['ChargeState'];
 				d3.selectAll('.vVoltage').html(v.Data['Voltage'] + 'mV');
 				d3.selectAll('.vRawVoltage').html(v.Data['Voltage']);
-				d3.selectAll('.vChargeState').html(charge);
+				d3.selectAll('.vCalRaw').html(v.Data['RawVoltage'] + 'mV');
 				d3.selectAll('.vFirmware').html(v.Data['Firmware']);
-				d3.selectAll('.ctrl.cUp').attr('disabled', charge !== 'Idle' ? '' : null);
-				d3.selectAll('.ctrl.cDown').attr('disabled', charge === 'Idle' ? '' : null);
+				if (v.Data['Firmware'] !== stateSocket.firmware) {
+					stateSocket.firmware = v.Data['Firmware'];
+					stateSocket.loadFeatures();
+				}
+				d3.selectAll('.vCapacity').html(formatCapacity(v.Data['Capacity']));
+				var running = v.Data['Running'], paused = v.Data['Paused'];
+				d3.selectAll('.vChargeState').html(paused ? charge + ' (paused)' : charge);
+				d3.selectAll('.ctrl.cUp').attr('disabled', running ? '' : null);
+				d3.selectAll('.ctrl.cDown').attr('disabled', running ? null : '');
+				d3.selectAll('.ctrl.cPause').attr('disabled', running && !paused ? null : '');
+				d3.selectAll('.ctrl.cResume').attr('disabled', paused ? null : '');
 				return;
 			case "cycle":
 				var cy = v.Data;
@@ -84,6 +130,9 @@ stateSocket.start = function() {
 				d3.selectAll('.cyType').html(cy['Type']);
 				d3.selectAll('.cyStatus').html(cy['Status']);
 				d3.selectAll('.cyTarget').html(cy['Target'] + 'mV');
+				if (cy['Capacity']['MilliAmpHours'] > 0) {
+					d3.selectAll('.cyCapacity').html(formatCapacity(cy['Capacity']));
+				}
 				return;
 			default:
 				console.error("unknown event", v);
@@ -0,0 +1,151 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Default file names of generated self-signed certificate, in goregen's root directory.
+const (
+	SelfSignedCert = "cert.pem"
+	SelfSignedKey  = "key.pem"
+)
+
+// TLSConfig enables https, using provided certificate, or a self-signed
+// one generated on first launch when CertFile & KeyFile are empty.
+type TLSConfig struct {
+	Enabled      bool
+	CertFile     string   // PEM encoded certificate (chain)
+	KeyFile      string   // PEM encoded private key of certificate
+	Hosts        []string // extra names & IPs of generated certificate, besides localhost & host of ListenAddr
+	RedirectAddr string   // if set, plain http listening address (e.g. ":80") redirecting to https
+}
+
+// certFiles returns paths to certificate & key, self-signed ones are in dir.
+func (cfg TLSConfig) certFiles(dir string) (cert string, key string, selfSigned bool) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" {
+		return filepath.Join(dir, SelfSignedCert), filepath.Join(dir, SelfSignedKey), true
+	}
+	return cfg.CertFile, cfg.KeyFile, false
+}
+
+// GenerateCert writes a new self-signed certificate & its key to certFile & keyFile,
+// valid for hosts (names or IPs).
+func GenerateCert(certFile string, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"goregen"}, CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// certHosts lists hosts a self-signed certificate is generated for.
+func certHosts(listenAddr string, extra []string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		hosts = append(hosts, name)
+	}
+	if host, _, err := net.SplitHostPort(listenAddr); err == nil && host != "" && host != "localhost" {
+		hosts = append(hosts, host)
+	}
+	seen := make(map[string]bool)
+	var unique []string
+	for _, h := range append(hosts, extra...) {
+		if !seen[h] {
+			seen[h] = true
+			unique = append(unique, h)
+		}
+	}
+	return unique
+}
+
+// loadCert loads certificate configured in cfg, generating a self-signed
+// one in dir if needed.
+func loadCert(cfg TLSConfig, listenAddr string, dir string) (tls.Certificate, error) {
+	certFile, keyFile, selfSigned := cfg.certFiles(dir)
+	if selfSigned {
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			err = GenerateCert(certFile, keyFile, certHosts(listenAddr, cfg.Hosts))
+			if err != nil {
+				return tls.Certificate{}, fmt.Errorf("couldn't generate self-signed certificate: %s", err)
+			}
+			log.Printf("generated self-signed certificate \"%s\"", certFile)
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return cert, err
+	}
+	if selfSigned {
+		sum := sha256.Sum256(cert.Certificate[0])
+		log.Printf("self-signed certificate SHA-256 fingerprint: %s", hex.EncodeToString(sum[:]))
+	}
+	return cert, nil
+}
+
+// redirectToHTTPS redirects plain http requests to same url over https, on port of tlsAddr.
+func redirectToHTTPS(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,109 @@
+package web
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCert_Provided(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goregen-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "provided.crt"), filepath.Join(dir, "provided.key")
+	if err = GenerateCert(certFile, keyFile, []string{"regen.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile}
+	cert, err := loadCert(cfg, ":8443", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = x.VerifyHostname("regen.example.com"); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, SelfSignedCert)); !os.IsNotExist(err) {
+		t.Errorf("expected no self-signed certificate with provided one, got %v", err)
+	}
+
+	cfg.KeyFile = filepath.Join(dir, "missing.key")
+	if _, err = loadCert(cfg, ":8443", dir); err == nil {
+		t.Error("expected error loading missing key")
+	}
+}
+
+func TestLoadCert_SelfSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goregen-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := TLSConfig{Enabled: true, Hosts: []string{"regen.lan", "10.0.0.2"}}
+	cert, err := loadCert(cfg, "192.168.1.10:8443", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "192.168.1.10", "regen.lan", "10.0.0.2"} {
+		if err = x.VerifyHostname(host); err != nil {
+			t.Errorf("%s: %s", host, err)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, SelfSignedKey)); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected key mode 0600, got %s", fi.Mode().Perm())
+	}
+
+	// reused on next launch
+	again, err := loadCert(cfg, "192.168.1.10:8443", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Certificate[0], cert.Certificate[0]) {
+		t.Error("expected self-signed certificate to be reused")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	for _, test := range []struct {
+		tlsAddr  string
+		host     string
+		uri      string
+		location string
+	}{
+		{":443", "regen.lan", "/", "https://regen.lan/"},
+		{":443", "regen.lan:80", "/charts?box=a", "https://regen.lan/charts?box=a"},
+		{":8443", "regen.lan:8080", "/box/a/", "https://regen.lan:8443/box/a/"},
+		{"0.0.0.0:8443", "192.168.1.10", "/", "https://192.168.1.10:8443/"},
+		{":443", "[::1]:80", "/", "https://[::1]/"},
+		{":8443", "[::1]:80", "/", "https://[::1]:8443/"},
+	} {
+		r := httptest.NewRequest("GET", test.uri, nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		redirectToHTTPS(test.tlsAddr).ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("%s%s: expected status %d, got %d", test.host, test.uri, http.StatusMovedPermanently, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != test.location {
+			t.Errorf("%s%s (tls on %s): expected redirect to %s, got %s", test.host, test.uri, test.tlsAddr, test.location, loc)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/solar3s/goregen/regenbox"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// tuiModes are switched through by key 'm' of terminal dashboard.
+var tuiModes = []regenbox.BotMode{regenbox.Charger, regenbox.Discharger, regenbox.Cycler, regenbox.Profiler}
+
+// tuiMaxPoints is the maximum number of voltages kept for the chart.
+const tuiMaxPoints = 4096
+
+// brailleDots are bits of braille cell dots, by column & row.
+var brailleDots = [2][4]rune{{0x01, 0x02, 0x04, 0x40}, {0x08, 0x10, 0x20, 0x80}}
+
+// tuiControl runs actions of terminal dashboard keys on boxes.
+type tuiControl interface {
+	Start(b *Box) error
+	Stop(b *Box)
+	Running(b *Box) bool
+	Paused(b *Box) bool
+	Pause(b *Box) error
+	Resume(b *Box) error
+	SetMode(b *Box, mode regenbox.BotMode) error
+}
+
+// serverControl is the tuiControl of a Server, acting as its http handlers do.
+type serverControl struct {
+	s *Server
+}
+
+func (c serverControl) Start(b *Box) error {
+	err := c.s.loadProfile(b)
+	if err != nil {
+		return err
+	}
+	return c.s.startSession(b, NewSession(b, c.s.liveConfig().User))
+}
+
+func (c serverControl) Stop(b *Box) {
+	b.Regenbox.Stop()
+}
+
+func (c serverControl) Running(b *Box) bool {
+	return !b.Regenbox.Stopped()
+}
+
+func (c serverControl) Paused(b *Box) bool {
+	return b.Regenbox.Paused()
+}
+
+func (c serverControl) Pause(b *Box) error {
+	return b.Regenbox.Pause()
+}
+
+func (c serverControl) Resume(b *Box) error {
+	return b.Regenbox.Resume()
+}
+
+func (c serverControl) SetMode(b *Box, mode regenbox.BotMode) error {
+	bc := b.Config()
+	bc.Regenbox.Mode = mode
+	return c.s.setBoxConfig(b, bc, false)
+}
+
+// tui is a terminal dashboard of a box, fed like websockets are.
+type tui struct {
+	s        *Server
+	control  tuiControl
+	fd       int
+	out      io.Writer
+	boxes    []*Box
+	index    int // of current box in boxes
+	voltages []int
+	snapshot regenbox.Snapshot
+	status   string                            // result of last action
+	confirm  func() (status string, quit bool) // action waiting for confirmation, if any
+}
+
+// RunTUI renders a live dashboard of boxes on terminal in & out, with keybindings
+// to start, stop, pause & switch mode of a box, until it's quit with 'q'.
+func (s *Server) RunTUI(in *os.File, out io.Writer) error {
+	fd := int(in.Fd())
+	if !terminal.IsTerminal(fd) {
+		return errors.New("tui: stdin is not a terminal")
+	}
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("tui: %s", err)
+	}
+	defer terminal.Restore(fd, state)
+	// alternate screen & hidden cursor
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+
+	done := make(chan struct{})
+	defer close(done)
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := in.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			for _, k := range buf[:n] {
+				select {
+				case keys <- k:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	t := &tui{s: s, control: serverControl{s}, fd: fd, out: out, boxes: s.Boxes.List()}
+	if len(t.boxes) == 0 {
+		return ErrUnknownBox
+	}
+	for {
+		next, quit := t.watch(t.boxes[t.index], keys)
+		if quit {
+			return nil
+		}
+		t.index = next
+	}
+}
+
+// watch renders dashboard of b on each of its events, until another box is
+// selected, or dashboard is quit.
+func (t *tui) watch(b *Box, keys <-chan byte) (next int, quit bool) {
+	// same subscriptions as Websocket
+	liveId, liveCh := b.liveData.Subscribe()
+	defer b.liveData.Unsubscribe(liveId)
+	cycleId, cycleCh := b.SubscribeCycles()
+	defer b.UnsubscribeCycles(cycleId)
+	interval := time.Duration(t.s.liveConfig().Web.WebsocketInterval)
+	ticker := time.NewTicker(interval)
+	defer func() { ticker.Stop() }()
+
+	t.voltages = append(t.voltages[:0], b.liveData.Data...)
+	t.snapshot = b.Regenbox.Snapshot()
+	for {
+		t.render(b)
+		select {
+		case <-ticker.C:
+			t.snapshot = b.Regenbox.Snapshot()
+			// follow reloaded config
+			if d := time.Duration(t.s.liveConfig().Web.WebsocketInterval); d != interval {
+				interval = d
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
+			}
+		case v, ok := <-liveCh:
+			if !ok {
+				liveCh = nil
+				continue
+			}
+			t.voltages = append(t.voltages, v)
+			if len(t.voltages) > tuiMaxPoints {
+				t.voltages = t.voltages[len(t.voltages)-tuiMaxPoints:]
+			}
+		case <-cycleCh:
+			// last message is rendered from b.CycleMessage()
+			t.snapshot = b.Regenbox.Snapshot()
+		case k, ok := <-keys:
+			if !ok {
+				return t.index, true
+			}
+			next, quit, changed := t.key(b, k)
+			if quit || changed {
+				return next, quit
+			}
+			t.snapshot = b.Regenbox.Snapshot()
+		}
+	}
+}
+
+// key handles key k pressed on dashboard of b.
+func (t *tui) key(b *Box, k byte) (next int, quit bool, changed bool) {
+	if t.confirm != nil {
+		confirm := t.confirm
+		t.confirm = nil
+		t.status = "cancelled"
+		if k == 'y' || k == 'Y' {
+			t.status, quit = confirm()
+		}
+		return t.index, quit, false
+	}
+
+	switch k {
+	case 'q', 3: // Ctrl-C
+		if b.Session() == nil {
+			return t.index, true, false
+		}
+		t.ask("a session is running, quit goregen anyway? [y/n]", func() (string, bool) { return "", true })
+	case 's':
+		err := t.control.Start(b)
+		t.status = "started " + b.Config().Regenbox.Mode.String()
+		if err != nil {
+			t.status = "couldn't start: " + err.Error()
+		}
+	case 'x':
+		if !t.control.Running(b) {
+			t.status = "not running"
+			break
+		}
+		t.ask("stop running session? [y/n]", func() (string, bool) {
+			t.control.Stop(b)
+			return "stopped", false
+		})
+	case 'p':
+		var err error
+		t.status = "paused"
+		if t.control.Paused(b) {
+			err = t.control.Resume(b)
+			t.status = "resumed"
+		} else {
+			err = t.control.Pause(b)
+		}
+		if err != nil {
+			t.status = err.Error()
+		}
+	case 'm':
+		bc := b.Config()
+		// next mode valid with current config
+		mode := bc.Regenbox.Mode
+		for i := range tuiModes {
+			if tuiModes[i] != mode {
+				continue
+			}
+			for j := 1; j < len(tuiModes); j++ {
+				bc.Regenbox.Mode = tuiModes[(i+j)%len(tuiModes)]
+				if bc.Validate() == nil {
+					break
+				}
+			}
+			break
+		}
+		err := t.control.SetMode(b, bc.Regenbox.Mode)
+		t.status = "mode set to " + bc.Regenbox.Mode.String()
+		if err == regenbox.ErrBoxRunning {
+			t.status = "box must be stopped first"
+		} else if err != nil {
+			t.status = "couldn't set mode: " + err.Error()
+		}
+	case '\t', 'n':
+		if len(t.boxes) > 1 {
+			t.status = ""
+			return (t.index + 1) % len(t.boxes), false, true
+		}
+	}
+	return t.index, false, false
+}
+
+// ask shows question, action is run if it's answered with 'y'.
+func (t *tui) ask(question string, action func() (status string, quit bool)) {
+	t.status = question
+	t.confirm = action
+}
+
+// render draws dashboard of b to fit terminal.
+func (t *tui) render(b *Box) {
+	width, height, err := terminal.GetSize(t.fd)
+	if err != nil || width < 40 || height < 16 {
+		width, height = 80, 24
+	}
+	sn := t.snapshot
+	cfg := b.Config()
+	rc := cfg.Regenbox
+
+	var lines []string
+	title := fmt.Sprintf("goregen %s - %s", t.s.Config.Web.version, b.Id)
+	if len(t.boxes) > 1 {
+		title += fmt.Sprintf(" (%d/%d)", t.index+1, len(t.boxes))
+	}
+	lines = append(lines,
+		fmt.Sprintf("\x1b[1m%s\x1b[0m%*s", title, width-len(title), time.Now().Format("15:04:05")),
+		"",
+		fmt.Sprintf("State     %-14s Firmware  %s", sn.State, sn.Firmware),
+		fmt.Sprintf("Charge    %-14s Voltage   %dmV", sn.ChargeState, sn.Voltage),
+	)
+	session := "-"
+	if sess := b.Session(); sess != nil {
+		p := b.Regenbox.Progress()
+		session = fmt.Sprintf("%s, step %d (%s), %.1fmAh", sess.CycleType, p.Step+1,
+			time.Duration(p.Elapsed).Truncate(time.Second), p.Capacity.MilliAmpHours)
+		if sn.Paused {
+			session += ", paused"
+		}
+	}
+	lines = append(lines, "Session   "+session)
+	message := "-"
+	if msg := b.CycleMessage(); msg != nil {
+		message = fmt.Sprintf("%s: %s", msg.Type, msg.Status)
+		if msg.Erronous {
+			message = "\x1b[31m" + message + "\x1b[0m"
+		}
+	}
+	lines = append(lines, "Message   "+message)
+	config := fmt.Sprintf("Config    %s, top %dmV, bottom %dmV, ticker %s", rc.Mode, rc.TopVoltage, rc.BottomVoltage, rc.Ticker)
+	switch rc.Mode {
+	case regenbox.Cycler:
+		config += fmt.Sprintf(", %d half-cycles", rc.NbHalfCycles)
+		if rc.ChargeFirst {
+			config += ", charge first"
+		}
+	case regenbox.Profiler:
+		config += ", profile " + rc.Profile
+	}
+	if rc.DetailedLog {
+		config += ", detailed log"
+	}
+	lines = append(lines, config, "")
+
+	// chart, with voltage labels on its left
+	chartHeight := height - len(lines) - 4
+	chartWidth := width - 8
+	values := t.voltages
+	if len(values) > chartWidth*2 {
+		values = values[len(values)-chartWidth*2:]
+	}
+	if len(values) == 0 {
+		lines = append(lines, "waiting for measures...")
+		for i := 1; i < chartHeight+1; i++ {
+			lines = append(lines, "")
+		}
+	} else {
+		min, max := values[0], values[0]
+		for _, v := range values {
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+		min, max = min-10, max+10
+		for i, row := range brailleChart(values, chartWidth, chartHeight, min, max) {
+			label, axis := "", "│"
+			switch i {
+			case 0:
+				label = fmt.Sprint(max)
+			case chartHeight - 1:
+				label = fmt.Sprint(min)
+			case (chartHeight - 1) / 2:
+				label = fmt.Sprint((min + max) / 2)
+			}
+			if label != "" {
+				axis = "┤"
+			}
+			lines = append(lines, fmt.Sprintf("%6s %s%s", label, axis, row))
+		}
+		span := fmt.Sprintf("-%s", time.Duration(len(values))*time.Duration(b.liveData.Interval))
+		lines = append(lines, fmt.Sprintf("%8s%s%*s", "", span, chartWidth-len(span), "now"))
+	}
+
+	lines = append(lines, "",
+		"\x1b[7m [s]tart  [x] stop  [p]ause/resume  [m]ode  [tab] next box  [q]uit \x1b[0m",
+		t.status)
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	for i, l := range lines {
+		if i >= height {
+			break
+		}
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(l)
+		buf.WriteString("\x1b[K")
+	}
+	buf.WriteString("\x1b[J")
+	_, _ = t.out.Write(buf.Bytes())
+}
+
+// brailleChart plots values as a line on width x height braille cells, of
+// 2x4 dots each, between min & max. Values are right-aligned, one per dot column.
+func brailleChart(values []int, width, height, min, max int) []string {
+	cols, rows := width*2, height*4
+	if len(values) > cols {
+		values = values[len(values)-cols:]
+	}
+	cells := make([][]rune, height)
+	for i := range cells {
+		cells[i] = make([]rune, width)
+	}
+	row := func(v int) int {
+		if max <= min {
+			return rows / 2
+		}
+		r := rows - 1 - (v-min)*(rows-1)/(max-min)
+		if r < 0 {
+			return 0
+		} else if r >= rows {
+			return rows - 1
+		}
+		return r
+	}
+
+	prev := -1
+	for i, v := range values {
+		x := cols - len(values) + i
+		lo, hi := row(v), row(v)
+		// join previous point with a vertical line
+		if prev >= 0 && prev < lo {
+			lo = prev + 1
+		} else if prev > hi {
+			hi = prev - 1
+		}
+		for y := lo; y <= hi; y++ {
+			cells[y/4][x/2] |= brailleDots[x%2][y%4]
+		}
+		prev = row(v)
+	}
+
+	lines := make([]string, height)
+	for i, cell := range cells {
+		var sb strings.Builder
+		for _, c := range cell {
+			if c == 0 {
+				sb.WriteByte(' ')
+			} else {
+				sb.WriteRune(0x2800 + c)
+			}
+		}
+		lines[i] = sb.String()
+	}
+	return lines
+}
@@ -0,0 +1,140 @@
+package web
+
+import (
+	"errors"
+	"github.com/solar3s/goregen/regenbox"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBrailleChart(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		values        []int
+		width, height int
+		min, max      int
+		expected      []string
+	}{
+		{"rising", []int{0, 1, 2, 3}, 2, 1, 0, 3, []string{"⡠⠊"}},
+		{"right-aligned", []int{0, 3}, 2, 1, 0, 3, []string{" ⡸"}},
+		{"last values only", []int{3, 3, 3, 0, 3}, 2, 1, 0, 3, []string{"⠉⡾"}},
+		{"flat", []int{5, 5}, 1, 2, 5, 5, []string{" ", "⠉"}},
+		{"clipped", []int{-10, 10}, 1, 1, 0, 3, []string{"⡸"}},
+		{"joined rows", []int{0, 7}, 1, 2, 0, 7, []string{"⢸", "⡸"}},
+	} {
+		lines := brailleChart(test.values, test.width, test.height, test.min, test.max)
+		if !reflect.DeepEqual(lines, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, lines)
+		}
+	}
+}
+
+// fakeControl records actions run by keys of dashboard, see tuiControl.
+type fakeControl struct {
+	calls   []string
+	running bool
+	paused  bool
+	err     error // returned by every action
+}
+
+func (c *fakeControl) Start(b *Box) error {
+	c.calls = append(c.calls, "start")
+	c.running = c.err == nil
+	return c.err
+}
+
+func (c *fakeControl) Stop(b *Box) {
+	c.calls = append(c.calls, "stop")
+	c.running = false
+}
+
+func (c *fakeControl) Running(b *Box) bool { return c.running }
+func (c *fakeControl) Paused(b *Box) bool  { return c.paused }
+
+func (c *fakeControl) Pause(b *Box) error {
+	c.calls = append(c.calls, "pause")
+	c.paused = c.err == nil
+	return c.err
+}
+
+func (c *fakeControl) Resume(b *Box) error {
+	c.calls = append(c.calls, "resume")
+	c.paused = c.err != nil
+	return c.err
+}
+
+func (c *fakeControl) SetMode(b *Box, mode regenbox.BotMode) error {
+	c.calls = append(c.calls, "mode "+mode.String())
+	return c.err
+}
+
+func TestTUI_Key(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Boxes = append(cfg.Boxes, cfg.Boxes[0])
+		cfg.Boxes[1].Id = "other"
+		cfg.Boxes[1].Device += "-other"
+	})
+	defer ts.Close()
+	boxes := ts.srv.Boxes.List()
+	b := boxes[0]
+	if b.Config().Regenbox.Mode != regenbox.Charger {
+		t.Fatalf("expected box in %s mode, got %s", regenbox.Charger, b.Config().Regenbox.Mode)
+	}
+	control := &fakeControl{}
+	tu := &tui{s: ts.srv, control: control, boxes: boxes}
+
+	errBusy := errors.New("busy")
+	for _, test := range []struct {
+		keys   string
+		err    error
+		calls  []string
+		status string
+		quit   bool
+	}{
+		{"x", nil, nil, "not running", false},
+		{"s", nil, []string{"start"}, "started Charger", false},
+		{"p", nil, []string{"pause"}, "paused", false},
+		{"p", nil, []string{"resume"}, "resumed", false},
+		{"p", errBusy, []string{"pause"}, "busy", false},
+		{"xn", nil, nil, "cancelled", false},
+		{"xy", nil, []string{"stop"}, "stopped", false},
+		{"s", errBusy, []string{"start"}, "couldn't start: busy", false},
+		{"m", nil, []string{"mode Discharger"}, "mode set to Discharger", false},
+		{"m", regenbox.ErrBoxRunning, []string{"mode Discharger"}, "box must be stopped first", false},
+		{"z", nil, nil, "box must be stopped first", false}, // unbound
+		{"q", nil, nil, "box must be stopped first", true},
+	} {
+		control.calls, control.err = nil, test.err
+		var quit bool
+		for _, k := range []byte(test.keys) {
+			_, quit, _ = tu.key(b, k)
+		}
+		if !reflect.DeepEqual(control.calls, test.calls) || tu.status != test.status || quit != test.quit {
+			t.Errorf("keys %q: expected calls %v, status \"%s\" & quit %t, got %v, \"%s\" & %t",
+				test.keys, test.calls, test.status, test.quit, control.calls, tu.status, quit)
+		}
+	}
+
+	// a running session is confirmed before quitting
+	control.err = nil
+	if _, quit, _ := tu.key(b, 'q'); !quit {
+		t.Error("expected quit without session")
+	}
+	b.setSession(&Session{})
+	if _, quit, _ := tu.key(b, 3); quit || !strings.Contains(tu.status, "quit goregen anyway") {
+		t.Errorf("expected confirmation of quit, got \"%s\"", tu.status)
+	}
+	if _, quit, _ := tu.key(b, 'y'); !quit {
+		t.Error("expected quit once confirmed")
+	}
+	b.setSession(nil)
+
+	// next box
+	if next, quit, changed := tu.key(b, '\t'); next != 1 || quit || !changed {
+		t.Errorf("expected switch to box 1, got %d, %t, %t", next, quit, changed)
+	}
+	if len(control.calls) != 0 {
+		t.Errorf("unexpected actions %v", control.calls)
+	}
+}
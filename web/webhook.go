@@ -0,0 +1,212 @@
+package web
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/rkjdid/util"
+	"github.com/solar3s/goregen/regenbox"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// WebhookSignatureHeader holds HMAC-SHA256 of body, keyed with WebhookConfig.Secret.
+const WebhookSignatureHeader = "X-Goregen-Signature"
+
+const webhookQueueSize = 64
+
+// webhookRetryDelay is the delay before retrying a failed delivery, doubled after each attempt.
+var webhookRetryDelay = time.Second
+
+// WebhookConfig configures an url POSTed to on cycle messages, in a [[Webhooks]] section.
+type WebhookConfig struct {
+	URL         string
+	Template    string        // text/template of body, executed with a WebhookPayload (json encoded payload if empty)
+	ContentType string        // defaults to application/json
+	Secret      string        // if set, body is signed in X-Goregen-Signature header as "sha256=<hex hmac>"
+	FinalOnly   bool          // only send final messages (session completed, timed out, stopped...)
+	ErrorsOnly  bool          // only send erronous messages
+	Boxes       []string      // only send messages of these box Ids, all boxes if empty
+	Retries     int           // attempts after a failed delivery, with exponential backoff (default: 3, -1: none)
+	Timeout     util.Duration // of each attempt
+}
+
+var DefaultWebhookConfig = WebhookConfig{
+	ContentType: "application/json",
+	Retries:     3,
+	Timeout:     util.Duration(time.Second * 10),
+}
+
+// WebhookPayload is sent to webhooks for each cycle message.
+type WebhookPayload struct {
+	Box      string
+	Time     time.Time
+	Message  regenbox.CycleMessage
+	ChartLog *ChartLogHeader `json:",omitempty"` // summary of saved chart log, final messages only
+	FileName string          `json:",omitempty"` // name of saved chart log, final messages only
+}
+
+var webhookFuncs = template.FuncMap{
+	// json encodes v, for use of payload values in a json template
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+type webhook struct {
+	cfg    WebhookConfig
+	tpl    *template.Template
+	client *http.Client
+	queue  chan WebhookPayload
+}
+
+// newWebhook validates cfg & starts delivering payloads sent to its queue.
+func newWebhook(cfg WebhookConfig) (*webhook, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("webhook URL is empty")
+	}
+	if cfg.ContentType == "" {
+		cfg.ContentType = DefaultWebhookConfig.ContentType
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = DefaultWebhookConfig.Retries
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultWebhookConfig.Timeout
+	}
+	wh := &webhook{
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		queue:  make(chan WebhookPayload, webhookQueueSize),
+	}
+	if cfg.Template != "" {
+		tpl, err := template.New(cfg.URL).Funcs(webhookFuncs).Parse(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %s", cfg.URL, err)
+		}
+		wh.tpl = tpl
+	}
+	go wh.run()
+	return wh, nil
+}
+
+// startWebhooks creates a webhook for each valid cfgs.
+func startWebhooks(cfgs []WebhookConfig) []*webhook {
+	var hooks []*webhook
+	for _, cfg := range cfgs {
+		wh, err := newWebhook(cfg)
+		if err != nil {
+			log.Printf("ignoring webhook: %s", err)
+			continue
+		}
+		hooks = append(hooks, wh)
+	}
+	return hooks
+}
+
+// accept is true if p passes wh filters.
+func (wh *webhook) accept(p WebhookPayload) bool {
+	if wh.cfg.FinalOnly && !p.Message.Final || wh.cfg.ErrorsOnly && !p.Message.Erronous {
+		return false
+	}
+	if len(wh.cfg.Boxes) == 0 {
+		return true
+	}
+	for _, id := range wh.cfg.Boxes {
+		if id == p.Box {
+			return true
+		}
+	}
+	return false
+}
+
+// send queues p for delivery, payloads are delivered in order.
+func (wh *webhook) send(p WebhookPayload) {
+	select {
+	case wh.queue <- p:
+	default:
+		log.Printf("webhook %s: queue is full, dropping message: %s", wh.cfg.URL, p.Message.Status)
+	}
+}
+
+func (wh *webhook) run() {
+	for p := range wh.queue {
+		body, err := wh.body(p)
+		if err != nil {
+			log.Printf("webhook %s: %s", wh.cfg.URL, err)
+			continue
+		}
+		delay := webhookRetryDelay
+		for i := 0; ; i++ {
+			retry, err := wh.post(body)
+			if err == nil {
+				break
+			}
+			if !retry || i >= wh.cfg.Retries {
+				log.Printf("webhook %s: giving up: %s", wh.cfg.URL, err)
+				break
+			}
+			log.Printf("webhook %s: %s, retrying in %s", wh.cfg.URL, err, delay)
+			<-time.After(delay)
+			delay *= 2
+		}
+	}
+}
+
+// body renders p with wh template, or as json.
+func (wh *webhook) body(p WebhookPayload) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if wh.tpl != nil {
+		err = wh.tpl.Execute(&buf, p)
+	} else {
+		err = json.NewEncoder(&buf).Encode(p)
+	}
+	return buf.Bytes(), err
+}
+
+// post sends body to wh, retry is true if failure is worth retrying.
+func (wh *webhook) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, wh.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", wh.cfg.ContentType)
+	req.Header.Set("User-Agent", "goregen")
+	if wh.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.cfg.Secret))
+		mac.Write(body)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return false, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// notify sends p to every webhook accepting it.
+func (s *Server) notify(p WebhookPayload) {
+	for _, wh := range s.webhooks {
+		if wh.accept(p) {
+			wh.send(p)
+		}
+	}
+}
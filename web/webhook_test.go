@@ -0,0 +1,180 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/solar3s/goregen/regenbox"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// webhookDelivery is a request received by webhookReceiver.
+type webhookDelivery struct {
+	header http.Header
+	body   []byte
+	time   time.Time
+}
+
+// webhookReceiver answers deliveries with statuses in order, then with 204.
+func webhookReceiver(statuses ...int) (*httptest.Server, chan webhookDelivery) {
+	ch := make(chan webhookDelivery, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ch <- webhookDelivery{header: r.Header, body: body, time: time.Now()}
+		status := http.StatusNoContent
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	return srv, ch
+}
+
+// receive returns next delivery of ch, ok is false if there was none in time.
+func receive(ch chan webhookDelivery, timeout time.Duration) (d webhookDelivery, ok bool) {
+	select {
+	case d = <-ch:
+		return d, true
+	case <-time.After(timeout):
+		return d, false
+	}
+}
+
+func TestWebhook_Accept(t *testing.T) {
+	final := WebhookPayload{Box: "a", Message: regenbox.CycleMessage{Final: true}}
+	failed := WebhookPayload{Box: "b", Message: regenbox.CycleMessage{Final: true, Erronous: true}}
+	step := WebhookPayload{Box: "a"}
+	for _, test := range []struct {
+		cfg      WebhookConfig
+		accepted []WebhookPayload
+		rejected []WebhookPayload
+	}{
+		{WebhookConfig{}, []WebhookPayload{final, failed, step}, nil},
+		{WebhookConfig{FinalOnly: true}, []WebhookPayload{final, failed}, []WebhookPayload{step}},
+		{WebhookConfig{ErrorsOnly: true}, []WebhookPayload{failed}, []WebhookPayload{final, step}},
+		{WebhookConfig{Boxes: []string{"a"}}, []WebhookPayload{final, step}, []WebhookPayload{failed}},
+		{WebhookConfig{FinalOnly: true, Boxes: []string{"a", "c"}}, []WebhookPayload{final}, []WebhookPayload{failed, step}},
+	} {
+		wh := &webhook{cfg: test.cfg}
+		for _, p := range test.accepted {
+			if !wh.accept(p) {
+				t.Errorf("%+v: expected %+v to be accepted", test.cfg, p)
+			}
+		}
+		for _, p := range test.rejected {
+			if wh.accept(p) {
+				t.Errorf("%+v: expected %+v to be rejected", test.cfg, p)
+			}
+		}
+	}
+}
+
+func TestWebhook_Deliver(t *testing.T) {
+	receiver, ch := webhookReceiver()
+	defer receiver.Close()
+	wh, err := newWebhook(WebhookConfig{URL: receiver.URL, Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh.send(WebhookPayload{Box: "a", Message: regenbox.CycleMessage{Status: "Charged", Final: true}})
+	d, ok := receive(ch, time.Second)
+	if !ok {
+		t.Fatal("nothing delivered")
+	}
+	if ct := d.header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type \"%s\"", ct)
+	}
+	var p WebhookPayload
+	err = json.Unmarshal(d.body, &p)
+	if err != nil || p.Box != "a" || p.Message.Status != "Charged" {
+		t.Errorf("unexpected payload %s (%v)", d.body, err)
+	}
+
+	// receivers check signature against their copy of secret
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(d.body)
+	if sig := d.header.Get(WebhookSignatureHeader); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("invalid signature \"%s\"", sig)
+	}
+}
+
+func TestWebhook_Template(t *testing.T) {
+	receiver, ch := webhookReceiver()
+	defer receiver.Close()
+	wh, err := newWebhook(WebhookConfig{
+		URL:         receiver.URL,
+		Template:    `{"text": {{json (printf "%s: %s" .Box .Message.Status)}}}`,
+		ContentType: "text/plain",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh.send(WebhookPayload{Box: "a", Message: regenbox.CycleMessage{Status: `"Charged"`}})
+	d, ok := receive(ch, time.Second)
+	if !ok {
+		t.Fatal("nothing delivered")
+	}
+	if string(d.body) != `{"text": "a: \"Charged\""}` {
+		t.Errorf("unexpected body %s", d.body)
+	}
+	if ct := d.header.Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("unexpected content type \"%s\"", ct)
+	}
+	if sig := d.header.Get(WebhookSignatureHeader); sig != "" {
+		t.Errorf("unexpected signature \"%s\" without secret", sig)
+	}
+
+	if _, err = newWebhook(WebhookConfig{URL: receiver.URL, Template: "{{.Box"}); err == nil {
+		t.Error("expected an error on invalid template")
+	}
+}
+
+func TestWebhook_Retry(t *testing.T) {
+	defer func(d time.Duration) {
+		webhookRetryDelay = d
+	}(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond * 50
+
+	for _, test := range []struct {
+		statuses []int
+		retries  int
+		attempts int
+	}{
+		{[]int{500, 429, 200}, 0, 3}, // default retries
+		{[]int{503, 503, 503}, 2, 3},
+		{[]int{500}, -1, 1},
+		{[]int{400}, 3, 1}, // client errors aren't retried
+	} {
+		receiver, ch := webhookReceiver(test.statuses...)
+		wh, err := newWebhook(WebhookConfig{URL: receiver.URL, Retries: test.retries})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wh.send(WebhookPayload{Box: "a"})
+		var times []time.Time
+		for {
+			d, ok := receive(ch, 10*webhookRetryDelay)
+			if !ok {
+				break
+			}
+			times = append(times, d.time)
+		}
+		receiver.Close()
+		if len(times) != test.attempts {
+			t.Errorf("%v: expected %d attempts, got %d", test.statuses, test.attempts, len(times))
+			continue
+		}
+		// delay doubles between each attempt
+		for i := 1; i < len(times); i++ {
+			min := webhookRetryDelay << uint(i-1)
+			if d := times[i].Sub(times[i-1]); d < min {
+				t.Errorf("%v: expected attempt %d after at least %s, got %s", test.statuses, i+1, min, d)
+			}
+		}
+	}
+}